@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"time"
 
 	_ "net/http/pprof"
@@ -13,52 +16,128 @@ import (
 
 	"github.com/richardartoul/nola/virtual"
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
 )
 
 var (
 	port                        = flag.Int("port", 9090, "TCP port for HTTP server to bind")
 	serverID                    = flag.String("serverID", uuid.New().String(), "ID to identify the server. Must be globally unique within the cluster")
 	discoveryType               = flag.String("discoveryType", virtual.DiscoveryTypeLocalHost, "how the server should register itself with the discovery serice. Valid options: localhost|remote. Use localhost for local testing, use remote for multi-node setups")
-	registryType                = flag.String("registryBackend", "memory", "backend to use for the Registry. Validation options: memory|foundationdb")
+	registryType                = flag.String("registryBackend", "memory", "backend to use for the Registry. Validation options: memory|file|foundationdb")
 	foundationDBClusterFilePath = flag.String("foundationDBClusterFilePath", "", "path to use for the FoundationDB cluster file")
+	fileRegistryDir             = flag.String("fileRegistryDir", "nola-registry", "directory to store the registry in when using the file registry backend")
+	wasmRuntime                 = flag.String("wasmRuntime", "", "runtime to execute WASM modules with unless they specify one explicitly. Valid options: compiler|interpreter. Uses the compiler if it's supported on the current platform and the interpreter otherwise if empty")
+	moduleCacheDir              = flag.String("moduleCacheDir", "", "directory to persist compiled WASM modules in so they don't have to be recompiled on restart. Compiled modules are only cached in memory if empty")
+	internalPort                = flag.Int("internalPort", 0, "TCP port for the internal HTTP server, which serves the endpoints that servers use to communicate with each other. They're served on --port if zero")
+	internalToken               = flag.String("internalToken", os.Getenv("NOLA_INTERNAL_TOKEN"), "credential that servers use to authenticate requests to each other. Must be the same for every server in the cluster. Defaults to the NOLA_INTERNAL_TOKEN environment variable")
+	tlsCertFile                 = flag.String("tlsCertFile", "", "path to the PEM-encoded TLS certificate for the server. It must be valid for --serverID (as a DNS SAN) since other servers verify it. TLS is disabled if empty")
+	tlsKeyFile                  = flag.String("tlsKeyFile", "", "path to the PEM-encoded private key for --tlsCertFile")
+	tlsCAFile                   = flag.String("tlsCAFile", "", "path to the PEM-encoded CA certificates used to verify other servers' and clients' certificates. Uses the system's CAs to verify servers if empty")
+	tlsRequireClientCert        = flag.Bool("tlsRequireClientCert", false, "require every client to present a certificate signed by --tlsCAFile (mutual TLS)")
+	authConfigPath              = flag.String("authConfig", "", "path to a JSON file that configures authentication and authorization for the public API, see authConfig. Every request is allowed if empty")
+	logLevel                    = flag.String("logLevel", "info", "minimum level of the messages that are logged for actors in namespaces that don't set their own log level. Valid options: debug|info|warn|error")
+	traceFile                   = flag.String("traceFile", "", "path to a file to write finished trace spans to as JSON lines. Use - for stdout. Spans are not exported if empty")
 )
 
+// logger is shared by the environment and the components it's constructed with.
+var logger = virtual.NewWriterLogger(os.Stderr)
+
+// authConfig is the format of the --authConfig file.
+type authConfig struct {
+	// Tokens maps static bearer tokens to the name of the principal they authenticate.
+	Tokens map[string]string `json:"tokens"`
+	// HMACKeys maps HMAC key IDs to their secrets. The key ID is used as the name of the
+	// principal.
+	HMACKeys map[string]string `json:"hmac_keys"`
+	// MTLS enables authenticating requests with TLS client certificates.
+	MTLS  bool                        `json:"mtls"`
+	Rules []virtual.AuthorizationRule `json:"rules"`
+}
+
 func main() {
 	flag.Parse()
 
+	// Subcommands operate on the registry directly and exit without starting the server.
+	// The registry flags must be provided before the subcommand, for example:
+	//
+	//	app --registryBackend=foundationdb export --namespace=ns --file=ns.ndjson
+	switch flag.Arg(0) {
+	case "export":
+		if err := runExport(flag.Args()[1:]); err != nil {
+			log.Fatalf("error exporting: %v", err)
+		}
+		return
+	case "import":
+		if err := runImport(flag.Args()[1:]); err != nil {
+			log.Fatalf("error importing: %v", err)
+		}
+		return
+	case "":
+	default:
+		log.Fatalf("unknown subcommand: %s", flag.Arg(0))
+	}
+
 	flag.VisitAll(func(f *flag.Flag) {
 		fmt.Printf(" --%s=%s\n", f.Name, f.Value.String())
 	})
 
-	var reg registry.Registry
-	switch *registryType {
-	case "memory":
-		reg = registry.NewLocalRegistry()
-	case "foundationdb":
-		var err error
-		reg, err = registry.NewFoundationDBRegistry(*foundationDBClusterFilePath)
-		if err != nil {
-			log.Fatalf("error creating FoundationDB registry: %v\n", err)
-		}
-	default:
-		log.Fatalf("unknown registry type: %v", *registryType)
+	reg := newRegistry()
+
+	authOpts, err := loadAuthOptions()
+	if err != nil {
+		log.Fatalf("error loading auth config: %v", err)
+	}
+
+	tlsOpts := virtual.TLSOptions{
+		CertFile:          *tlsCertFile,
+		KeyFile:           *tlsKeyFile,
+		CAFile:            *tlsCAFile,
+		RequireClientCert: *tlsRequireClientCert,
+	}
+
+	client, err := virtual.NewHTTPClient(virtual.HTTPClientOptions{
+		InternalToken: *internalToken,
+		TLS:           tlsOpts,
+	})
+	if err != nil {
+		log.Fatalf("error creating HTTP client: %v", err)
 	}
 
-	client := virtual.NewHTTPClient()
+	// Other servers only use the advertised address for internal requests.
+	discoveryPort := *port
+	if *internalPort != 0 {
+		discoveryPort = *internalPort
+	}
+
+	traceExporter, err := newTraceExporter()
+	if err != nil {
+		log.Fatalf("error creating trace exporter: %v", err)
+	}
 
 	ctx, cc := context.WithTimeout(context.Background(), 10*time.Second)
 	environment, err := virtual.NewEnvironment(ctx, *serverID, reg, client, virtual.EnvironmentOptions{
 		Discovery: virtual.DiscoveryOptions{
 			DiscoveryType: *discoveryType,
-			Port:          *port,
+			Port:          discoveryPort,
 		},
+		ModuleCacheDir: *moduleCacheDir,
+		WASMRuntime:    *wasmRuntime,
+		TLS:            tlsOpts,
+		TraceExporter:  traceExporter,
+		LogLevel:       *logLevel,
+		Logger:         logger,
 	})
 	cc()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	server := virtual.NewServer(reg, environment)
+	server := virtual.NewServer(reg, environment, virtual.ServerOptions{
+		Auth:          authOpts,
+		InternalPort:  *internalPort,
+		InternalToken: *internalToken,
+		TLS:           tlsOpts,
+	})
 
 	log.Printf("listening on port: %d\n", *port)
 
@@ -66,3 +145,146 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+func newTraceExporter() (tracing.Exporter, error) {
+	switch *traceFile {
+	case "":
+		return nil, nil
+	case "-":
+		return tracing.NewWriterExporter(os.Stdout, logger), nil
+	}
+	f, err := os.OpenFile(*traceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening trace file: %w", err)
+	}
+	return tracing.NewWriterExporter(f, logger), nil
+}
+
+func loadAuthOptions() (virtual.AuthOptions, error) {
+	if *authConfigPath == "" {
+		return virtual.AuthOptions{}, nil
+	}
+
+	b, err := os.ReadFile(*authConfigPath)
+	if err != nil {
+		return virtual.AuthOptions{}, err
+	}
+	var config authConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return virtual.AuthOptions{}, fmt.Errorf("error unmarshaling auth config: %w", err)
+	}
+
+	opts := virtual.AuthOptions{Rules: config.Rules}
+	if len(config.Tokens) > 0 {
+		opts.Authenticators = append(opts.Authenticators, virtual.NewStaticTokenAuthenticator(config.Tokens))
+	}
+	if len(config.HMACKeys) > 0 {
+		keys := make(map[string][]byte, len(config.HMACKeys))
+		for keyID, secret := range config.HMACKeys {
+			keys[keyID] = []byte(secret)
+		}
+		opts.Authenticators = append(opts.Authenticators, virtual.NewHMACAuthenticator(keys))
+	}
+	if config.MTLS {
+		opts.Authenticators = append(opts.Authenticators, virtual.NewMTLSAuthenticator())
+	}
+	if len(opts.Authenticators) == 0 {
+		return virtual.AuthOptions{}, fmt.Errorf("auth config: %s does not configure any authenticators", *authConfigPath)
+	}
+	return opts, opts.Validate()
+}
+
+func newRegistry() registry.Registry {
+	switch *registryType {
+	case "memory":
+		return registry.NewLocalRegistry()
+	case "file":
+		reg, err := registry.NewFileRegistry(*fileRegistryDir, registry.FileRegistryOptions{
+			Logger: logger,
+		})
+		if err != nil {
+			log.Fatalf("error creating file registry: %v\n", err)
+		}
+		return reg
+	case "foundationdb":
+		reg, err := registry.NewFoundationDBRegistry(*foundationDBClusterFilePath)
+		if err != nil {
+			log.Fatalf("error creating FoundationDB registry: %v\n", err)
+		}
+		return reg
+	default:
+		log.Fatalf("unknown registry type: %v", *registryType)
+	}
+	panic("unreachable")
+}
+
+// runExport exports the KV storage of a single actor, or of every actor in a namespace,
+// to a file (or stdout).
+func runExport(args []string) error {
+	var (
+		fs        = flag.NewFlagSet("export", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace to export")
+		actorID   = fs.String("actorID", "", "ID of the actor to export. If omitted, every actor in the namespace is exported")
+		path      = fs.String("file", "", "path of the file to write the export to. If omitted, the export is written to stdout")
+	)
+	fs.Parse(args)
+	if *namespace == "" {
+		return fmt.Errorf("--namespace is required")
+	}
+
+	var w io.Writer = os.Stdout
+	if *path != "" {
+		f, err := os.Create(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	reg := newRegistry()
+	defer reg.Close(context.Background())
+
+	if *actorID != "" {
+		return reg.ExportActorKV(context.Background(), *namespace, *actorID, w)
+	}
+	return reg.ExportNamespaceKV(context.Background(), *namespace, w)
+}
+
+// runImport imports an export created by runExport into a namespace, which does not
+// need to be the namespace it was exported from.
+func runImport(args []string) error {
+	var (
+		fs        = flag.NewFlagSet("import", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace to import into")
+		path      = fs.String("file", "", "path of the file to read the export from. If omitted, the export is read from stdin")
+	)
+	fs.Parse(args)
+	if *namespace == "" {
+		return fmt.Errorf("--namespace is required")
+	}
+
+	var r io.Reader = os.Stdin
+	if *path != "" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	reg := newRegistry()
+	defer reg.Close(context.Background())
+
+	result, err := reg.ImportActorKV(context.Background(), *namespace, r)
+	if err != nil {
+		return err
+	}
+	marshaled, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(marshaled))
+	return nil
+}
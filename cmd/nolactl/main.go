@@ -0,0 +1,773 @@
+// nolactl is a command line tool for administering and debugging NOLA clusters through
+// the HTTP API of any of their servers. For example:
+//
+//	nolactl register-module --namespace=playground --moduleID=test_util --file=testdata/tinygo/util/main.wasm
+//	nolactl create-actor --namespace=playground --moduleID=test_util --actorID=a
+//	nolactl invoke --namespace=playground --actorID=a --operation=inc
+//	nolactl kv-scan --namespace=playground --actorID=a
+//	nolactl export --namespace=playground --file=playground.ndjson
+//
+// Requests are authenticated with a bearer token, an HMAC signature or a TLS client
+// certificate depending on the flags, to match the authenticators the servers are
+// configured with.
+//
+// Run nolactl help for the list of commands.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/richardartoul/nola/virtual"
+	"github.com/richardartoul/nola/virtual/registry"
+)
+
+var (
+	addr  = flag.String("addr", envOrDefault("NOLA_ADDR", "http://localhost:9090"), "address of the NOLA server to send requests to. Defaults to the NOLA_ADDR environment variable, or http://localhost:9090 if it's not set")
+	token = flag.String("token", os.Getenv("NOLA_TOKEN"), "bearer token to authenticate requests with. Defaults to the NOLA_TOKEN environment variable")
+
+	hmacKeyID  = flag.String("hmacKeyID", os.Getenv("NOLA_HMAC_KEY_ID"), "ID of the HMAC key to sign requests with. Defaults to the NOLA_HMAC_KEY_ID environment variable. Requests are not signed if empty")
+	hmacSecret = flag.String("hmacSecret", os.Getenv("NOLA_HMAC_SECRET"), "secret of the HMAC key to sign requests with. Defaults to the NOLA_HMAC_SECRET environment variable")
+
+	tlsCAFile   = flag.String("tlsCAFile", "", "path to the PEM-encoded CA certificates used to verify the server's certificate. Uses the system's CAs if empty")
+	tlsCertFile = flag.String("tlsCertFile", "", "path to the PEM-encoded TLS client certificate to present to the server, for servers that require mutual TLS")
+	tlsKeyFile  = flag.String("tlsKeyFile", "", "path to the PEM-encoded private key for --tlsCertFile")
+)
+
+// command is a nolactl subcommand.
+type command struct {
+	description string
+	run         func(c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"register-module":  {"register a WASM module from a file", runRegisterModule},
+	"describe-module":  {"describe a module", runDescribeModule},
+	"list-modules":     {"list the modules in a namespace", runListModules},
+	"delete-module":    {"delete a module that no actors use", runDeleteModule},
+	"create-actor":     {"create an actor from a module", runCreateActor},
+	"describe-actor":   {"describe an actor, including the server it's activated on and the size of its KV storage", runDescribeActor},
+	"list-actors":      {"list the actors in a namespace", runListActors},
+	"delete-actor":     {"delete an actor and all of its data", runDeleteActor},
+	"invoke":           {"invoke an operation on an actor", runInvoke},
+	"kv-get":           {"get a key from an actor's KV storage", runKVGet},
+	"kv-put":           {"put a key in an actor's KV storage", runKVPut},
+	"kv-scan":          {"list the keys and values in an actor's KV storage", runKVScan},
+	"list-servers":     {"list the live servers in the cluster", runListServers},
+	"list-activations": {"list the actors that are activated on the server", runListActivations},
+	"export":           {"export the KV storage of an actor, or of every actor in a namespace", runExport},
+	"import":           {"import an export into a namespace", runImport},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	name := flag.Arg(0)
+	if name == "" || name == "help" {
+		usage()
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating client: %v\n", err)
+		os.Exit(1)
+	}
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error running %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: nolactl [flags] <command> [command flags]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-18s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(out, "\nRun nolactl <command> --help for the command's flags.\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func runRegisterModule(c *client, args []string) error {
+	var (
+		fs           = flag.NewFlagSet("register-module", flag.ExitOnError)
+		namespace    = fs.String("namespace", "", "namespace to register the module in")
+		moduleID     = fs.String("moduleID", "", "ID of the module")
+		path         = fs.String("file", "", "path of the WASM module to register")
+		manifestPath = fs.String("manifest", "", "path of a JSON file that contains the module's manifest, if any")
+		policyPath   = fs.String("hostPolicy", "", "path of a JSON file that contains the module's host policy, if any")
+		wasmRuntime  = fs.String("wasmRuntime", "", "runtime to execute the module with. Valid options: compiler|interpreter. Uses the servers' default if empty")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "moduleID", "file"); err != nil {
+		return err
+	}
+
+	headers := map[string]string{
+		"namespace":    *namespace,
+		"module_id":    *moduleID,
+		"wasm_runtime": *wasmRuntime,
+	}
+	for header, path := range map[string]string{"manifest": *manifestPath, "host_policy": *policyPath} {
+		if path == "" {
+			continue
+		}
+		// The server expects these headers to contain JSON, so compact the file so that
+		// it fits on a single line.
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, contents); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		headers[header] = compacted.String()
+	}
+
+	f, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result, err := c.do("POST", "/api/v1/register-module", f, headers)
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func runDescribeModule(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("describe-module", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace of the module")
+		moduleID  = fs.String("moduleID", "", "ID of the module")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "moduleID"); err != nil {
+		return err
+	}
+
+	result, err := c.post("/api/v1/describe-module", map[string]string{
+		"namespace": *namespace,
+		"module_id": *moduleID,
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func runListModules(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("list-modules", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace to list the modules of")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace"); err != nil {
+		return err
+	}
+
+	result, err := c.post("/api/v1/list-modules", map[string]string{"namespace": *namespace})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		ModuleIDs []string `json:"module_ids"`
+	}
+	if err := json.Unmarshal(result, &resp); err != nil {
+		return fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	for _, moduleID := range resp.ModuleIDs {
+		fmt.Println(moduleID)
+	}
+	return nil
+}
+
+func runDeleteModule(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("delete-module", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace of the module")
+		moduleID  = fs.String("moduleID", "", "ID of the module to delete")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "moduleID"); err != nil {
+		return err
+	}
+
+	_, err := c.post("/api/v1/delete-module", map[string]string{
+		"namespace": *namespace,
+		"module_id": *moduleID,
+	})
+	return err
+}
+
+func runCreateActor(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("create-actor", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace to create the actor in")
+		actorID   = fs.String("actorID", "", "ID of the actor")
+		moduleID  = fs.String("moduleID", "", "ID of the module to create the actor from")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "actorID", "moduleID"); err != nil {
+		return err
+	}
+
+	result, err := c.post("/api/v1/create-actor", map[string]string{
+		"namespace": *namespace,
+		"actor_id":  *actorID,
+		"module_id": *moduleID,
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func runDescribeActor(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("describe-actor", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace of the actor")
+		actorID   = fs.String("actorID", "", "ID of the actor")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "actorID"); err != nil {
+		return err
+	}
+
+	query := url.Values{"ns": {*namespace}, "id": {*actorID}}
+	result, err := c.do("GET", "/api/v1/admin/actor?"+query.Encode(), nil, nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func runListActors(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("list-actors", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace to list the actors of")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace"); err != nil {
+		return err
+	}
+
+	// Namespaces can have a lot of actors so they're listed a page at a time.
+	for after := ""; ; {
+		result, err := c.post("/api/v1/list-actors", map[string]any{
+			"namespace": *namespace,
+			"after":     after,
+		})
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			ActorIDs []string `json:"actor_ids"`
+		}
+		if err := json.Unmarshal(result, &resp); err != nil {
+			return fmt.Errorf("error unmarshaling response: %w", err)
+		}
+		if len(resp.ActorIDs) == 0 {
+			return nil
+		}
+		for _, actorID := range resp.ActorIDs {
+			fmt.Println(actorID)
+		}
+		after = resp.ActorIDs[len(resp.ActorIDs)-1]
+	}
+}
+
+func runDeleteActor(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("delete-actor", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace of the actor")
+		actorID   = fs.String("actorID", "", "ID of the actor to delete")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "actorID"); err != nil {
+		return err
+	}
+
+	_, err := c.post("/api/v1/delete-actor", map[string]string{
+		"namespace": *namespace,
+		"actor_id":  *actorID,
+	})
+	return err
+}
+
+func runInvoke(c *client, args []string) error {
+	var (
+		fs             = flag.NewFlagSet("invoke", flag.ExitOnError)
+		namespace      = fs.String("namespace", "", "namespace of the actor")
+		actorID        = fs.String("actorID", "", "ID of the actor to invoke")
+		operation      = fs.String("operation", "", "operation to invoke")
+		payload        = fs.String("payload", "", "JSON payload to invoke the operation with")
+		payloadFile    = fs.String("payloadFile", "", "path of a file that contains the payload to invoke the operation with. Use - for stdin")
+		moduleID       = fs.String("moduleID", "", "ID of the module to create the actor from if it doesn't exist yet. The actor must already exist if empty")
+		idempotencyKey = fs.String("idempotencyKey", "", "key that makes the invocation idempotent, if any")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "actorID", "operation"); err != nil {
+		return err
+	}
+	if *payload != "" && *payloadFile != "" {
+		return fmt.Errorf("only one of --payload and --payloadFile can be provided")
+	}
+
+	req := invokeRequest{
+		Namespace:      *namespace,
+		ActorID:        *actorID,
+		Operation:      *operation,
+		IdempotencyKey: *idempotencyKey,
+	}
+	req.CreateIfNotExist.ModuleID = *moduleID
+	switch {
+	case *payload != "":
+		if !json.Valid([]byte(*payload)) {
+			return fmt.Errorf("--payload is not valid JSON, use --payloadFile for other payloads")
+		}
+		req.PayloadJSON = json.RawMessage(*payload)
+	case *payloadFile == "-":
+		contents, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req.Payload = contents
+	case *payloadFile != "":
+		contents, err := ioutil.ReadFile(*payloadFile)
+		if err != nil {
+			return err
+		}
+		req.Payload = contents
+	}
+
+	result, err := c.post("/api/v1/invoke-actor", req)
+	if err != nil {
+		return err
+	}
+	return printBytes(result)
+}
+
+// invokeRequest is the body of invoke-actor requests.
+type invokeRequest struct {
+	Namespace        string `json:"namespace"`
+	ActorID          string `json:"actor_id"`
+	Operation        string `json:"operation"`
+	Payload          []byte `json:"payload,omitempty"`
+	CreateIfNotExist struct {
+		ModuleID string `json:"module_id,omitempty"`
+	} `json:"create_if_not_exist"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	PayloadJSON    json.RawMessage `json:"payload_json,omitempty"`
+}
+
+func runKVGet(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("kv-get", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace of the actor")
+		actorID   = fs.String("actorID", "", "ID of the actor")
+		key       = fs.String("key", "", "key to get")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "actorID", "key"); err != nil {
+		return err
+	}
+
+	result, err := c.post("/api/v1/get-actor-kv", actorKVRequest{
+		Namespace: *namespace,
+		ActorID:   *actorID,
+		Key:       []byte(*key),
+	})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Exists bool   `json:"exists"`
+		Value  []byte `json:"value"`
+	}
+	if err := json.Unmarshal(result, &resp); err != nil {
+		return fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	if !resp.Exists {
+		return fmt.Errorf("key: %s does not exist", *key)
+	}
+	return printBytes(resp.Value)
+}
+
+func runKVPut(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("kv-put", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace of the actor")
+		actorID   = fs.String("actorID", "", "ID of the actor")
+		key       = fs.String("key", "", "key to put")
+		value     = fs.String("value", "", "value to put")
+		valueFile = fs.String("valueFile", "", "path of a file that contains the value to put. Use - for stdin")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "actorID", "key"); err != nil {
+		return err
+	}
+	if *value != "" && *valueFile != "" {
+		return fmt.Errorf("only one of --value and --valueFile can be provided")
+	}
+
+	v := []byte(*value)
+	switch {
+	case *valueFile == "-":
+		contents, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		v = contents
+	case *valueFile != "":
+		contents, err := ioutil.ReadFile(*valueFile)
+		if err != nil {
+			return err
+		}
+		v = contents
+	}
+
+	_, err := c.post("/api/v1/put-actor-kv", actorKVRequest{
+		Namespace: *namespace,
+		ActorID:   *actorID,
+		Key:       []byte(*key),
+		Value:     v,
+	})
+	return err
+}
+
+// actorKVRequest is the body of get-actor-kv and put-actor-kv requests.
+type actorKVRequest struct {
+	Namespace string `json:"namespace"`
+	ActorID   string `json:"actor_id"`
+	Key       []byte `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+}
+
+func runKVScan(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("kv-scan", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace of the actor")
+		actorID   = fs.String("actorID", "", "ID of the actor")
+		prefix    = fs.String("prefix", "", "only list the keys that start with this prefix")
+		limit     = fs.Int("limit", 100, "maximum number of keys to list")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace", "actorID"); err != nil {
+		return err
+	}
+
+	result, err := c.post("/api/v1/scan-actor-kv", map[string]any{
+		"namespace": *namespace,
+		"actor_id":  *actorID,
+		"prefix":    []byte(*prefix),
+		"limit":     *limit,
+	})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		KVs []registry.ActorKV `json:"kvs"`
+	}
+	if err := json.Unmarshal(result, &resp); err != nil {
+		return fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	// Keys and values are arbitrary bytes so they're quoted to keep each pair on a single
+	// line.
+	for _, kv := range resp.KVs {
+		fmt.Printf("%s\t%s\n", strconv.Quote(string(kv.Key)), strconv.Quote(string(kv.Value)))
+	}
+	return nil
+}
+
+func runListServers(c *client, args []string) error {
+	fs := flag.NewFlagSet("list-servers", flag.ExitOnError)
+	fs.Parse(args)
+
+	result, err := c.do("GET", "/api/v1/admin/servers", nil, nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func runListActivations(c *client, args []string) error {
+	fs := flag.NewFlagSet("list-activations", flag.ExitOnError)
+	fs.Parse(args)
+
+	result, err := c.do("GET", "/api/v1/admin/activations", nil, nil)
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+func runExport(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("export", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace to export")
+		actorID   = fs.String("actorID", "", "ID of the actor to export. If omitted, every actor in the namespace is exported")
+		path      = fs.String("file", "", "path of the file to write the export to. If omitted, the export is written to stdout")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace"); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *path != "" {
+		f, err := os.Create(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	marshaled, err := json.Marshal(map[string]string{
+		"namespace": *namespace,
+		"actor_id":  *actorID,
+	})
+	if err != nil {
+		return err
+	}
+	body, err := c.doStream("POST", "/api/v1/export-actor-kv", bytes.NewReader(marshaled), map[string]string{
+		"Content-Type": "application/json",
+	})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// runImport imports an export created by runExport into a namespace, which does not
+// need to be the namespace it was exported from.
+func runImport(c *client, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("import", flag.ExitOnError)
+		namespace = fs.String("namespace", "", "namespace to import into")
+		path      = fs.String("file", "", "path of the file to read the export from. If omitted, the export is read from stdin")
+	)
+	fs.Parse(args)
+	if err := requireFlags(fs, "namespace"); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *path != "" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	result, err := c.do("POST", "/api/v1/import-actor-kv", r, map[string]string{
+		"namespace": *namespace,
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(result)
+}
+
+// client sends requests to the HTTP API of a NOLA server.
+type client struct {
+	addr       string
+	token      string
+	hmacKeyID  string
+	hmacSecret []byte
+	http       *http.Client
+}
+
+// newClient returns a client that is configured by the global flags.
+func newClient() (*client, error) {
+	if (*hmacKeyID == "") != (*hmacSecret == "") {
+		return nil, fmt.Errorf("--hmacKeyID and --hmacSecret must be provided together")
+	}
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		return nil, fmt.Errorf("--tlsCertFile and --tlsKeyFile must be provided together")
+	}
+
+	tlsConfig := &tls.Config{}
+	if *tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(*tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS CA file: %s does not contain any PEM-encoded certificates", *tlsCAFile)
+		}
+	}
+	if *tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &client{
+		addr:       strings.TrimSuffix(*addr, "/"),
+		token:      *token,
+		hmacKeyID:  *hmacKeyID,
+		hmacSecret: []byte(*hmacSecret),
+		http:       &http.Client{Timeout: 5 * time.Minute, Transport: transport},
+	}, nil
+}
+
+// post sends req as the JSON body of a POST request to the endpoint and returns the
+// response's body.
+func (c *client) post(path string, req any) ([]byte, error) {
+	marshaled, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.do("POST", path, bytes.NewReader(marshaled), map[string]string{
+		"Content-Type": "application/json",
+	})
+}
+
+// do sends a request to the endpoint and returns the response's body, or an error that
+// contains the body if the response's status is not 200.
+func (c *client) do(method, path string, body io.Reader, headers map[string]string) ([]byte, error) {
+	respBody, err := c.doStream(method, path, body, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer respBody.Close()
+	b, err := ioutil.ReadAll(respBody)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %w", err)
+	}
+	return b, nil
+}
+
+// doStream is the same as do, except that the caller reads the response's body and must
+// close it.
+func (c *client) doStream(
+	method string,
+	path string,
+	body io.Reader,
+	headers map[string]string,
+) (io.ReadCloser, error) {
+	// Signatures cover the hash of the body so it has to be read before the request is
+	// sent.
+	var bodyBytes []byte
+	if c.hmacKeyID != "" && body != nil {
+		var err error
+		bodyBytes, err = ioutil.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading request body: %w", err)
+		}
+		body = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, c.addr+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.hmacKeyID != "" {
+		virtual.SignHTTPRequest(req, c.hmacKeyID, c.hmacSecret, bodyBytes)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading response: %w", err)
+		}
+		return nil, fmt.Errorf("%s %s returned status code: %d, body: %s",
+			method, path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return resp.Body, nil
+}
+
+// requireFlags returns an error if any of the named flags were not provided.
+func requireFlags(fs *flag.FlagSet, names ...string) error {
+	provided := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		provided[f.Name] = f.Value.String() != ""
+	})
+	for _, name := range names {
+		if !provided[name] {
+			return fmt.Errorf("--%s is required", name)
+		}
+	}
+	return nil
+}
+
+// printJSON prints a JSON response indented, or as is if it isn't JSON.
+func printJSON(b []byte) error {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, b, "", "  "); err != nil {
+		return printBytes(b)
+	}
+	return printBytes(indented.Bytes())
+}
+
+// printBytes prints b followed by a newline unless it already ends with one.
+func printBytes(b []byte) error {
+	if _, err := os.Stdout.Write(b); err != nil {
+		return err
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		_, err := os.Stdout.Write([]byte("\n"))
+		return err
+	}
+	return nil
+}
+
+func envOrDefault(name, defaultValue string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return defaultValue
+}
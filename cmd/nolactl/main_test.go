@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual"
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientAuthentication tests that requests are authenticated with the bearer token and
+// signed with the HMAC key the client is configured with.
+func TestClientAuthentication(t *testing.T) {
+	authenticator := virtual.NewHMACAuthenticator(map[string][]byte{"key-1": []byte("secret")})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token-1", r.Header.Get("Authorization"))
+		principal, err := authenticator.Authenticate(r)
+		require.NoError(t, err)
+		require.Equal(t, "key-1", principal)
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, `{"namespace": "ns-1"}`, string(body))
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	c := &client{
+		addr:       server.URL,
+		token:      "token-1",
+		hmacKeyID:  "key-1",
+		hmacSecret: []byte("secret"),
+		http:       server.Client(),
+	}
+	result, err := c.post("/api/v1/list-modules", map[string]string{"namespace": "ns-1"})
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(result))
+}
+
+// TestClientErrors tests that responses with a status other than 200 are returned as
+// errors that contain the response's body.
+func TestClientErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "module does not exist", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	c := &client{addr: server.URL, http: server.Client()}
+	_, err := c.post("/api/v1/describe-module", map[string]string{"namespace": "ns-1"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "returned status code: 404")
+	require.Contains(t, err.Error(), "module does not exist")
+}
+
+// TestRequireFlags tests that commands fail if a required flag is missing.
+func TestRequireFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("namespace", "", "")
+	fs.String("actorID", "", "")
+	require.NoError(t, fs.Parse([]string{"--namespace=ns-1", "--actorID="}))
+
+	require.NoError(t, requireFlags(fs, "namespace"))
+	require.EqualError(t, requireFlags(fs, "namespace", "actorID"), "--actorID is required")
+
+	c := &client{addr: "http://localhost:0", http: http.DefaultClient}
+	require.EqualError(t, runCreateActor(c, []string{"--namespace=ns-1"}), "--actorID is required")
+}
+
+// TestListActors tests that list-actors prints every page of actors.
+func TestListActors(t *testing.T) {
+	pages := map[string][]string{
+		"":  {"a", "b"},
+		"b": {"c"},
+		"c": {},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/list-actors", r.URL.Path)
+		var req struct {
+			Namespace string `json:"namespace"`
+			After     string `json:"after"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "ns-1", req.Namespace)
+		page, ok := pages[req.After]
+		require.True(t, ok, "unexpected after: %s", req.After)
+		json.NewEncoder(w).Encode(map[string][]string{"actor_ids": page})
+	}))
+	defer server.Close()
+
+	c := &client{addr: server.URL, http: server.Client()}
+	output := captureStdout(t, func() {
+		require.NoError(t, runListActors(c, []string{"--namespace=ns-1"}))
+	})
+	require.Equal(t, "a\nb\nc\n", output)
+}
+
+// TestRegisterModule tests that register-module sends the module's bytes and compacts
+// its manifest into a header.
+func TestRegisterModule(t *testing.T) {
+	dir := t.TempDir()
+	modulePath := filepath.Join(dir, "module.wasm")
+	require.NoError(t, ioutil.WriteFile(modulePath, []byte("wasm"), 0o644))
+	manifestPath := filepath.Join(dir, "manifest.json")
+	require.NoError(t, ioutil.WriteFile(manifestPath, []byte(`{
+  "operations": [{"name": "inc"}]
+}`), 0o644))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/register-module", r.URL.Path)
+		require.Equal(t, "ns-1", r.Header.Get("namespace"))
+		require.Equal(t, "test-module", r.Header.Get("module_id"))
+		require.Equal(t, `{"operations":[{"name":"inc"}]}`, r.Header.Get("manifest"))
+		require.Empty(t, r.Header.Get("host_policy"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, "wasm", string(body))
+		w.Write([]byte(`{"version":1}`))
+	}))
+	defer server.Close()
+
+	c := &client{addr: server.URL, http: server.Client()}
+	output := captureStdout(t, func() {
+		require.NoError(t, runRegisterModule(c, []string{
+			"--namespace=ns-1", "--moduleID=test-module",
+			"--file=" + modulePath, "--manifest=" + manifestPath,
+		}))
+	})
+	require.Equal(t, "{\n  \"version\": 1\n}\n", output)
+}
+
+// TestInvoke tests that invoke sends JSON payloads as JSON and rejects invalid ones.
+func TestInvoke(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req invokeRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "ns-1", req.Namespace)
+		require.Equal(t, "a", req.ActorID)
+		require.Equal(t, "inc", req.Operation)
+		require.Equal(t, "test-module", req.CreateIfNotExist.ModuleID)
+		require.JSONEq(t, `{"n": 1}`, string(req.PayloadJSON))
+		w.Write([]byte("1"))
+	}))
+	defer server.Close()
+
+	c := &client{addr: server.URL, http: server.Client()}
+	output := captureStdout(t, func() {
+		require.NoError(t, runInvoke(c, []string{
+			"--namespace=ns-1", "--actorID=a", "--operation=inc",
+			"--moduleID=test-module", `--payload={"n": 1}`,
+		}))
+	})
+	require.Equal(t, "1\n", output)
+
+	err := runInvoke(c, []string{"--namespace=ns-1", "--actorID=a", "--operation=inc", "--payload=abc"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not valid JSON")
+}
+
+// captureStdout returns what fn writes to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+
+	outputCh := make(chan string, 1)
+	go func() {
+		var output strings.Builder
+		io.Copy(&output, r)
+		outputCh <- output.String()
+	}()
+	fn()
+	require.NoError(t, w.Close())
+	return <-outputCh
+}
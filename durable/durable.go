@@ -23,6 +23,9 @@ type Object interface {
 		w io.Writer,
 	) error
 	Hydrate(ctx context.Context, r io.Reader, readerSize int) error
+	// MemoryUsage returns the size of the object's memory in bytes as of the end of its
+	// most recent invocation.
+	MemoryUsage() int64
 }
 
 type Logger func(msg string)
@@ -0,0 +1,160 @@
+package durablewazero
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const (
+	wapcHostModuleName   = "wapc"
+	wapcConsoleLogFnName = "__console_log"
+)
+
+type consoleLoggerCtxKey struct{}
+
+// WithConsoleLogger returns a context that causes the messages that the module logs with
+// waPC's console log function (for example with wapc.ConsoleLog in the guest) to be passed
+// to logger for invocations that use the context. Otherwise, messages are printed with
+// wapc.PrintlnLogger.
+//
+// This is required because wapc.Logger is configured once per compiled module and doesn't
+// receive the context, so it has no way of knowing which instance logged the message.
+func WithConsoleLogger(ctx context.Context, logger func(msg string)) context.Context {
+	return context.WithValue(ctx, consoleLoggerCtxKey{}, logger)
+}
+
+// consoleLogRuntime wraps a wazero.Runtime so that the waPC host module that wapc-go
+// instantiates in it implements the console log function with the logger in the
+// invocation's context, if any.
+type consoleLogRuntime struct {
+	wazero.Runtime
+}
+
+func (r consoleLogRuntime) NewHostModuleBuilder(moduleName string) wazero.HostModuleBuilder {
+	b := r.Runtime.NewHostModuleBuilder(moduleName)
+	if moduleName != wapcHostModuleName {
+		return b
+	}
+	return &consoleLogModuleBuilder{HostModuleBuilder: b}
+}
+
+type consoleLogModuleBuilder struct {
+	wazero.HostModuleBuilder
+	// intercepted is whether the console log function was replaced. This depends on the
+	// way wapc-go builds the host module, so the module refuses to compile if it wasn't
+	// rather than silently ignoring the loggers in the invocations' contexts.
+	intercepted bool
+}
+
+func (b *consoleLogModuleBuilder) Compile(ctx context.Context) (wazero.CompiledModule, error) {
+	if err := b.checkIntercepted(); err != nil {
+		return nil, err
+	}
+	return b.HostModuleBuilder.Compile(ctx)
+}
+
+func (b *consoleLogModuleBuilder) Instantiate(
+	ctx context.Context,
+	ns wazero.Namespace,
+) (api.Module, error) {
+	if err := b.checkIntercepted(); err != nil {
+		return nil, err
+	}
+	return b.HostModuleBuilder.Instantiate(ctx, ns)
+}
+
+func (b *consoleLogModuleBuilder) checkIntercepted() error {
+	if !b.intercepted {
+		return fmt.Errorf(
+			"%s.%s was not exported with WithGoModuleFunction so it can't be intercepted",
+			wapcHostModuleName, wapcConsoleLogFnName)
+	}
+	return nil
+}
+
+func (b *consoleLogModuleBuilder) NewFunctionBuilder() wazero.HostFunctionBuilder {
+	return &consoleLogFunctionBuilder{
+		HostFunctionBuilder: b.HostModuleBuilder.NewFunctionBuilder(),
+		module:              b,
+	}
+}
+
+// consoleLogFunctionBuilder wraps every function builder of the waPC host module so that
+// the builder chain returns the wrapped module builder, and replaces the implementation of
+// the console log function once its export name is known.
+type consoleLogFunctionBuilder struct {
+	wazero.HostFunctionBuilder
+	module *consoleLogModuleBuilder
+
+	moduleFn api.GoModuleFunction
+	params   []api.ValueType
+	results  []api.ValueType
+}
+
+func (b *consoleLogFunctionBuilder) WithGoFunction(
+	fn api.GoFunction,
+	params, results []api.ValueType,
+) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithGoFunction(fn, params, results)
+	b.moduleFn = nil
+	return b
+}
+
+func (b *consoleLogFunctionBuilder) WithGoModuleFunction(
+	fn api.GoModuleFunction,
+	params, results []api.ValueType,
+) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithGoModuleFunction(fn, params, results)
+	b.moduleFn, b.params, b.results = fn, params, results
+	return b
+}
+
+func (b *consoleLogFunctionBuilder) WithFunc(fn interface{}) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithFunc(fn)
+	b.moduleFn = nil
+	return b
+}
+
+func (b *consoleLogFunctionBuilder) WithName(name string) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithName(name)
+	return b
+}
+
+func (b *consoleLogFunctionBuilder) WithParameterNames(names ...string) wazero.HostFunctionBuilder {
+	b.HostFunctionBuilder = b.HostFunctionBuilder.WithParameterNames(names...)
+	return b
+}
+
+func (b *consoleLogFunctionBuilder) Export(name string) wazero.HostModuleBuilder {
+	if name == wapcConsoleLogFnName && b.moduleFn != nil {
+		b.HostFunctionBuilder = b.HostFunctionBuilder.WithGoModuleFunction(
+			consoleLog(b.moduleFn), b.params, b.results)
+		b.module.intercepted = true
+	}
+	b.HostFunctionBuilder.Export(name)
+	return b.module
+}
+
+// consoleLog returns the implementation of the console log function, which passes the
+// message to the logger in the context, or falls back to wapc-go's implementation if
+// there is none.
+func consoleLog(fallback api.GoModuleFunction) api.GoModuleFunction {
+	return api.GoModuleFunc(func(ctx context.Context, m api.Module, stack []uint64) {
+		logger, ok := ctx.Value(consoleLoggerCtxKey{}).(func(msg string))
+		if !ok || logger == nil {
+			fallback.Call(ctx, m, stack)
+			return
+		}
+
+		// The parameters are the offset and length of the message in the guest's memory.
+		msg, ok := m.Memory().Read(ctx, uint32(stack[0]), uint32(stack[1]))
+		if !ok {
+			// Same as wapc-go, which panics if the guest passes an invalid message.
+			panic("out of memory reading console log message")
+		}
+		logger(string(msg))
+	})
+}
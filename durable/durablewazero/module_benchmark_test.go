@@ -3,21 +3,36 @@ package durablewazero
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
-	"github.com/wapc/wapc-go/engines/wazero"
 )
 
 func BenchmarkObjectExecution(b *testing.B) {
+	for _, runtime := range testRuntimes() {
+		b.Run(fmt.Sprintf("runtime=%q", runtime), func(b *testing.B) {
+			benchmarkObjectExecution(b, runtime)
+		})
+	}
+}
+
+func benchmarkObjectExecution(b *testing.B, runtime string) {
 	ctx := context.Background()
 
-	module, err := NewModule(ctx, wazero.Engine(), testHost, utilWasmBytes)
+	engine, err := Engine(runtime)
+	require.NoError(b, err)
+	module, err := NewModule(ctx, engine, testHost, utilWasmBytes)
 	require.NoError(b, err)
-	defer panicIfErr(module.Close(ctx))
+	defer func() {
+		panicIfErr(module.Close(ctx))
+	}()
 
 	object, err := module.Instantiate(ctx, "a")
 	require.NoError(b, err)
+	defer func() {
+		panicIfErr(object.Close(ctx))
+	}()
 
 	buf := bytes.NewBuffer(nil)
 
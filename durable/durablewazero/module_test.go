@@ -8,8 +8,11 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/richardartoul/nola/durable"
+
 	"github.com/stretchr/testify/require"
-	"github.com/wapc/wapc-go/engines/wazero"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
 )
 
 var utilWasmBytes []byte
@@ -23,9 +26,19 @@ func init() {
 }
 
 func TestDurable(t *testing.T) {
+	for _, runtime := range testRuntimes() {
+		t.Run(fmt.Sprintf("runtime=%q", runtime), func(t *testing.T) {
+			testDurable(t, runtime)
+		})
+	}
+}
+
+func testDurable(t *testing.T, runtime string) {
 	ctx := context.Background()
 
-	module, err := NewModule(ctx, wazero.Engine(), testHost, utilWasmBytes)
+	engine, err := Engine(runtime)
+	require.NoError(t, err)
+	module, err := NewModule(ctx, engine, testHost, utilWasmBytes)
 	require.NoError(t, err)
 	defer func() {
 		panicIfErr(module.Close(ctx))
@@ -76,6 +89,104 @@ func TestDurable(t *testing.T) {
 	require.Equal(t, int64(2), getCount(t, result))
 }
 
+func TestConsoleLogger(t *testing.T) {
+	for _, runtime := range testRuntimes() {
+		t.Run(fmt.Sprintf("runtime=%q", runtime), func(t *testing.T) {
+			ctx := context.Background()
+			engine, err := Engine(runtime)
+			require.NoError(t, err)
+			module, err := NewModule(ctx, engine, testHost, utilWasmBytes)
+			require.NoError(t, err)
+			defer func() {
+				panicIfErr(module.Close(ctx))
+			}()
+
+			objects := make([]durable.Object, 0, 2)
+			for _, id := range []string{"a", "b"} {
+				object, err := module.Instantiate(ctx, id)
+				require.NoError(t, err)
+				defer object.Close(ctx)
+				objects = append(objects, object)
+			}
+
+			// Each invocation's messages go to the logger in its context even though the
+			// instances share the module.
+			var logsA, logsB []string
+			ctxA := WithConsoleLogger(ctx, func(msg string) { logsA = append(logsA, msg) })
+			ctxB := WithConsoleLogger(ctx, func(msg string) { logsB = append(logsB, msg) })
+			_, err = objects[0].Invoke(ctxA, "log", []byte("hello from a"))
+			require.NoError(t, err)
+			_, err = objects[1].Invoke(ctxB, "log", []byte("hello from b"))
+			require.NoError(t, err)
+			require.Equal(t, []string{"hello from a"}, logsA)
+			require.Equal(t, []string{"hello from b"}, logsB)
+
+			// Falls back to the module's logger if the context has none.
+			_, err = objects[0].Invoke(ctx, "log", []byte("hello from a"))
+			require.NoError(t, err)
+			require.Len(t, logsA, 1)
+		})
+	}
+}
+
+// TestConsoleLoggerIntercept tests that the waPC host module refuses to instantiate if
+// the console log function can't be intercepted, for example because wapc-go changed the
+// way it builds the host module, instead of silently ignoring WithConsoleLogger.
+func TestConsoleLoggerIntercept(t *testing.T) {
+	ctx := context.Background()
+	r, err := newRuntime(wazero.NewRuntimeConfigInterpreter())(ctx)
+	require.NoError(t, err)
+	defer r.Close(ctx)
+
+	noop := api.GoModuleFunc(func(ctx context.Context, m api.Module, stack []uint64) {})
+	params := []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}
+
+	_, err = r.NewHostModuleBuilder(wapcHostModuleName).
+		NewFunctionBuilder().
+		WithFunc(func(offset, length uint32) {}).
+		Export(wapcConsoleLogFnName).
+		Instantiate(ctx, r)
+	require.Error(t, err)
+
+	// Only the waPC host module is affected.
+	_, err = r.NewHostModuleBuilder("other").
+		NewFunctionBuilder().
+		WithFunc(func(offset, length uint32) {}).
+		Export(wapcConsoleLogFnName).
+		Instantiate(ctx, r)
+	require.NoError(t, err)
+
+	builder := r.NewHostModuleBuilder(wapcHostModuleName).
+		NewFunctionBuilder().
+		WithGoModuleFunction(noop, params, nil).
+		Export(wapcConsoleLogFnName)
+	require.True(t, builder.(*consoleLogModuleBuilder).intercepted)
+	_, err = builder.Instantiate(ctx, r)
+	require.NoError(t, err)
+}
+
+func TestEngine(t *testing.T) {
+	_, err := Engine("does-not-exist")
+	require.Error(t, err)
+	require.Error(t, ValidateRuntime("does-not-exist"))
+
+	_, err = Engine(RuntimeCompiler)
+	if CompilerSupported() {
+		require.NoError(t, err)
+	} else {
+		require.Error(t, err)
+	}
+}
+
+// testRuntimes returns all the runtimes that are supported on the current platform.
+func testRuntimes() []string {
+	runtimes := []string{RuntimeDefault, RuntimeInterpreter}
+	if CompilerSupported() {
+		runtimes = append(runtimes, RuntimeCompiler)
+	}
+	return runtimes
+}
+
 func testHost(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
 	return nil, fmt.Errorf(
 		"testHotNotImplemented [%s::%s::%s::%s)",
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 
 	"github.com/wapc/wapc-go"
 	"github.com/wapc/wapc-go/engines/wazero"
@@ -19,16 +20,35 @@ type object struct {
 	sync.Mutex
 	instance wapc.Instance
 	onClose  func()
+	// memorySize is the size of the instance's memory as of the end of the last
+	// invocation. It's stored separately so that it can be read without waiting for
+	// in-progress invocations.
+	memorySize int64
 }
 
 func newObject(
 	instance wapc.Instance,
 	onClose func(),
 ) *object {
-	return &object{
+	o := &object{
 		instance: instance,
 		onClose:  onClose,
 	}
+	o.updateMemorySize(context.Background())
+	return o
+}
+
+func (o *object) MemoryUsage() int64 {
+	return atomic.LoadInt64(&o.memorySize)
+}
+
+// updateMemorySize must be called with the lock held.
+func (o *object) updateMemorySize(ctx context.Context) {
+	memory := o.instance.(*wazero.Instance).UnwrapModule().Memory()
+	if memory == nil {
+		return
+	}
+	atomic.StoreInt64(&o.memorySize, int64(memory.Size(ctx)))
 }
 
 func (o *object) Invoke(
@@ -39,6 +59,9 @@ func (o *object) Invoke(
 	o.Lock()
 	defer o.Unlock()
 
+	// Modules may grow their memory during any invocation.
+	defer o.updateMemorySize(ctx)
+
 	// TODO: Make byte ownership more clear?
 	return o.instance.Invoke(ctx, operation, payload)
 }
@@ -124,6 +147,7 @@ func (o *object) Hydrate(
 			additionalPagesNeeded++
 		}
 		memory.Grow(ctx, uint32(additionalPagesNeeded))
+		defer o.updateMemorySize(ctx)
 	}
 
 	// Very important we do this *after* calling memory.Grow, otherwise the
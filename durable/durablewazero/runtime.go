@@ -0,0 +1,113 @@
+package durablewazero
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/assemblyscript"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/wapc/wapc-go"
+	wazeroengine "github.com/wapc/wapc-go/engines/wazero"
+)
+
+const (
+	// RuntimeDefault uses the wazero compiler if it's supported on the current platform,
+	// and the wazero interpreter otherwise.
+	RuntimeDefault = ""
+	// RuntimeCompiler compiles modules to native code ahead of time. It has the best
+	// performance, but is only supported on some platforms and compiling large modules
+	// is slow.
+	RuntimeCompiler = "compiler"
+	// RuntimeInterpreter interprets modules. It is supported on every platform and has
+	// no compilation overhead, but is much slower to execute.
+	RuntimeInterpreter = "interpreter"
+)
+
+// ValidateRuntime returns an error if name is not the name of a supported runtime. Note
+// that it doesn't check whether the runtime is supported on the current platform.
+func ValidateRuntime(name string) error {
+	switch name {
+	case RuntimeDefault, RuntimeCompiler, RuntimeInterpreter:
+		return nil
+	default:
+		return fmt.Errorf(
+			"unknown WASM runtime: %s, valid options are: %s|%s",
+			name, RuntimeCompiler, RuntimeInterpreter)
+	}
+}
+
+// CompilerSupported returns whether RuntimeCompiler is supported on the current platform.
+func CompilerSupported() bool {
+	switch runtime.GOOS {
+	case "darwin", "windows", "linux", "freebsd":
+	default:
+		return false
+	}
+	switch runtime.GOARCH {
+	case "amd64", "arm64":
+		return true
+	default:
+		return false
+	}
+}
+
+// Engine returns the engine for the runtime with the provided name so it can be passed
+// to NewModule.
+func Engine(name string) (wapc.Engine, error) {
+	config, err := runtimeConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return wazeroengine.EngineWithRuntime(newRuntime(config)), nil
+}
+
+// NewRuntime creates a runtime with the provided name that provides the same host modules
+// as the runtimes that modules are instantiated in by Engine, so it can be used to
+// inspect modules without instantiating them.
+func NewRuntime(ctx context.Context, name string) (wazero.Runtime, error) {
+	config, err := runtimeConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return newRuntime(config)(ctx)
+}
+
+func runtimeConfig(name string) (wazero.RuntimeConfig, error) {
+	switch name {
+	case RuntimeDefault:
+		return wazero.NewRuntimeConfig(), nil
+	case RuntimeCompiler:
+		if !CompilerSupported() {
+			return nil, fmt.Errorf("WASM runtime: %s is not supported on this platform", name)
+		}
+		return wazero.NewRuntimeConfigCompiler(), nil
+	case RuntimeInterpreter:
+		return wazero.NewRuntimeConfigInterpreter(), nil
+	default:
+		return nil, ValidateRuntime(name)
+	}
+}
+
+// newRuntime is the same as wazeroengine.DefaultRuntime, except it uses the provided
+// config so the runtime can be selected explicitly, and it supports WithConsoleLogger.
+func newRuntime(config wazero.RuntimeConfig) wazeroengine.NewRuntime {
+	return func(ctx context.Context) (wazero.Runtime, error) {
+		r := wazero.NewRuntimeWithConfig(ctx, config)
+
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+			_ = r.Close(ctx)
+			return nil, err
+		}
+
+		// This disables the abort message as no other engines write it.
+		envBuilder := r.NewHostModuleBuilder("env")
+		assemblyscript.NewFunctionExporter().WithAbortMessageDisabled().ExportFunctions(envBuilder)
+		if _, err := envBuilder.Instantiate(ctx, r); err != nil {
+			_ = r.Close(ctx)
+			return nil, err
+		}
+		return consoleLogRuntime{r}, nil
+	}
+}
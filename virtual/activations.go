@@ -2,33 +2,70 @@ package virtual
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/richardartoul/nola/durable"
 	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
-	"github.com/wapc/wapc-go/engines/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// maxInboxDeliveryAttempts is the number of times delivery of an inbox message is
+	// attempted before it is moved to the actor's dead letter queue.
+	maxInboxDeliveryAttempts = 10
+	// minInboxRetryBackoff and maxInboxRetryBackoff bound the exponential backoff between
+	// attempts to deliver an inbox message.
+	minInboxRetryBackoff = 100 * time.Millisecond
+	maxInboxRetryBackoff = time.Minute
+
+	// moduleLoadTimeout is the maximum duration of fetching and compiling a module. It's
+	// independent of the timeouts of the invocations that are waiting for the module.
+	moduleLoadTimeout = 5 * time.Minute
 )
 
 type activations struct {
 	sync.RWMutex
 
 	// State.
-	_modules    map[types.NamespacedID]Module
-	_actors     map[types.NamespacedID]activatedActor
-	serverState struct {
+	_modules map[types.NamespacedID]loadedModule
+	// _compiledModules contains the WASM modules that have been compiled, keyed by the
+	// hash of their bytes and the runtime they were compiled for, so that modules that
+	// were registered with the same bytes (for example, in different namespaces) are only
+	// compiled once. Compiled modules are closed and removed once they're no longer used
+	// by any loaded module or activated actor.
+	_compiledModules map[string]*compiledModule
+	_actors          map[types.NamespacedID]activatedActor
+	serverState      struct {
 		sync.RWMutex
 		serverID      string
 		serverVersion int64
 	}
 
+	// moduleLoads and moduleCompiles deduplicate concurrent module fetches and
+	// compilations, keyed by module ID and module hash respectively.
+	moduleLoads    singleflight.Group
+	moduleCompiles singleflight.Group
+
 	// Dependencies.
-	registry      registry.Registry
-	environment   Environment
-	goModules     map[types.NamespacedIDNoType]Module
-	customHostFns map[string]func([]byte) ([]byte, error)
+	registry       registry.Registry
+	environment    Environment
+	goModules      map[types.NamespacedIDNoType]Module
+	customHostFns  map[string]func([]byte) ([]byte, error)
+	moduleCacheDir string
+	wasmRuntime    string
+	quotas         *namespaceQuotas
+	logging        *actorLogging
 }
 
 func newActivations(
@@ -36,15 +73,24 @@ func newActivations(
 	environment Environment,
 	goModules map[types.NamespacedIDNoType]Module,
 	customHostFns map[string]func([]byte) ([]byte, error),
+	moduleCacheDir string,
+	wasmRuntime string,
+	quotas *namespaceQuotas,
+	logging *actorLogging,
 ) *activations {
 	return &activations{
-		_modules: make(map[types.NamespacedID]Module),
-		_actors:  make(map[types.NamespacedID]activatedActor),
+		_modules:         make(map[types.NamespacedID]loadedModule),
+		_compiledModules: make(map[string]*compiledModule),
+		_actors:          make(map[types.NamespacedID]activatedActor),
 
-		registry:      registry,
-		environment:   environment,
-		goModules:     goModules,
-		customHostFns: customHostFns,
+		registry:       registry,
+		environment:    environment,
+		goModules:      goModules,
+		customHostFns:  customHostFns,
+		moduleCacheDir: moduleCacheDir,
+		wasmRuntime:    wasmRuntime,
+		quotas:         quotas,
+		logging:        logging,
 	}
 }
 
@@ -58,19 +104,67 @@ func (a *activations) invoke(
 	reference types.ActorReferenceVirtual,
 	operation string,
 	payload []byte,
+	idempotencyKey string,
 ) ([]byte, error) {
+	actor, err := a.ensureActivated(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	return actor.invoke(ctx, operation, payload, idempotencyKey)
+}
+
+// invokeStream is the same as invoke, except the actor's result is emitted as a
+// stream of chunks. See StreamingActor for more details.
+func (a *activations) invokeStream(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	payload []byte,
+	emit func(chunk []byte) error,
+) error {
+	actor, err := a.ensureActivated(ctx, reference)
+	if err != nil {
+		return err
+	}
+	return actor.invokeStream(ctx, operation, payload, a.registry.MaxTransactionDuration(), emit)
+}
+
+// deliverInbox delivers all the pending messages in the actor's inbox.
+func (a *activations) deliverInbox(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+) error {
+	actor, err := a.ensureActivated(ctx, reference)
+	if err != nil {
+		return err
+	}
+	return actor.deliverInbox(ctx, a.quotas)
+}
+
+// ensureActivated returns the in-memory activation for the provided reference, creating
+// it (and loading its module) if necessary.
+func (a *activations) ensureActivated(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+) (activatedActor, error) {
 	a.RLock()
 	actor, ok := a._actors[reference.ActorID()]
 	if ok && actor.reference.Generation() >= reference.Generation() {
 		a.RUnlock()
-		return actor.invoke(ctx, operation, payload)
+		return actor, nil
 	}
 	a.RUnlock()
 
+	// Load the namespace's log level before the actor can log anything since looking it
+	// up when the actor logs never blocks. Failures are ignored since the log level will
+	// be refreshed in the background anyways.
+	a.logging.levels.load(ctx, reference.Namespace())
+
 	a.Lock()
+	actor, ok = a._actors[reference.ActorID()]
 	if ok && actor.reference.Generation() >= reference.Generation() {
 		a.Unlock()
-		return actor.invoke(ctx, operation, payload)
+		return actor, nil
 	}
 
 	if ok && actor.reference.Generation() < reference.Generation() {
@@ -84,117 +178,364 @@ func (a *activations) invoke(
 		}
 
 		delete(a._actors, reference.ActorID())
+		a.releaseCompiledModuleLocked(ctx, actor.compiled)
+		evictionsTotal.WithLabels(reference.Namespace(), reference.ModuleID().ID).Inc()
 		actor = activatedActor{}
 	}
 
-	// Actor was not already activated locally. Check if the module is already
-	// cached.
-	module, ok := a._modules[reference.ModuleID()]
-	if ok {
-		// Module is cached, instantiate the actor then we're done.
+	// Actor was not already activated locally. We may need to load the module's bytes
+	// from a remote store so lets release the lock before continuing.
+	a.Unlock()
+
+	module, err := a.loadModule(ctx, reference.ModuleID())
+	if err != nil {
+		return activatedActor{}, err
+	}
+
+	// Now that we've loaded the module, we need to reacquire the lock to create the
+	// actor. Note that since we released the lock previously, we need to redo the
+	// check to make sure the actor doesn't already exist since a different goroutine
+	// may have created it in the meantime.
+
+	a.Lock()
+
+	actor, ok = a._actors[reference.ActorID()]
+	if !ok {
+		if !a.acquireCompiledModuleLocked(module.compiled) {
+			// The module was loaded again with different bytes and the version that was
+			// loaded by this call was closed in the meantime.
+			a.Unlock()
+			return activatedActor{}, fmt.Errorf(
+				"error activating actor: %s, module: %s was reloaded concurrently",
+				reference.ActorID(), reference.ModuleID())
+		}
+		logger := a.logging.newActorLogger(reference)
 		hostCapabilities := newHostCapabilities(
 			a.registry, a.environment, a.customHostFns,
-			reference.Namespace(), reference.ActorID().ID, reference.ModuleID().ID, a.getServerState)
+			reference.Namespace(), reference.ActorID().ID, reference.ModuleID().ID, a.getServerState,
+			module.policy, a.quotas, logger)
 		iActor, err := module.Instantiate(ctx, reference.ActorID().ID, hostCapabilities)
 		if err != nil {
+			a.releaseCompiledModuleLocked(ctx, module.compiled)
 			a.Unlock()
-			return nil, fmt.Errorf(
-				"error instantiating actor: %s from module: %s, err: %w",
-				reference.ActorID(), reference.ModuleID(), err)
+			return activatedActor{}, fmt.Errorf(
+				"error instantiating actor: %s from module: %s",
+				reference.ActorID(), reference.ModuleID())
 		}
-		actor, err = newActivatedActor(ctx, iActor, reference, hostCapabilities)
+		actor, err = newActivatedActor(ctx, iActor, reference, hostCapabilities, module.manifest, logger)
 		if err != nil {
+			a.releaseCompiledModuleLocked(ctx, module.compiled)
 			a.Unlock()
-			return nil, fmt.Errorf("error activating actor: %w", err)
+			return activatedActor{}, fmt.Errorf("error activating actor: %w", err)
 		}
+		actor.compiled = module.compiled
 		a._actors[reference.ActorID()] = actor
+		activationsTotal.WithLabels(reference.Namespace(), reference.ModuleID().ID).Inc()
 	}
 
-	// Module is not cached. We may need to load the bytes from a remote store
-	// so lets release the lock before continuing.
 	a.Unlock()
+	return actor, nil
+}
 
-	// TODO: Thundering herd problem here on module load. We should add support
-	//       for automatically deduplicating this fetch. Although, it may actually
-	//       be more prudent to just do that in the Registry implementation so we
-	//       can implement deduplication + on-disk caching transparently in one
-	//       place.
-	moduleBytes, _, err := a.registry.GetModule(
-		ctx, reference.Namespace(), reference.ModuleID().ID)
-	if err != nil {
-		return nil, fmt.Errorf(
-			"error getting module bytes from registry for module: %s, err: %w",
-			reference.ModuleID(), err)
-	}
-
-	// Now that we've loaded the module bytes from a (potentially remote) store, we
-	// need to reacquire the lock to create the in-memory module + actor. Note that
-	// since we released the lock previously, we need to redo all the checks to make
-	// sure the module/actor don't already exist since a different goroutine may have
-	// created them in the meantime.
-
-	a.Lock()
+// loadModule returns the module for the provided module ID, fetching it from the registry
+// (and compiling it) if necessary. Concurrent loads of the same module are deduplicated so
+// that activating many actors of a module that isn't cached yet only fetches and compiles
+// the module once. The module's info is always read from the registry, since modules can
+// be deleted and registered again with different bytes or options, so the cached module is
+// only used if its info is unchanged.
+func (a *activations) loadModule(
+	ctx context.Context,
+	moduleID types.NamespacedID,
+) (loadedModule, error) {
+	key := fmt.Sprintf("%s::%s", moduleID.Namespace, moduleID.ID)
+	v, err := doDetached(ctx, &a.moduleLoads, key, moduleLoadTimeout, func(ctx context.Context) (any, error) {
+		moduleInfo, err := a.registry.GetModuleInfo(ctx, moduleID.Namespace, moduleID.ID)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error getting module info from registry for module: %s, err: %w",
+				moduleID, err)
+		}
+		a.RLock()
+		module, ok := a._modules[moduleID]
+		a.RUnlock()
+		if ok && reflect.DeepEqual(module.info, moduleInfo) {
+			return module, nil
+		}
 
-	module, ok = a._modules[reference.ModuleID()]
-	if !ok {
-		hostFn := newHostFnRouter(
-			a.registry, a.environment, a.customHostFns,
-			reference.Namespace(), reference.ModuleID().ID)
+		// The module isn't cached, or it was deleted and registered again since it was
+		// cached.
+		module = loadedModule{info: moduleInfo}
+		module.manifest = moduleInfo.Opts.Manifest
+		module.policy = moduleInfo.Opts.HostPolicy
 
-		if len(moduleBytes) > 0 {
+		if moduleInfo.Size > 0 {
 			// WASM byte codes exists for the module so we should just use that.
-			// TODO: Hard-coded for now, but we should support using different runtimes with
-			//       configuration since we've already abstracted away the module/object
-			//       interfaces.
-			wazeroMod, err := durablewazero.NewModule(ctx, wazero.Engine(), hostFn, moduleBytes)
+			wasmRuntime := moduleInfo.Opts.WASMRuntime
+			if wasmRuntime == durablewazero.RuntimeDefault {
+				wasmRuntime = a.wasmRuntime
+			}
+			compiled, err := a.compileModule(ctx, moduleID, moduleInfo.Hash, wasmRuntime)
 			if err != nil {
-				a.Unlock()
-				return nil, fmt.Errorf(
-					"error constructing module: %s from module bytes, err: %w",
-					reference.ModuleID(), err)
+				return nil, err
 			}
 
 			// Wrap the wazero module so it implements Module.
-			module = wazeroModule{wazeroMod}
-			a._modules[reference.ModuleID()] = module
+			module.compiled = compiled
+			module.Module = wazeroModule{
+				m:      compiled.Module,
+				module: types.NewNamespacedIDNoType(moduleID.Namespace, moduleID.ID),
+				policy: module.policy,
+			}
 		} else {
 			// No WASM code, must be a hard-coded Go module.
-			goModID := types.NewNamespacedIDNoType(reference.
-				ModuleID().Namespace, reference.ModuleID().ID)
+			goModID := types.NewNamespacedIDNoType(moduleID.Namespace, moduleID.ID)
 			goMod, ok := a.goModules[goModID]
 			if !ok {
 				return nil, fmt.Errorf(
 					"error constructing module: %s, hard-coded Go module does not exist",
-					reference.ModuleID())
+					moduleID)
 			}
-			module = goMod
-			a._modules[reference.ModuleID()] = module
+			module.Module = goMod
 		}
 
+		a.Lock()
+		defer a.Unlock()
+		if prev, ok := a._modules[moduleID]; ok {
+			// The previous version of the module is no longer used by this module ID,
+			// although actors that were activated from it may still be using it.
+			a.releaseCompiledModuleLocked(ctx, prev.compiled)
+		}
+		a._modules[moduleID] = module
+		return module, nil
+	})
+	if err != nil {
+		return loadedModule{}, err
 	}
+	return v.(loadedModule), nil
+}
 
-	actor, ok = a._actors[reference.ActorID()]
-	if !ok {
-		hostCapabilities := newHostCapabilities(
-			a.registry, a.environment, a.customHostFns,
-			reference.Namespace(), reference.ActorID().ID, reference.ModuleID().ID, a.getServerState)
-		iActor, err := module.Instantiate(ctx, reference.ActorID().ID, hostCapabilities)
+// compileModule returns the WASM module with the provided hash compiled for the provided
+// runtime, fetching its bytes from the registry and compiling them if a module with the
+// same hash hasn't been compiled for the runtime already. Concurrent compilations of the
+// same module are deduplicated. The caller owns a reference to the returned module and
+// must release it with releaseCompiledModuleLocked once it's no longer used.
+func (a *activations) compileModule(
+	ctx context.Context,
+	moduleID types.NamespacedID,
+	hash string,
+	wasmRuntime string,
+) (*compiledModule, error) {
+	key := fmt.Sprintf("%s::%s", hash, wasmRuntime)
+	for {
+		v, err := doDetached(ctx, &a.moduleCompiles, key, moduleLoadTimeout, func(ctx context.Context) (any, error) {
+			return a.compileModuleOnce(ctx, moduleID, key, hash, wasmRuntime)
+		})
 		if err != nil {
-			a.Unlock()
-			return nil, fmt.Errorf(
-				"error instantiating actor: %s from module: %s",
-				reference.ActorID(), reference.ModuleID())
+			return nil, err
+		}
+		compiled := v.(*compiledModule)
+
+		a.Lock()
+		ok := a.acquireCompiledModuleLocked(compiled)
+		a.Unlock()
+		if ok {
+			return compiled, nil
 		}
-		actor, err = newActivatedActor(ctx, iActor, reference, hostCapabilities)
+		// The module was closed before this call could acquire it, compile it again.
+	}
+}
+
+// compileModuleOnce implements compileModule, except it doesn't acquire a reference to
+// the module it returns.
+func (a *activations) compileModuleOnce(
+	ctx context.Context,
+	moduleID types.NamespacedID,
+	key string,
+	hash string,
+	wasmRuntime string,
+) (*compiledModule, error) {
+	a.RLock()
+	compiled, ok := a._compiledModules[key]
+	a.RUnlock()
+	if ok {
+		return compiled, nil
+	}
+
+	moduleBytes, _, err := a.registry.GetModule(ctx, moduleID.Namespace, moduleID.ID)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error getting module bytes from registry for module: %s, err: %w",
+			moduleID, err)
+	}
+
+	compileCtx := ctx
+	if a.moduleCacheDir != "" {
+		// wazero doesn't support sharing a cache directory between runtimes, and
+		// every module gets its own runtime, so every module hash (and WASM
+		// runtime) gets its own directory.
+		cacheDir := hash
+		if wasmRuntime != durablewazero.RuntimeDefault {
+			cacheDir = fmt.Sprintf("%s-%s", hash, wasmRuntime)
+		}
+		compileCtx, err = experimental.WithCompilationCacheDirName(
+			ctx, filepath.Join(a.moduleCacheDir, cacheDir))
 		if err != nil {
-			a.Unlock()
-			return nil, fmt.Errorf("error activating actor: %w", err)
+			return nil, fmt.Errorf(
+				"error configuring compilation cache for module: %s, err: %w",
+				moduleID, err)
 		}
-		a._actors[reference.ActorID()] = actor
 	}
 
-	a.Unlock()
-	return actor.invoke(ctx, operation, payload)
+	engine, err := durablewazero.Engine(wasmRuntime)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error constructing module: %s, err: %w", moduleID, err)
+	}
+	hostFn := newHostFnRouter(a.registry, a.environment, a.customHostFns)
+	m, err := durablewazero.NewModule(compileCtx, engine, hostFn, moduleBytes)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"error constructing module: %s from module bytes, err: %w",
+			moduleID, err)
+	}
+
+	compiled = &compiledModule{Module: m, key: key}
+	a.Lock()
+	defer a.Unlock()
+	a._compiledModules[key] = compiled
+	return compiled, nil
+}
+
+// acquireCompiledModuleLocked acquires a reference to compiled, unless it was closed
+// already in which case it returns false. A nil module (I.E the module of a Go actor) can
+// always be acquired. The caller must hold the lock.
+func (a *activations) acquireCompiledModuleLocked(compiled *compiledModule) bool {
+	if compiled == nil {
+		return true
+	}
+	if compiled.closed {
+		return false
+	}
+	compiled.refs++
+	return true
+}
+
+// releaseCompiledModuleLocked releases a reference to compiled, and closes it if that was
+// the last one. The caller must hold the lock.
+func (a *activations) releaseCompiledModuleLocked(ctx context.Context, compiled *compiledModule) {
+	if compiled == nil {
+		return
+	}
+	compiled.refs--
+	if compiled.refs > 0 {
+		return
+	}
+
+	compiled.closed = true
+	if a._compiledModules[compiled.key] == compiled {
+		delete(a._compiledModules, compiled.key)
+	}
+	if err := compiled.Close(ctx); err != nil {
+		a.logging.logger.Log(LogLevelError, "error closing compiled module",
+			"module", compiled.key, "error", err)
+	}
+}
+
+// doDetached calls fn through group so that concurrent calls with the same key are
+// deduplicated. fn is passed a context that isn't derived from any caller's context so
+// that the first caller timing out or being canceled doesn't fail the call for every
+// other caller that is waiting on it, fn's context times out after timeout instead.
+// Callers still stop waiting when their own context is done.
+func doDetached(
+	ctx context.Context,
+	group *singleflight.Group,
+	key string,
+	timeout time.Duration,
+	fn func(ctx context.Context) (any, error),
+) (any, error) {
+	ch := group.DoChan(key, func() (any, error) {
+		ctx, cc := context.WithTimeout(context.Background(), timeout)
+		defer cc()
+		return fn(ctx)
+	})
+	select {
+	case result := <-ch:
+		return result.Val, result.Err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("error waiting for: %s, err: %w", key, ctx.Err())
+	}
+}
+
+// tailLogs returns up to the last limit messages that were logged for the actor, oldest
+// first, and whether the actor is activated in this environment. Messages are only
+// retained in memory while the actor is activated.
+func (a *activations) tailLogs(namespace, actorID string, limit int) ([]LogEntry, bool) {
+	a.RLock()
+	actor, ok := a._actors[types.NewNamespacedID(namespace, actorID, types.IDTypeActor)]
+	a.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return actor.logger.buffer.tail(limit), true
+}
+
+// ActivationInfo describes an actor that is activated in an environment.
+type ActivationInfo struct {
+	Namespace  string `json:"namespace"`
+	ActorID    string `json:"actor_id"`
+	ModuleID   string `json:"module_id"`
+	Generation uint64 `json:"generation"`
+	// Worker is true if the activation is a worker instead of an actor.
+	Worker      bool      `json:"worker,omitempty"`
+	ActivatedAt time.Time `json:"activated_at"`
+	// IdleTime is how long the actor has gone without being invoked. It is zero while the
+	// actor has invocations in flight.
+	IdleTime time.Duration `json:"idle_time"`
+	// QueueDepth is the number of invocations that are currently running or waiting for
+	// the actor.
+	QueueDepth int64 `json:"queue_depth"`
+}
+
+// listActivations returns the actors that are activated in this environment, ordered by
+// namespace and ID.
+func (a *activations) listActivations() []ActivationInfo {
+	a.RLock()
+	actors := make([]activatedActor, 0, len(a._actors))
+	for _, actor := range a._actors {
+		actors = append(actors, actor)
+	}
+	a.RUnlock()
+
+	now := time.Now()
+	infos := make([]ActivationInfo, 0, len(actors))
+	for _, actor := range actors {
+		infos = append(infos, ActivationInfo{
+			Namespace:   actor.reference.Namespace(),
+			ActorID:     actor.reference.ActorID().ID,
+			ModuleID:    actor.reference.ModuleID().ID,
+			Generation:  actor.reference.Generation(),
+			Worker:      actor.reference.ActorID().IDType == types.IDTypeWorker,
+			ActivatedAt: actor.stats.activatedAt,
+			IdleTime:    actor.stats.idleTime(now),
+			QueueDepth:  actor.stats.inFlight.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Namespace != infos[j].Namespace {
+			return infos[i].Namespace < infos[j].Namespace
+		}
+		return infos[i].ActorID < infos[j].ActorID
+	})
+	return infos
+}
+
+// isModuleLoaded returns whether the module was loaded from the registry successfully,
+// which means that it exists.
+func (a *activations) isModuleLoaded(moduleID types.NamespacedID) bool {
+	a.RLock()
+	defer a.RUnlock()
+	_, ok := a._modules[moduleID]
+	return ok
 }
 
 func (a *activations) numActivatedActors() int {
@@ -203,6 +544,25 @@ func (a *activations) numActivatedActors() int {
 	return len(a._actors)
 }
 
+// memoryUsage returns the total memory usage of the activated actors that can report it,
+// I.E WASM actors.
+func (a *activations) memoryUsage() int64 {
+	a.RLock()
+	defer a.RUnlock()
+	var total int64
+	for _, actor := range a._actors {
+		if reporter, ok := actor._a.(memoryReporter); ok {
+			total += reporter.MemoryUsage()
+		}
+	}
+	return total
+}
+
+// memoryReporter is implemented by actors that can report their memory usage.
+type memoryReporter interface {
+	MemoryUsage() int64
+}
+
 func (a *activations) setServerState(
 	serverID string,
 	serverVersion int64,
@@ -222,12 +582,82 @@ func (a *activations) getServerState() (
 	return a.serverState.serverID, a.serverState.serverVersion
 }
 
+// loadedModule is a Module that has been loaded from the registry.
+type loadedModule struct {
+	Module
+	// info is the module's info in the registry when it was loaded.
+	info registry.ModuleInfo
+	// compiled is the module's compiled WASM module, or nil if it's a Go module.
+	compiled *compiledModule
+	// manifest is the module's manifest, if it has one.
+	manifest *registry.ModuleManifest
+	// policy is the module's host policy, if it has one.
+	policy *registry.HostPolicy
+}
+
+// compiledModule is a compiled WASM module, see activations._compiledModules.
+type compiledModule struct {
+	durable.Module
+	key string
+	// refs is the number of loaded modules and activated actors that use the module, and
+	// closed is set once it drops to zero. Both are protected by the activations lock.
+	refs   int
+	closed bool
+}
+
 type activatedActor struct {
 	// Don't access directly from outside this structs own method implementations,
 	// use methods like invoke() and close() instead.
 	_a        Actor
 	reference types.ActorReferenceVirtual
-	host      HostCapabilities
+	// compiled is the compiled WASM module that the actor was instantiated from, or nil
+	// if it's a Go actor.
+	compiled *compiledModule
+	host     HostCapabilities
+	// manifest is the manifest of the actor's module, if it has one.
+	manifest *registry.ModuleManifest
+	// inboxLock ensures that only one goroutine delivers messages from the actor's
+	// inbox at a time.
+	inboxLock *sync.Mutex
+	logger    *actorLogger
+	stats     *activationStats
+}
+
+// activationStats tracks the usage of an activated actor so that it can be introspected.
+type activationStats struct {
+	activatedAt time.Time
+	// lastInvokedAt is the time, in Unix nanoseconds, that the actor's most recent
+	// invocation completed.
+	lastInvokedAt atomic.Int64
+	// inFlight is the number of invocations (including inbox deliveries) that are
+	// currently running or waiting for the actor.
+	inFlight atomic.Int64
+}
+
+func newActivationStats() *activationStats {
+	now := time.Now()
+	s := &activationStats{activatedAt: now}
+	s.lastInvokedAt.Store(now.UnixNano())
+	return s
+}
+
+// track records the start of an invocation and returns a function that must be called
+// once it completes.
+func (s *activationStats) track() func() {
+	s.inFlight.Add(1)
+	return func() {
+		s.lastInvokedAt.Store(time.Now().UnixNano())
+		s.inFlight.Add(-1)
+	}
+}
+
+// idleTime returns how long the actor has gone without being invoked, which is zero while
+// an invocation is in flight.
+func (s *activationStats) idleTime(now time.Time) time.Duration {
+	if s.inFlight.Load() > 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, s.lastInvokedAt.Load()))
 }
 
 func newActivatedActor(
@@ -235,14 +665,20 @@ func newActivatedActor(
 	actor Actor,
 	reference types.ActorReferenceVirtual,
 	host HostCapabilities,
+	manifest *registry.ModuleManifest,
+	logger *actorLogger,
 ) (activatedActor, error) {
 	a := activatedActor{
 		_a:        actor,
 		reference: reference,
 		host:      host,
+		manifest:  manifest,
+		inboxLock: &sync.Mutex{},
+		logger:    logger,
+		stats:     newActivationStats(),
 	}
 
-	_, err := a.invoke(ctx, wapcutils.StartupOperationName, nil)
+	_, err := a.invoke(ctx, wapcutils.StartupOperationName, nil, "")
 	if err != nil {
 		a.close(ctx)
 		return activatedActor{}, fmt.Errorf("newActivatedActor: error invoking startup function: %w", err)
@@ -251,17 +687,58 @@ func newActivatedActor(
 	return a, nil
 }
 
+// invoke invokes the actor. If idempotencyKey is not empty then the result is stored and
+// returned again for subsequent invocations with the same key, see
+// Environment.InvokeActor.
 func (a *activatedActor) invoke(
 	ctx context.Context,
 	operation string,
 	payload []byte,
+	idempotencyKey string,
 ) ([]byte, error) {
+	defer a.stats.track()()
+	readOnly, err := a.validateInvocation(operation, payload)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withActorLogger(ctx, a.logger, operation)
+
 	// Workers can't have KV storage because they're not global singletons like actors
 	// are. They're also not registered with the Registry explicitly, so we can skip
 	// this step in that case.
 	if a.reference.ActorID().IDType != types.IDTypeWorker {
+		hasIdempotencyKey := idempotencyKey != ""
 		result, err := a.host.Transact(ctx, func(tr registry.ActorKVTransaction) (any, error) {
-			return a._a.Invoke(ctx, operation, payload, tr)
+			if hasIdempotencyKey {
+				// Check for a stored result before invoking the actor, in the same
+				// transaction, so that the actor is never invoked for a duplicate and so that
+				// the transaction conflicts if a concurrent invocation with the same key
+				// commits first.
+				stored, err := getInvocationResult(ctx, tr, idempotencyKey, operation)
+				if err != nil || stored != nil {
+					return stored, err
+				}
+			}
+
+			actorTr := tr
+			if readOnly {
+				actorTr = readOnlyActorKVTransaction{tr}
+			}
+			result, err := a._a.Invoke(ctx, operation, payload, actorTr)
+			if err != nil || !hasIdempotencyKey {
+				return result, err
+			}
+
+			// The result is stored in the same transaction as the actor's writes so either
+			// both the writes and the result are persisted, or neither is.
+			err = tr.PutInvocationResult(ctx, idempotencyKey, registry.InvocationResult{
+				Operation: operation,
+				Result:    result,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return result, nil
 		})
 		if err != nil {
 			return nil, err
@@ -272,6 +749,285 @@ func (a *activatedActor) invoke(
 	return a._a.Invoke(ctx, operation, payload, nil)
 }
 
+func (a *activatedActor) invokeStream(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	maxTransactionDuration time.Duration,
+	emit func(chunk []byte) error,
+) error {
+	defer a.stats.track()()
+	readOnly, err := a.validateInvocation(operation, payload)
+	if err != nil {
+		return err
+	}
+	ctx = withActorLogger(ctx, a.logger, operation)
+
+	// Same as invoke(), workers have no KV storage. For actors, the chunks are emitted
+	// as they're produced, before the transaction commits, so the caller has to rely on
+	// the end of the stream (see InvokeStream.Committed()) to determine whether the
+	// invocation's writes were committed or rolled back.
+	if a.reference.ActorID().IDType != types.IDTypeWorker {
+		if maxTransactionDuration > 0 {
+			// The stream has to complete within the limits of a single KV transaction.
+			var cc func()
+			ctx, cc = context.WithTimeout(ctx, maxTransactionDuration)
+			defer cc()
+		}
+
+		_, err := a.host.Transact(ctx, func(tr registry.ActorKVTransaction) (any, error) {
+			if readOnly {
+				tr = readOnlyActorKVTransaction{tr}
+			}
+			return nil, invokeActorStream(ctx, a._a, operation, payload, tr, emit)
+		})
+		return err
+	}
+
+	return invokeActorStream(ctx, a._a, operation, payload, nil, emit)
+}
+
+// validateInvocation validates an invocation against the manifest of the actor's module,
+// if it has one, and returns whether the operation is read-only.
+func (a *activatedActor) validateInvocation(operation string, payload []byte) (bool, error) {
+	if a.manifest == nil || operation == wapcutils.StartupOperationName {
+		return false, nil
+	}
+	op, ok := a.manifest.Operation(operation)
+	if !ok {
+		return false, fmt.Errorf(
+			"%w, operation: %s, module: %s",
+			errUndeclaredOperation, operation, a.reference.ModuleID())
+	}
+	if err := op.ValidatePayload(payload); err != nil {
+		return false, err
+	}
+	return op.ReadOnly, nil
+}
+
+// deliverInbox delivers the messages in the actor's inbox one at a time, in order, until
+// the inbox is empty. Each message is delivered and acknowledged in the same transaction
+// so that its effects on the actor's KV storage are applied exactly once. A message that
+// fails to be delivered is retried with exponential backoff, and moved to the actor's
+// dead letter queue after maxInboxDeliveryAttempts so it can't block the inbox forever.
+// Messages are validated against the module's manifest like any other invocation, and
+// a message that fails validation is moved to the dead letter queue right away since
+// retrying it can never succeed. Deliveries are also subject to the rate limits of the
+// actor's namespace, messages that exceed them are retried once the limits allow it.
+func (a *activatedActor) deliverInbox(ctx context.Context, quotas *namespaceQuotas) error {
+	if a.reference.ActorID().IDType == types.IDTypeWorker {
+		return fmt.Errorf("workers do not have inboxes")
+	}
+	defer a.stats.track()()
+	if !a.inboxLock.TryLock() {
+		// Some other goroutine is already delivering the inbox.
+		return nil
+	}
+	defer a.inboxLock.Unlock()
+
+	for {
+		var (
+			msg          registry.InboxMessage
+			invokeErr    error
+			invalidErr   error
+			rateLimitErr error
+			// admitted is whether the message was admitted by the rate limits. The limits
+			// are only checked once per message so that the transaction being retried
+			// doesn't take more than one token.
+			admitted bool
+		)
+		delivered, err := a.host.Transact(ctx, func(tr registry.ActorKVTransaction) (any, error) {
+			var (
+				ok  bool
+				err error
+			)
+			msg, ok, err = tr.PeekInbox(ctx)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				return false, nil
+			}
+			if time.Now().Before(msg.RetryAt) {
+				// Still backing off after a failed attempt.
+				return false, nil
+			}
+			readOnly, err := a.validateInvocation(msg.Operation, msg.Payload)
+			if err != nil {
+				invalidErr = err
+				return true, tr.DeadLetterInboxMessage(ctx, msg.Seq, err.Error())
+			}
+			if !admitted {
+				// Deliveries are subject to the same rate limits as direct invocations,
+				// otherwise actors could bypass them by messaging each other. Messages
+				// that exceed them stay at the head of the inbox until they're allowed.
+				err := quotas.checkRateLimits(
+					ctx, a.reference.Namespace(), a.reference.ModuleID().ID, a.reference.ActorID().ID)
+				if retryAfter, ok := IsRateLimitedErr(err); ok {
+					rateLimitErr = err
+					return false, tr.RetryInboxMessage(ctx, msg.Seq, err.Error(), time.Now().Add(retryAfter))
+				}
+				if err != nil {
+					return false, err
+				}
+				admitted = true
+			}
+			actorTr := tr
+			if readOnly {
+				actorTr = readOnlyActorKVTransaction{tr}
+			}
+			invokeCtx := withActorLogger(ctx, a.logger, msg.Operation)
+			if _, err := a._a.Invoke(invokeCtx, msg.Operation, msg.Payload, actorTr); err != nil {
+				invokeErr = err
+				return false, fmt.Errorf(
+					"error delivering inbox message: %s to actor: %s, err: %w",
+					msg.ID, a.reference.ActorID().ID, err)
+			}
+			if err := tr.AckInboxMessage(ctx, msg.Seq); err != nil {
+				return false, err
+			}
+			return true, nil
+		})
+		if err != nil {
+			if invokeErr != nil && ctx.Err() == nil {
+				if err := a.recordInboxDeliveryFailure(ctx, msg, invokeErr); err != nil {
+					return fmt.Errorf("error recording failed delivery: %v, err: %w", invokeErr, err)
+				}
+			}
+			return err
+		}
+		if invalidErr != nil {
+			a.logger.log(ctx, LogLevelError, "moved inbox message to dead letter queue",
+				"message_id", msg.ID, "error", invalidErr)
+		}
+		if rateLimitErr != nil {
+			a.logger.log(ctx, LogLevelDebug, "delaying inbox message delivery",
+				"message_id", msg.ID, "error", rateLimitErr)
+		}
+		if !delivered.(bool) {
+			return nil
+		}
+	}
+}
+
+// recordInboxDeliveryFailure records a failed attempt to deliver msg in a new transaction,
+// since the transaction the attempt was made in is rolled back.
+func (a *activatedActor) recordInboxDeliveryFailure(
+	ctx context.Context,
+	msg registry.InboxMessage,
+	cause error,
+) error {
+	attempts := msg.Attempts + 1
+	_, err := a.host.Transact(ctx, func(tr registry.ActorKVTransaction) (any, error) {
+		if attempts >= maxInboxDeliveryAttempts {
+			return nil, tr.DeadLetterInboxMessage(ctx, msg.Seq, cause.Error())
+		}
+		retryAt := time.Now().Add(inboxRetryBackoff(attempts))
+		return nil, tr.RetryInboxMessage(ctx, msg.Seq, cause.Error(), retryAt)
+	})
+	if err != nil {
+		return err
+	}
+	if attempts >= maxInboxDeliveryAttempts {
+		a.logger.log(ctx, LogLevelError, "moved inbox message to dead letter queue",
+			"message_id", msg.ID, "attempts", attempts, "error", cause)
+	}
+	return nil
+}
+
+// inboxRetryBackoff returns how long to wait before attempting to deliver an inbox
+// message again after the provided number of failed attempts.
+func inboxRetryBackoff(attempts int) time.Duration {
+	return retryBackoff(attempts, minInboxRetryBackoff, maxInboxRetryBackoff)
+}
+
+// retryBackoff returns the exponential backoff after the provided number of failed
+// attempts, starting at min and capped at max.
+func retryBackoff(attempts int, min, max time.Duration) time.Duration {
+	backoff := min
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
 func (a *activatedActor) close(ctx context.Context) error {
 	return a._a.Close(ctx)
 }
+
+var (
+	errReadOnlyOperation   = errors.New("read-only operations cannot modify the actor's state")
+	errUndeclaredOperation = errors.New("operation is not declared in the manifest of the module")
+)
+
+// readOnlyActorKVTransaction wraps an ActorKVTransaction and rejects all writes. It's
+// used for invocations of operations that are declared as read-only in their module's
+// manifest.
+type readOnlyActorKVTransaction struct {
+	registry.ActorKVTransaction
+}
+
+func (r readOnlyActorKVTransaction) Put(ctx context.Context, key []byte, value []byte) error {
+	return errReadOnlyOperation
+}
+
+func (r readOnlyActorKVTransaction) EnqueueMessage(
+	ctx context.Context,
+	actorID string,
+	msg registry.InboxMessage,
+) error {
+	return errReadOnlyOperation
+}
+
+func (r readOnlyActorKVTransaction) AckInboxMessage(ctx context.Context, seq int64) error {
+	return errReadOnlyOperation
+}
+
+func (r readOnlyActorKVTransaction) RetryInboxMessage(
+	ctx context.Context,
+	seq int64,
+	reason string,
+	retryAt time.Time,
+) error {
+	return errReadOnlyOperation
+}
+
+func (r readOnlyActorKVTransaction) DeadLetterInboxMessage(
+	ctx context.Context,
+	seq int64,
+	reason string,
+) error {
+	return errReadOnlyOperation
+}
+
+func (r readOnlyActorKVTransaction) JoinActors(
+	ctx context.Context,
+	participants []registry.TransactionParticipant,
+) (registry.MultiActorKV, error) {
+	kv, err := r.ActorKVTransaction.JoinActors(ctx, participants)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyMultiActorKV{kv}, nil
+}
+
+func (r readOnlyActorKVTransaction) PutInvocationResult(
+	ctx context.Context,
+	idempotencyKey string,
+	result registry.InvocationResult,
+) error {
+	return errReadOnlyOperation
+}
+
+// readOnlyMultiActorKV is the same as readOnlyActorKVTransaction, except for the KV
+// storage of the participants of a transaction.
+type readOnlyMultiActorKV struct {
+	registry.MultiActorKV
+}
+
+func (r readOnlyMultiActorKV) Put(ctx context.Context, actorID string, key []byte, value []byte) error {
+	return errReadOnlyOperation
+}
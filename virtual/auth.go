@@ -0,0 +1,355 @@
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// AuthActionRead is required to read a namespace's modules, actors, actor KV storage,
+	// actor logs and usage (describe-module, list-modules, list-actors, get-actor-kv,
+	// scan-actor-kv, watch-actor-kv, export-actor-kv, tail-actor-logs and
+	// namespace-usage).
+	AuthActionRead = "read"
+	// AuthActionInvoke is required to invoke actors and workers and publish to topics in
+	// a namespace.
+	AuthActionInvoke = "invoke"
+	// AuthActionManage is required to register and delete modules, create and delete
+	// actors, and write or import actor KV storage in a namespace.
+	AuthActionManage = "manage"
+	// AuthActionAdmin is required for server-wide endpoints, like /debug/pprof and the
+	// /api/v1/admin introspection endpoints, and to create, update, delete and list
+	// namespaces. Only rules with the wildcard namespace grant it.
+	AuthActionAdmin = "admin"
+
+	// AuthWildcard matches any principal, namespace or action in an AuthorizationRule.
+	AuthWildcard = "*"
+
+	// internalTokenHeader is the header that servers use to authenticate the requests
+	// they send to each other, see ServerOptions.InternalToken.
+	internalTokenHeader = "X-Nola-Internal-Token"
+
+	// The headers used by the HMAC authenticator, see SignHTTPRequest.
+	hmacKeyIDHeader     = "X-Nola-Key-ID"
+	hmacTimestampHeader = "X-Nola-Timestamp"
+	hmacSignatureHeader = "X-Nola-Signature"
+	// hmacContentHashHeader carries the hex encoded SHA-256 of the request's body. It's
+	// covered by the signature so the signature can be verified before the body is read.
+	hmacContentHashHeader = "X-Nola-Content-SHA256"
+
+	// hmacMaxClockSkew is how far a signed request's timestamp may be from the server's
+	// clock, which bounds how long a captured request can be replayed for.
+	hmacMaxClockSkew = 5 * time.Minute
+	// hmacMaxBufferedBodySize is the maximum size of a request body that the HMAC
+	// authenticator will buffer to verify its hash before calling the handler. The hash of
+	// larger bodies (like modules) is verified as the handler reads them instead.
+	hmacMaxBufferedBodySize = 1 << 20
+)
+
+// hmacSignedHeaders are the request headers that are covered by HMAC signatures because
+// some endpoints (like register-module) take their arguments in headers.
+var hmacSignedHeaders = []string{
+	"namespace", "module_id", "manifest", "host_policy", "wasm_runtime",
+}
+
+// errNoCredentials is returned by Authenticators when the request doesn't contain the
+// credentials they understand, so that the next Authenticator can be tried.
+var errNoCredentials = errors.New("request does not contain credentials")
+
+// Authenticator authenticates HTTP requests.
+type Authenticator interface {
+	// Authenticate returns the name of the principal that sent the request. It returns
+	// an error that wraps errNoCredentials if the request doesn't contain credentials
+	// that the Authenticator understands.
+	Authenticate(r *http.Request) (string, error)
+}
+
+// AuthorizationRule grants a principal permission to perform a set of actions in a
+// namespace. Any field may contain AuthWildcard.
+type AuthorizationRule struct {
+	Principal string   `json:"principal"`
+	Namespace string   `json:"namespace"`
+	Actions   []string `json:"actions"`
+}
+
+func (r AuthorizationRule) allows(principal, namespace, action string) bool {
+	if r.Principal != AuthWildcard && r.Principal != principal {
+		return false
+	}
+	if r.Namespace != AuthWildcard && r.Namespace != namespace {
+		return false
+	}
+	for _, a := range r.Actions {
+		if a == AuthWildcard || a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthOptions contains the authentication and authorization options for the server's
+// public API.
+type AuthOptions struct {
+	// Authenticators are tried in order until one of them finds credentials in the request.
+	// Authentication is disabled, and every request is allowed, if it's empty.
+	Authenticators []Authenticator
+	// Rules contains the authorization rules. Requests are denied unless at least one
+	// rule allows them.
+	Rules []AuthorizationRule
+}
+
+// Validate validates the options.
+func (a *AuthOptions) Validate() error {
+	for _, rule := range a.Rules {
+		if rule.Principal == "" || rule.Namespace == "" {
+			return errors.New("authorization rules must specify a principal and namespace")
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case AuthActionRead, AuthActionInvoke, AuthActionManage, AuthActionAdmin, AuthWildcard:
+			default:
+				return fmt.Errorf("unknown authorization action: %s", action)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *AuthOptions) enabled() bool {
+	return len(a.Authenticators) > 0
+}
+
+// authenticate returns the principal that sent the request.
+func (a *AuthOptions) authenticate(r *http.Request) (string, error) {
+	for _, authenticator := range a.Authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return principal, nil
+	}
+	return "", errNoCredentials
+}
+
+func (a *AuthOptions) authorize(principal, namespace, action string) bool {
+	for _, rule := range a.Rules {
+		if rule.allows(principal, namespace, action) {
+			return true
+		}
+	}
+	return false
+}
+
+type authPrincipalKey struct{}
+
+// principalFromContext returns the principal that was authenticated by the server's
+// authentication middleware.
+func principalFromContext(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(authPrincipalKey{}).(string)
+	return principal, ok
+}
+
+type staticTokenAuthenticator struct {
+	tokens map[string]string
+}
+
+// NewStaticTokenAuthenticator returns an Authenticator that authenticates requests with
+// the bearer token in their Authorization header. tokens maps each token to the name of
+// the principal that it authenticates.
+func NewStaticTokenAuthenticator(tokens map[string]string) Authenticator {
+	return &staticTokenAuthenticator{tokens: tokens}
+}
+
+func (s *staticTokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", errNoCredentials
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	// Compare against every token so that the time taken doesn't leak which tokens exist.
+	var principal string
+	for candidate, p := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			principal = p
+		}
+	}
+	if principal == "" {
+		return "", errors.New("invalid bearer token")
+	}
+	return principal, nil
+}
+
+type hmacAuthenticator struct {
+	keys map[string][]byte
+	now  func() time.Time
+}
+
+// NewHMACAuthenticator returns an Authenticator that authenticates requests signed with
+// SignHTTPRequest. keys maps each key ID to its secret, the key ID is used as the name of
+// the principal.
+func NewHMACAuthenticator(keys map[string][]byte) Authenticator {
+	return &hmacAuthenticator{keys: keys, now: time.Now}
+}
+
+func (h *hmacAuthenticator) Authenticate(r *http.Request) (string, error) {
+	keyID := r.Header.Get(hmacKeyIDHeader)
+	if keyID == "" {
+		return "", errNoCredentials
+	}
+	secret, ok := h.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown HMAC key ID: %s", keyID)
+	}
+
+	timestamp := r.Header.Get(hmacTimestampHeader)
+	unixSeconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("error parsing HMAC timestamp: %w", err)
+	}
+	skew := h.now().Sub(time.Unix(unixSeconds, 0))
+	if skew > hmacMaxClockSkew || skew < -hmacMaxClockSkew {
+		return "", fmt.Errorf("HMAC timestamp: %s is outside of the allowed clock skew", timestamp)
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get(hmacSignatureHeader))
+	if err != nil {
+		return "", fmt.Errorf("error decoding HMAC signature: %w", err)
+	}
+	contentHash, err := hex.DecodeString(r.Header.Get(hmacContentHashHeader))
+	if err != nil || len(contentHash) != sha256.Size {
+		return "", errors.New("missing or invalid HMAC content hash")
+	}
+
+	// The signature covers the hash of the body instead of the body itself so that it
+	// can be verified before any of the body is read.
+	expected := hmacSignature(secret, r, timestamp, contentHash)
+	if !hmac.Equal(signature, expected) {
+		return "", errors.New("invalid HMAC signature")
+	}
+
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, hmacMaxBufferedBodySize+1))
+	if err != nil {
+		return "", fmt.Errorf("error reading body: %w", err)
+	}
+	if len(body) <= hmacMaxBufferedBodySize {
+		// The whole body was read so verify it now and replace it so the handler can
+		// still read it.
+		bodyHash := sha256.Sum256(body)
+		if !hmac.Equal(bodyHash[:], contentHash) {
+			return "", errors.New("request body does not match the HMAC content hash")
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return keyID, nil
+	}
+
+	// Large bodies are verified as the handler reads them so they don't have to be
+	// buffered, the handler gets an error instead of EOF if the body doesn't match.
+	r.Body = &hmacBodyVerifier{
+		r:        io.MultiReader(bytes.NewReader(body), r.Body),
+		closer:   r.Body,
+		hash:     sha256.New(),
+		expected: contentHash,
+	}
+	return keyID, nil
+}
+
+// hmacBodyVerifier hashes a request body as it's read and returns an error instead of
+// io.EOF if its hash doesn't match the expected one.
+type hmacBodyVerifier struct {
+	r        io.Reader
+	closer   io.Closer
+	hash     hash.Hash
+	expected []byte
+}
+
+func (v *hmacBodyVerifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(v.hash.Sum(nil), v.expected) {
+		return n, errors.New("request body does not match the HMAC content hash")
+	}
+	return n, err
+}
+
+func (v *hmacBodyVerifier) Close() error {
+	return v.closer.Close()
+}
+
+// SignHTTPRequest signs the request for NewHMACAuthenticator with the provided key. body
+// must be the request's body, the caller is responsible for setting it on the request.
+func SignHTTPRequest(r *http.Request, keyID string, secret []byte, body []byte) {
+	var (
+		timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+		bodyHash  = sha256.Sum256(body)
+	)
+	r.Header.Set(hmacKeyIDHeader, keyID)
+	r.Header.Set(hmacTimestampHeader, timestamp)
+	r.Header.Set(hmacContentHashHeader, hex.EncodeToString(bodyHash[:]))
+	r.Header.Set(
+		hmacSignatureHeader,
+		hex.EncodeToString(hmacSignature(secret, r, timestamp, bodyHash[:])))
+}
+
+// hmacSignature signs the request's method, path, canonical query string (sorted by key),
+// the headers in hmacSignedHeaders, the timestamp and the hash of the body.
+func hmacSignature(secret []byte, r *http.Request, timestamp string, contentHash []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.Path, r.URL.Query().Encode())
+	for _, header := range hmacSignedHeaders {
+		fmt.Fprintf(mac, "%s:%s\n", header, strings.Join(r.Header.Values(header), ","))
+	}
+	fmt.Fprintf(mac, "%s\n%s", timestamp, hex.EncodeToString(contentHash))
+	return mac.Sum(nil)
+}
+
+type mtlsAuthenticator struct{}
+
+// NewMTLSAuthenticator returns an Authenticator that authenticates requests with the
+// verified TLS client certificate of the connection. The certificate's subject common
+// name is used as the name of the principal. The server must be configured to request
+// and verify client certificates.
+func NewMTLSAuthenticator() Authenticator {
+	return mtlsAuthenticator{}
+}
+
+func (mtlsAuthenticator) Authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", errNoCredentials
+	}
+	commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if commonName == "" {
+		return "", errors.New("client certificate does not have a common name")
+	}
+	return commonName, nil
+}
+
+// checkInternalToken returns whether the request carries the internal token. Every
+// request is allowed if the token is empty, which ServerOptions.Validate only permits
+// when authentication is disabled.
+func checkInternalToken(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	provided := r.Header.Get(internalTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
@@ -58,7 +58,7 @@ func benchmarkInvokeActor(b *testing.B, reg registry.Registry) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, err = env.InvokeActor(ctx, "bench-ns", "a", "incFast", nil, types.CreateIfNotExist{})
+		_, err = env.InvokeActor(ctx, "bench-ns", "a", "incFast", nil, types.CreateIfNotExist{}, "")
 		if err != nil {
 			panic(err)
 		}
@@ -128,7 +128,7 @@ func BenchmarkLocalCreateThenInvokeActor(b *testing.B) {
 		if err != nil {
 			panic(err)
 		}
-		_, err = env.InvokeActor(ctx, "bench-ns", actorID, "incFast", nil, types.CreateIfNotExist{})
+		_, err = env.InvokeActor(ctx, "bench-ns", actorID, "incFast", nil, types.CreateIfNotExist{}, "")
 		if err != nil {
 			panic(err)
 		}
@@ -162,7 +162,7 @@ func BenchmarkLocalActorToActorCommunication(b *testing.B) {
 	defer reportOpsPerSecond(b)()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err = env.InvokeActor(ctx, "bench-ns", "a", "invokeActor", marshaled, types.CreateIfNotExist{})
+		_, err = env.InvokeActor(ctx, "bench-ns", "a", "invokeActor", marshaled, types.CreateIfNotExist{}, "")
 		if err != nil {
 			panic(err)
 		}
@@ -217,7 +217,7 @@ func testSimpleBench(
 			_, err = env.InvokeWorker(context.Background(), "bench-ns", "test-module", "incFast", nil)
 			require.NoError(t, err)
 		} else {
-			_, err = env.InvokeActor(context.Background(), "bench-ns", actorID, "incFast", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(context.Background(), "bench-ns", actorID, "incFast", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 		}
 	}
@@ -249,7 +249,7 @@ func testSimpleBench(
 					start := time.Now()
 					if !useWorker {
 						actorID := fmt.Sprintf("%d", i%numActors)
-						_, err = env.InvokeActor(ctx, "bench-ns", actorID, "incFast", nil, types.CreateIfNotExist{})
+						_, err = env.InvokeActor(ctx, "bench-ns", actorID, "incFast", nil, types.CreateIfNotExist{}, "")
 						if err != nil {
 							panic(err)
 						}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net"
+	"os"
 	"sync"
 	"time"
 
+	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
 
 	"github.com/dgraph-io/ristretto"
 )
@@ -19,12 +22,17 @@ const (
 	heartbeatTimeout           = registry.HeartbeatTTL
 	defaultActivationsCacheTTL = heartbeatTimeout
 	maxNumActivationsToCache   = 1e6 // 1 Million.
+	defaultInboxPollInterval   = 250 * time.Millisecond
+	maxInboxesPerPoll          = 1000
 )
 
 type environment struct {
 	// State.
-	activations     *activations // Internally synchronized.
+	activations     *activations     // Internally synchronized.
+	quotas          *namespaceQuotas // Internally synchronized.
+	tracer          *tracing.Tracer
 	activationCache *ristretto.Cache
+	topics          *topicDeliverer // Internally synchronized.
 
 	heartbeatState struct {
 		sync.RWMutex
@@ -37,6 +45,8 @@ type environment struct {
 	closeCh chan struct{}
 	// Closed when the background heartbeating goroutine completes shutting down.
 	closedCh chan struct{}
+	// Closed when the background inbox delivery goroutine completes shutting down.
+	inboxClosedCh chan struct{}
 
 	// Dependencies.
 	serverID string
@@ -82,6 +92,9 @@ type EnvironmentOptions struct {
 	ActivationCacheTTL time.Duration
 	// DisableActivationCache disables the activation cache.
 	DisableActivationCache bool
+	// InboxPollInterval is the interval at which the environment polls the registry for
+	// actors with undelivered messages in their inbox.
+	InboxPollInterval time.Duration
 	// Discovery contains the discovery options.
 	Discovery DiscoveryOptions
 
@@ -93,6 +106,37 @@ type EnvironmentOptions struct {
 	// developeres leveraging NOLA as a library to extend the environment
 	// with additional host functionality.
 	CustomHostFns map[string]func([]byte) ([]byte, error)
+	// ModuleCacheDir is the directory that compiled WASM modules are persisted in so
+	// they don't have to be recompiled when the environment is restarted. Compiled
+	// modules are only cached in memory if it's empty. The directory must not be
+	// shared with any other environment.
+	ModuleCacheDir string
+	// WASMRuntime is the runtime that WASM modules are executed with unless they specify
+	// one explicitly. See the durablewazero package for the valid options.
+	WASMRuntime string
+	// NamespaceQuotasRefreshInterval is the interval at which the environment refreshes
+	// the quotas and usage of the namespaces that it enforces the invocation rate and KV
+	// storage quotas of. See registry.NamespaceQuotas. The log levels of namespaces are
+	// refreshed at the same interval.
+	NamespaceQuotasRefreshInterval time.Duration
+	// TraceExporter exports the spans of the invocations that the environment performs,
+	// see the tracing package. Trace context is still propagated if it's nil.
+	TraceExporter tracing.Exporter
+	// Logger is the logger that the environment logs with, including the messages that
+	// actors log. Messages that are logged for an actor are tagged with its namespace,
+	// module ID and actor ID. Defaults to a logger that writes to stderr.
+	Logger Logger
+	// LogLevel is the minimum level of the messages that are logged for actors in
+	// namespaces that don't have a log level of their own, see
+	// registry.NamespaceOptions. Defaults to info.
+	LogLevel string
+	// ActorLogBufferSize is the number of recent messages that are retained in memory
+	// for each activated actor so they can be tailed, see TailActorLogs. Defaults to 100.
+	ActorLogBufferSize int
+	// TLS contains the TLS options that the environment's server and client are configured
+	// with, if any. The environment verifies that its certificate is valid for its server
+	// ID since other servers would reject every request to it otherwise.
+	TLS TLSOptions
 }
 
 // NewEnvironment creates a new Environment.
@@ -106,6 +150,36 @@ func NewEnvironment(
 	if opts.ActivationCacheTTL == 0 {
 		opts.ActivationCacheTTL = defaultActivationsCacheTTL
 	}
+	if opts.InboxPollInterval == 0 {
+		opts.InboxPollInterval = defaultInboxPollInterval
+	}
+	if opts.NamespaceQuotasRefreshInterval == 0 {
+		opts.NamespaceQuotasRefreshInterval = defaultNamespaceQuotasRefreshInterval
+	}
+	if opts.Logger == nil {
+		opts.Logger = NewWriterLogger(os.Stderr)
+	}
+	if opts.LogLevel == "" {
+		opts.LogLevel = LogLevelInfo.String()
+	}
+	logLevel, err := ParseLogLevel(opts.LogLevel)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LogLevel: %w", err)
+	}
+	if opts.ActorLogBufferSize == 0 {
+		opts.ActorLogBufferSize = defaultActorLogBufferSize
+	}
+	if _, err := durablewazero.Engine(opts.WASMRuntime); err != nil {
+		return nil, fmt.Errorf("invalid WASMRuntime: %w", err)
+	}
+	if err := opts.TLS.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid TLS options: %w", err)
+	}
+	if opts.TLS.Enabled() {
+		if err := opts.TLS.verifyServerID(serverID); err != nil {
+			return nil, err
+		}
+	}
 
 	activationCache, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: maxNumActivationsToCache * 10, // * 10 per the docs.
@@ -134,14 +208,34 @@ func NewEnvironment(
 		activationCache: activationCache,
 		closeCh:         make(chan struct{}),
 		closedCh:        make(chan struct{}),
+		inboxClosedCh:   make(chan struct{}),
+		quotas:          newNamespaceQuotas(reg, opts.NamespaceQuotasRefreshInterval),
+		tracer:          tracing.NewTracer(opts.TraceExporter),
 		registry:        reg,
 		client:          client,
 		address:         address,
 		serverID:        serverID,
 		opts:            opts,
 	}
-	activations := newActivations(reg, env, env.opts.GoModules, env.opts.CustomHostFns)
+	logging := &actorLogging{
+		logger:     env.opts.Logger,
+		level:      logLevel,
+		levels:     newNamespaceLogLevels(reg, opts.NamespaceQuotasRefreshInterval),
+		bufferSize: env.opts.ActorLogBufferSize,
+	}
+	activations := newActivations(
+		reg, env, env.opts.GoModules, env.opts.CustomHostFns,
+		env.opts.ModuleCacheDir, env.opts.WASMRuntime, env.quotas, logging)
 	env.activations = activations
+	env.topics = newTopicDeliverer(func(
+		ctx context.Context,
+		namespace, actorID, operation string,
+		payload []byte,
+		idempotencyKey string,
+	) error {
+		_, err := env.InvokeActor(ctx, namespace, actorID, operation, payload, types.CreateIfNotExist{}, idempotencyKey)
+		return err
+	}, env.opts.Logger)
 
 	for modID := range env.opts.GoModules {
 		// Register all the GoModules in the registry so they're useable with calls to
@@ -156,7 +250,7 @@ func NewEnvironment(
 		}
 	}
 
-	log.Printf("registering self with address: %s", address)
+	env.opts.Logger.Log(LogLevelInfo, "registering self", "server_id", serverID, "address", address)
 
 	// Do one heartbeat right off the bat so the environment is immediately useable.
 	err = env.heartbeat()
@@ -181,12 +275,26 @@ func NewEnvironment(
 					return
 				}
 				if err := env.heartbeat(); err != nil {
-					log.Printf("error performing background heartbeat: %v\n", err)
+					env.opts.Logger.Log(LogLevelError, "error performing background heartbeat", "error", err)
 				}
 			case <-env.closeCh:
-				log.Printf(
-					"environment with serverID: %s and address: %s is shutting down\n",
-					env.serverID, env.address)
+				env.opts.Logger.Log(
+					LogLevelInfo, "environment is shutting down",
+					"server_id", env.serverID, "address", env.address)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(env.inboxClosedCh)
+		ticker := time.NewTicker(env.opts.InboxPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				env.deliverPendingInboxes()
+			case <-env.closeCh:
 				return
 			}
 		}
@@ -212,12 +320,66 @@ func (r *environment) InvokeActor(
 	operation string,
 	payload []byte,
 	create types.CreateIfNotExist,
-) ([]byte, error) {
-	vs, err := r.registry.GetVersionStamp(ctx)
+	idempotencyKey string,
+) (result []byte, err error) {
+	ctx, span := r.tracer.Start(ctx, "nola.InvokeActor", actorSpanAttributes(namespace, actorID, operation)...)
+	defer func() { span.End(err) }()
+
+	if err := r.quotas.checkInvocation(ctx, namespace); err != nil {
+		return nil, err
+	}
+
+	vs, err := r.getVersionStamp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting version stamp: %w", err)
+	}
+
+	references, err := r.resolveActivation(ctx, namespace, actorID, create)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.invokeReferences(ctx, vs, references, operation, payload, idempotencyKey)
+}
+
+func (r *environment) InvokeActorStream(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	operation string,
+	payload []byte,
+	create types.CreateIfNotExist,
+) (stream InvokeStream, err error) {
+	// The span only covers dispatching the invocation, the actor's turn has its own span
+	// that ends once the stream is complete.
+	ctx, span := r.tracer.Start(ctx, "nola.InvokeActorStream", actorSpanAttributes(namespace, actorID, operation)...)
+	defer func() { span.End(err) }()
+
+	if err := r.quotas.checkInvocation(ctx, namespace); err != nil {
+		return nil, err
+	}
+
+	vs, err := r.getVersionStamp(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error getting version stamp: %w", err)
 	}
 
+	references, err := r.resolveActivation(ctx, namespace, actorID, create)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.invokeReferencesStream(ctx, vs, references, operation, payload)
+}
+
+// resolveActivation returns the references for the provided actor's current activation,
+// either from the activation cache or by calling EnsureActivation() on the registry.
+func (r *environment) resolveActivation(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	create types.CreateIfNotExist,
+) ([]types.ActorReference, error) {
 	bufIface := bufPool.Get()
 	defer bufPool.Put(bufIface)
 	cacheKey := bufPool.Get().([]byte)[:0]
@@ -231,13 +393,18 @@ func (r *environment) InvokeActor(
 	)
 	if !r.opts.DisableActivationCache {
 		referencesI, ok = r.activationCache.Get(cacheKey)
+		if ok {
+			activationCacheLookups.WithLabels("hit").Inc()
+		} else {
+			activationCacheLookups.WithLabels("miss").Inc()
+		}
 	}
 	if ok {
 		references = referencesI.([]types.ActorReference)
 	} else {
 		var err error
 		// TODO: Need a concurrency limiter on this thing.
-		references, err = r.registry.EnsureActivation(ctx, namespace, actorID)
+		references, err = r.ensureActivation(ctx, namespace, actorID)
 		if registry.IsActorDoesNotExistErr(err) && create.ModuleID != "" {
 			// Actor does not exist, but caller specified we can create it on their behalf.
 			// TODO: This is racey, technically create.Options should be passed to
@@ -245,13 +412,15 @@ func (r *environment) InvokeActor(
 			// now because it doesn't cause any correctness issues, just means a few requests
 			// may fail the first time an actor is invoked if many invocations happen
 			// concurrently but it will sort itself out automatically.
-			_, err := r.registry.CreateActor(ctx, namespace, actorID, create.ModuleID, create.Options)
+			createCtx, span := tracing.Start(ctx, "registry.CreateActor")
+			_, err := r.registry.CreateActor(createCtx, namespace, actorID, create.ModuleID, create.Options)
+			span.End(err)
 			if err != nil {
 				return nil, fmt.Errorf(
 					"error creating non-existent actor: %s in registry: %w with options: %v",
 					actorID, err, create)
 			}
-			references, err = r.registry.EnsureActivation(ctx, namespace, actorID)
+			references, err = r.ensureActivation(ctx, namespace, actorID)
 			if err != nil {
 				return nil, fmt.Errorf(
 					"error ensuring activation of actor: %s in registry: %w",
@@ -278,7 +447,7 @@ func (r *environment) InvokeActor(
 			"ensureActivation() success with 0 references for actor ID: %s", actorID)
 	}
 
-	return r.invokeReferences(ctx, vs, references, operation, payload)
+	return references, nil
 }
 
 func (r *environment) InvokeActorDirect(
@@ -289,9 +458,98 @@ func (r *environment) InvokeActorDirect(
 	reference types.ActorReferenceVirtual,
 	operation string,
 	payload []byte,
+	idempotencyKey string,
+) ([]byte, error) {
+	if err := r.validateDirectInvocation(versionStamp, serverID, serverVersion); err != nil {
+		return nil, err
+	}
+
+	// The span covers the actor's turn.
+	ctx, span := r.tracer.Start(ctx, "nola.InvokeActorDirect", referenceSpanAttributes(reference, operation)...)
+	start := time.Now()
+	result, err := r.invokeDirect(ctx, reference, operation, payload, idempotencyKey)
+	recordInvocation(reference.Namespace(), reference.ModuleID().ID, operation, start, err)
+	span.End(err)
+	return result, err
+}
+
+// getVersionStamp calls GetVersionStamp on the registry in a span.
+func (r *environment) getVersionStamp(ctx context.Context) (int64, error) {
+	ctx, span := tracing.Start(ctx, "registry.GetVersionStamp")
+	vs, err := r.registry.GetVersionStamp(ctx)
+	span.End(err)
+	return vs, err
+}
+
+// ensureActivation calls EnsureActivation on the registry in a span.
+func (r *environment) ensureActivation(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+) ([]types.ActorReference, error) {
+	ctx, span := tracing.Start(ctx, "registry.EnsureActivation")
+	references, err := r.registry.EnsureActivation(ctx, namespace, actorID)
+	span.End(err)
+	return references, err
+}
+
+func (r *environment) invokeDirect(
+	ctx context.Context,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	payload []byte,
+	idempotencyKey string,
 ) ([]byte, error) {
+	if operation == wapcutils.DeliverInboxOperationName {
+		// The rate limits are checked for each message that is delivered instead.
+		return nil, r.activations.deliverInbox(ctx, reference)
+	}
+	if err := r.quotas.checkRateLimits(
+		ctx, reference.Namespace(), reference.ModuleID().ID, reference.ActorID().ID); err != nil {
+		return nil, err
+	}
+	return r.activations.invoke(ctx, reference, operation, payload, idempotencyKey)
+}
+
+func (r *environment) InvokeActorDirectStream(
+	ctx context.Context,
+	versionStamp int64,
+	serverID string,
+	serverVersion int64,
+	reference types.ActorReferenceVirtual,
+	operation string,
+	payload []byte,
+) (InvokeStream, error) {
+	if err := r.validateDirectInvocation(versionStamp, serverID, serverVersion); err != nil {
+		return nil, err
+	}
+	ctx, span := r.tracer.Start(ctx, "nola.InvokeActorDirectStream", referenceSpanAttributes(reference, operation)...)
+	start := time.Now()
+	if err := r.quotas.checkRateLimits(
+		ctx, reference.Namespace(), reference.ModuleID().ID, reference.ActorID().ID); err != nil {
+		recordInvocation(reference.Namespace(), reference.ModuleID().ID, operation, start, err)
+		span.End(err)
+		return nil, err
+	}
+
+	return newChanStream(ctx, func(emit func(chunk []byte) error) error {
+		err := r.activations.invokeStream(ctx, reference, operation, payload, emit)
+		recordInvocation(reference.Namespace(), reference.ModuleID().ID, operation, start, err)
+		span.End(err)
+		return err
+	}), nil
+}
+
+// validateDirectInvocation ensures that this environment is (still) allowed to run
+// invocations for actors that the registry has assigned to the provided serverID and
+// serverVersion as of versionStamp.
+func (r *environment) validateDirectInvocation(
+	versionStamp int64,
+	serverID string,
+	serverVersion int64,
+) error {
 	if serverID == "" {
-		return nil, errors.New("serverID cannot be empty")
+		return errors.New("serverID cannot be empty")
 	}
 	if serverID != r.serverID {
 		// Make sure the client has reached the server it intended. This is an important
@@ -304,23 +562,20 @@ func (r *environment) InvokeActorDirect(
 		//       client should assert on that as well to avoid issues where the request
 		//       reaches the wrong application entirely and that application just returns
 		//       OK to everything.
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"request for serverID: %s received by server: %s, cannot fullfil",
 			serverID, r.serverID)
 	}
 	if versionStamp <= 0 {
-		return nil, fmt.Errorf("versionStamp must be >= 0, but was: %d", versionStamp)
+		return fmt.Errorf("versionStamp must be >= 0, but was: %d", versionStamp)
 	}
 
-	// TODO: Delete me, but useful for now.
-	log.Printf("%d::%s:%s::%s::%s\n", versionStamp, serverID, reference.ModuleID().ID, reference.ActorID().ID, operation)
-
 	r.heartbeatState.RLock()
 	heartbeatResult := r.heartbeatState.HeartbeatResult
 	r.heartbeatState.RUnlock()
 
 	if heartbeatResult.VersionStamp+heartbeatResult.HeartbeatTTL < versionStamp {
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"InvokeLocal: server heartbeat(%d) + TTL(%d) < versionStamp(%d)",
 			heartbeatResult.VersionStamp, heartbeatResult.HeartbeatTTL, versionStamp)
 	}
@@ -329,12 +584,12 @@ func (r *environment) InvokeActorDirect(
 	// the env hasn't missed a heartbeat recently, which could cause it to lose ownership of the actor.
 	// This bug was identified using this mode.l https://github.com/richardartoul/nola/blob/master/proofs/stateright/activation-cache/README.md
 	if heartbeatResult.ServerVersion != serverVersion {
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"InvokeLocal: server version(%d) != server version from reference(%d)",
 			heartbeatResult.ServerVersion, serverVersion)
 	}
 
-	return r.activations.invoke(ctx, reference, operation, payload)
+	return nil
 }
 
 func (r *environment) InvokeWorker(
@@ -350,14 +605,77 @@ func (r *environment) InvokeWorker(
 	//       ability for multiple workers of the same module ID to execute in parallel on a
 	//       single server. This should be relatively straightforward to do with a few modications
 	//       to activations.go.
+	if err := r.quotas.checkInvocation(ctx, namespace); err != nil {
+		return nil, err
+	}
+
 	ref, err := types.NewVirtualWorkerReference(namespace, moduleID, moduleID)
 	if err != nil {
 		return nil, fmt.Errorf("InvokeWorker: error creating actor reference: %w", err)
 	}
 
+	ctx, span := r.tracer.Start(ctx, "nola.InvokeWorker", referenceSpanAttributes(ref, operation)...)
+	start := time.Now()
+	// Workers aren't subject to per-actor rate limits since they're stateless.
+	if err := r.quotas.checkRateLimits(ctx, namespace, moduleID, ""); err != nil {
+		r.recordWorkerInvocation(ref, operation, start, err)
+		span.End(err)
+		return nil, err
+	}
+
 	// Workers provide none of the consistency / linearizability guarantees that actor's do, so we
 	// can bypass the registry entirely and just immediately invoke the function.
-	return r.activations.invoke(ctx, ref, operation, payload)
+	result, err := r.activations.invoke(ctx, ref, operation, payload, "")
+	r.recordWorkerInvocation(ref, operation, start, err)
+	span.End(err)
+	return result, err
+}
+
+// recordWorkerInvocation records the metrics for an invocation of a worker. Unlike the
+// modules of actors, which are resolved by the registry before they're invoked, the
+// module of a worker is whatever the caller provided. Invocations of modules that haven't
+// been loaded on this server are recorded as "other" so that callers can't create an
+// unbounded number of series by invoking modules that don't exist.
+func (r *environment) recordWorkerInvocation(
+	ref types.ActorReferenceVirtual,
+	operation string,
+	start time.Time,
+	err error,
+) {
+	namespace, moduleID := ref.Namespace(), ref.ModuleID().ID
+	if !r.activations.isModuleLoaded(ref.ModuleID()) {
+		namespace, moduleID = otherModuleLabel, otherModuleLabel
+	}
+	recordInvocation(namespace, moduleID, operation, start, err)
+}
+
+func (r *environment) Publish(
+	ctx context.Context,
+	namespace string,
+	topic string,
+	payload []byte,
+) error {
+	subscriptions, err := r.registry.GetSubscriptions(ctx, namespace, topic)
+	if err != nil {
+		return fmt.Errorf("error getting subscriptions for topic: %s, err: %w", topic, err)
+	}
+
+	// Copy the payload since it will be retained until every subscriber has received it.
+	payloadCopy := append([]byte(nil), payload...)
+
+	var firstErr error
+	for _, sub := range subscriptions {
+		err := r.topics.enqueue(namespace, topic, sub.ActorID, sub.Operation, payloadCopy)
+		if err != nil && firstErr == nil {
+			// Keep going so one slow subscriber doesn't prevent delivery to the others.
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return fmt.Errorf("error publishing to topic: %s, err: %w", topic, firstErr)
+	}
+
+	return nil
 }
 
 func (r *environment) Close() error {
@@ -367,12 +685,97 @@ func (r *environment) Close() error {
 	delete(localEnvironmentsRouter, r.address)
 	localEnvironmentsRouterLock.Unlock()
 
+	r.topics.close()
 	close(r.closeCh)
 	<-r.closedCh
+	<-r.inboxClosedCh
+
+	activatedActors.Delete(r.serverID)
+	wasmMemoryBytes.Delete(r.serverID)
 
 	return nil
 }
 
+// deliverPendingInboxes triggers delivery for every actor that has undelivered messages
+// in its inbox and is activated on this server, or isn't activated on any live server.
+// The delivery itself is routed to whichever server the actor is activated on, just like
+// a regular invocation, since only that server is allowed to begin transactions for the
+// actor.
+func (r *environment) deliverPendingInboxes() {
+	ctx, cc := context.WithTimeout(context.Background(), heartbeatTimeout)
+	defer cc()
+
+	pending, err := r.registry.ListActorsWithPendingMessages(ctx, r.serverID, maxInboxesPerPoll)
+	if err != nil {
+		r.opts.Logger.Log(LogLevelError, "error listing actors with pending messages", "error", err)
+		return
+	}
+
+	for _, actor := range pending {
+		_, err := r.InvokeActor(
+			ctx, actor.Namespace, actor.ID,
+			wapcutils.DeliverInboxOperationName, nil, types.CreateIfNotExist{}, "")
+		if err != nil {
+			r.opts.Logger.Log(
+				LogLevelError, "error delivering inbox",
+				"namespace", actor.Namespace, "actor_id", actor.ID, "error", err)
+		}
+	}
+}
+
+func (r *environment) TailActorLogs(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	limit int,
+) ([]LogEntry, bool, error) {
+	if logs, ok := r.activations.tailLogs(namespace, actorID, limit); ok {
+		return logs, true, nil
+	}
+
+	// Use DescribeActor instead of EnsureActivation so that tailing the logs of an actor
+	// that isn't activated doesn't activate it.
+	info, err := r.registry.DescribeActor(ctx, namespace, actorID)
+	if registry.IsActorDoesNotExistErr(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error resolving activation of actor: %s, err: %w", actorID, err)
+	}
+	activation := info.Activation
+	if activation == nil || activation.ServerID == r.serverID {
+		return nil, false, nil
+	}
+
+	localEnvironmentsRouterLock.RLock()
+	localEnv, ok := localEnvironmentsRouter[activation.ServerAddress]
+	localEnvironmentsRouterLock.RUnlock()
+	if ok {
+		return localEnv.TailActorLogsDirect(activation.ServerID, namespace, actorID, limit)
+	}
+	return r.client.TailActorLogsRemote(
+		ctx, activation.ServerID, activation.ServerAddress, namespace, actorID, limit)
+}
+
+func (r *environment) TailActorLogsDirect(
+	serverID string,
+	namespace string,
+	actorID string,
+	limit int,
+) ([]LogEntry, bool, error) {
+	if serverID != r.serverID {
+		return nil, false, fmt.Errorf(
+			"request for server ID: %s received by server: %s, cannot tail logs",
+			serverID, r.serverID)
+	}
+	logs, ok := r.activations.tailLogs(namespace, actorID, limit)
+	return logs, ok, nil
+}
+
+func (r *environment) ListActivations() []ActivationInfo {
+	return r.activations.listActivations()
+}
+
 func (r *environment) numActivatedActors() int {
 	return r.activations.numActivatedActors()
 }
@@ -380,10 +783,21 @@ func (r *environment) numActivatedActors() int {
 func (r *environment) heartbeat() error {
 	ctx, cc := context.WithTimeout(context.Background(), heartbeatTimeout)
 	defer cc()
+
+	numActivatedActors := r.numActivatedActors()
+	activatedActors.WithLabels(r.serverID).Set(float64(numActivatedActors))
+	wasmMemoryBytes.WithLabels(r.serverID).Set(float64(r.activations.memoryUsage()))
+
+	start := time.Now()
 	result, err := r.registry.Heartbeat(ctx, r.serverID, registry.HeartbeatState{
-		NumActivatedActors: r.numActivatedActors(),
+		NumActivatedActors: numActivatedActors,
 		Address:            r.address,
 	})
+	heartbeatResult := "success"
+	if err != nil {
+		heartbeatResult = "error"
+	}
+	heartbeatDuration.WithLabels(heartbeatResult).Observe(time.Since(start).Seconds())
 	if err != nil {
 		return fmt.Errorf("error heartbeating: %w", err)
 	}
@@ -417,6 +831,7 @@ func (r *environment) invokeReferences(
 	references []types.ActorReference,
 	operation string,
 	payload []byte,
+	idempotencyKey string,
 ) ([]byte, error) {
 	// TODO: Load balancing or some other strategy if the number of references is > 1?
 	ref := references[0]
@@ -424,9 +839,28 @@ func (r *environment) invokeReferences(
 	localEnv, ok := localEnvironmentsRouter[ref.Address()]
 	localEnvironmentsRouterLock.RUnlock()
 	if ok {
-		return localEnv.InvokeActorDirect(ctx, versionStamp, ref.ServerID(), ref.ServerVersion(), ref, operation, payload)
+		return localEnv.InvokeActorDirect(
+			ctx, versionStamp, ref.ServerID(), ref.ServerVersion(), ref, operation, payload, idempotencyKey)
+	}
+	return r.client.InvokeActorRemote(ctx, versionStamp, ref, operation, payload, idempotencyKey)
+}
+
+func (r *environment) invokeReferencesStream(
+	ctx context.Context,
+	versionStamp int64,
+	references []types.ActorReference,
+	operation string,
+	payload []byte,
+) (InvokeStream, error) {
+	// TODO: Same load balancing TODO as invokeReferences().
+	ref := references[0]
+	localEnvironmentsRouterLock.RLock()
+	localEnv, ok := localEnvironmentsRouter[ref.Address()]
+	localEnvironmentsRouterLock.RUnlock()
+	if ok {
+		return localEnv.InvokeActorDirectStream(ctx, versionStamp, ref.ServerID(), ref.ServerVersion(), ref, operation, payload)
 	}
-	return r.client.InvokeActorRemote(ctx, versionStamp, ref, operation, payload)
+	return r.client.InvokeActorRemoteStream(ctx, versionStamp, ref, operation, payload)
 }
 
 func (r *environment) freezeHeartbeatState() {
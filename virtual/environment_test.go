@@ -2,16 +2,27 @@ package virtual
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
 
@@ -57,7 +68,7 @@ func TestSimpleActor(t *testing.T) {
 		ctx := context.Background()
 		for _, ns := range []string{"ns-1", "ns-2"} {
 			// Can't invoke because actor doesn't exist yet.
-			_, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+			_, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 			require.Error(t, err)
 
 			// Create actor.
@@ -66,12 +77,12 @@ func TestSimpleActor(t *testing.T) {
 
 			for i := 0; i < 100; i++ {
 				// Invoke should work now.
-				result, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+				result, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 				require.NoError(t, err)
 				require.Equal(t, int64(i+1), getCount(t, result))
 
 				if i == 0 {
-					result, err = env.InvokeActor(ctx, ns, "a", "getStartupWasCalled", nil, types.CreateIfNotExist{})
+					result, err = env.InvokeActor(ctx, ns, "a", "getStartupWasCalled", nil, types.CreateIfNotExist{}, "")
 					require.NoError(t, err)
 					require.Equal(t, []byte("true"), result)
 				}
@@ -93,19 +104,19 @@ func TestCreateIfNotExist(t *testing.T) {
 				if i == 0 {
 					// Invoke should fail if CreateIfNotExist is not set.
 					_, err := env.InvokeActor(
-						ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+						ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 					require.Error(t, err)
 					require.True(t, registry.IsActorDoesNotExistErr(err))
 				}
 
 				// Should succeed with it set.
 				result, err := env.InvokeActor(
-					ctx, ns, "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"})
+					ctx, ns, "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
 				require.NoError(t, err)
 				require.Equal(t, int64(i+1), getCount(t, result))
 
 				if i == 0 {
-					result, err = env.InvokeActor(ctx, ns, "a", "getStartupWasCalled", nil, types.CreateIfNotExist{})
+					result, err = env.InvokeActor(ctx, ns, "a", "getStartupWasCalled", nil, types.CreateIfNotExist{}, "")
 					require.NoError(t, err)
 					require.Equal(t, []byte("true"), result)
 				}
@@ -158,7 +169,7 @@ func TestGenerationCountIncInvalidatesActivation(t *testing.T) {
 
 			// Build some state.
 			for i := 0; i < 100; i++ {
-				result, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+				result, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 				require.NoError(t, err)
 				require.Equal(t, int64(i+1), getCount(t, result))
 			}
@@ -171,7 +182,7 @@ func TestGenerationCountIncInvalidatesActivation(t *testing.T) {
 				if i == 0 {
 					for {
 						// Wait for cache to expire.
-						result, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+						result, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 						require.NoError(t, err)
 						if getCount(t, result) == 1 {
 							break
@@ -180,7 +191,7 @@ func TestGenerationCountIncInvalidatesActivation(t *testing.T) {
 					}
 					continue
 				}
-				result, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+				result, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 				require.NoError(t, err)
 				require.Equal(t, int64(i+1), getCount(t, result))
 			}
@@ -206,23 +217,23 @@ func TestKVHostFunctions(t *testing.T) {
 				require.NoError(t, err)
 
 				for i := 0; i < 100; i++ {
-					_, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+					_, err := env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 					require.NoError(t, err)
 
 					// Write the current count to a key.
 					key := []byte(fmt.Sprintf("key-%d", i))
-					_, err = env.InvokeActor(ctx, ns, "a", "kvPutCount", key, types.CreateIfNotExist{})
+					_, err = env.InvokeActor(ctx, ns, "a", "kvPutCount", key, types.CreateIfNotExist{}, "")
 					require.NoError(t, err)
 
 					// Read the key back and make sure the value is == the count
-					payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{})
+					payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{}, "")
 					require.NoError(t, err)
 					val := getCount(t, payload)
 					require.Equal(t, int64(i+1), val)
 
 					if i > 0 {
 						key := []byte(fmt.Sprintf("key-%d", i-1))
-						payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{})
+						payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{}, "")
 						require.NoError(t, err)
 						val := getCount(t, payload)
 						require.Equal(t, int64(i), val)
@@ -233,7 +244,7 @@ func TestKVHostFunctions(t *testing.T) {
 			// Ensure all previous KV are still readable.
 			for i := 0; i < 100; i++ {
 				key := []byte(fmt.Sprintf("key-%d", i))
-				payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{})
+				payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{}, "")
 				require.NoError(t, err)
 				val := getCount(t, payload)
 				require.Equal(t, int64(i+1), val)
@@ -257,16 +268,16 @@ func TestKVTransactions(t *testing.T) {
 			_, err := reg.CreateActor(ctx, ns, "a", "test-module", types.ActorOptions{})
 			require.NoError(t, err)
 
-			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Write the current count to a key.
 			key := []byte("key")
-			_, err = env.InvokeActor(ctx, ns, "a", "kvPutCount", key, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "kvPutCount", key, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Read the key back and make sure the value is == the count
-			payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{})
+			payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 			val := getCount(t, payload)
 			require.Equal(t, int64(1), val)
@@ -275,14 +286,14 @@ func TestKVTransactions(t *testing.T) {
 			// returns an error so the updated counter will not be committed to
 			// KV storage. This tests that implicit KV transactions are rolled
 			// back if the actor returns an error.
-			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
-			_, err = env.InvokeActor(ctx, ns, "a", "kvPutCountError", key, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "kvPutCountError", key, types.CreateIfNotExist{}, "")
 			require.True(t, strings.Contains(err.Error(), "some fake error"), err.Error())
 
 			// Count should still be 1.
-			payload, err = env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{})
+			payload, err = env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 			val = getCount(t, payload)
 			require.Equal(t, int64(1), val)
@@ -309,28 +320,28 @@ func TestKVHostFunctionsActorsSeparatedRegression(t *testing.T) {
 			require.NoError(t, err)
 
 			// Inc a twice, but b once.
-			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
-			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
-			_, err = env.InvokeActor(ctx, ns, "b", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "b", "inc", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			key := []byte("key")
 
 			// Persist each actor's count.
-			_, err = env.InvokeActor(ctx, ns, "a", "kvPutCount", key, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "kvPutCount", key, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
-			_, err = env.InvokeActor(ctx, ns, "b", "kvPutCount", key, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "b", "kvPutCount", key, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Make sure we can read back the independent counts.
-			payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{})
+			payload, err := env.InvokeActor(ctx, ns, "a", "kvGet", key, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 			val := getCount(t, payload)
 			require.Equal(t, int64(2), val)
 
-			payload, err = env.InvokeActor(ctx, ns, "b", "kvGet", key, types.CreateIfNotExist{})
+			payload, err = env.InvokeActor(ctx, ns, "b", "kvGet", key, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 			val = getCount(t, payload)
 			require.Equal(t, int64(1), val)
@@ -350,33 +361,33 @@ func TestCreateActorHostFunction(t *testing.T) {
 			require.NoError(t, err)
 
 			// Succeeds because actor exists.
-			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "inc", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Fails because actor does not exist.
-			_, err = env.InvokeActor(ctx, ns, "b", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "b", "inc", nil, types.CreateIfNotExist{}, "")
 			require.Error(t, err)
 
 			// Create a new actor b by calling fork() on a, not by creating it ourselves.
-			_, err = env.InvokeActor(ctx, ns, "a", "fork", []byte("b"), types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "fork", []byte("b"), types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Should succeed now that actor a has created actor b.
-			_, err = env.InvokeActor(ctx, ns, "b", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "b", "inc", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			for _, actor := range []string{"a", "b"} {
 				for i := 0; i < 100; i++ {
-					_, err := env.InvokeActor(ctx, ns, actor, "inc", nil, types.CreateIfNotExist{})
+					_, err := env.InvokeActor(ctx, ns, actor, "inc", nil, types.CreateIfNotExist{}, "")
 					require.NoError(t, err)
 
 					// Write the current count to a key.
 					key := []byte(fmt.Sprintf("key-%d", i))
-					_, err = env.InvokeActor(ctx, ns, actor, "kvPutCount", key, types.CreateIfNotExist{})
+					_, err = env.InvokeActor(ctx, ns, actor, "kvPutCount", key, types.CreateIfNotExist{}, "")
 					require.NoError(t, err)
 
 					// Read the key back and make sure the value is == the count
-					payload, err := env.InvokeActor(ctx, ns, actor, "kvGet", key, types.CreateIfNotExist{})
+					payload, err := env.InvokeActor(ctx, ns, actor, "kvGet", key, types.CreateIfNotExist{}, "")
 					require.NoError(t, err)
 					val := getCount(t, payload)
 					require.Equal(t, int64(i+2), val)
@@ -399,7 +410,7 @@ func TestInvokeActorHostFunction(t *testing.T) {
 			_, err := reg.CreateActor(ctx, ns, "a", "test-module", types.ActorOptions{})
 			require.NoError(t, err)
 
-			_, err = env.InvokeActor(ctx, ns, "a", "fork", []byte("b"), types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "fork", []byte("b"), types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Ensure actor a can communicate with actor b.
@@ -410,7 +421,7 @@ func TestInvokeActorHostFunction(t *testing.T) {
 			}
 			marshaled, err := json.Marshal(invokeReq)
 			require.NoError(t, err)
-			_, err = env.InvokeActor(ctx, ns, "a", "invokeActor", marshaled, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "invokeActor", marshaled, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Ensure actor b can communicate with actor a.
@@ -421,7 +432,7 @@ func TestInvokeActorHostFunction(t *testing.T) {
 			}
 			marshaled, err = json.Marshal(invokeReq)
 			require.NoError(t, err)
-			_, err = env.InvokeActor(ctx, ns, "b", "invokeActor", marshaled, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "b", "invokeActor", marshaled, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Ensure both actor's state was actually updated and they can request
@@ -433,7 +444,7 @@ func TestInvokeActorHostFunction(t *testing.T) {
 			}
 			marshaled, err = json.Marshal(invokeReq)
 			require.NoError(t, err)
-			result, err := env.InvokeActor(ctx, ns, "a", "invokeActor", marshaled, types.CreateIfNotExist{})
+			result, err := env.InvokeActor(ctx, ns, "a", "invokeActor", marshaled, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 			require.Equal(t, int64(1), getCount(t, result))
 
@@ -444,7 +455,7 @@ func TestInvokeActorHostFunction(t *testing.T) {
 			}
 			marshaled, err = json.Marshal(invokeReq)
 			require.NoError(t, err)
-			result, err = env.InvokeActor(ctx, ns, "b", "invokeActor", marshaled, types.CreateIfNotExist{})
+			result, err = env.InvokeActor(ctx, ns, "b", "invokeActor", marshaled, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 			require.Equal(t, int64(1), getCount(t, result))
 		}
@@ -463,7 +474,7 @@ func TestScheduleInvocationHostFunction(t *testing.T) {
 			_, err := reg.CreateActor(ctx, ns, "a", "test-module", types.ActorOptions{})
 			require.NoError(t, err)
 
-			_, err = env.InvokeActor(ctx, ns, "a", "fork", []byte("b"), types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "fork", []byte("b"), types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// A bit meta, but tell a to schedule an invocation on b to schedule an invocation
@@ -503,19 +514,19 @@ func TestScheduleInvocationHostFunction(t *testing.T) {
 			require.NoError(t, err)
 
 			// Schedule both the a::a invocation and the a::b::a invocation.
-			_, err = env.InvokeActor(ctx, ns, "a", "scheduleInvocation", marshaledAScheduleB, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "scheduleInvocation", marshaledAScheduleB, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
-			_, err = env.InvokeActor(ctx, ns, "a", "scheduleInvocation", marshaledAScheduleA, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, ns, "a", "scheduleInvocation", marshaledAScheduleA, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 
 			// Make sure a is 0 immediately after scheduling.
-			result, err := env.InvokeActor(ctx, ns, "a", "getCount", nil, types.CreateIfNotExist{})
+			result, err := env.InvokeActor(ctx, ns, "a", "getCount", nil, types.CreateIfNotExist{}, "")
 			require.NoError(t, err)
 			require.Equal(t, int64(0), getCount(t, result))
 
 			// Wait for both the a::a and a::b::a invocations to run.
 			for {
-				result, err := env.InvokeActor(ctx, ns, "a", "getCount", nil, types.CreateIfNotExist{})
+				result, err := env.InvokeActor(ctx, ns, "a", "getCount", nil, types.CreateIfNotExist{}, "")
 				require.NoError(t, err)
 				if getCount(t, result) != int64(2) {
 					time.Sleep(100 * time.Millisecond)
@@ -523,7 +534,7 @@ func TestScheduleInvocationHostFunction(t *testing.T) {
 				}
 
 				// We didn't ever schedule an inc for b so it should remain zero.
-				result, err = env.InvokeActor(ctx, ns, "b", "getCount", nil, types.CreateIfNotExist{})
+				result, err = env.InvokeActor(ctx, ns, "b", "getCount", nil, types.CreateIfNotExist{}, "")
 				require.NoError(t, err)
 				require.Equal(t, int64(0), getCount(t, result))
 				break
@@ -552,7 +563,7 @@ func TestInvokeActorHostFunctionDeadlockRegression(t *testing.T) {
 		marshaled, err := json.Marshal(invokeReq)
 		require.NoError(t, err)
 
-		_, err = env.InvokeActor(ctx, "ns-1", "a", "invokeActor", marshaled, types.CreateIfNotExist{})
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "invokeActor", marshaled, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 	}
 
@@ -608,29 +619,29 @@ func TestHeartbeatAndSelfHealing(t *testing.T) {
 		// Registry about the server from the server heartbeats. Therefore we need to
 		// heartbeat at least once after every actor is activated if we want to ensure the
 		// registry is able to actually load-balance the activations evenly.
-		_, err = env1.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+		_, err = env1.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
-		_, err = env2.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+		_, err = env2.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
-		_, err = env3.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+		_, err = env3.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 		require.NoError(t, env1.heartbeat())
 		require.NoError(t, env2.heartbeat())
 		require.NoError(t, env3.heartbeat())
-		_, err = env1.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{})
+		_, err = env1.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
-		_, err = env2.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{})
+		_, err = env2.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
-		_, err = env3.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{})
+		_, err = env3.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 		require.NoError(t, env1.heartbeat())
 		require.NoError(t, env2.heartbeat())
 		require.NoError(t, env3.heartbeat())
-		_, err = env1.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{})
+		_, err = env1.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
-		_, err = env2.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{})
+		_, err = env2.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
-		_, err = env3.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{})
+		_, err = env3.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 		require.NoError(t, env1.heartbeat())
 		require.NoError(t, env2.heartbeat())
@@ -659,7 +670,7 @@ func TestHeartbeatAndSelfHealing(t *testing.T) {
 			for {
 				// Spin loop until there are no more errors as function calls will fail for
 				// a bit until heartbeat + activation cache expire.
-				_, err = env3.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+				_, err = env3.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 				if err != nil {
 					time.Sleep(100 * time.Millisecond)
 					continue
@@ -669,13 +680,13 @@ func TestHeartbeatAndSelfHealing(t *testing.T) {
 			continue
 		}
 
-		_, err = env3.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+		_, err = env3.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 		require.NoError(t, env3.heartbeat())
-		_, err = env3.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{})
+		_, err = env3.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 		require.NoError(t, env3.heartbeat())
-		_, err = env3.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{})
+		_, err = env3.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 		require.NoError(t, env3.heartbeat())
 	}
@@ -697,7 +708,7 @@ func TestVersionStampIsHonored(t *testing.T) {
 		_, err := reg.CreateActor(ctx, "ns-1", "a", "test-module", types.ActorOptions{})
 		require.NoError(t, err)
 
-		_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 
 		env.freezeHeartbeatState()
@@ -706,7 +717,7 @@ func TestVersionStampIsHonored(t *testing.T) {
 			// Eventually RPCs should start to fail because the server's versionstamp will become
 			// stale and it will no longer be confident that it's allowed to run RPCs for the
 			// actor.
-			_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+			_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 			if err != nil && strings.Contains(err.Error(), "server heartbeat") {
 				break
 			}
@@ -726,7 +737,7 @@ func TestCustomHostFns(t *testing.T) {
 		_, err := reg.CreateActor(ctx, "ns-1", "a", "test-module", types.ActorOptions{})
 		require.NoError(t, err)
 
-		result, err := env.InvokeActor(ctx, "ns-1", "a", "invokeCustomHostFn", []byte("testCustomFn"), types.CreateIfNotExist{})
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "invokeCustomHostFn", []byte("testCustomFn"), types.CreateIfNotExist{}, "")
 		require.NoError(t, err)
 		require.Equal(t, []byte("ok"), result)
 	}
@@ -750,12 +761,1580 @@ func TestGoModulesRegisterTwice(t *testing.T) {
 	require.NoError(t, env.Close())
 }
 
+// TestInvokeActorStream tests that actors can be invoked in streaming mode, both by
+// actors that emit multiple chunks and actors that don't support streaming at all.
+func TestInvokeActorStream(t *testing.T) {
+	testFn := func(t *testing.T, reg registry.Registry, env Environment) {
+		ctx := context.Background()
+		_, err := reg.CreateActor(ctx, "ns-1", "a", "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+
+		// Regular operations should be emitted as a single chunk.
+		stream, err := env.InvokeActorStream(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("1")}, collectStream(t, stream))
+
+		// Errors should be surfaced at the end of the stream.
+		stream, err = env.InvokeActorStream(ctx, "ns-1", "a", "unknownOperation", nil, types.CreateIfNotExist{})
+		require.NoError(t, err)
+		for stream.Next() {
+		}
+		require.Error(t, stream.Err())
+		require.NoError(t, stream.Close())
+	}
+
+	runWithDifferentConfigs(t, testFn)
+}
+
+// TestInvokeActorStreamMultipleChunks tests that Go actors which implement StreamingActor
+// can emit multiple chunks, and that closing a stream early interrupts the actor.
+func TestInvokeActorStreamMultipleChunks(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsGo)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.CreateActor(ctx, "ns-1", "a", "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+
+	stream, err := env.InvokeActorStream(ctx, "ns-1", "a", "streamCount", []byte("10"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	chunks := collectStream(t, stream)
+	require.Equal(t, 10, len(chunks))
+	for i, chunk := range chunks {
+		require.Equal(t, int64(i), getCount(t, chunk))
+	}
+
+	// Close the stream after consuming a single chunk. The actor should be interrupted
+	// and the next invocation should not deadlock.
+	stream, err = env.InvokeActorStream(ctx, "ns-1", "a", "streamCount", []byte("1000"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.True(t, stream.Next())
+	require.Equal(t, int64(0), getCount(t, stream.Chunk()))
+	require.NoError(t, stream.Close())
+
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Chunks are delivered as soon as they're emitted, even if the actor never finishes
+	// the invocation, until the stream is closed.
+	stream, err = env.InvokeActorStream(ctx, "ns-1", "a", "streamForever", nil, types.CreateIfNotExist{})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.True(t, stream.Next())
+		require.Equal(t, int64(i), getCount(t, stream.Chunk()))
+	}
+	require.NoError(t, stream.Close())
+	require.False(t, stream.Committed())
+
+	// Chunks are delivered before the transaction commits, so an invocation that fails
+	// after emitting a chunk must end the stream without committing, and its writes
+	// must be rolled back.
+	stream, err = env.InvokeActorStream(ctx, "ns-1", "a", "streamKVPutCountError", []byte("key"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	require.True(t, stream.Next())
+	require.Equal(t, int64(1), getCount(t, stream.Chunk()))
+	require.False(t, stream.Next())
+	require.Error(t, stream.Err())
+	require.False(t, stream.Committed())
+	require.NoError(t, stream.Close())
+
+	result, err = env.InvokeActor(ctx, "ns-1", "a", "kvGet", []byte("key"), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	require.Nil(t, result)
+}
+
+// TestPubSub tests that actors can subscribe to topics and that published messages are
+// delivered to every subscriber in order, including when an actor publishes to a topic
+// it is subscribed to itself.
+func TestPubSub(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	opts := defaultOptsGo
+	opts.InboxPollInterval = 10 * time.Millisecond
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	for _, actor := range []string{"a", "b", "c"} {
+		_, err = reg.CreateActor(ctx, "ns-1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+	for _, actor := range []string{"a", "b"} {
+		_, err = env.InvokeActor(ctx, "ns-1", actor, "subscribe", []byte("topic"), types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+	}
+
+	// Publishing to a topic with no subscribers is a no-op.
+	require.NoError(t, env.Publish(ctx, "ns-1", "other-topic", []byte("ignored")))
+
+	publishFromActor := func(operation, msg string) error {
+		marshaled, err := json.Marshal(wapcutils.PublishRequest{Topic: "topic", Payload: []byte(msg)})
+		require.NoError(t, err)
+		for {
+			_, err = env.InvokeActor(ctx, "ns-1", "a", operation, marshaled, types.CreateIfNotExist{}, "")
+			// Publishing conflicts with concurrent deliveries to the subscribers' inboxes,
+			// in which case the invocation is rolled back and can be retried.
+			if !registry.IsTransactionConflictErr(err) {
+				return err
+			}
+		}
+	}
+
+	getMessages := func(actor string) []string {
+		result, err := env.InvokeActor(ctx, "ns-1", actor, "getMessages", nil, types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+		var messages []string
+		require.NoError(t, json.Unmarshal(result, &messages))
+		return messages
+	}
+	waitForMessages := func(actor string, expected []string) {
+		for {
+			// The test actor records messages in memory, which isn't rolled back if a
+			// delivery's transaction conflicts with a concurrent publish and is retried,
+			// so ignore consecutive duplicates.
+			var messages []string
+			for _, msg := range getMessages(actor) {
+				if len(messages) == 0 || messages[len(messages)-1] != msg {
+					messages = append(messages, msg)
+				}
+			}
+			if len(messages) < len(expected) {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			require.Equal(t, expected, messages)
+			return
+		}
+	}
+
+	// Messages published from outside of an actor and messages published by actors are
+	// delivered through different paths, so they're only ordered relative to the messages
+	// that were published through the same path. Go actors aren't single-threaded either,
+	// so the paths are exercised one after the other to keep the deliveries of one from
+	// conflicting with the invocations of the other.
+	var expected []string
+	for i := 0; i < 50; i++ {
+		msg := fmt.Sprintf("msg-%d", i)
+		expected = append(expected, msg)
+		require.NoError(t, env.Publish(ctx, "ns-1", "topic", []byte(msg)))
+	}
+	waitForMessages("a", expected)
+	waitForMessages("b", expected)
+	for i := 50; i < 100; i++ {
+		// Have a subscriber publish to the topic it is subscribed to.
+		msg := fmt.Sprintf("msg-%d", i)
+		expected = append(expected, msg)
+		require.NoError(t, publishFromActor("publish", msg))
+	}
+	waitForMessages("a", expected)
+	waitForMessages("b", expected)
+
+	// Messages published by invocations that fail are never delivered.
+	require.Error(t, publishFromActor("publishError", "aborted"))
+
+	// c never subscribed.
+	require.Nil(t, getMessages("c"))
+
+	// Once unsubscribed, b should stop receiving messages.
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "unsubscribe", []byte("topic"), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	require.NoError(t, publishFromActor("publish", "last"))
+	waitForMessages("a", append(expected, "last"))
+	waitForMessages("b", expected)
+}
+
+// TestTransactMultiActor tests that actors can atomically read/write the KV storage of
+// multiple actors in a single transaction.
+func TestTransactMultiActor(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsGo)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	for _, actor := range []string{"a", "b"} {
+		_, err = reg.CreateActor(ctx, "ns-1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+
+	// Transfer concurrently in both directions. Every transfer is atomic so the sum of
+	// the balances should always be 0.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from, to := "a", "b"
+			if i%2 == 0 {
+				// b is not activated yet for the first transfer which ensures
+				// participants don't have to be activated.
+				from, to = "b", "a"
+			}
+			for j := 0; j < 10; j++ {
+				_, err := env.InvokeActor(ctx, "ns-1", from, "kvTransfer", []byte(to), types.CreateIfNotExist{}, "")
+				require.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	getBalance := func(actor string) int64 {
+		result, err := env.InvokeActor(ctx, "ns-1", actor, "kvGet", []byte("balance"), types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+		return getCount(t, result)
+	}
+	require.Equal(t, int64(0), getBalance("a"))
+	require.Equal(t, int64(0), getBalance("b"))
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "kvTransfer", []byte("b"), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(-1), getBalance("a"))
+	require.Equal(t, int64(1), getBalance("b"))
+
+	// Failed transfers should be rolled back for every participant.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "kvTransferError", []byte("b"), types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+	require.Equal(t, int64(-1), getBalance("a"))
+	require.Equal(t, int64(1), getBalance("b"))
+}
+
+// TestHostFnRouterActorKV tests that WASM actors can read and write the KV storage of
+// other actors within their own transaction.
+func TestHostFnRouterActorKV(t *testing.T) {
+	ctx := context.Background()
+	reg := registry.NewLocalRegistry()
+	_, err := reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b"} {
+		_, err = reg.CreateActor(ctx, "ns-1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+	_, err = reg.Heartbeat(ctx, "server1", registry.HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	refs, err := reg.EnsureActivation(ctx, "ns-1", "a")
+	require.NoError(t, err)
+	// Participants are fenced with the activation they had when the transaction began, so
+	// b has to be activated beforehand.
+	_, err = reg.EnsureActivation(ctx, "ns-1", "b")
+	require.NoError(t, err)
+
+	tr, err := reg.BeginTransaction(ctx, "ns-1", "a", refs[0].ServerID(), refs[0].ServerVersion())
+	require.NoError(t, err)
+	ctx = context.WithValue(ctx, hostFnActorIDCtxKey{}, "a")
+	ctx = context.WithValue(ctx, hostFnActorModuleKey{}, types.NewNamespacedIDNoType("ns-1", "test-module"))
+	ctx = context.WithValue(ctx, hostFnActorTxnKey{}, tr)
+
+	router := newHostFnRouter(reg, nil, nil)
+	call := func(op string, req wapcutils.ActorKVRequest) ([]byte, error) {
+		marshaled, err := json.Marshal(req)
+		require.NoError(t, err)
+		return router(ctx, "wapc", "nola", op, marshaled)
+	}
+
+	result, err := call(wapcutils.KVGetActorOperationName, wapcutils.ActorKVRequest{ActorID: "b", Key: []byte("key")})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0}, result)
+	_, err = call(wapcutils.KVPutActorOperationName, wapcutils.ActorKVRequest{
+		ActorID: "b", Key: []byte("key"), Value: []byte("value")})
+	require.NoError(t, err)
+	result, err = call(wapcutils.KVGetActorOperationName, wapcutils.ActorKVRequest{ActorID: "b", Key: []byte("key")})
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{1}, "value"...), result)
+
+	// Actors that don't exist can't be joined.
+	_, err = call(wapcutils.KVGetActorOperationName, wapcutils.ActorKVRequest{ActorID: "c", Key: []byte("key")})
+	require.Error(t, err)
+
+	// Host policies that allow invoking other actors don't allow writing to their KV
+	// storage directly.
+	policyCtx := context.WithValue(ctx, hostFnActorPolicyKey{}, &registry.HostPolicy{
+		AllowedOperations: []string{
+			wapcutils.KVPutOperationName,
+			wapcutils.KVGetOperationName,
+			wapcutils.KVGetActorOperationName,
+			wapcutils.InvokeActorOperationName,
+		},
+		AllowedTargets: []registry.HostPolicyTarget{{Namespace: "ns-1", ModuleID: "test-module"}},
+	})
+	marshaled, err := json.Marshal(wapcutils.ActorKVRequest{ActorID: "b", Key: []byte("key"), Value: []byte("denied")})
+	require.NoError(t, err)
+	_, err = router(policyCtx, "wapc", "nola", wapcutils.KVPutActorOperationName, marshaled)
+	require.True(t, IsHostPermissionDeniedErr(err))
+	marshaled, err = json.Marshal(wapcutils.ActorKVRequest{ActorID: "b", Key: []byte("key")})
+	require.NoError(t, err)
+	result, err = router(policyCtx, "wapc", "nola", wapcutils.KVGetActorOperationName, marshaled)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{1}, "value"...), result)
+
+	// The writes are committed with the caller's transaction.
+	require.NoError(t, tr.Commit(context.Background()))
+	v, ok, err := reg.GetActorKV(context.Background(), "ns-1", "b", []byte("key"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "value", string(v))
+}
+
+// TestIdempotencyKeys tests that retrying an invocation with the same idempotency key
+// returns the stored result instead of invoking the actor again.
+func TestIdempotencyKeys(t *testing.T) {
+	testFn := func(t *testing.T, reg registry.Registry, env Environment) {
+		ctx := context.Background()
+		for _, actor := range []string{"a", "b"} {
+			_, err := reg.CreateActor(ctx, "ns-1", actor, "test-module", types.ActorOptions{})
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 3; i++ {
+			result, err := env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "key-1")
+			require.NoError(t, err)
+			require.Equal(t, int64(1), getCount(t, result))
+		}
+
+		// Different keys are not deduplicated.
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "key-2")
+		require.NoError(t, err)
+		require.Equal(t, int64(2), getCount(t, result))
+
+		// Reusing a key for a different operation is an error.
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "getCount", nil, types.CreateIfNotExist{}, "key-1")
+		require.Error(t, err)
+
+		// Keys are scoped to the target actor.
+		result, err = env.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{}, "key-1")
+		require.NoError(t, err)
+		require.Equal(t, int64(1), getCount(t, result))
+
+		// Actors can provide idempotency keys when they invoke other actors.
+		marshaled, err := json.Marshal(types.InvokeActorRequest{
+			ActorID:        "b",
+			Operation:      "inc",
+			IdempotencyKey: "key-3",
+		})
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			result, err = env.InvokeActor(ctx, "ns-1", "a", "invokeActor", marshaled, types.CreateIfNotExist{}, "")
+			require.NoError(t, err)
+			require.Equal(t, int64(2), getCount(t, result))
+		}
+
+		// The key of an invocation should not leak into the invocations it performs.
+		marshaled, err = json.Marshal(types.InvokeActorRequest{
+			ActorID:   "b",
+			Operation: "inc",
+		})
+		require.NoError(t, err)
+		result, err = env.InvokeActor(ctx, "ns-1", "a", "invokeActor", marshaled, types.CreateIfNotExist{}, "key-4")
+		require.NoError(t, err)
+		require.Equal(t, int64(3), getCount(t, result))
+		result, err = env.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{}, "key-4")
+		require.NoError(t, err)
+		require.Equal(t, int64(4), getCount(t, result))
+	}
+
+	runWithDifferentConfigs(t, testFn)
+}
+
+func TestInbox(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	opts := defaultOptsGo
+	opts.InboxPollInterval = 10 * time.Millisecond
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	for _, actor := range []string{"a", "b"} {
+		_, err = reg.CreateActor(ctx, "ns-1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+
+	sendMessage := func(operation, id, msg string) error {
+		marshaled, err := json.Marshal(wapcutils.SendMessageRequest{
+			ActorID:   "b",
+			ID:        id,
+			Operation: "recordMessage",
+			Payload:   []byte(msg),
+		})
+		require.NoError(t, err)
+		_, err = env.InvokeActor(ctx, "ns-1", "a", operation, marshaled, types.CreateIfNotExist{}, "")
+		return err
+	}
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("msg-%d", i)
+		expected = append(expected, msg)
+		require.NoError(t, sendMessage("sendMessage", fmt.Sprintf("%d", i), msg))
+		// Resending with the same ID should not result in a duplicate delivery.
+		require.NoError(t, sendMessage("sendMessage", fmt.Sprintf("%d", i), "duplicate"))
+		// Messages sent by invocations that fail should never be delivered.
+		require.Error(t, sendMessage("sendMessageError", fmt.Sprintf("error-%d", i), "error"))
+	}
+
+	for {
+		result, err := env.InvokeActor(ctx, "ns-1", "b", "getMessages", nil, types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+		var messages []string
+		require.NoError(t, json.Unmarshal(result, &messages))
+		if len(messages) < len(expected) {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		require.Equal(t, expected, messages)
+		break
+	}
+
+	// Make sure no messages are redelivered once the inbox is drained.
+	time.Sleep(100 * time.Millisecond)
+	result, err := env.InvokeActor(ctx, "ns-1", "b", "getMessages", nil, types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	var messages []string
+	require.NoError(t, json.Unmarshal(result, &messages))
+	require.Equal(t, expected, messages)
+
+	pending, err := reg.ListActorsWithPendingMessages(ctx, "serverID1", 10)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	// A message that fails to be delivered is retried with a backoff instead of being
+	// redelivered in a tight loop.
+	marshaled, err := json.Marshal(wapcutils.SendMessageRequest{
+		ActorID:   "b",
+		ID:        "poison",
+		Operation: "unknownOperation",
+	})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "sendMessage", marshaled, types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+
+	refs, err := reg.EnsureActivation(ctx, "ns-1", "b")
+	require.NoError(t, err)
+	for {
+		tr, err := reg.BeginTransaction(ctx, "ns-1", "b", refs[0].ServerID(), refs[0].ServerVersion())
+		require.NoError(t, err)
+		msg, ok, err := tr.PeekInbox(ctx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, tr.Cancel(ctx))
+		if msg.Attempts == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		require.Equal(t, 1, msg.Attempts)
+		require.Contains(t, msg.LastError, "unhandled operation")
+		require.True(t, msg.RetryAt.After(time.Now()))
+		break
+	}
+	pending, err = reg.ListActorsWithPendingMessages(ctx, "serverID1", 10)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+}
+
+func collectStream(t *testing.T, stream InvokeStream) [][]byte {
+	defer func() {
+		require.NoError(t, stream.Close())
+	}()
+
+	var chunks [][]byte
+	for stream.Next() {
+		chunks = append(chunks, append([]byte(nil), stream.Chunk()...))
+	}
+	require.NoError(t, stream.Err())
+	require.True(t, stream.Committed())
+	return chunks
+}
+
+// TestNamespaceQuotas tests that the environment enforces the invocation rate and KV
+// storage quotas of namespaces.
+func TestNamespaceQuotas(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	opts := defaultOptsWASM
+	opts.NamespaceQuotasRefreshInterval = time.Minute
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	quotas := env.(*environment).quotas
+	clock := newTestClock()
+	quotas.now = clock.now
+
+	ctx := context.Background()
+	require.NoError(t, reg.CreateNamespace(ctx, "ns-rate", registry.NamespaceOptions{
+		Quotas: registry.NamespaceQuotas{MaxInvocationsPerSecond: 1},
+	}))
+	require.NoError(t, reg.CreateNamespace(ctx, "ns-kv", registry.NamespaceOptions{
+		Quotas: registry.NamespaceQuotas{MaxKVBytes: 1},
+	}))
+	for _, ns := range []string{"ns-rate", "ns-kv", "ns-unlimited"} {
+		_, err = reg.RegisterModule(ctx, ns, "test-module", utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+	}
+	create := types.CreateIfNotExist{ModuleID: "test-module"}
+
+	// The first invocation uses up the namespace's burst, the next one exceeds its rate
+	// until the rate allows another invocation.
+	_, err = env.InvokeActor(ctx, "ns-rate", "a", "inc", nil, create, "")
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-rate", "a", "inc", nil, create, "")
+	require.True(t, registry.IsQuotaExceededErr(err))
+	_, err = env.InvokeWorker(ctx, "ns-rate", "test-module", "inc", nil)
+	require.True(t, registry.IsQuotaExceededErr(err))
+	clock.advance(time.Second)
+	_, err = env.InvokeActor(ctx, "ns-rate", "a", "inc", nil, create, "")
+	require.NoError(t, err)
+
+	// Writes are rejected once the usage is refreshed and the namespace's actors store
+	// MaxKVBytes, reads still work.
+	_, err = env.InvokeActor(ctx, "ns-kv", "a", "kvPutCount", []byte("key"), create, "")
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-kv", "a", "kvPutCount", []byte("key"), create, "")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		// Refreshes happen in the background once the cached usage is stale.
+		clock.advance(opts.NamespaceQuotasRefreshInterval)
+		_, err = env.InvokeActor(ctx, "ns-kv", "a", "kvPutCount", []byte("key"), create, "")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Contains(t, err.Error(), "namespace quota exceeded")
+	_, err = env.InvokeActor(ctx, "ns-kv", "a", "kvGet", []byte("key"), create, "")
+	require.NoError(t, err)
+
+	// Namespaces without quotas are unaffected.
+	for i := 0; i < 10; i++ {
+		_, err = env.InvokeActor(ctx, "ns-unlimited", "a", "kvPutCount", []byte("key"), create, "")
+		require.NoError(t, err)
+	}
+
+	// The state of namespaces that aren't used anymore is evicted when another namespace
+	// is refreshed.
+	clock.advance(namespaceQuotasIdleTTL * opts.NamespaceQuotasRefreshInterval)
+	require.Eventually(t, func() bool {
+		_, err = env.InvokeActor(ctx, "ns-unlimited", "a", "inc", nil, create, "")
+		require.NoError(t, err)
+		quotas.Lock()
+		defer quotas.Unlock()
+		_, ok := quotas.namespaces["ns-kv"]
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// testClock is a clock that only moves when it's advanced.
+type testClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Now()}
+}
+
+func (c *testClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// TestRateLimits tests that the environment enforces the per-namespace, per-module and
+// per-actor rate limits of namespaces, and that changes to them are picked up.
+func TestRateLimits(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	opts := defaultOptsWASM
+	opts.NamespaceQuotasRefreshInterval = time.Minute
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	clock := newTestClock()
+	env.(*environment).quotas.now = clock.now
+
+	ctx := context.Background()
+	rateLimits := registry.NamespaceRateLimits{
+		Modules:      map[string]registry.RateLimit{"limited-module": {PerSecond: 0.5}},
+		Actors:       map[string]registry.RateLimit{"limited-actor": {PerSecond: 1}},
+		DefaultActor: &registry.RateLimit{PerSecond: 100, Burst: 2},
+	}
+	require.NoError(t, reg.CreateNamespace(ctx, "ns-1", registry.NamespaceOptions{RateLimits: rateLimits}))
+	for _, moduleID := range []string{"test-module", "limited-module"} {
+		_, err = reg.RegisterModule(ctx, "ns-1", moduleID, utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+	}
+	create := types.CreateIfNotExist{ModuleID: "test-module"}
+
+	// Actors with explicit limits.
+	_, err = env.InvokeActor(ctx, "ns-1", "limited-actor", "inc", nil, create, "")
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "limited-actor", "inc", nil, create, "")
+	retryAfter, ok := IsRateLimitedErr(err)
+	require.True(t, ok, err)
+	require.Equal(t, time.Second, retryAfter)
+	clock.advance(retryAfter)
+	_, err = env.InvokeActor(ctx, "ns-1", "limited-actor", "inc", nil, create, "")
+	require.NoError(t, err)
+
+	// Other actors use the default limit, independently of each other.
+	for _, actorID := range []string{"a", "b"} {
+		for i := 0; i < 2; i++ {
+			_, err = env.InvokeActor(ctx, "ns-1", actorID, "inc", nil, create, "")
+			require.NoError(t, err)
+		}
+		_, err = env.InvokeActor(ctx, "ns-1", actorID, "inc", nil, create, "")
+		_, ok = IsRateLimitedErr(err)
+		require.True(t, ok, err)
+	}
+
+	// Module limits apply to workers and actors alike.
+	_, err = env.InvokeWorker(ctx, "ns-1", "limited-module", "inc", nil)
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "c", "inc", nil, types.CreateIfNotExist{ModuleID: "limited-module"}, "")
+	retryAfter, ok = IsRateLimitedErr(err)
+	require.True(t, ok, err)
+	require.Equal(t, 2*time.Second, retryAfter)
+
+	// Removing the limits takes effect after the environment refreshes them.
+	require.NoError(t, reg.UpdateNamespace(ctx, "ns-1", registry.NamespaceOptions{}))
+	require.Eventually(t, func() bool {
+		// Refreshes happen in the background once the cached limits are stale. Advancing
+		// the clock also refills the actor's limiter, so only two invocations in a row
+		// show that the limit is gone.
+		clock.advance(opts.NamespaceQuotasRefreshInterval)
+		for i := 0; i < 2; i++ {
+			if _, err = env.InvokeActor(ctx, "ns-1", "limited-actor", "inc", nil, create, ""); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		_, err = env.InvokeWorker(ctx, "ns-1", "limited-module", "inc", nil)
+		require.NoError(t, err)
+	}
+}
+
+// TestInboxRateLimits tests that inbox deliveries are subject to the rate limits of the
+// actor's namespace, and that messages that exceed them are delayed instead of dropped.
+func TestInboxRateLimits(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	ctx := context.Background()
+	require.NoError(t, reg.CreateNamespace(ctx, "ns-1", registry.NamespaceOptions{
+		RateLimits: registry.NamespaceRateLimits{
+			Actors: map[string]registry.RateLimit{"b": {PerSecond: 1, Burst: 1}},
+		},
+	}))
+
+	opts := defaultOptsGo
+	opts.InboxPollInterval = 10 * time.Millisecond
+	opts.NamespaceQuotasRefreshInterval = time.Minute
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	clock := newTestClock()
+	env.(*environment).quotas.now = clock.now
+
+	for _, actor := range []string{"a", "b"} {
+		_, err = reg.CreateActor(ctx, "ns-1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+	for _, id := range []string{"1", "2"} {
+		marshaled, err := json.Marshal(wapcutils.SendMessageRequest{
+			ActorID:   "b",
+			ID:        id,
+			Operation: "recordMessage",
+			Payload:   []byte(id),
+		})
+		require.NoError(t, err)
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "sendMessage", marshaled, types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+	}
+
+	// Invoking b directly would take its tokens, so read its messages from its activation.
+	getMessages := func() []string {
+		activations := env.(*environment).activations
+		activations.RLock()
+		actor, ok := activations._actors[types.NewNamespacedID("ns-1", "b", types.IDTypeActor)]
+		activations.RUnlock()
+		if !ok {
+			return nil
+		}
+		ta := actor._a.(*testActor)
+		ta.messagesLock.Lock()
+		defer ta.messagesLock.Unlock()
+		return append([]string(nil), ta.messages...)
+	}
+	require.Eventually(t, func() bool {
+		return len(getMessages()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, []string{"1"}, getMessages())
+
+	// The second message is delivered once the limit allows it.
+	clock.advance(time.Second)
+	require.Eventually(t, func() bool {
+		return len(getMessages()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"1", "2"}, getMessages())
+	deadLetters, err := reg.ListDeadLetters(ctx, "ns-1", "b")
+	require.NoError(t, err)
+	require.Empty(t, deadLetters)
+}
+
+// TestMetrics tests that invocations, activations and heartbeats are recorded in the
+// metrics that are served by the /metrics endpoint.
+func TestMetrics(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "metrics-server", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "metrics-ns", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	// Metrics are global so only the ones for the namespace and server that are unique
+	// to this test can be compared exactly.
+	cacheHitsBefore := activationCacheLookups.WithLabels("hit").Value()
+	for i := 0; i < 3; i++ {
+		_, err = env.InvokeActor(
+			ctx, "metrics-ns", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+		require.NoError(t, err)
+	}
+	_, err = env.InvokeActor(ctx, "metrics-ns", "a", "unknown-operation", nil, types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+
+	require.Equal(t, float64(3), invocationsTotal.WithLabels("metrics-ns", "test-module", "inc", "success").Value())
+	require.Equal(t, float64(1), invocationsTotal.WithLabels("metrics-ns", "test-module", "unknown-operation", "error").Value())
+	require.Equal(t, uint64(3), invocationDuration.WithLabels("metrics-ns", "test-module", "inc").Count())
+	require.Equal(t, float64(1), activationsTotal.WithLabels("metrics-ns", "test-module").Value())
+	require.GreaterOrEqual(t, activationCacheLookups.WithLabels("hit").Value()-cacheHitsBefore, float64(3))
+
+	// Operations that aren't declared in the module's manifest, and operations beyond the
+	// maximum number of distinct operations per module, are recorded as "other" so that
+	// callers can't create an unbounded number of series.
+	_, err = reg.RegisterModule(ctx, "metrics-ns", "manifest-module", utilWasmBytes, registry.ModuleOptions{
+		Manifest: &registry.ModuleManifest{Operations: []registry.OperationManifest{{Name: "inc"}}},
+	})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(
+		ctx, "metrics-ns", "b", "undeclared", nil, types.CreateIfNotExist{ModuleID: "manifest-module"}, "")
+	require.Error(t, err)
+	require.Equal(t, float64(1), invocationsTotal.WithLabels("metrics-ns", "manifest-module", "other", "error").Value())
+	require.Equal(t, float64(0), invocationsTotal.WithLabels("metrics-ns", "manifest-module", "undeclared", "error").Value())
+	for i := 0; i < maxOperationLabelsPerModule; i++ {
+		_, err = env.InvokeActor(ctx, "metrics-ns", "a", fmt.Sprintf("operation-%d", i), nil, types.CreateIfNotExist{}, "")
+		require.Error(t, err)
+	}
+	// "inc" and "unknown-operation" were recorded already.
+	require.Equal(t, float64(2), invocationsTotal.WithLabels("metrics-ns", "test-module", "other", "error").Value())
+	require.Equal(t, float64(1), invocationsTotal.WithLabels("metrics-ns", "test-module", "operation-61", "error").Value())
+	require.Equal(t, float64(0), invocationsTotal.WithLabels("metrics-ns", "test-module", "operation-62", "error").Value())
+
+	require.NoError(t, env.(*environment).heartbeat())
+	require.Equal(t, float64(2), activatedActors.WithLabels("metrics-server").Value())
+	require.Greater(t, wasmMemoryBytes.WithLabels("metrics-server").Value(), float64(0))
+
+	// Invocations of workers whose module doesn't exist are recorded as "other" since
+	// their namespace and module ID are provided by the caller.
+	otherBefore := invocationsTotal.WithLabels("other", "other", "metrics-worker-op", "error").Value()
+	_, err = env.InvokeWorker(ctx, "metrics-ns-unknown", "unknown-module", "metrics-worker-op", nil)
+	require.Error(t, err)
+	require.Equal(t, otherBefore+1, invocationsTotal.WithLabels("other", "other", "metrics-worker-op", "error").Value())
+	require.Equal(t, float64(0), invocationsTotal.WithLabels("metrics-ns-unknown", "unknown-module", "metrics-worker-op", "error").Value())
+	_, err = env.InvokeWorker(ctx, "metrics-ns", "test-module", "inc", nil)
+	require.NoError(t, err)
+	require.Equal(t, float64(4), invocationsTotal.WithLabels("metrics-ns", "test-module", "inc", "success").Value())
+
+	s := NewServer(reg, env, ServerOptions{})
+	server := httptest.NewServer(s.publicHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Contains(t, string(body),
+		`nola_invocations_total{namespace="metrics-ns",module="test-module",operation="inc",result="success"} 4`)
+	require.Contains(t, string(body), "# TYPE nola_registry_transaction_duration_seconds histogram")
+}
+
+// TestTracing tests that invocations continue the trace in their context, and that the
+// trace is propagated to the actors they invoke.
+func TestTracing(t *testing.T) {
+	exporter := &testSpanExporter{}
+	opts := defaultOptsWASM
+	opts.TraceExporter = exporter
+
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = reg.CreateActor(ctx, "ns-1", "b", "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+
+	remote, err := tracing.ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.NoError(t, err)
+	ctx = tracing.ContextWithRemoteSpanContext(ctx, remote)
+
+	marshaled, err := json.Marshal(types.InvokeActorRequest{ActorID: "b", Operation: "inc"})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "invokeActor", marshaled, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.NoError(t, err)
+
+	spans := exporter.getSpans()
+	byID := make(map[string]tracing.SpanData, len(spans))
+	for _, span := range spans {
+		require.Equal(t, remote.TraceID.String(), span.TraceID)
+		byID[span.SpanID] = span
+	}
+
+	// The turn of actor b must descend from the turn of actor a, which must descend
+	// from the remote span.
+	var turnA, turnB tracing.SpanData
+	for _, span := range spans {
+		if span.Name != "nola.InvokeActorDirect" {
+			continue
+		}
+		switch span.Attributes["actor_id"] {
+		case "a":
+			turnA = span
+		case "b":
+			turnB = span
+		}
+	}
+	require.NotEmpty(t, turnA.SpanID)
+	require.NotEmpty(t, turnB.SpanID)
+	require.True(t, isDescendant(byID, turnB, turnA.SpanID))
+	require.True(t, isDescendant(byID, turnA, remote.SpanID.String()))
+
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	require.Contains(t, names, "nola.InvokeActor")
+	require.Contains(t, names, "registry.CreateActor")
+	require.Contains(t, names, "registry.EnsureActivation")
+}
+
+// TestActorLogging tests that the messages actors log are tagged with the actor, filtered
+// by the namespace's log level, and can be tailed.
+func TestActorLogging(t *testing.T) {
+	logger := &testLogger{}
+	opts := defaultOptsWASM
+	opts.Logger = logger
+	opts.ActorLogBufferSize = 2
+
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	require.NoError(t, reg.CreateNamespace(ctx, "ns-2", registry.NamespaceOptions{LogLevel: "error"}))
+	for _, ns := range []string{"ns-1", "ns-2"} {
+		_, err = reg.RegisterModule(ctx, ns, "test-module", utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+	}
+
+	_, ok, err := env.TailActorLogs(ctx, "ns-1", "a", 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	for i := 0; i < 3; i++ {
+		_, err = env.InvokeActor(
+			ctx, "ns-1", "a", "log", []byte(fmt.Sprintf("hello %d", i)),
+			types.CreateIfNotExist{ModuleID: "test-module"}, "")
+		require.NoError(t, err)
+	}
+	require.Contains(t, logger.getMessages(), testLogMessage{
+		level: LogLevelInfo,
+		msg:   "hello 0",
+		keyvals: []any{
+			"namespace", "ns-1", "module_id", "test-module", "actor_id", "a", "operation", "log",
+		},
+	})
+
+	// Only the most recent messages are retained.
+	logs, ok, err := env.TailActorLogs(ctx, "ns-1", "a", 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, logs, 2)
+	require.Equal(t, "hello 1", logs[0].Message)
+	require.Equal(t, "hello 2", logs[1].Message)
+	require.Equal(t, "info", logs[1].Level)
+	require.Equal(t, map[string]string{"operation": "log"}, logs[1].Fields)
+	logs, ok, err = env.TailActorLogs(ctx, "ns-1", "a", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, logs, 1)
+	require.Equal(t, "hello 2", logs[0].Message)
+
+	// Info messages are below the log level of ns-2.
+	_, err = env.InvokeActor(
+		ctx, "ns-2", "a", "log", []byte("hidden"), types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.NoError(t, err)
+	logs, ok, err = env.TailActorLogs(ctx, "ns-2", "a", 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Empty(t, logs)
+	for _, msg := range logger.getMessages() {
+		require.NotEqual(t, "hidden", msg.msg)
+	}
+
+	s := NewServer(reg, env, ServerOptions{})
+	server := httptest.NewServer(s.publicHandler())
+	defer server.Close()
+	marshaled, err := json.Marshal(tailActorLogsRequest{Namespace: "ns-1", ActorID: "a"})
+	require.NoError(t, err)
+	resp, err := http.Post(server.URL+"/api/v1/tail-actor-logs", "application/json", strings.NewReader(string(marshaled)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	var tailResp tailActorLogsResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&tailResp))
+	require.True(t, tailResp.Activated)
+	require.Len(t, tailResp.Logs, 2)
+	require.Equal(t, "hello 2", tailResp.Logs[1].Message)
+
+	// Servers forward the request to the server that the actor is activated on.
+	opts2 := opts
+	opts2.Discovery.Port = 2
+	env2, err := NewEnvironment(context.Background(), "serverID2", reg, nil, opts2)
+	require.NoError(t, err)
+	defer env2.Close()
+	logs, ok, err = env2.TailActorLogs(ctx, "ns-1", "a", 0)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, logs, 2)
+	logs, ok, err = env2.TailActorLogs(ctx, "ns-1", "not-activated", 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Empty(t, logs)
+
+	// Including over HTTP.
+	client, err := NewHTTPClient(HTTPClientOptions{})
+	require.NoError(t, err)
+	address := strings.TrimPrefix(server.URL, "http://")
+	logs, ok, err = client.TailActorLogsRemote(ctx, "serverID1", address, "ns-1", "a", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, logs, 1)
+	require.Equal(t, "hello 2", logs[0].Message)
+	_, _, err = client.TailActorLogsRemote(ctx, "serverID2", address, "ns-1", "a", 1)
+	require.Error(t, err)
+}
+
+// TestNamespaceLogLevelsNonBlocking tests that looking up the log level of a namespace
+// never blocks on the registry.
+func TestNamespaceLogLevelsNonBlocking(t *testing.T) {
+	reg := &blockingNamespaceRegistry{
+		Registry: registry.NewLocalRegistry(),
+		block:    make(chan struct{}),
+	}
+	ctx := context.Background()
+	require.NoError(t, reg.CreateNamespace(ctx, "ns-1", registry.NamespaceOptions{LogLevel: "error"}))
+
+	levels := newNamespaceLogLevels(reg, time.Millisecond)
+	require.Equal(t, "", levels.get("ns-1"))
+	close(reg.block)
+	for levels.get("ns-1") != "error" {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type blockingNamespaceRegistry struct {
+	registry.Registry
+	block chan struct{}
+}
+
+func (r *blockingNamespaceRegistry) GetNamespace(
+	ctx context.Context,
+	namespace string,
+) (registry.NamespaceInfo, error) {
+	<-r.block
+	return r.Registry.GetNamespace(ctx, namespace)
+}
+
+func TestWriterLogger(t *testing.T) {
+	var buf strings.Builder
+	logger := NewWriterLogger(&buf)
+	logger.Log(LogLevelWarn, "some message", "actor_id", "a", "error", errors.New("some error"), "dangling")
+	line := buf.String()
+	require.True(t, strings.HasSuffix(line, "\n"))
+	require.Contains(t, line,
+		`level=warn msg="some message" actor_id=a error="some error" dangling=""`)
+
+	level, err := ParseLogLevel("debug")
+	require.NoError(t, err)
+	require.Equal(t, LogLevelDebug, level)
+	_, err = ParseLogLevel("verbose")
+	require.Error(t, err)
+}
+
+type testLogMessage struct {
+	level   LogLevel
+	msg     string
+	keyvals []any
+}
+
+type testLogger struct {
+	sync.Mutex
+	messages []testLogMessage
+}
+
+func (l *testLogger) Log(level LogLevel, msg string, keyvals ...any) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, testLogMessage{level: level, msg: msg, keyvals: keyvals})
+}
+
+func (l *testLogger) getMessages() []testLogMessage {
+	l.Lock()
+	defer l.Unlock()
+	return append([]testLogMessage(nil), l.messages...)
+}
+
+func isDescendant(byID map[string]tracing.SpanData, span tracing.SpanData, ancestorID string) bool {
+	for span.ParentSpanID != "" {
+		if span.ParentSpanID == ancestorID {
+			return true
+		}
+		parent, ok := byID[span.ParentSpanID]
+		if !ok {
+			return false
+		}
+		span = parent
+	}
+	return false
+}
+
+type testSpanExporter struct {
+	sync.Mutex
+	spans []tracing.SpanData
+}
+
+func (e *testSpanExporter) ExportSpan(span tracing.SpanData) {
+	e.Lock()
+	defer e.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *testSpanExporter) getSpans() []tracing.SpanData {
+	e.Lock()
+	defer e.Unlock()
+	return append([]tracing.SpanData(nil), e.spans...)
+}
+
 func getCount(t *testing.T, v []byte) int64 {
 	x, err := strconv.Atoi(string(v))
 	require.NoError(t, err)
 	return int64(x)
 }
 
+// TestCompiledModulesSharedAcrossNamespaces tests that WASM modules that were registered
+// with the same bytes in different namespaces are only compiled once, but their actors
+// are still isolated from each other.
+func TestCompiledModulesSharedAcrossNamespaces(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	for _, ns := range []string{"ns-1", "ns-2"} {
+		result, err := reg.RegisterModule(ctx, ns, "test-module", utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+		require.NotEmpty(t, result.Hash)
+	}
+
+	for i := 0; i < 3; i++ {
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+		require.NoError(t, err)
+		require.Equal(t, int64(i+1), getCount(t, result))
+	}
+	result, err := env.InvokeActor(ctx, "ns-2", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Host functions should operate on the namespace of the actor that invoked them.
+	_, err = env.InvokeActor(ctx, "ns-2", "a", "fork", []byte("b"), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-2", "b", "inc", nil, types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+
+	activations := env.(*environment).activations
+	activations.RLock()
+	defer activations.RUnlock()
+	require.Len(t, activations._modules, 2)
+	require.Len(t, activations._compiledModules, 1)
+}
+
+// TestWASMRuntimes tests that modules can override the environment's WASM runtime.
+func TestWASMRuntimes(t *testing.T) {
+	opts := defaultOptsWASM
+	opts.WASMRuntime = "does-not-exist"
+	_, err := NewEnvironment(context.Background(), "serverID1", registry.NewLocalRegistry(), nil, opts)
+	require.Error(t, err)
+
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "default", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = reg.RegisterModule(ctx, "ns-1", "interpreter", utilWasmBytes, registry.ModuleOptions{
+		WASMRuntime: durablewazero.RuntimeInterpreter,
+	})
+	require.NoError(t, err)
+	_, err = reg.RegisterModule(ctx, "ns-1", "invalid", utilWasmBytes, registry.ModuleOptions{
+		WASMRuntime: "does-not-exist",
+	})
+	require.Error(t, err)
+
+	for _, moduleID := range []string{"default", "interpreter"} {
+		for i := 0; i < 2; i++ {
+			result, err := env.InvokeActor(ctx, "ns-1", moduleID, "inc", nil, types.CreateIfNotExist{ModuleID: moduleID}, "")
+			require.NoError(t, err)
+			require.Equal(t, int64(i+1), getCount(t, result))
+		}
+	}
+
+	// The same bytes are compiled once per runtime.
+	activations := env.(*environment).activations
+	activations.RLock()
+	defer activations.RUnlock()
+	require.Len(t, activations._compiledModules, 2)
+	require.Contains(t, activations._compiledModules, fmt.Sprintf("%s::%s", registryHash(utilWasmBytes), durablewazero.RuntimeInterpreter))
+}
+
+// registryHash returns the hash that the registry assigns to modules with the provided
+// bytes.
+func registryHash(moduleBytes []byte) string {
+	hash := sha256.Sum256(moduleBytes)
+	return hex.EncodeToString(hash[:])
+}
+
+// TestModuleManifest tests that invocations are validated against the manifest of the
+// actor's module.
+func TestModuleManifest(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{
+		Manifest: &registry.ModuleManifest{Operations: []registry.OperationManifest{
+			{Name: "inc"},
+			{Name: "getCount", ReadOnly: true},
+			{Name: "kvPutCount", ReadOnly: true},
+			{Name: "kvGet", ReadOnly: true, PayloadSchema: json.RawMessage(`{"type": "string", "enum": ["a", "b"]}`)},
+		}},
+	})
+	require.NoError(t, err)
+
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.NoError(t, err)
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "getCount", nil, types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Operations that aren't declared in the manifest are rejected.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "fork", []byte("b"), types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not declared in the manifest")
+
+	// Read-only operations can't write.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "kvPutCount", []byte("a"), types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "read-only")
+
+	// Payloads are validated against the operation's schema.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "kvGet", []byte(`"a"`), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "kvGet", []byte(`"c"`), types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "kvGet", []byte("a"), types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+
+	// Same for streaming invocations.
+	stream, err := env.InvokeActorStream(ctx, "ns-1", "a", "fork", []byte("b"), types.CreateIfNotExist{})
+	require.NoError(t, err)
+	defer stream.Close()
+	require.False(t, stream.Next())
+	require.Error(t, stream.Err())
+	require.Contains(t, stream.Err().Error(), "not declared in the manifest")
+}
+
+// TestInboxManifest tests that inbox messages are validated against the manifest of the
+// receiving actor's module and that messages which can never be delivered are moved to the
+// dead letter queue right away.
+func TestInboxManifest(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	ctx := context.Background()
+	// Register the Go module with a manifest before the environment registers it without one.
+	_, err := reg.RegisterModule(ctx, "ns-1", "test-module", nil, registry.ModuleOptions{
+		AllowEmptyModuleBytes: true,
+		Manifest: &registry.ModuleManifest{Operations: []registry.OperationManifest{
+			{Name: "sendMessage"},
+			{Name: "recordMessage"},
+			{Name: "getMessages", ReadOnly: true},
+		}},
+	})
+	require.NoError(t, err)
+
+	opts := defaultOptsGo
+	opts.InboxPollInterval = 10 * time.Millisecond
+	env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+
+	for _, actor := range []string{"a", "b"} {
+		_, err = reg.CreateActor(ctx, "ns-1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+
+	sendMessage := func(id, operation, msg string) {
+		marshaled, err := json.Marshal(wapcutils.SendMessageRequest{
+			ActorID:   "b",
+			ID:        id,
+			Operation: operation,
+			Payload:   []byte(msg),
+		})
+		require.NoError(t, err)
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "sendMessage", marshaled, types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+	}
+	sendMessage("1", "undeclared", "")
+	sendMessage("2", "getMessages", "")
+	sendMessage("3", "recordMessage", "msg")
+
+	// The message with the undeclared operation is dead lettered without being retried
+	// and doesn't block the messages behind it.
+	for {
+		result, err := env.InvokeActor(ctx, "ns-1", "b", "getMessages", nil, types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+		var messages []string
+		require.NoError(t, json.Unmarshal(result, &messages))
+		if len(messages) == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		require.Equal(t, []string{"msg"}, messages)
+		break
+	}
+	deadLetters, err := reg.ListDeadLetters(ctx, "ns-1", "b")
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 1)
+	require.Equal(t, "1", deadLetters[0].ID)
+	require.Contains(t, deadLetters[0].LastError, "not declared in the manifest")
+}
+
+// TestModuleReregistered tests that actors activated after a module is deleted and registered
+// again use the new module instead of the cached one.
+func TestModuleReregistered(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.NoError(t, err)
+
+	require.NoError(t, reg.DeleteActor(ctx, "ns-1", "a"))
+	require.NoError(t, reg.DeleteModule(ctx, "ns-1", "test-module"))
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{
+		Manifest: &registry.ModuleManifest{Operations: []registry.OperationManifest{
+			{Name: "getCount", ReadOnly: true},
+		}},
+	})
+	require.NoError(t, err)
+
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not declared in the manifest")
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "getCount", nil, types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+}
+
+// TestCompiledModulesEvicted tests that compiled modules are closed once no loaded module
+// or activated actor uses them anymore.
+func TestCompiledModulesEvicted(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+	activations := env.(*environment).activations
+	numCompiledModules := func() int {
+		activations.RLock()
+		defer activations.RUnlock()
+		return len(activations._compiledModules)
+	}
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.NoError(t, err)
+	require.Equal(t, 1, numCompiledModules())
+
+	// Register the module again with different bytes (an extra custom section). Actor a
+	// still uses the previous version so both versions remain compiled.
+	require.NoError(t, reg.DeleteActor(ctx, "ns-1", "a"))
+	require.NoError(t, reg.DeleteModule(ctx, "ns-1", "test-module"))
+	modifiedBytes := append(append([]byte(nil), utilWasmBytes...), 0, 2, 1, 'x')
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", modifiedBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.NoError(t, err)
+	require.Equal(t, 2, numCompiledModules())
+
+	// Once actor a is reactivated from the new version (after the cached activation
+	// expires) the previous version is evicted.
+	_, err = reg.CreateActor(ctx, "ns-1", "a", "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+	require.NoError(t, reg.IncGeneration(ctx, "ns-1", "a"))
+	require.Eventually(t, func() bool {
+		_, err := env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+		return numCompiledModules() == 1
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+// TestHostPolicy tests that the host functions an actor calls are checked against its
+// module's host policy.
+func TestHostPolicy(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "restricted-module", utilWasmBytes, registry.ModuleOptions{
+		HostPolicy: &registry.HostPolicy{
+			AllowedOperations: []string{
+				wapcutils.KVPutOperationName,
+				wapcutils.KVGetOperationName,
+				wapcutils.InvokeActorOperationName,
+			},
+			AllowedTargets: []registry.HostPolicyTarget{{Namespace: "ns-1", ModuleID: "allowed-module"}},
+		},
+	})
+	require.NoError(t, err)
+	for _, moduleID := range []string{"allowed-module", "other-module"} {
+		_, err = reg.RegisterModule(ctx, "ns-1", moduleID, utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+	}
+	_, err = reg.CreateActor(ctx, "ns-1", "other", "other-module", types.ActorOptions{})
+	require.NoError(t, err)
+
+	// Allowed operations work.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "restricted-module"}, "")
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "kvPutCount", []byte("key"), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	result, err := env.InvokeActor(ctx, "ns-1", "a", "kvGet", []byte("key"), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), getCount(t, result))
+
+	// Operations and custom host functions that aren't allowed are rejected.
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "fork", []byte("b"), types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "host permission denied")
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "invokeCustomHostFn", []byte("testCustomFn"), types.CreateIfNotExist{}, "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "host permission denied")
+
+	invokeActor := func(req types.InvokeActorRequest) error {
+		marshaled, err := json.Marshal(req)
+		require.NoError(t, err)
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "invokeActor", marshaled, types.CreateIfNotExist{}, "")
+		return err
+	}
+
+	// Actors of allowed modules can be created and targeted.
+	require.NoError(t, invokeActor(types.InvokeActorRequest{
+		ActorID:          "allowed",
+		Operation:        "inc",
+		CreateIfNotExist: types.CreateIfNotExist{ModuleID: "allowed-module"},
+	}))
+
+	// Actors of other modules can't be created or targeted.
+	err = invokeActor(types.InvokeActorRequest{
+		ActorID:          "not-allowed",
+		Operation:        "inc",
+		CreateIfNotExist: types.CreateIfNotExist{ModuleID: "other-module"},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "host permission denied")
+	err = invokeActor(types.InvokeActorRequest{ActorID: "other", Operation: "inc"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "host permission denied")
+	// Checking the target must not activate it.
+	info, err := reg.DescribeActor(ctx, "ns-1", "other")
+	require.NoError(t, err)
+	require.Nil(t, info.Activation)
+
+	// Modules without a policy can call every host function.
+	_, err = env.InvokeActor(ctx, "ns-1", "other", "fork", []byte("c"), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+
+	// The same policy is enforced for Go modules, which call the host directly.
+	host := newHostCapabilities(
+		reg, env, nil, "ns-1", "go-actor", "go-module",
+		func() (string, int64) { return "serverID1", 0 },
+		&registry.HostPolicy{AllowedOperations: []string{wapcutils.KVGetOperationName}},
+		nil, nil)
+	_, err = host.CreateActor(ctx, wapcutils.CreateActorRequest{ActorID: "b"})
+	require.True(t, IsHostPermissionDeniedErr(err))
+	_, err = host.Transact(ctx, func(tr registry.ActorKVTransaction) (any, error) {
+		return nil, tr.Put(ctx, []byte("key"), []byte("value"))
+	})
+	require.True(t, IsHostPermissionDeniedErr(err))
+}
+
+// TestModuleLoadsDeduplicated tests that activating many actors of the same module
+// concurrently only fetches the module from the registry once.
+func TestModuleLoadsDeduplicated(t *testing.T) {
+	reg := &countingRegistry{Registry: registry.NewLocalRegistry()}
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			actorID := fmt.Sprintf("a-%d", i)
+			_, err := env.InvokeActor(ctx, "ns-1", actorID, "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+			require.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(1), reg.getModuleCount.Load())
+}
+
+// TestModuleLoadsDetachedFromCaller tests that the caller that triggers a module load
+// timing out doesn't fail the load for the other callers that are waiting on it.
+func TestModuleLoadsDetachedFromCaller(t *testing.T) {
+	reg := &countingRegistry{
+		Registry:       registry.NewLocalRegistry(),
+		getModuleBlock: make(chan struct{}),
+	}
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	firstErrCh := make(chan error, 1)
+	go func() {
+		ctx, cc := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cc()
+		_, err := env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+		firstErrCh <- err
+	}()
+	for reg.getModuleCount.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	secondErrCh := make(chan error, 1)
+	go func() {
+		_, err := env.InvokeActor(ctx, "ns-1", "b", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+		secondErrCh <- err
+	}()
+
+	require.Error(t, <-firstErrCh)
+	close(reg.getModuleBlock)
+	require.NoError(t, <-secondErrCh)
+	require.Equal(t, int64(1), reg.getModuleCount.Load())
+}
+
+// TestModuleCacheDir tests that compiled modules are persisted in, and loaded from, the
+// module cache directory.
+func TestModuleCacheDir(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		reg  = registry.NewLocalRegistry()
+		opts = defaultOptsWASM
+	)
+	opts.ModuleCacheDir = dir
+
+	result, err := reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		env, err := NewEnvironment(ctx, "serverID1", reg, nil, opts)
+		require.NoError(t, err)
+
+		result, err := env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+		require.NoError(t, err)
+		require.Equal(t, int64(1), getCount(t, result))
+		require.NoError(t, env.Close())
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, result.Hash))
+	require.NoError(t, err)
+	if wazeroCompilerSupported() {
+		require.NotEmpty(t, entries)
+	}
+}
+
+// wazeroCompilerSupported returns whether wazero uses its compiler (and therefore
+// its compilation cache) on this platform.
+func wazeroCompilerSupported() bool {
+	return runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64"
+}
+
+type countingRegistry struct {
+	registry.Registry
+	getModuleCount atomic.Int64
+	// If set, GetModule blocks until getModuleBlock is closed or its context is done.
+	getModuleBlock chan struct{}
+}
+
+func (r *countingRegistry) GetModule(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+) ([]byte, registry.ModuleOptions, error) {
+	r.getModuleCount.Add(1)
+	if r.getModuleBlock != nil {
+		select {
+		case <-r.getModuleBlock:
+		case <-ctx.Done():
+			return nil, registry.ModuleOptions{}, ctx.Err()
+		}
+	}
+	return r.Registry.GetModule(ctx, namespace, moduleID)
+}
+
 func runWithDifferentConfigs(
 	t *testing.T,
 	testFn func(t *testing.T, reg registry.Registry, env Environment),
@@ -774,6 +2353,22 @@ func runWithDifferentConfigs(
 		testFn(t, reg, env)
 	})
 
+	t.Run("wasm interpreter", func(t *testing.T) {
+		opts := defaultOptsWASM
+		opts.WASMRuntime = durablewazero.RuntimeInterpreter
+		reg := registry.NewLocalRegistry()
+		env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+		require.NoError(t, err)
+		defer env.Close()
+
+		_, err = reg.RegisterModule(context.Background(), "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+		_, err = reg.RegisterModule(context.Background(), "ns-2", "test-module", utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+
+		testFn(t, reg, env)
+	})
+
 	t.Run("go", func(t *testing.T) {
 		reg := registry.NewLocalRegistry()
 		env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsGo)
@@ -793,6 +2388,7 @@ func (tm testModule) Instantiate(
 	host HostCapabilities,
 ) (Actor, error) {
 	return &testActor{
+		id:   id,
 		host: host,
 	}, nil
 }
@@ -802,10 +2398,13 @@ func (tm testModule) Close(ctx context.Context) error {
 }
 
 type testActor struct {
+	id   string
 	host HostCapabilities
 
 	count            int
 	startupWasCalled bool
+	messagesLock     sync.Mutex
+	messages         []string
 }
 
 func (ta *testActor) Invoke(
@@ -865,6 +2464,86 @@ func (ta *testActor) Invoke(
 		}
 		err := ta.host.ScheduleInvokeActor(ctx, req)
 		return nil, err
+	case "subscribe":
+		return nil, ta.host.Subscribe(ctx, wapcutils.SubscribeRequest{
+			Topic:     string(payload),
+			Operation: "recordMessage",
+		})
+	case "unsubscribe":
+		return nil, ta.host.Unsubscribe(ctx, wapcutils.UnsubscribeRequest{
+			Topic: string(payload),
+		})
+	case "publish", "publishError":
+		var req wapcutils.PublishRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		if err := ta.host.Publish(ctx, transaction, req); err != nil {
+			return nil, err
+		}
+		if operation == "publishError" {
+			return nil, errors.New("publishError")
+		}
+		return nil, nil
+	case "kvTransfer", "kvTransferError":
+		// Transfers 1 unit of "balance" from this actor to the actor specified in the
+		// payload.
+		to := string(payload)
+		_, err := ta.host.TransactMultiActor(ctx, transaction, []string{to}, func(kv registry.MultiActorKV) (any, error) {
+			for _, update := range []struct {
+				actorID string
+				delta   int
+			}{{ta.id, -1}, {to, 1}} {
+				var balance int
+				v, ok, err := kv.Get(ctx, update.actorID, []byte("balance"))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					balance, err = strconv.Atoi(string(v))
+					if err != nil {
+						return nil, err
+					}
+				}
+				balance += update.delta
+				if err := kv.Put(ctx, update.actorID, []byte("balance"), []byte(strconv.Itoa(balance))); err != nil {
+					return nil, err
+				}
+			}
+			if operation == "kvTransferError" {
+				return nil, errors.New("kvTransferError")
+			}
+			return nil, nil
+		})
+		return nil, err
+	case "sendMessage", "sendMessageError":
+		var req wapcutils.SendMessageRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return nil, err
+		}
+		err := transaction.EnqueueMessage(ctx, req.ActorID, registry.InboxMessage{
+			ID:        req.ID,
+			Operation: req.Operation,
+			Payload:   req.Payload,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if operation == "sendMessageError" {
+			return nil, errors.New("sendMessageError")
+		}
+		return nil, nil
+	case "recordMessage":
+		// Go actors are not single-threaded like WASM actors so topic deliveries can
+		// race with the test reading the messages.
+		ta.messagesLock.Lock()
+		defer ta.messagesLock.Unlock()
+		ta.messages = append(ta.messages, string(payload))
+		return nil, nil
+	case "getMessages":
+		ta.messagesLock.Lock()
+		defer ta.messagesLock.Unlock()
+		return json.Marshal(ta.messages)
 	case "invokeCustomHostFn":
 		return ta.host.CustomFn(ctx, string(payload), payload)
 	default:
@@ -872,6 +2551,49 @@ func (ta *testActor) Invoke(
 	}
 }
 
+func (ta *testActor) InvokeStream(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+	emit func(chunk []byte) error,
+) error {
+	switch operation {
+	case "streamCount":
+		n, err := strconv.Atoi(string(payload))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := emit([]byte(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "streamForever":
+		for i := 0; ; i++ {
+			if err := emit([]byte(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+	case "streamKVPutCountError":
+		value := []byte(fmt.Sprintf("%d", ta.count))
+		if err := transaction.Put(ctx, payload, value); err != nil {
+			return err
+		}
+		if err := emit(value); err != nil {
+			return err
+		}
+		return errors.New("some fake error")
+	default:
+		result, err := ta.Invoke(ctx, operation, payload, transaction)
+		if err != nil {
+			return err
+		}
+		return emit(result)
+	}
+}
+
 // TestServerVersionIsHonored ensures client-server coordination around server versions by blocking actor invocations if versions don't match,
 // indicating a missed heartbeat by the server and loss of ownership of the actor.
 // This reproduces the bug identified in https://github.com/richardartoul/nola/blob/master/proofs/stateright/activation-cache/README.md
@@ -885,6 +2607,7 @@ func TestServerVersionIsHonored(t *testing.T) {
 		ActivationCacheTTL: time.Second * 15,
 	})
 	require.NoError(t, err)
+	defer env1.Close()
 
 	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
 	require.NoError(t, err)
@@ -892,7 +2615,7 @@ func TestServerVersionIsHonored(t *testing.T) {
 	_, err = reg.CreateActor(ctx, "ns-1", "a", "test-module", types.ActorOptions{})
 	require.NoError(t, err)
 
-	_, err = env1.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+	_, err = env1.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 	require.NoError(t, err)
 
 	env1.pauseHeartbeat()
@@ -903,10 +2626,10 @@ func TestServerVersionIsHonored(t *testing.T) {
 
 	require.NoError(t, env1.heartbeat())
 
-	_, err = env1.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{})
+	_, err = env1.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
 	require.EqualErrorf(t, err, "InvokeLocal: server version(2) != server version from reference(1)", "Error should be: %v, got: %v", "InvokeLocal: server version(1) != server version from reference(0)", err)
 }
 
-func (ta testActor) Close(ctx context.Context) error {
+func (ta *testActor) Close(ctx context.Context) error {
 	return nil
 }
@@ -3,11 +3,11 @@ package virtual
 import (
 	"context"
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
 )
@@ -20,6 +20,9 @@ type hostCapabilities struct {
 	actorID          string
 	actorModuleID    string
 	getServerStateFn func() (string, int64)
+	policy           hostPolicy
+	quotas           *namespaceQuotas
+	logger           *actorLogger
 }
 
 func newHostCapabilities(
@@ -30,6 +33,9 @@ func newHostCapabilities(
 	actorID string,
 	actorModuleID string,
 	getServerStateFn func() (string, int64),
+	policy *registry.HostPolicy,
+	quotas *namespaceQuotas,
+	logger *actorLogger,
 ) HostCapabilities {
 	return &hostCapabilities{
 		reg:              reg,
@@ -39,6 +45,15 @@ func newHostCapabilities(
 		actorID:          actorID,
 		actorModuleID:    actorModuleID,
 		getServerStateFn: getServerStateFn,
+		policy: hostPolicy{
+			policy:    policy,
+			reg:       reg,
+			namespace: namespace,
+			moduleID:  actorModuleID,
+			actorID:   actorID,
+		},
+		quotas: quotas,
+		logger: logger,
 	}
 }
 
@@ -48,7 +63,7 @@ func (h *hostCapabilities) BeginTransaction(
 	// Use lazy implementation because we create an implicit transaction for every
 	// invocation which would be extremely expensive if it were not for the fact that
 	// the transaction is never actually begun unless a KV operation is initiated.
-	tr := newLazyActorTransaction(h.reg, h.getServerStateFn, h.namespace, h.actorID)
+	tr := h.newTransaction()
 	return tr, nil
 }
 
@@ -57,7 +72,7 @@ func (h *hostCapabilities) Transact(
 	fn func(tr registry.ActorKVTransaction) (any, error),
 ) (any, error) {
 	// Use lazy implementation for same reason described in BeginTransaction() above.
-	tr := newLazyActorTransaction(h.reg, h.getServerStateFn, h.namespace, h.actorID)
+	tr := h.newTransaction()
 	result, err := fn(tr)
 	if err != nil {
 		tr.Cancel(ctx)
@@ -69,6 +84,85 @@ func (h *hostCapabilities) Transact(
 	return result, nil
 }
 
+// newTransaction returns a lazy transaction for the actor that enforces the host policy
+// of the actor's module, if it has one, and the quotas of the actor's namespace.
+func (h *hostCapabilities) newTransaction() registry.ActorKVTransaction {
+	var tr registry.ActorKVTransaction = newLazyActorTransaction(
+		h.reg, h.getServerStateFn, h.namespace, h.actorID)
+	if h.quotas != nil {
+		tr = namespaceQuotasActorKVTransaction{
+			ActorKVTransaction: tr, quotas: h.quotas, namespace: h.namespace}
+	}
+	if h.policy.policy == nil {
+		return tr
+	}
+	return hostPolicyActorKVTransaction{ActorKVTransaction: tr, policy: h.policy}
+}
+
+func (h *hostCapabilities) TransactMultiActor(
+	ctx context.Context,
+	tr registry.ActorKVTransaction,
+	actorIDs []string,
+	fn func(kv registry.MultiActorKV) (any, error),
+) (any, error) {
+	// tr enforces the actor's host policy and namespace quotas for the participants too.
+	kv, err := joinActors(ctx, h.reg, h.policy, tr, actorIDs)
+	if err != nil {
+		return nil, fmt.Errorf("hostCapabilities: TransactMultiActor: %w", err)
+	}
+	result, err := fn(kv)
+	if err != nil {
+		return nil, fmt.Errorf("hostCapabilities: TransactMultiActor: %w", err)
+	}
+	return result, nil
+}
+
+// joinActors joins the provided actors to tr, which belongs to the actor that policy is
+// enforced for, along with the fencing tokens of their current activations. The registry
+// validates the fencing tokens within the transaction itself so it fails if any of the
+// actors are reactivated elsewhere concurrently, including if they're activated for the
+// first time after tr performed its first read.
+func joinActors(
+	ctx context.Context,
+	reg registry.Registry,
+	policy hostPolicy,
+	tr registry.ActorKVTransaction,
+	actorIDs []string,
+) (registry.MultiActorKV, error) {
+	participants := make([]registry.TransactionParticipant, 0, len(actorIDs))
+	for _, actorID := range actorIDs {
+		if actorID == policy.actorID {
+			// The transaction's own actor is always a participant.
+			continue
+		}
+		// Check the policy before resolving the fencing token since that activates the
+		// actor, which must not happen if the call ends up being denied.
+		if err := policy.checkTargetActor(ctx, actorID, types.CreateIfNotExist{}); err != nil {
+			return nil, err
+		}
+		references, err := reg.EnsureActivation(ctx, policy.namespace, actorID)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"error ensuring activation of actor: %s, err: %w", actorID, err)
+		}
+		if len(references) == 0 {
+			return nil, fmt.Errorf(
+				"ensureActivation() returned 0 references for actor: %s", actorID)
+		}
+		participants = append(participants, registry.TransactionParticipant{
+			ActorID:       actorID,
+			ServerID:      references[0].ServerID(),
+			ServerVersion: references[0].ServerVersion(),
+		})
+	}
+
+	kv, err := tr.JoinActors(ctx, participants)
+	if err != nil {
+		return nil, fmt.Errorf("error joining actors: %w", err)
+	}
+	return kv, nil
+}
+
 func (h *hostCapabilities) CreateActor(
 	ctx context.Context,
 	req wapcutils.CreateActorRequest,
@@ -79,6 +173,12 @@ func (h *hostCapabilities) CreateActor(
 		// actor.
 		req.ModuleID = h.actorModuleID
 	}
+	if err := h.policy.checkOperation(wapcutils.CreateActorOperationName); err != nil {
+		return CreateActorResult{}, err
+	}
+	if err := h.policy.checkCreateActor(req.ModuleID); err != nil {
+		return CreateActorResult{}, err
+	}
 
 	_, err := h.reg.CreateActor(ctx, h.namespace, req.ActorID, req.ModuleID, types.ActorOptions{})
 	if err != nil {
@@ -91,7 +191,15 @@ func (h *hostCapabilities) InvokeActor(
 	ctx context.Context,
 	req types.InvokeActorRequest,
 ) ([]byte, error) {
-	return h.env.InvokeActor(ctx, h.namespace, req.ActorID, req.Operation, req.Payload, req.CreateIfNotExist)
+	if err := h.policy.checkOperation(wapcutils.InvokeActorOperationName); err != nil {
+		return nil, err
+	}
+	if err := h.policy.checkTargetActor(ctx, req.ActorID, req.CreateIfNotExist); err != nil {
+		return nil, err
+	}
+
+	return h.env.InvokeActor(
+		ctx, h.namespace, req.ActorID, req.Operation, req.Payload, req.CreateIfNotExist, req.IdempotencyKey)
 }
 
 func (h *hostCapabilities) ScheduleInvokeActor(
@@ -102,6 +210,12 @@ func (h *hostCapabilities) ScheduleInvokeActor(
 		// Omitted if the actor wants to schedule a delayed invocation (timer) for itself.
 		req.Invoke.ActorID = h.actorID
 	}
+	if err := h.policy.checkOperation(wapcutils.ScheduleInvocationOperationName); err != nil {
+		return err
+	}
+	if err := h.policy.checkTargetActor(ctx, req.Invoke.ActorID, req.Invoke.CreateIfNotExist); err != nil {
+		return err
+	}
 
 	// TODO: When the actor gets GC'd (which is not currently implemented), this
 	//       timer won't get GC'd with it. We should keep track of all outstanding
@@ -111,19 +225,56 @@ func (h *hostCapabilities) ScheduleInvokeActor(
 		// Copy the payload to make sure its safe to retain across invocations.
 		payloadCopy := make([]byte, len(req.Invoke.Payload))
 		copy(payloadCopy, req.Invoke.Payload)
+		ctx, span := tracing.Start(
+			ctx, "nola.ScheduledInvocation",
+			actorSpanAttributes(h.namespace, req.Invoke.ActorID, req.Invoke.Operation)...)
 		_, err := h.env.InvokeActor(
 			ctx, h.namespace, req.Invoke.ActorID,
-			req.Invoke.Operation, req.Invoke.Payload, req.Invoke.CreateIfNotExist)
+			req.Invoke.Operation, req.Invoke.Payload, req.Invoke.CreateIfNotExist,
+			req.Invoke.IdempotencyKey)
+		span.End(err)
 		if err != nil {
-			log.Printf(
-				"error performing scheduled invocation from actor: %s to actor: %s for operation: %s, err: %v\n",
-				h.actorID, req.Invoke.ActorID, req.Invoke.Operation, err)
+			h.logger.log(
+				ctx, LogLevelError, "error performing scheduled invocation",
+				"target_actor_id", req.Invoke.ActorID, "target_operation", req.Invoke.Operation,
+				"error", err)
 		}
 	})
 
 	return nil
 }
 
+func (h *hostCapabilities) Subscribe(
+	ctx context.Context,
+	req wapcutils.SubscribeRequest,
+) error {
+	if err := h.policy.checkOperation(wapcutils.SubscribeOperationName); err != nil {
+		return err
+	}
+	return h.reg.Subscribe(ctx, h.namespace, req.Topic, h.actorID, req.Operation)
+}
+
+func (h *hostCapabilities) Unsubscribe(
+	ctx context.Context,
+	req wapcutils.UnsubscribeRequest,
+) error {
+	if err := h.policy.checkOperation(wapcutils.UnsubscribeOperationName); err != nil {
+		return err
+	}
+	return h.reg.Unsubscribe(ctx, h.namespace, req.Topic, h.actorID)
+}
+
+func (h *hostCapabilities) Publish(
+	ctx context.Context,
+	tr registry.ActorKVTransaction,
+	req wapcutils.PublishRequest,
+) error {
+	if err := h.policy.checkOperation(wapcutils.PublishOperationName); err != nil {
+		return err
+	}
+	return publishToInboxes(ctx, h.reg, tr, h.namespace, req.Topic, req.Payload)
+}
+
 func (h *hostCapabilities) CustomFn(
 	ctx context.Context,
 	operation string,
@@ -131,6 +282,9 @@ func (h *hostCapabilities) CustomFn(
 ) ([]byte, error) {
 	customFn, ok := h.customHostFns[operation]
 	if ok {
+		if err := h.policy.checkCustomFn(operation); err != nil {
+			return nil, err
+		}
 		res, err := customFn(payload)
 		if err != nil {
 			return nil, fmt.Errorf("error running custom host function: %s, err: %w", operation, err)
@@ -206,6 +360,133 @@ func (l *lazyActorTransaction) Get(
 	return v, ok, nil
 }
 
+func (l *lazyActorTransaction) EnqueueMessage(
+	ctx context.Context,
+	actorID string,
+	msg registry.InboxMessage,
+) error {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: EnqueueMessage: error initializing transaction: %w", err)
+	}
+	if err := l.tr.EnqueueMessage(ctx, actorID, msg); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: EnqueueMessage: error calling EnqueueMessage: %w", err)
+	}
+	return nil
+}
+
+func (l *lazyActorTransaction) PeekInbox(
+	ctx context.Context,
+) (registry.InboxMessage, bool, error) {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return registry.InboxMessage{}, false, fmt.Errorf(
+			"lazyActorTransaction: PeekInbox: error initializing transaction: %w", err)
+	}
+	msg, ok, err := l.tr.PeekInbox(ctx)
+	if err != nil {
+		return registry.InboxMessage{}, false, fmt.Errorf(
+			"lazyActorTransaction: PeekInbox: error calling PeekInbox: %w", err)
+	}
+	return msg, ok, nil
+}
+
+func (l *lazyActorTransaction) AckInboxMessage(
+	ctx context.Context,
+	seq int64,
+) error {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: AckInboxMessage: error initializing transaction: %w", err)
+	}
+	if err := l.tr.AckInboxMessage(ctx, seq); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: AckInboxMessage: error calling AckInboxMessage: %w", err)
+	}
+	return nil
+}
+
+func (l *lazyActorTransaction) RetryInboxMessage(
+	ctx context.Context,
+	seq int64,
+	reason string,
+	retryAt time.Time,
+) error {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: RetryInboxMessage: error initializing transaction: %w", err)
+	}
+	if err := l.tr.RetryInboxMessage(ctx, seq, reason, retryAt); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: RetryInboxMessage: error calling RetryInboxMessage: %w", err)
+	}
+	return nil
+}
+
+func (l *lazyActorTransaction) DeadLetterInboxMessage(
+	ctx context.Context,
+	seq int64,
+	reason string,
+) error {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: DeadLetterInboxMessage: error initializing transaction: %w", err)
+	}
+	if err := l.tr.DeadLetterInboxMessage(ctx, seq, reason); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: DeadLetterInboxMessage: error calling DeadLetterInboxMessage: %w", err)
+	}
+	return nil
+}
+
+func (l *lazyActorTransaction) GetInvocationResult(
+	ctx context.Context,
+	idempotencyKey string,
+) (registry.InvocationResult, bool, error) {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return registry.InvocationResult{}, false, fmt.Errorf(
+			"lazyActorTransaction: GetInvocationResult: error initializing transaction: %w", err)
+	}
+	result, ok, err := l.tr.GetInvocationResult(ctx, idempotencyKey)
+	if err != nil {
+		return registry.InvocationResult{}, false, fmt.Errorf(
+			"lazyActorTransaction: GetInvocationResult: error calling GetInvocationResult: %w", err)
+	}
+	return result, ok, nil
+}
+
+func (l *lazyActorTransaction) PutInvocationResult(
+	ctx context.Context,
+	idempotencyKey string,
+	result registry.InvocationResult,
+) error {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: PutInvocationResult: error initializing transaction: %w", err)
+	}
+	if err := l.tr.PutInvocationResult(ctx, idempotencyKey, result); err != nil {
+		return fmt.Errorf(
+			"lazyActorTransaction: PutInvocationResult: error calling PutInvocationResult: %w", err)
+	}
+	return nil
+}
+
+func (l *lazyActorTransaction) JoinActors(
+	ctx context.Context,
+	participants []registry.TransactionParticipant,
+) (registry.MultiActorKV, error) {
+	if err := l.maybeInitTr(ctx, true); err != nil {
+		return nil, fmt.Errorf(
+			"lazyActorTransaction: JoinActors: error initializing transaction: %w", err)
+	}
+	kv, err := l.tr.JoinActors(ctx, participants)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"lazyActorTransaction: JoinActors: error calling JoinActors: %w", err)
+	}
+	return kv, nil
+}
+
 func (l *lazyActorTransaction) Commit(ctx context.Context) error {
 	if err := l.maybeInitTr(ctx, false); err != nil {
 		return fmt.Errorf(
@@ -0,0 +1,190 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+// errHostPermissionDenied is returned (wrapped) when an actor calls a host function that
+// its module's host policy does not allow.
+var errHostPermissionDenied = errors.New("host permission denied")
+
+// IsHostPermissionDeniedErr returns a boolean indicating whether the error is an instance
+// of (or wraps) errHostPermissionDenied. Note that errors returned to WASM modules are
+// converted to strings, so this only works for errors returned directly by the host.
+func IsHostPermissionDeniedErr(err error) bool {
+	return errors.Is(err, errHostPermissionDenied)
+}
+
+// hostPolicy enforces the host policy of an actor's module.
+type hostPolicy struct {
+	// policy is nil if the module doesn't have a policy, in which case everything is
+	// allowed.
+	policy    *registry.HostPolicy
+	reg       registry.Registry
+	namespace string
+	moduleID  string
+	actorID   string
+}
+
+func (p hostPolicy) checkOperation(op string) error {
+	if p.policy == nil || p.policy.AllowsOperation(op) {
+		return nil
+	}
+	return p.denied("host operation: %s is not allowed", op)
+}
+
+func (p hostPolicy) checkCustomFn(fn string) error {
+	if p.policy == nil || p.policy.AllowsCustomFn(fn) {
+		return nil
+	}
+	return p.denied("custom host function: %s is not allowed", fn)
+}
+
+// checkCreateActor checks whether the actor is allowed to create actors of the provided
+// module.
+func (p hostPolicy) checkCreateActor(moduleID string) error {
+	if p.policy == nil || p.policy.AllowsTarget(p.namespace, moduleID) {
+		return nil
+	}
+	return p.denied("creating actors of module: %s is not allowed", moduleID)
+}
+
+// checkTargetActor checks whether the actor is allowed to target the provided actor,
+// which is created with create.ModuleID if it doesn't exist.
+func (p hostPolicy) checkTargetActor(
+	ctx context.Context,
+	actorID string,
+	create types.CreateIfNotExist,
+) error {
+	if p.policy == nil || actorID == p.actorID || p.policy.AllowsAllTargets() {
+		return nil
+	}
+	if create.ModuleID != "" {
+		if err := p.checkCreateActor(create.ModuleID); err != nil {
+			return err
+		}
+	}
+
+	// Use DescribeActor instead of EnsureActivation since resolving the target's module
+	// must not activate the target, especially if the call ends up being denied.
+	//
+	// TODO: This performs an additional registry lookup for every host call that targets
+	//       another actor when the module's policy restricts targets. We could use the
+	//       environment's activation cache instead.
+	info, err := p.reg.DescribeActor(ctx, p.namespace, actorID)
+	if registry.IsActorDoesNotExistErr(err) && create.ModuleID != "" {
+		// The actor will be created with create.ModuleID which was checked above.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error resolving module of target actor: %s, err: %w", actorID, err)
+	}
+	return p.checkTargetModule(actorID, p.namespace, info.ModuleID)
+}
+
+// checkTargetModule checks whether the actor is allowed to target the provided actor of
+// the provided module.
+func (p hostPolicy) checkTargetModule(actorID, moduleNamespace, moduleID string) error {
+	if p.policy == nil || actorID == p.actorID {
+		return nil
+	}
+	if p.policy.AllowsTarget(moduleNamespace, moduleID) {
+		return nil
+	}
+	return p.denied("targeting actor: %s of module: %s is not allowed", actorID, moduleID)
+}
+
+func (p hostPolicy) denied(format string, args ...any) error {
+	return fmt.Errorf(
+		"%w: actor: %s of module: %s in namespace: %s: %s",
+		errHostPermissionDenied, p.actorID, p.moduleID, p.namespace, fmt.Sprintf(format, args...))
+}
+
+// hostPolicyActorKVTransaction wraps an ActorKVTransaction and enforces the host policy
+// of the actor's module on the operations that actors can perform with it.
+type hostPolicyActorKVTransaction struct {
+	registry.ActorKVTransaction
+	policy hostPolicy
+}
+
+func (h hostPolicyActorKVTransaction) Put(ctx context.Context, key []byte, value []byte) error {
+	if err := h.policy.checkOperation(wapcutils.KVPutOperationName); err != nil {
+		return err
+	}
+	return h.ActorKVTransaction.Put(ctx, key, value)
+}
+
+func (h hostPolicyActorKVTransaction) Get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	if err := h.policy.checkOperation(wapcutils.KVGetOperationName); err != nil {
+		return nil, false, err
+	}
+	return h.ActorKVTransaction.Get(ctx, key)
+}
+
+func (h hostPolicyActorKVTransaction) EnqueueMessage(
+	ctx context.Context,
+	actorID string,
+	msg registry.InboxMessage,
+) error {
+	if err := h.policy.checkOperation(wapcutils.SendMessageOperationName); err != nil {
+		return err
+	}
+	if err := h.policy.checkTargetActor(ctx, actorID, types.CreateIfNotExist{}); err != nil {
+		return err
+	}
+	return h.ActorKVTransaction.EnqueueMessage(ctx, actorID, msg)
+}
+
+func (h hostPolicyActorKVTransaction) JoinActors(
+	ctx context.Context,
+	participants []registry.TransactionParticipant,
+) (registry.MultiActorKV, error) {
+	for _, p := range participants {
+		if err := h.policy.checkTargetActor(ctx, p.ActorID, types.CreateIfNotExist{}); err != nil {
+			return nil, err
+		}
+	}
+	kv, err := h.ActorKVTransaction.JoinActors(ctx, participants)
+	if err != nil {
+		return nil, err
+	}
+	return hostPolicyMultiActorKV{kv: kv, policy: h.policy}, nil
+}
+
+// hostPolicyMultiActorKV is the same as hostPolicyActorKVTransaction, except for the KV
+// storage of the participants of a transaction. Reading and writing the KV storage of
+// other actors requires the KV-GET-ACTOR and KV-PUT-ACTOR operations respectively so that
+// policies can allow actors to invoke other actors without also allowing them to modify
+// their KV storage directly.
+type hostPolicyMultiActorKV struct {
+	kv     registry.MultiActorKV
+	policy hostPolicy
+}
+
+func (h hostPolicyMultiActorKV) Put(ctx context.Context, actorID string, key []byte, value []byte) error {
+	op := wapcutils.KVPutActorOperationName
+	if actorID == h.policy.actorID {
+		op = wapcutils.KVPutOperationName
+	}
+	if err := h.policy.checkOperation(op); err != nil {
+		return err
+	}
+	return h.kv.Put(ctx, actorID, key, value)
+}
+
+func (h hostPolicyMultiActorKV) Get(ctx context.Context, actorID string, key []byte) ([]byte, bool, error) {
+	op := wapcutils.KVGetActorOperationName
+	if actorID == h.policy.actorID {
+		op = wapcutils.KVGetOperationName
+	}
+	if err := h.policy.checkOperation(op); err != nil {
+		return nil, false, err
+	}
+	return h.kv.Get(ctx, actorID, key)
+}
@@ -4,18 +4,33 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
 )
 
 type httpClient struct {
-	c *http.Client
+	c    *http.Client
+	opts HTTPClientOptions
+}
+
+// HTTPClientOptions contains the options for the HTTP client.
+type HTTPClientOptions struct {
+	// InternalToken is sent with every request so that other servers can authenticate
+	// them, see ServerOptions.InternalToken.
+	InternalToken string
+	// TLS contains the TLS options. If TLS is enabled then every server in the cluster
+	// must serve TLS, and their certificates are verified against the server IDs in actor
+	// references.
+	TLS TLSOptions
 }
 
 func (h *httpClient) InvokeActorRemote(
@@ -24,64 +39,231 @@ func (h *httpClient) InvokeActorRemote(
 	reference types.ActorReference,
 	operation string,
 	payload []byte,
+	idempotencyKey string,
 ) ([]byte, error) {
+	resp, err := h.invokeDirect(
+		ctx, "/api/v1/invoke-actor-direct", versionStamp, reference, operation, payload, idempotencyKey)
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirect: %w", err)
+	}
+	defer resp.Body.Close()
+
+	invokeResp, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<26))
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error reading body: %w", err)
+	}
+
+	return invokeResp, nil
+}
+
+func (h *httpClient) InvokeActorRemoteStream(
+	ctx context.Context,
+	versionStamp int64,
+	reference types.ActorReference,
+	operation string,
+	payload []byte,
+) (InvokeStream, error) {
+	resp, err := h.invokeDirect(
+		ctx, "/api/v1/invoke-actor-direct-stream", versionStamp, reference, operation, payload, "")
+	if err != nil {
+		return nil, fmt.Errorf("HTTPClient: InvokeDirectStream: %w", err)
+	}
+
+	return newHTTPStream(resp.Body), nil
+}
+
+// invokeDirect issues an invokeActorDirectRequest to the provided path on the server that
+// the reference points to. The caller is responsible for closing the response body if no
+// error is returned.
+func (h *httpClient) invokeDirect(
+	ctx context.Context,
+	path string,
+	versionStamp int64,
+	reference types.ActorReference,
+	operation string,
+	payload []byte,
+	idempotencyKey string,
+) (*http.Response, error) {
 	ir := invokeActorDirectRequest{
-		VersionStamp:  versionStamp,
-		ServerID:      reference.ServerID(),
-		ServerVersion: reference.ServerVersion(),
-		Namespace:     reference.Namespace(),
-		ModuleID:      reference.ModuleID().ID,
-		ActorID:       reference.ActorID().ID,
-		Generation:    reference.Generation(),
-		Operation:     operation,
-		Payload:       payload,
+		VersionStamp:   versionStamp,
+		ServerID:       reference.ServerID(),
+		ServerVersion:  reference.ServerVersion(),
+		Namespace:      reference.Namespace(),
+		ModuleID:       reference.ModuleID().ID,
+		ActorID:        reference.ActorID().ID,
+		Generation:     reference.Generation(),
+		Operation:      operation,
+		Payload:        payload,
+		IdempotencyKey: idempotencyKey,
 	}
+	ir.Traceparent = tracing.Traceparent(ctx)
 	marshaled, err := json.Marshal(&ir)
 	if err != nil {
-		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error marshaling invokeActorDirectRequest: %w", err)
+		return nil, fmt.Errorf("error marshaling invokeActorDirectRequest: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(
-		ctx, "POST",
-		fmt.Sprintf("http://%s/api/v1/invoke-actor-direct", reference.Address()),
-		bytes.NewReader(marshaled))
+	return h.post(ctx, reference.ServerID(), reference.Address(), path, marshaled)
+}
+
+func (h *httpClient) TailActorLogsRemote(
+	ctx context.Context,
+	serverID string,
+	address string,
+	namespace string,
+	actorID string,
+	limit int,
+) ([]LogEntry, bool, error) {
+	marshaled, err := json.Marshal(&tailActorLogsDirectRequest{
+		ServerID:  serverID,
+		Namespace: namespace,
+		ActorID:   actorID,
+		Limit:     limit,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error constructing request: %w", err)
+		return nil, false, fmt.Errorf("HTTPClient: TailActorLogs: error marshaling request: %w", err)
 	}
 
-	resp, err := h.c.Do(req)
+	resp, err := h.post(ctx, serverID, address, "/api/v1/tail-actor-logs-direct", marshaled)
 	if err != nil {
-		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error running request: %w", err)
+		return nil, false, fmt.Errorf("HTTPClient: TailActorLogs: %w", err)
 	}
 	defer resp.Body.Close()
 
+	var tailResp tailActorLogsResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<26)).Decode(&tailResp); err != nil {
+		return nil, false, fmt.Errorf("HTTPClient: TailActorLogs: error decoding response: %w", err)
+	}
+	return tailResp.Logs, tailResp.Activated, nil
+}
+
+// post issues a POST request with the provided body to the provided path on the server
+// with the provided ID and address. The caller is responsible for closing the response
+// body if no error is returned.
+func (h *httpClient) post(
+	ctx context.Context,
+	serverID string,
+	address string,
+	path string,
+	body []byte,
+) (*http.Response, error) {
+	url := fmt.Sprintf("http://%s%s", address, path)
+	if h.opts.TLS.Enabled() {
+		url = fmt.Sprintf("https://%s%s", tlsPeerHost(serverID, address), path)
+		ctx = withTLSPeer(ctx, serverID, address)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error constructing request: %w", err)
+	}
+	if h.opts.InternalToken != "" {
+		req.Header.Set(internalTokenHeader, h.opts.InternalToken)
+	}
+
+	resp, err := h.c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error running request: %w", err)
+	}
+
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		var errMsg string
 		body, err := ioutil.ReadAll(resp.Body)
 		if err == nil {
 			errMsg = string(body)
 		}
-		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error status code: %d, msg: %s", resp.StatusCode, errMsg)
+		err = fmt.Errorf("error status code: %d, msg: %s", resp.StatusCode, errMsg)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// Preserve the retry-after hint for the caller.
+			seconds, _ := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64)
+			return nil, &RateLimitedError{RetryAfter: time.Duration(seconds) * time.Second, err: err}
+		}
+		return nil, err
 	}
 
-	invokeResp, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<26))
-	if err != nil {
-		return nil, fmt.Errorf("HTTPClient: InvokeDirect: error reading body: %w", err)
+	return resp, nil
+}
+
+// httpStream implements InvokeStream by decoding the NDJSON-encoded streamFrames written
+// by writeStream() in server.go.
+type httpStream struct {
+	body io.ReadCloser
+	dec  *json.Decoder
+
+	curr      []byte
+	err       error
+	finished  bool
+	committed bool
+}
+
+func newHTTPStream(body io.ReadCloser) InvokeStream {
+	return &httpStream{
+		body: body,
+		dec:  json.NewDecoder(body),
 	}
+}
 
-	return invokeResp, nil
+func (s *httpStream) Next() bool {
+	if s.finished {
+		return false
+	}
+
+	var frame streamFrame
+	if err := s.dec.Decode(&frame); err != nil {
+		// The stream should always be terminated with a Done or Error frame so even
+		// io.EOF indicates that the stream was truncated.
+		return s.finish(fmt.Errorf("HTTPClient: error decoding stream frame: %w", err))
+	}
+	if frame.Error != "" {
+		return s.finish(errors.New(frame.Error))
+	}
+	if frame.Done {
+		s.committed = frame.Committed
+		return s.finish(nil)
+	}
+
+	s.curr = frame.Payload
+	return true
+}
+
+func (s *httpStream) finish(err error) bool {
+	s.curr = nil
+	s.err = err
+	s.finished = true
+	return false
+}
+
+func (s *httpStream) Chunk() []byte {
+	return s.curr
+}
+
+func (s *httpStream) Err() error {
+	return s.err
+}
+
+func (s *httpStream) Committed() bool {
+	return s.committed
+}
+
+func (s *httpStream) Close() error {
+	s.finished = true
+	return s.body.Close()
 }
 
 // NewHTTPClient returns a new HTTPClient that implements the RemoteClient interface.
-func NewHTTPClient() RemoteClient {
+func NewHTTPClient(opts HTTPClientOptions) (RemoteClient, error) {
+	if err := opts.TLS.Validate(); err != nil {
+		return nil, fmt.Errorf("error validating TLS options: %w", err)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
 	transport := &http.Transport{
 		// Some of this is copy-pasta from http.DefaultTransport.
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
 		MaxIdleConns:        0, // No limit.
 		MaxIdleConnsPerHost: 6500,
 		MaxConnsPerHost:     0, // No limit.
@@ -98,6 +280,16 @@ func NewHTTPClient() RemoteClient {
 		WriteBufferSize:       1 << 18,
 		ReadBufferSize:        1 << 18,
 	}
+	if opts.TLS.Enabled() {
+		config, err := opts.TLS.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.DialTLSContext = dialTLSWithServerID(dialer, config)
+		// Requests are sent to hosts that only dialTLSWithServerID can resolve, see
+		// tlsPeerHost.
+		transport.Proxy = nil
+	}
 	c := &http.Client{Transport: transport}
-	return &httpClient{c: c}
+	return &httpClient{c: c, opts: opts}, nil
 }
@@ -0,0 +1,35 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/richardartoul/nola/virtual/registry"
+)
+
+// getInvocationResult returns the result stored for the idempotency key, or nil if there
+// is none. A nil slice is returned as an empty non-nil slice so callers can tell the
+// difference.
+func getInvocationResult(
+	ctx context.Context,
+	tr registry.ActorKVTransaction,
+	idempotencyKey string,
+	operation string,
+) ([]byte, error) {
+	stored, ok, err := tr.GetInvocationResult(ctx, idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	if stored.Operation != operation {
+		return nil, fmt.Errorf(
+			"idempotency key: %s was previously used for operation: %s, but was reused for operation: %s",
+			idempotencyKey, stored.Operation, operation)
+	}
+	if stored.Result == nil {
+		return []byte{}, nil
+	}
+	return stored.Result, nil
+}
@@ -0,0 +1,304 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/durable/durablewazero"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const defaultActorLogBufferSize = 100
+
+// LogLevel is the severity of a log message.
+type LogLevel = types.LogLevel
+
+const (
+	LogLevelDebug = types.LogLevelDebug
+	LogLevelInfo  = types.LogLevelInfo
+	LogLevelWarn  = types.LogLevelWarn
+	LogLevelError = types.LogLevelError
+)
+
+// ParseLogLevel parses the name of a log level, I.E debug, info, warn or error.
+func ParseLogLevel(level string) (LogLevel, error) {
+	return types.ParseLogLevel(level)
+}
+
+// Logger is a leveled, structured logger, see types.Logger.
+type Logger = types.Logger
+
+// NewWriterLogger returns a Logger that writes every message to w as a line of
+// space-separated key=value pairs (logfmt).
+func NewWriterLogger(w io.Writer) Logger {
+	return types.NewWriterLogger(w)
+}
+
+// LogEntry is a message that was logged for an actor.
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+	// Fields contains the message's key/value pairs, except for the ones that identify the
+	// actor.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// actorLogging creates the loggers of activated actors.
+type actorLogging struct {
+	logger     Logger
+	level      LogLevel
+	levels     *namespaceLogLevels
+	bufferSize int
+}
+
+func (l *actorLogging) newActorLogger(reference types.ActorReferenceVirtual) *actorLogger {
+	return &actorLogger{
+		logging:   l,
+		namespace: reference.Namespace(),
+		moduleID:  reference.ModuleID().ID,
+		actorID:   reference.ActorID().ID,
+		buffer:    newLogRingBuffer(l.bufferSize),
+	}
+}
+
+// namespaceLevel returns the minimum level of the messages that are logged for the
+// namespace's actors, which is the namespace's log level if it has one and the
+// environment's log level otherwise.
+func (l *actorLogging) namespaceLevel(namespace string) LogLevel {
+	levelName := l.levels.get(namespace)
+	if levelName == "" {
+		return l.level
+	}
+	level, err := ParseLogLevel(levelName)
+	if err != nil {
+		return l.level
+	}
+	return level
+}
+
+// namespaceLogLevels caches the log levels of namespaces. Lookups never block on the
+// registry since actors log from within their invocations: stale entries are refreshed
+// in the background, and entries are loaded with load() when actors are activated so
+// that the level is known before the actors log anything. Entries that haven't been
+// looked up for namespaceLogLevelIdleTTL refresh intervals are evicted.
+type namespaceLogLevels struct {
+	sync.Mutex
+	levels map[string]*namespaceLogLevel
+
+	registry        registry.Registry
+	refreshInterval time.Duration
+}
+
+const namespaceLogLevelIdleTTL = 10
+
+type namespaceLogLevel struct {
+	level       string
+	refreshedAt time.Time
+	usedAt      time.Time
+	refreshing  bool
+}
+
+func newNamespaceLogLevels(
+	reg registry.Registry,
+	refreshInterval time.Duration,
+) *namespaceLogLevels {
+	return &namespaceLogLevels{
+		levels:          make(map[string]*namespaceLogLevel),
+		registry:        reg,
+		refreshInterval: refreshInterval,
+	}
+}
+
+// get returns the cached log level of the namespace, or an empty string if it doesn't
+// have one or it isn't cached yet.
+func (n *namespaceLogLevels) get(namespace string) string {
+	if n == nil {
+		return ""
+	}
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	entry, ok := n.levels[namespace]
+	if !ok {
+		entry = &namespaceLogLevel{}
+		n.levels[namespace] = entry
+	}
+	entry.usedAt = now
+	if !entry.refreshing && now.Sub(entry.refreshedAt) >= n.refreshInterval {
+		entry.refreshing = true
+		go n.refresh(namespace)
+	}
+	return entry.level
+}
+
+// load loads the log level of the namespace if it isn't cached yet.
+func (n *namespaceLogLevels) load(ctx context.Context, namespace string) error {
+	if n == nil {
+		return nil
+	}
+	n.Lock()
+	_, ok := n.levels[namespace]
+	n.Unlock()
+	if ok {
+		return nil
+	}
+	return n.fetch(ctx, namespace)
+}
+
+func (n *namespaceLogLevels) refresh(namespace string) {
+	ctx, cc := context.WithTimeout(context.Background(), heartbeatTimeout)
+	defer cc()
+	if err := n.fetch(ctx, namespace); err != nil {
+		n.Lock()
+		if entry, ok := n.levels[namespace]; ok {
+			// Try again on the next lookup.
+			entry.refreshing = false
+		}
+		n.Unlock()
+	}
+}
+
+func (n *namespaceLogLevels) fetch(ctx context.Context, namespace string) error {
+	var level string
+	info, err := n.registry.GetNamespace(ctx, namespace)
+	if err == nil {
+		level = info.Opts.LogLevel
+	} else if !registry.IsNamespaceDoesNotExistErr(err) {
+		return fmt.Errorf("error getting log level of namespace: %s, err: %w", namespace, err)
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	entry, ok := n.levels[namespace]
+	if !ok {
+		entry = &namespaceLogLevel{usedAt: now}
+		n.levels[namespace] = entry
+	}
+	entry.level = level
+	entry.refreshedAt = now
+	entry.refreshing = false
+
+	for ns, entry := range n.levels {
+		if !entry.refreshing && now.Sub(entry.usedAt) >= namespaceLogLevelIdleTTL*n.refreshInterval {
+			delete(n.levels, ns)
+		}
+	}
+	return nil
+}
+
+// actorLogger logs messages for an activated actor. Messages are tagged with the actor's
+// namespace, module and ID, filtered by the namespace's log level, and retained in a ring
+// buffer so that the actor's recent messages can be tailed.
+type actorLogger struct {
+	logging   *actorLogging
+	namespace string
+	moduleID  string
+	actorID   string
+	buffer    *logRingBuffer
+}
+
+func (l *actorLogger) log(ctx context.Context, level LogLevel, msg string, keyvals ...any) {
+	if level < l.logging.namespaceLevel(l.namespace) {
+		return
+	}
+
+	entry := LogEntry{
+		Time:    time.Now(),
+		Level:   level.String(),
+		Message: msg,
+	}
+	if len(keyvals) > 0 {
+		entry.Fields = make(map[string]string, len(keyvals)/2)
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			entry.Fields[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+		}
+	}
+	l.buffer.add(entry)
+
+	tagged := make([]any, 0, len(keyvals)+6)
+	tagged = append(tagged,
+		"namespace", l.namespace,
+		"module_id", l.moduleID,
+		"actor_id", l.actorID)
+	tagged = append(tagged, keyvals...)
+	l.logging.logger.Log(level, msg, tagged...)
+}
+
+// actorLoggerCtxKey is the key that is used to store/retrieve the logger of the actor
+// that is being invoked from the context.
+type actorLoggerCtxKey struct{}
+
+// withActorLogger returns a context that carries the actor's logger so that the host
+// functions the actor calls can log on its behalf, and that passes the messages the actor
+// logs with waPC's console log function to the logger, tagged with the operation.
+func withActorLogger(ctx context.Context, logger *actorLogger, operation string) context.Context {
+	ctx = context.WithValue(ctx, actorLoggerCtxKey{}, logger)
+	return durablewazero.WithConsoleLogger(ctx, func(msg string) {
+		logger.log(ctx, LogLevelInfo, msg, "operation", operation)
+	})
+}
+
+func extractActorLogger(ctx context.Context) (*actorLogger, error) {
+	logger, ok := ctx.Value(actorLoggerCtxKey{}).(*actorLogger)
+	if !ok {
+		return nil, fmt.Errorf("wazeroHostFnRouter: could not find actor logger in context")
+	}
+	return logger, nil
+}
+
+// logRingBuffer retains the most recent log entries up to its capacity.
+type logRingBuffer struct {
+	sync.Mutex
+	entries []LogEntry
+	// next is the index that the next entry will be written to.
+	next int
+	full bool
+}
+
+func newLogRingBuffer(size int) *logRingBuffer {
+	return &logRingBuffer{entries: make([]LogEntry, size)}
+}
+
+func (b *logRingBuffer) add(entry LogEntry) {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.entries) == 0 {
+		return
+	}
+	b.entries[b.next] = entry
+	b.next++
+	if b.next == len(b.entries) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+// tail returns up to the last limit entries, oldest first. All the retained entries are
+// returned if limit is not positive.
+func (b *logRingBuffer) tail(limit int) []LogEntry {
+	b.Lock()
+	defer b.Unlock()
+	size := b.next
+	if b.full {
+		size = len(b.entries)
+	}
+	if limit <= 0 || limit > size {
+		limit = size
+	}
+
+	result := make([]LogEntry, 0, limit)
+	start := b.next - limit
+	if start < 0 {
+		start += len(b.entries)
+	}
+	for i := 0; i < limit; i++ {
+		result = append(result, b.entries[(start+i)%len(b.entries)])
+	}
+	return result
+}
@@ -0,0 +1,112 @@
+package virtual
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/metrics"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	// maxOperationLabelsPerModule is the maximum number of distinct values of the
+	// operation label of the invocation metrics of each module. Operation names are
+	// provided by callers, so they're only validated for modules that have a manifest.
+	maxOperationLabelsPerModule = 64
+	// otherOperationLabel is the value of the operation label of invocations of
+	// operations that aren't declared in their module's manifest, or that exceed
+	// maxOperationLabelsPerModule.
+	otherOperationLabel = "other"
+	// otherModuleLabel is the value of the namespace and module labels of invocations of
+	// workers whose module couldn't be resolved, since both are provided by callers.
+	otherModuleLabel = "other"
+)
+
+var (
+	invocationsTotal = metrics.NewCounterVec(
+		"nola_invocations_total",
+		"Number of actor and worker invocations dispatched by the server.",
+		"namespace", "module", "operation", "result")
+	invocationDuration = metrics.NewHistogramVec(
+		"nola_invocation_duration_seconds",
+		"Latency of actor and worker invocations dispatched by the server.",
+		metrics.DefaultLatencyBuckets,
+		"namespace", "module", "operation")
+	activationsTotal = metrics.NewCounterVec(
+		"nola_actor_activations_total",
+		"Number of actors that were activated in memory.",
+		"namespace", "module")
+	evictionsTotal = metrics.NewCounterVec(
+		"nola_actor_evictions_total",
+		"Number of in-memory actors that were closed to be replaced by a newer generation.",
+		"namespace", "module")
+	activationCacheLookups = metrics.NewCounterVec(
+		"nola_activation_cache_lookups_total",
+		"Number of activation cache lookups by result (hit or miss). The hit ratio is "+
+			"hits / (hits + misses).",
+		"result")
+	heartbeatDuration = metrics.NewHistogramVec(
+		"nola_heartbeat_duration_seconds",
+		"Latency of heartbeats to the registry.",
+		metrics.DefaultLatencyBuckets,
+		"result")
+	activatedActors = metrics.NewGaugeVec(
+		"nola_activated_actors",
+		"Number of actors that are activated in memory.",
+		"server_id")
+	wasmMemoryBytes = metrics.NewGaugeVec(
+		"nola_wasm_memory_bytes",
+		"Total size of the memory of the WASM actors that are activated in memory.",
+		"server_id")
+)
+
+// recordInvocation records the metrics for an invocation that started at start and
+// completed with err.
+func recordInvocation(namespace, moduleID, operation string, start time.Time, err error) {
+	result := "success"
+	if _, ok := IsRateLimitedErr(err); ok {
+		result = "rate_limited"
+	} else if err != nil {
+		result = "error"
+	}
+	operation = operationLabels.get(namespace, moduleID, operation, err)
+	invocationsTotal.WithLabels(namespace, moduleID, operation, result).Inc()
+	invocationDuration.WithLabels(namespace, moduleID, operation).Observe(time.Since(start).Seconds())
+}
+
+var operationLabels = &operationLabelSet{
+	byModule: make(map[types.NamespacedIDNoType]map[string]struct{}),
+}
+
+// operationLabelSet bounds the cardinality of the operation label of the invocation
+// metrics by tracking the operations that have been used as a label for each module.
+type operationLabelSet struct {
+	sync.Mutex
+	byModule map[types.NamespacedIDNoType]map[string]struct{}
+}
+
+// get returns the value of the operation label for an invocation of operation that
+// completed with err.
+func (o *operationLabelSet) get(namespace, moduleID, operation string, err error) string {
+	if errors.Is(err, errUndeclaredOperation) {
+		return otherOperationLabel
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	key := types.NewNamespacedIDNoType(namespace, moduleID)
+	operations, ok := o.byModule[key]
+	if !ok {
+		operations = make(map[string]struct{})
+		o.byModule[key] = operations
+	}
+	if _, ok := operations[operation]; ok {
+		return operation
+	}
+	if len(operations) >= maxOperationLabelsPerModule {
+		return otherOperationLabel
+	}
+	operations[operation] = struct{}{}
+	return operation
+}
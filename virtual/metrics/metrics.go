@@ -0,0 +1,246 @@
+// Package metrics implements counters, gauges and histograms that are exposed in the
+// Prometheus text exposition format. It only implements the subset of the Prometheus
+// client that NOLA needs so that it doesn't have to depend on it.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultLatencyBuckets are the default histogram buckets for latencies in seconds.
+var DefaultLatencyBuckets = []float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// DefaultRegistry is the registry that the package-level constructors register metrics
+// with, and that the server's /metrics endpoint exposes.
+var DefaultRegistry = NewRegistry()
+
+// NewCounterVec creates a CounterVec and registers it with DefaultRegistry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return DefaultRegistry.NewCounterVec(name, help, labels...)
+}
+
+// NewGaugeVec creates a GaugeVec and registers it with DefaultRegistry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return DefaultRegistry.NewGaugeVec(name, help, labels...)
+}
+
+// NewHistogramVec creates a HistogramVec and registers it with DefaultRegistry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return DefaultRegistry.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// Registry contains a set of metrics.
+type Registry struct {
+	sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+// NewRegistry creates a new Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// NewCounterVec creates a CounterVec and registers it with the registry. It panics if a
+// metric with the same name was already registered.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, "counter", labels, func() *Counter {
+		return &Counter{}
+	})}
+	r.register(name, c)
+	return c
+}
+
+// NewGaugeVec creates a GaugeVec and registers it with the registry. It panics if a
+// metric with the same name was already registered.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{vec: newVec(name, help, "gauge", labels, func() *Gauge {
+		return &Gauge{}
+	})}
+	r.register(name, g)
+	return g
+}
+
+// NewHistogramVec creates a HistogramVec with the provided (sorted) bucket upper bounds and
+// registers it with the registry. It panics if a metric with the same name was already
+// registered.
+func (r *Registry) NewHistogramVec(
+	name, help string,
+	buckets []float64,
+	labels ...string,
+) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of histogram: %s are not sorted", name))
+	}
+	h := &HistogramVec{vec: newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})}
+	r.register(name, h)
+	return h
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric: %s registered twice", name))
+	}
+	r.metrics[name] = m
+}
+
+// WriteText writes every metric in the registry to w in the Prometheus text exposition
+// format, sorted by name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make([]metric, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	bits uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64) {
+	addFloat(&c.bits, v)
+}
+
+// Value returns the counter's current value.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Add adds v to the gauge.
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+// Value returns the gauge's current value.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Histogram samples observations into buckets.
+type Histogram struct {
+	sync.Mutex
+	buckets []float64
+	// counts contains the number of observations in each bucket, non-cumulatively.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.Lock()
+	defer h.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.Lock()
+	defer h.Unlock()
+	return h.count
+}
+
+// CounterVec is a set of counters with the same name that are partitioned by labels.
+type CounterVec struct {
+	*vec[*Counter]
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	return c.writeSeries(w, func(w io.Writer, labels string, v *Counter) error {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", c.name, labels, formatFloat(v.Value()))
+		return err
+	})
+}
+
+// GaugeVec is a set of gauges with the same name that are partitioned by labels.
+type GaugeVec struct {
+	*vec[*Gauge]
+}
+
+func (g *GaugeVec) write(w io.Writer) error {
+	return g.writeSeries(w, func(w io.Writer, labels string, v *Gauge) error {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", g.name, labels, formatFloat(v.Value()))
+		return err
+	})
+}
+
+// HistogramVec is a set of histograms with the same name that are partitioned by labels.
+type HistogramVec struct {
+	*vec[*Histogram]
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	return h.writeSeries(w, func(w io.Writer, labels string, v *Histogram) error {
+		v.Lock()
+		counts := append([]uint64(nil), v.counts...)
+		count, sum := v.count, v.sum
+		v.Unlock()
+
+		var cumulative uint64
+		for i, upperBound := range v.buckets {
+			cumulative += counts[i]
+			_, err := fmt.Fprintf(
+				w, "%s_bucket%s %d\n",
+				h.name, withLabel(labels, "le", formatFloat(upperBound)), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(
+			w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, withLabel(labels, "le", "+Inf"), count,
+			h.name, labels, formatFloat(sum),
+			h.name, labels, count)
+		return err
+	})
+}
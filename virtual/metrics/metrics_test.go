@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("test_counter", "A counter.", "namespace", "result")
+	gauge := r.NewGaugeVec("test_gauge", "A gauge\nwith two lines.")
+	histogram := r.NewHistogramVec("test_histogram", "A histogram.", []float64{0.1, 1}, "op")
+
+	counter.WithLabels("ns-2", "success").Inc()
+	counter.WithLabels("ns-1", "error").Add(2)
+	counter.WithLabels("ns-1", "success").Inc()
+	counter.WithLabels("ns-\"3\"", "success").Inc()
+	counter.WithLabels("ns-\"3\"", "success").Inc()
+	counter.WithLabels("ns-4", "success").Inc()
+	counter.Delete("ns-4", "success")
+	gauge.WithLabels().Set(1.5)
+	histogram.WithLabels("inc").Observe(0.05)
+	histogram.WithLabels("inc").Observe(0.5)
+	histogram.WithLabels("inc").Observe(5)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	require.Equal(t, `# HELP test_counter A counter.
+# TYPE test_counter counter
+test_counter{namespace="ns-\"3\"",result="success"} 2
+test_counter{namespace="ns-1",result="error"} 2
+test_counter{namespace="ns-1",result="success"} 1
+test_counter{namespace="ns-2",result="success"} 1
+# HELP test_gauge A gauge\nwith two lines.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_histogram A histogram.
+# TYPE test_histogram histogram
+test_histogram_bucket{op="inc",le="0.1"} 1
+test_histogram_bucket{op="inc",le="1"} 2
+test_histogram_bucket{op="inc",le="+Inf"} 3
+test_histogram_sum{op="inc"} 5.55
+test_histogram_count{op="inc"} 3
+`, buf.String())
+}
+
+func TestRegistryInvalidUsage(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("test_counter", "A counter.", "namespace")
+	require.Panics(t, func() { r.NewGaugeVec("test_counter", "A gauge.") })
+	require.Panics(t, func() { counter.WithLabels() })
+	require.Panics(t, func() { r.NewHistogramVec("test_histogram", "A histogram.", []float64{1, 0.1}) })
+}
@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// vec is a set of series of the same metric, keyed by their label values.
+type vec[T any] struct {
+	sync.RWMutex
+	series map[string]vecSeries[T]
+
+	name   string
+	help   string
+	typ    string
+	labels []string
+	newFn  func() T
+}
+
+type vecSeries[T any] struct {
+	labelValues []string
+	value       T
+}
+
+func newVec[T any](name, help, typ string, labels []string, newFn func() T) *vec[T] {
+	return &vec[T]{
+		series: make(map[string]vecSeries[T]),
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		newFn:  newFn,
+	}
+}
+
+// WithLabels returns the series with the provided label values, creating it if
+// necessary. It panics if the number of values doesn't match the number of labels.
+func (v *vec[T]) WithLabels(values ...string) T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf(
+			"metric: %s has %d labels, but got %d values", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.RLock()
+	s, ok := v.series[key]
+	v.RUnlock()
+	if ok {
+		return s.value
+	}
+
+	v.Lock()
+	defer v.Unlock()
+	s, ok = v.series[key]
+	if !ok {
+		s = vecSeries[T]{labelValues: append([]string(nil), values...), value: v.newFn()}
+		v.series[key] = s
+	}
+	return s.value
+}
+
+// Delete deletes the series with the provided label values, if it exists.
+func (v *vec[T]) Delete(values ...string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.series, strings.Join(values, "\xff"))
+}
+
+// writeSeries writes the metric's HELP and TYPE lines followed by each of its series,
+// sorted by their label values.
+func (v *vec[T]) writeSeries(w io.Writer, fn func(w io.Writer, labels string, value T) error) error {
+	v.RLock()
+	series := make([]vecSeries[T], 0, len(v.series))
+	for _, s := range v.series {
+		series = append(series, s)
+	}
+	v.RUnlock()
+	sort.Slice(series, func(i, j int) bool {
+		a, b := series[i].labelValues, series[j].labelValues
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ); err != nil {
+		return err
+	}
+	for _, s := range series {
+		if err := fn(w, formatLabels(v.labels, s.labelValues), s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabelValue(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds a label to labels, which were formatted by formatLabels.
+func withLabel(labels, name, value string) string {
+	label := fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(value))
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// addFloat atomically adds delta to the float64 stored in bits.
+func addFloat(bits *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(bits, old, updated) {
+			return
+		}
+	}
+}
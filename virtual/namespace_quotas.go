@@ -0,0 +1,257 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"golang.org/x/sync/singleflight"
+)
+
+const defaultNamespaceQuotasRefreshInterval = 10 * time.Second
+
+// namespaceQuotas enforces the namespace quotas that can't be enforced by the registry
+// itself, I.E the invocation rate and the total size of the actors' KV storage, as well
+// as the namespace's rate limits (see rate_limiter.go). The options and usage of each
+// namespace are cached and refreshed from the registry in the background, so changes to a
+// namespace's options take effect about one refresh interval later.
+//
+// Note that the invocation rate is enforced by every server independently, so a
+// namespace's effective rate across the cluster is a multiple of MaxInvocationsPerSecond.
+type namespaceQuotas struct {
+	sync.Mutex
+	namespaces map[string]*namespaceQuotaState
+	// loads deduplicates the concurrent first lookups of a namespace.
+	loads singleflight.Group
+
+	registry        registry.Registry
+	refreshInterval time.Duration
+	now             func() time.Time
+}
+
+// namespaceQuotasIdleTTL is the number of refresh intervals after which the state of a
+// namespace that isn't looked up anymore is evicted.
+const namespaceQuotasIdleTTL = 10
+
+type namespaceQuotaState struct {
+	// refreshedAt, usedAt and refreshing are protected by the namespaceQuotas' lock, the
+	// other fields by the state's own lock.
+	refreshedAt time.Time
+	usedAt      time.Time
+	refreshing  bool
+
+	sync.Mutex
+	quotas  registry.NamespaceQuotas
+	kvBytes int64
+	// limiter is nil if the namespace doesn't have an invocation rate quota.
+	limiter *tokenBucket
+
+	// rateLimits contains the namespace's rate limits, and the limiters below enforce
+	// them. The limiters are nil (or missing) for targets that aren't rate limited.
+	rateLimits       registry.NamespaceRateLimits
+	namespaceLimiter *tokenBucket
+	moduleLimiters   map[string]*tokenBucket
+	actorLimiters    map[string]*tokenBucket
+}
+
+func newNamespaceQuotas(
+	reg registry.Registry,
+	refreshInterval time.Duration,
+) *namespaceQuotas {
+	return &namespaceQuotas{
+		namespaces:      make(map[string]*namespaceQuotaState),
+		registry:        reg,
+		refreshInterval: refreshInterval,
+		now:             time.Now,
+	}
+}
+
+// checkInvocation returns an error that wraps the registry's quota exceeded error if
+// invoking an actor or worker in the namespace would exceed its invocation rate.
+func (n *namespaceQuotas) checkInvocation(ctx context.Context, namespace string) error {
+	if n == nil {
+		return nil
+	}
+	state, err := n.getState(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	state.Lock()
+	limiter, maxRate := state.limiter, state.quotas.MaxInvocationsPerSecond
+	state.Unlock()
+	if limiter == nil {
+		return nil
+	}
+	if retryAfter, ok := limiter.allow(n.now()); !ok {
+		return &RateLimitedError{
+			RetryAfter: retryAfter,
+			err:        registry.NewQuotaExceededErr(namespace, "max invocations per second: %v", maxRate),
+		}
+	}
+	return nil
+}
+
+// checkKVWrite returns an error that wraps the registry's quota exceeded error if the
+// namespace's actors already store MaxKVBytes or more. The check uses the cached usage,
+// so actors may exceed the quota by the amount they write until the usage is refreshed.
+func (n *namespaceQuotas) checkKVWrite(ctx context.Context, namespace string) error {
+	if n == nil {
+		return nil
+	}
+	state, err := n.getState(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	maxKVBytes := state.quotas.MaxKVBytes
+	if maxKVBytes > 0 && state.kvBytes >= maxKVBytes {
+		return registry.NewQuotaExceededErr(namespace, "max KV bytes: %d", maxKVBytes)
+	}
+	return nil
+}
+
+// getState returns the cached state of the namespace. The first lookup of a namespace
+// blocks until its state is loaded from the registry, later lookups return the cached
+// state immediately and refresh it in the background if it's stale.
+func (n *namespaceQuotas) getState(
+	ctx context.Context,
+	namespace string,
+) (*namespaceQuotaState, error) {
+	now := n.now()
+	n.Lock()
+	state, ok := n.namespaces[namespace]
+	if !ok {
+		state = &namespaceQuotaState{}
+		n.namespaces[namespace] = state
+	}
+	state.usedAt = now
+	loaded := !state.refreshedAt.IsZero()
+	stale := loaded && !state.refreshing && now.Sub(state.refreshedAt) >= n.refreshInterval
+	if stale {
+		state.refreshing = true
+	}
+	n.Unlock()
+
+	if !loaded {
+		_, err := doDetached(ctx, &n.loads, namespace, heartbeatTimeout, func(ctx context.Context) (any, error) {
+			return nil, n.refresh(ctx, namespace, state)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if stale {
+		go func() {
+			ctx, cc := context.WithTimeout(context.Background(), heartbeatTimeout)
+			defer cc()
+			if err := n.refresh(ctx, namespace, state); err != nil {
+				n.Lock()
+				// Try again on the next lookup.
+				state.refreshing = false
+				n.Unlock()
+			}
+		}()
+	}
+	return state, nil
+}
+
+// refresh loads the namespace's options and usage from the registry into state, and
+// evicts the namespaces that haven't been looked up for namespaceQuotasIdleTTL refresh
+// intervals.
+func (n *namespaceQuotas) refresh(
+	ctx context.Context,
+	namespace string,
+	state *namespaceQuotaState,
+) error {
+	var opts registry.NamespaceOptions
+	info, err := n.registry.GetNamespace(ctx, namespace)
+	if err == nil {
+		opts = info.Opts
+	} else if !registry.IsNamespaceDoesNotExistErr(err) {
+		return fmt.Errorf("error refreshing quotas of namespace: %s, err: %w", namespace, err)
+	}
+
+	quotas := opts.Quotas
+	var kvBytes int64
+	if quotas.MaxKVBytes > 0 {
+		usage, err := n.registry.GetNamespaceUsage(ctx, namespace)
+		if err != nil {
+			return fmt.Errorf("error refreshing usage of namespace: %s, err: %w", namespace, err)
+		}
+		kvBytes = usage.KVBytes
+	}
+
+	now := n.now()
+	state.Lock()
+	state.quotas = quotas
+	state.kvBytes = kvBytes
+	var invocationRate *registry.RateLimit
+	if quotas.MaxInvocationsPerSecond > 0 {
+		invocationRate = &registry.RateLimit{PerSecond: quotas.MaxInvocationsPerSecond}
+	}
+	state.limiter = syncTokenBucket(state.limiter, invocationRate, now)
+	state.refreshRateLimits(opts.RateLimits, now)
+	state.Unlock()
+
+	n.Lock()
+	defer n.Unlock()
+	state.refreshedAt = now
+	state.refreshing = false
+	for ns, s := range n.namespaces {
+		if !s.refreshing && now.Sub(s.usedAt) >= namespaceQuotasIdleTTL*n.refreshInterval {
+			delete(n.namespaces, ns)
+		}
+	}
+	return nil
+}
+
+// namespaceQuotasActorKVTransaction wraps an ActorKVTransaction and enforces the KV bytes
+// quota of the actor's namespace.
+type namespaceQuotasActorKVTransaction struct {
+	registry.ActorKVTransaction
+	quotas    *namespaceQuotas
+	namespace string
+}
+
+func (n namespaceQuotasActorKVTransaction) Put(ctx context.Context, key []byte, value []byte) error {
+	if err := n.quotas.checkKVWrite(ctx, n.namespace); err != nil {
+		return err
+	}
+	return n.ActorKVTransaction.Put(ctx, key, value)
+}
+
+func (n namespaceQuotasActorKVTransaction) JoinActors(
+	ctx context.Context,
+	participants []registry.TransactionParticipant,
+) (registry.MultiActorKV, error) {
+	kv, err := n.ActorKVTransaction.JoinActors(ctx, participants)
+	if err != nil {
+		return nil, err
+	}
+	return namespaceQuotasMultiActorKV{MultiActorKV: kv, quotas: n.quotas, namespace: n.namespace}, nil
+}
+
+// namespaceQuotasMultiActorKV is the same as namespaceQuotasActorKVTransaction, except
+// for the KV storage of the participants of a transaction.
+type namespaceQuotasMultiActorKV struct {
+	registry.MultiActorKV
+	quotas    *namespaceQuotas
+	namespace string
+}
+
+func (n namespaceQuotasMultiActorKV) Put(
+	ctx context.Context,
+	actorID string,
+	key []byte,
+	value []byte,
+) error {
+	if err := n.quotas.checkKVWrite(ctx, n.namespace); err != nil {
+		return err
+	}
+	return n.MultiActorKV.Put(ctx, actorID, key, value)
+}
@@ -0,0 +1,260 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+)
+
+// RateLimitedError is returned when an invocation is rejected by a rate limit (or by the
+// invocation rate quota of a namespace). The server returns it to HTTP clients as a 429
+// with a Retry-After header.
+type RateLimitedError struct {
+	// RetryAfter is how long the caller should wait before retrying the invocation.
+	RetryAfter time.Duration
+	err        error
+}
+
+func (r *RateLimitedError) Error() string {
+	return fmt.Sprintf("%s, retry after: %s", r.err, r.RetryAfter)
+}
+
+func (r *RateLimitedError) Unwrap() error {
+	return r.err
+}
+
+// IsRateLimitedErr returns whether the error is an instance of (or wraps) a
+// RateLimitedError and, if so, how long the caller should wait before retrying.
+func IsRateLimitedErr(err error) (time.Duration, bool) {
+	var rateLimitedErr *RateLimitedError
+	if !errors.As(err, &rateLimitedErr) {
+		return 0, false
+	}
+	return rateLimitedErr.RetryAfter, true
+}
+
+// checkRateLimits returns a RateLimitedError if invoking the actor would exceed any of
+// the rate limits of its namespace. actorID is empty for workers, which are only subject
+// to the namespace and module limits.
+func (n *namespaceQuotas) checkRateLimits(
+	ctx context.Context,
+	namespace string,
+	moduleID string,
+	actorID string,
+) error {
+	if n == nil {
+		return nil
+	}
+	state, err := n.getState(ctx, namespace)
+	if err != nil {
+		return err
+	}
+
+	type namedLimiter struct {
+		name    string
+		limiter *tokenBucket
+	}
+	var limiters []namedLimiter
+	state.Lock()
+	if actorID != "" {
+		if limiter := state.actorLimiter(actorID, n.now()); limiter != nil {
+			limiters = append(limiters, namedLimiter{fmt.Sprintf("actor: %s", actorID), limiter})
+		}
+	}
+	if limiter, ok := state.moduleLimiters[moduleID]; ok {
+		limiters = append(limiters, namedLimiter{fmt.Sprintf("module: %s", moduleID), limiter})
+	}
+	if state.namespaceLimiter != nil {
+		limiters = append(limiters, namedLimiter{"namespace", state.namespaceLimiter})
+	}
+	state.Unlock()
+
+	now := n.now()
+	for i, l := range limiters {
+		retryAfter, ok := l.limiter.allow(now)
+		if ok {
+			continue
+		}
+		// Return the tokens that were taken from the previous limiters since the
+		// invocation won't be performed.
+		for _, prev := range limiters[:i] {
+			prev.limiter.refund()
+		}
+		return &RateLimitedError{
+			RetryAfter: retryAfter,
+			err: fmt.Errorf(
+				"rate limit exceeded for %s in namespace: %s", l.name, namespace),
+		}
+	}
+	return nil
+}
+
+// actorLimiter returns the limiter for the actor, creating it if necessary, or nil if
+// the actor isn't rate limited. The caller must hold the state's lock.
+func (s *namespaceQuotaState) actorLimiter(actorID string, now time.Time) *tokenBucket {
+	if limiter, ok := s.actorLimiters[actorID]; ok {
+		return limiter
+	}
+	limit, ok := s.rateLimits.Actors[actorID]
+	if !ok {
+		if s.rateLimits.DefaultActor == nil {
+			return nil
+		}
+		limit = *s.rateLimits.DefaultActor
+	}
+	if s.actorLimiters == nil {
+		s.actorLimiters = make(map[string]*tokenBucket)
+	}
+	limiter := newRateLimitTokenBucket(limit, now)
+	s.actorLimiters[actorID] = limiter
+	return limiter
+}
+
+// refreshRateLimits updates the state's limiters to match the provided rate limits. The
+// caller must hold the state's lock.
+func (s *namespaceQuotaState) refreshRateLimits(
+	rateLimits registry.NamespaceRateLimits,
+	now time.Time,
+) {
+	s.rateLimits = rateLimits
+	s.namespaceLimiter = syncTokenBucket(s.namespaceLimiter, rateLimits.Namespace, now)
+
+	moduleLimiters := make(map[string]*tokenBucket, len(rateLimits.Modules))
+	for moduleID, limit := range rateLimits.Modules {
+		limit := limit
+		moduleLimiters[moduleID] = syncTokenBucket(s.moduleLimiters[moduleID], &limit, now)
+	}
+	s.moduleLimiters = moduleLimiters
+
+	for actorID, limiter := range s.actorLimiters {
+		// Full buckets are indistinguishable from new ones, so they're dropped to avoid
+		// keeping a limiter around for every actor that was ever invoked.
+		limit, ok := rateLimits.Actors[actorID]
+		if !ok && rateLimits.DefaultActor != nil {
+			limit, ok = *rateLimits.DefaultActor, true
+		}
+		if !ok || limiter.full(now) {
+			delete(s.actorLimiters, actorID)
+			continue
+		}
+		syncTokenBucket(limiter, &limit, now)
+	}
+}
+
+// syncTokenBucket returns a token bucket for the rate limit, reusing the existing one
+// (if any) so that its tokens aren't reset. It returns nil if limit is nil.
+func syncTokenBucket(existing *tokenBucket, limit *registry.RateLimit, now time.Time) *tokenBucket {
+	if limit == nil {
+		return nil
+	}
+	if existing == nil {
+		return newRateLimitTokenBucket(*limit, now)
+	}
+	existing.setRate(limit.PerSecond, rateLimitBurst(*limit), now)
+	return existing
+}
+
+func newRateLimitTokenBucket(limit registry.RateLimit, now time.Time) *tokenBucket {
+	return newTokenBucket(limit.PerSecond, rateLimitBurst(limit), now)
+}
+
+func rateLimitBurst(limit registry.RateLimit) float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return invocationBurst(limit.PerSecond)
+}
+
+// invocationBurst returns the number of invocations that can be performed in a burst
+// for the provided rate, which is one second worth of invocations.
+func invocationBurst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// tokenBucket is a token bucket rate limiter. It's safe for concurrent use.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64 // Tokens per second.
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a token bucket that allows rate events per second with bursts
+// of up to burst events. The bucket starts full.
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// allow consumes a token and returns true if an event is allowed at time now. Otherwise
+// it returns how long it will take for the next token to become available.
+func (b *tokenBucket) allow(now time.Time) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	if b.tokens < 1 {
+		seconds := (1 - b.tokens) / b.rate
+		return time.Duration(math.Ceil(seconds * float64(time.Second))), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// refund returns a token that was consumed by allow.
+func (b *tokenBucket) refund() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// full returns whether the bucket is full at time now.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// setRate changes the rate and burst of the bucket without resetting its tokens.
+func (b *tokenBucket) setRate(rate, burst float64, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.last = now
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
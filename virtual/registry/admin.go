@@ -0,0 +1,664 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+const (
+	// maxIndexKeysPerTransaction is the maximum number of keys that building the indexes
+	// of a namespace will scan in a single transaction.
+	maxIndexKeysPerTransaction = 1000
+	// namespaceIndexesBuildTimeout is the maximum amount of time that building the indexes
+	// of a namespace in the background can take before it's abandoned.
+	namespaceIndexesBuildTimeout = time.Hour
+)
+
+// errNamespaceIndexesNotBuilt is returned by requests that require the indexes of a
+// namespace while they're being built.
+var errNamespaceIndexesNotBuilt = errors.New("namespace indexes are still being built")
+
+func (k *kvRegistry) ListModules(
+	ctx context.Context,
+	namespace string,
+) ([]string, error) {
+	moduleIDs, err := k.kv.transact(func(tr transaction) (any, error) {
+		var (
+			prefix    = getModulesPrefix(namespace)
+			moduleIDs = []string{}
+		)
+		err := tr.iterPrefix(ctx, prefix, func(key, v []byte) error {
+			suffix, err := tuple.Unpack(key[len(prefix):])
+			if err != nil {
+				return fmt.Errorf("error unpacking module key: %w", err)
+			}
+			if len(suffix) != 2 {
+				return nil
+			}
+			// Modules stored by older versions are split into parts, list each module
+			// once.
+			if suffix[1] != "ref" && suffix[1] != int64(0) {
+				return nil
+			}
+			moduleID, ok := suffix[0].(string)
+			if !ok {
+				return fmt.Errorf("unexpected module key: %v", suffix)
+			}
+			if len(moduleIDs) > 0 && moduleIDs[len(moduleIDs)-1] == moduleID {
+				return nil
+			}
+			moduleIDs = append(moduleIDs, moduleID)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return moduleIDs, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListModules: error: %w", err)
+	}
+	return moduleIDs.([]string), nil
+}
+
+func (k *kvRegistry) DeleteModule(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+) error {
+	var chunkIDs []string
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		ok, err := moduleExists(ctx, tr, namespace, moduleID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf(
+				"error deleting module: %s, does not exist in namespace: %s",
+				moduleID, namespace)
+		}
+
+		numActors, err := getCounter(ctx, tr, getModuleActorCountKey(namespace, moduleID))
+		if err != nil {
+			return nil, err
+		}
+		if numActors > 0 {
+			return nil, fmt.Errorf(
+				"error deleting module: %s in namespace: %s, it is used by %d actors",
+				moduleID, namespace, numActors)
+		}
+
+		// Delete the keys that moduleExists checks in the same transaction so that actors
+		// can't be created from the module once it has been checked.
+		chunkIDs, err = deleteModuleRef(ctx, tr, namespace, moduleID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, tr.delete(ctx, getModulePartKey(namespace, moduleID, 0))
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteModule: error: %w", err)
+	}
+
+	if err := releaseModuleChunks(ctx, k.kv, chunkIDs); err != nil {
+		return fmt.Errorf(
+			"DeleteModule: error deleting module: %s in namespace: %s, err: %w",
+			moduleID, namespace, err)
+	}
+	// Delete the rest of the module's parts, for modules that were stored by older
+	// versions.
+	if err := k.deletePrefix(ctx, getModulePrefix(namespace, moduleID)); err != nil {
+		return fmt.Errorf(
+			"DeleteModule: error deleting module: %s in namespace: %s, err: %w",
+			moduleID, namespace, err)
+	}
+	return nil
+}
+
+// deleteModuleRef deletes the module's reference (if it has one) within tr and releases
+// its reference to the module's blob. It returns the IDs of the chunks that must be
+// released once tr commits, see releaseModuleBlob.
+func deleteModuleRef(
+	ctx context.Context,
+	tr transaction,
+	namespace,
+	moduleID string,
+) ([]string, error) {
+	refKey := getModuleRefKey(namespace, moduleID)
+	v, ok, err := tr.get(ctx, refKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var ref moduleRef
+	if err := json.Unmarshal(v, &ref); err != nil {
+		return nil, fmt.Errorf("error unmarshaling module: %w", err)
+	}
+	if err := tr.delete(ctx, refKey); err != nil {
+		return nil, err
+	}
+	return releaseModuleBlob(ctx, tr, ref.Hash)
+}
+
+func (k *kvRegistry) ListActors(
+	ctx context.Context,
+	namespace string,
+	after string,
+	limit int,
+) ([]string, error) {
+	actorIDs, err := k.kv.transact(func(tr transaction) (any, error) {
+		return k.listActorIDs(ctx, tr, namespace, after, limit)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListActors: error: %w", err)
+	}
+	return actorIDs.([]string), nil
+}
+
+func (k *kvRegistry) DeleteActor(
+	ctx context.Context,
+	namespace,
+	actorID string,
+) error {
+	// Delete the actor's record first so that it can't be activated or used anymore, then
+	// the rest of its data in batches.
+	existed, err := k.kv.transact(func(tr transaction) (any, error) {
+		actorKey := getActorKey(namespace, actorID)
+		ra, ok, err := k.getActor(ctx, tr, actorKey)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return false, nil
+		}
+
+		if err := tr.delete(ctx, actorKey); err != nil {
+			return nil, err
+		}
+		if err := addToCounter(ctx, tr, getNamespaceActorCountKey(namespace), -1); err != nil {
+			return nil, err
+		}
+		if err := addToCounter(ctx, tr, getModuleActorCountKey(namespace, ra.ModuleID), -1); err != nil {
+			return nil, err
+		}
+		kvBytes, err := getAtomicCounter(ctx, tr, getActorKVBytesKey(namespace, actorID))
+		if err != nil {
+			return nil, err
+		}
+		if err := addToActorKVBytes(ctx, tr, namespace, actorID, -kvBytes); err != nil {
+			return nil, err
+		}
+		if err := tr.delete(ctx, getActorKVBytesKey(namespace, actorID)); err != nil {
+			return nil, err
+		}
+		if err := deletePendingInbox(ctx, tr, namespace, actorID); err != nil {
+			return nil, err
+		}
+
+		if err := tr.delete(ctx, getActorIndexKey(namespace, actorID)); err != nil {
+			return nil, err
+		}
+
+		topics, err := k.getActorTopics(ctx, tr, namespace, actorID)
+		if err != nil {
+			return nil, err
+		}
+		for _, topic := range topics {
+			if err := tr.delete(ctx, getTopicSubscriptionKey(namespace, topic, actorID)); err != nil {
+				return nil, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteActor: error deleting actor: %s, err: %w", actorID, err)
+	}
+
+	// Delete the rest of the actor's data even if its record doesn't exist so that
+	// retrying a delete that failed part way through cleans up after it.
+	if err := k.deletePrefix(ctx, getActorPrefix(namespace, actorID)); err != nil {
+		return fmt.Errorf("DeleteActor: error deleting actor: %s, err: %w", actorID, err)
+	}
+	if !existed.(bool) {
+		return fmt.Errorf(
+			"DeleteActor: error deleting actor with ID: %s, does not exist in namespace: %s, err: %w",
+			actorID, namespace, errActorDoesNotExist)
+	}
+	return nil
+}
+
+// getActorTopics returns the topics the actor is subscribed to. The actor's entries in
+// the subscription index are stored in its prefix so they're deleted along with the rest
+// of its data.
+func (k *kvRegistry) getActorTopics(
+	ctx context.Context,
+	tr transaction,
+	namespace,
+	actorID string,
+) ([]string, error) {
+	built, err := k.namespaceIndexesBuilt(ctx, tr, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !built {
+		// Fall back to scanning the namespace's subscriptions, which are usually much
+		// fewer than its actors, until the index is built.
+		return getLegacyActorTopics(ctx, tr, namespace, actorID)
+	}
+
+	var (
+		subscriptionsPrefix = getActorSubscriptionsPrefix(namespace, actorID)
+		topics              []string
+	)
+	err = tr.iterPrefix(ctx, subscriptionsPrefix, func(key, v []byte) error {
+		suffix, err := tuple.Unpack(key[len(subscriptionsPrefix):])
+		if err != nil {
+			return fmt.Errorf("error unpacking actor subscription key: %w", err)
+		}
+		topic, ok := suffix[0].(string)
+		if len(suffix) != 1 || !ok {
+			return fmt.Errorf("unexpected actor subscription key: %v", suffix)
+		}
+		topics = append(topics, topic)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// getLegacyActorTopics returns the topics the actor is subscribed to by scanning all the
+// subscriptions in the namespace.
+func getLegacyActorTopics(
+	ctx context.Context,
+	tr transaction,
+	namespace,
+	actorID string,
+) ([]string, error) {
+	var (
+		topicsPrefix = getTopicsPrefix(namespace)
+		topics       []string
+	)
+	err := tr.iterPrefix(ctx, topicsPrefix, func(key, v []byte) error {
+		suffix, err := tuple.Unpack(key[len(topicsPrefix):])
+		if err != nil {
+			return fmt.Errorf("error unpacking topic key: %w", err)
+		}
+		if len(suffix) == 3 && suffix[1] == "subscriptions" && suffix[2] == actorID {
+			topic, ok := suffix[0].(string)
+			if !ok {
+				return fmt.Errorf("unexpected topic key: %v", suffix)
+			}
+			topics = append(topics, topic)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+func (k *kvRegistry) GetActorKV(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	key []byte,
+) ([]byte, bool, error) {
+	var (
+		value []byte
+		ok    bool
+	)
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		if err := k.ensureActorExists(ctx, tr, namespace, actorID); err != nil {
+			return nil, err
+		}
+		var err error
+		value, ok, err = tr.get(ctx, getActoKVKey(namespace, actorID, key))
+		return nil, err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("GetActorKV: error: %w", err)
+	}
+	return value, ok, nil
+}
+
+func (k *kvRegistry) PutActorKV(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	key []byte,
+	value []byte,
+) error {
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		if err := k.ensureActorExists(ctx, tr, namespace, actorID); err != nil {
+			return nil, err
+		}
+		return nil, putActorKV(ctx, tr, namespace, actorID, key, value)
+	})
+	if err != nil {
+		return fmt.Errorf("PutActorKV: error: %w", err)
+	}
+	return nil
+}
+
+func (k *kvRegistry) ScanActorKV(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	prefix []byte,
+	limit int,
+) ([]ActorKV, error) {
+	kvs, err := k.kv.transact(func(tr transaction) (any, error) {
+		if err := k.ensureActorExists(ctx, tr, namespace, actorID); err != nil {
+			return nil, err
+		}
+
+		var (
+			kvPrefix = getActorKVPrefix(namespace, actorID)
+			// Keys are packed as tuple elements, which are terminated by a zero byte and
+			// otherwise preserve prefixes, so dropping the terminator of the packed prefix
+			// matches every key that starts with it.
+			scanPrefix = getActoKVKey(namespace, actorID, prefix)
+			kvs        = []ActorKV{}
+		)
+		scanPrefix = scanPrefix[:len(scanPrefix)-1]
+		err := tr.iterPrefix(ctx, scanPrefix, func(key, v []byte) error {
+			if len(kvs) >= limit {
+				return errStopIteration
+			}
+			suffix, err := tuple.Unpack(key[len(kvPrefix):])
+			if err != nil {
+				return fmt.Errorf("error unpacking actor KV key: %w", err)
+			}
+			if len(suffix) != 1 {
+				return fmt.Errorf("unexpected actor KV key: %v", suffix)
+			}
+			actorKey, ok := suffix[0].([]byte)
+			if !ok {
+				return fmt.Errorf("unexpected actor KV key: %v", suffix)
+			}
+			kvs = append(kvs, ActorKV{Key: actorKey, Value: append([]byte(nil), v...)})
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return nil, err
+		}
+		return kvs, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ScanActorKV: error: %w", err)
+	}
+	return kvs.([]ActorKV), nil
+}
+
+// ensureActorExists returns an error that wraps errActorDoesNotExist if the actor does
+// not exist.
+func (k *kvRegistry) ensureActorExists(
+	ctx context.Context,
+	tr transaction,
+	namespace,
+	actorID string,
+) error {
+	_, ok, err := k.getActorBytes(ctx, tr, getActorKey(namespace, actorID))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf(
+			"actor with ID: %s does not exist in namespace: %s, err: %w",
+			actorID, namespace, errActorDoesNotExist)
+	}
+	return nil
+}
+
+// listActorIDs returns up to limit IDs of the actors in the namespace whose IDs are
+// greater than after, ordered by ID.
+func (k *kvRegistry) listActorIDs(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	after string,
+	limit int,
+) ([]string, error) {
+	built, err := k.namespaceIndexesBuilt(ctx, tr, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if !built {
+		return nil, fmt.Errorf(
+			"%w, namespace: %s, try again later", errNamespaceIndexesNotBuilt, namespace)
+	}
+
+	var (
+		indexPrefix = getActorIndexPrefix(namespace)
+		start       = indexPrefix
+		actorIDs    = []string{}
+	)
+	if after != "" {
+		// Appending a zero byte yields the smallest key that is greater than after's.
+		start = append(getActorIndexKey(namespace, after), 0x00)
+	}
+	err = tr.iterRange(ctx, start, prefixEnd(indexPrefix), func(key, v []byte) error {
+		if len(actorIDs) >= limit {
+			return errStopIteration
+		}
+		suffix, err := tuple.Unpack(key[len(indexPrefix):])
+		if err != nil {
+			return fmt.Errorf("error unpacking actor index key: %w", err)
+		}
+		actorID, ok := suffix[0].(string)
+		if len(suffix) != 1 || !ok {
+			return fmt.Errorf("unexpected actor index key: %v", suffix)
+		}
+		actorIDs = append(actorIDs, actorID)
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+	return actorIDs, nil
+}
+
+// namespaceIndexesBuilt returns whether the namespace's actor index and the index of the
+// topics each actor is subscribed to have been built. Actors and subscriptions are added
+// to the indexes when they're created, and the indexes of new namespaces are marked as
+// built when they're created (see markNewNamespaceIndexed), but the existing actors and
+// subscriptions of namespaces that were created by older versions have to be indexed
+// once. If the indexes haven't been built yet, they're built in the background.
+func (k *kvRegistry) namespaceIndexesBuilt(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+) (bool, error) {
+	_, ok, err := tr.get(ctx, getNamespaceIndexesBuiltKey(namespace))
+	if err != nil || ok {
+		return ok, err
+	}
+	// Namespaces that don't exist have nothing to index.
+	empty, err := isNamespaceEmpty(ctx, tr, namespace)
+	if err != nil || empty {
+		return empty, err
+	}
+	k.buildNamespaceIndexesInBackground(namespace)
+	return false, nil
+}
+
+// buildNamespaceIndexesInBackground builds the namespace's indexes in the background
+// unless they're already being built. Errors are dropped since the build is started again
+// by the next request that needs the indexes.
+func (k *kvRegistry) buildNamespaceIndexesInBackground(namespace string) {
+	if k.ctx.Err() != nil {
+		// The registry is closed.
+		return
+	}
+	k.indexBuildsWG.Add(1)
+	go func() {
+		defer k.indexBuildsWG.Done()
+		k.indexBuilds.Do(namespace, func() (any, error) {
+			ctx, cc := context.WithTimeout(k.ctx, namespaceIndexesBuildTimeout)
+			defer cc()
+			return nil, k.buildNamespaceIndexes(ctx, namespace)
+		})
+	}()
+}
+
+// buildNamespaceIndexes indexes the existing actors and subscriptions of the namespace in
+// batches of maxIndexKeysPerTransaction scanned keys, then marks its indexes as built.
+// Actors and subscriptions that are created or deleted concurrently are indexed by the
+// transactions that create and delete them, so they don't have to be locked out.
+func (k *kvRegistry) buildNamespaceIndexes(ctx context.Context, namespace string) error {
+	for _, prefix := range [][]byte{getActorsPrefix(namespace), getTopicsPrefix(namespace)} {
+		start := prefix
+		for start != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			next, err := k.kv.transact(func(tr transaction) (any, error) {
+				return indexNamespaceKeys(ctx, tr, namespace, start, prefixEnd(prefix))
+			})
+			if err != nil {
+				return fmt.Errorf("error building indexes of namespace: %s, err: %w", namespace, err)
+			}
+			start = next.([]byte)
+		}
+	}
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		return nil, tr.put(ctx, getNamespaceIndexesBuiltKey(namespace), []byte{})
+	})
+	return err
+}
+
+// indexNamespaceKeys adds the index entries of the actors and subscriptions stored in up
+// to maxIndexKeysPerTransaction keys in [start, end). It returns the key to continue at, or
+// nil if every key in the range was scanned.
+func indexNamespaceKeys(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	start, end []byte,
+) ([]byte, error) {
+	var (
+		actorsPrefix = getActorsPrefix(namespace)
+		topicsPrefix = getTopicsPrefix(namespace)
+		indexKeys    [][]byte
+		scanned      int
+		next         []byte
+	)
+	err := tr.iterRange(ctx, start, end, func(key, v []byte) error {
+		if scanned >= maxIndexKeysPerTransaction {
+			next = append([]byte(nil), key...)
+			return errStopIteration
+		}
+		scanned++
+
+		switch {
+		case bytes.HasPrefix(key, actorsPrefix):
+			suffix, err := tuple.Unpack(key[len(actorsPrefix):])
+			if err != nil {
+				return fmt.Errorf("error unpacking actor key: %w", err)
+			}
+			if len(suffix) == 2 && suffix[1] == "state" {
+				actorID, ok := suffix[0].(string)
+				if !ok {
+					return fmt.Errorf("unexpected actor key: %v", suffix)
+				}
+				indexKeys = append(indexKeys, getActorIndexKey(namespace, actorID))
+			}
+		case bytes.HasPrefix(key, topicsPrefix):
+			suffix, err := tuple.Unpack(key[len(topicsPrefix):])
+			if err != nil {
+				return fmt.Errorf("error unpacking topic key: %w", err)
+			}
+			if len(suffix) == 3 && suffix[1] == "subscriptions" {
+				topic, ok1 := suffix[0].(string)
+				actorID, ok2 := suffix[2].(string)
+				if !ok1 || !ok2 {
+					return fmt.Errorf("unexpected topic key: %v", suffix)
+				}
+				indexKeys = append(indexKeys, getActorSubscriptionKey(namespace, actorID, topic))
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+
+	for _, key := range indexKeys {
+		if err := tr.put(ctx, key, []byte{}); err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+// markNewNamespaceIndexed marks the indexes of a namespace that is being created as built,
+// unless it already has actors or subscriptions. They can only exist if they were created
+// by older versions, which didn't create namespaces explicitly, and have to be indexed.
+func markNewNamespaceIndexed(ctx context.Context, tr transaction, namespace string) error {
+	empty, err := isNamespaceEmpty(ctx, tr, namespace)
+	if err != nil || !empty {
+		return err
+	}
+	return tr.put(ctx, getNamespaceIndexesBuiltKey(namespace), []byte{})
+}
+
+// isNamespaceEmpty returns whether the namespace has no actors and no subscriptions.
+func isNamespaceEmpty(ctx context.Context, tr transaction, namespace string) (bool, error) {
+	for _, prefix := range [][]byte{getActorsPrefix(namespace), getTopicsPrefix(namespace)} {
+		empty := true
+		err := tr.iterPrefix(ctx, prefix, func(k, v []byte) error {
+			empty = false
+			return errStopIteration
+		})
+		if err != nil && err != errStopIteration {
+			return false, err
+		}
+		if !empty {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func getNamespaceIndexesBuiltKey(namespace string) []byte {
+	return tuple.Tuple{namespace, "indexes_built"}.Pack()
+}
+
+func getActorIndexKey(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actor_index", actorID}.Pack()
+}
+
+func getActorIndexPrefix(namespace string) []byte {
+	return tuple.Tuple{namespace, "actor_index"}.Pack()
+}
+
+// getActorSubscriptionKey returns the key of the actor's entry in the index of the topics
+// each actor is subscribed to. It's stored in the actor's prefix so that it's deleted
+// along with the rest of the actor's data.
+func getActorSubscriptionKey(namespace, actorID, topic string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "subscriptions", topic}.Pack()
+}
+
+func getActorSubscriptionsPrefix(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "subscriptions"}.Pack()
+}
+
+func getModulePrefix(namespace, moduleID string) []byte {
+	return tuple.Tuple{namespace, "modules", moduleID}.Pack()
+}
+
+func getActorPrefix(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID}.Pack()
+}
+
+func getTopicsPrefix(namespace string) []byte {
+	return tuple.Tuple{namespace, "topics"}.Pack()
+}
@@ -1,9 +1,21 @@
 package registry
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/richardartoul/nola/virtual/types"
@@ -13,6 +25,17 @@ import (
 
 // TODO: Add some concurrency tests.
 
+// testModuleBytes is a valid WAPC module that can be registered in tests.
+var testModuleBytes []byte
+
+func init() {
+	moduleBytes, err := ioutil.ReadFile("../../testdata/tinygo/util/main.wasm")
+	if err != nil {
+		panic(err)
+	}
+	testModuleBytes = moduleBytes
+}
+
 func testAllCommon(t *testing.T, registryCtor func() Registry) {
 	t.Run("simple", func(t *testing.T) {
 		testRegistrySimple(t, registryCtor())
@@ -25,6 +48,46 @@ func testAllCommon(t *testing.T, registryCtor func() Registry) {
 	t.Run("kv simple", func(t *testing.T) {
 		testKVSimple(t, registryCtor())
 	})
+
+	t.Run("topics", func(t *testing.T) {
+		testTopics(t, registryCtor())
+	})
+
+	t.Run("inbox", func(t *testing.T) {
+		testInbox(t, registryCtor())
+	})
+
+	t.Run("multi actor transactions", func(t *testing.T) {
+		testMultiActorTransactions(t, registryCtor())
+	})
+
+	t.Run("invocation results", func(t *testing.T) {
+		testInvocationResults(t, registryCtor())
+	})
+
+	t.Run("watch actor kv", func(t *testing.T) {
+		testWatchActorKV(t, registryCtor())
+	})
+
+	t.Run("export and import", func(t *testing.T) {
+		testExportImport(t, registryCtor())
+	})
+
+	t.Run("modules", func(t *testing.T) {
+		testModules(t, registryCtor())
+	})
+
+	t.Run("module validation", func(t *testing.T) {
+		testModuleValidation(t, registryCtor())
+	})
+
+	t.Run("namespaces", func(t *testing.T) {
+		testNamespaces(t, registryCtor())
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		testAdmin(t, registryCtor())
+	})
 }
 
 // testRegistrySimple is a basic smoke test that ensures we can register modules and create actors.
@@ -32,15 +95,15 @@ func testRegistrySimple(t *testing.T, registry Registry) {
 	ctx := context.Background()
 
 	// Create module.
-	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
 	require.NoError(t, err)
 
 	// Subsequent module for same namespace should fail.
-	_, err = registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	_, err = registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
 	require.Error(t, err)
 
 	// Succeeds with same module if different namespace.
-	_, err = registry.RegisterModule(ctx, "ns2", "test-module", []byte("wasm"), ModuleOptions{})
+	_, err = registry.RegisterModule(ctx, "ns2", "test-module", testModuleBytes, ModuleOptions{})
 	require.NoError(t, err)
 
 	// Create actor fails for unknown module.
@@ -70,7 +133,7 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	ctx := context.Background()
 
 	// Create module and actor to experiment with.
-	_, err := registry.RegisterModule(ctx, "ns1", "test-module", []byte("wasm"), ModuleOptions{})
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
 	require.NoError(t, err)
 
 	// Should fail because the actor does not exist.
@@ -122,6 +185,22 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	require.Equal(t, "a", activations[0].ActorID().ID)
 	require.Equal(t, uint64(2), activations[0].Generation())
 
+	// Ensure the actor's registry record reflects its current activation.
+	info, err := registry.DescribeActor(ctx, "ns1", "a")
+	require.NoError(t, err)
+	require.Equal(t, "ns1", info.Namespace)
+	require.Equal(t, "a", info.ActorID)
+	require.Equal(t, "test-module", info.ModuleID)
+	require.Equal(t, uint64(2), info.Generation)
+	require.NotNil(t, info.Activation)
+	require.Equal(t, "server1", info.Activation.ServerID)
+	require.Equal(t, "server1_address", info.Activation.ServerAddress)
+	require.Equal(t, int64(0), info.KVBytes)
+
+	_, err = registry.DescribeActor(ctx, "ns1", "does-not-exist")
+	require.Error(t, err)
+	require.True(t, IsActorDoesNotExistErr(err))
+
 	// Add another server, this one with no existing activations.
 	newHeartbeatResult, err := registry.Heartbeat(ctx, "server2", HeartbeatState{
 		NumActivatedActors: 0,
@@ -131,6 +210,15 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	require.True(t, newHeartbeatResult.VersionStamp > heartbeatResult.VersionStamp)
 	require.Equal(t, newHeartbeatResult.HeartbeatTTL, heartbeatResult.HeartbeatTTL)
 
+	servers, err := registry.ListServers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(servers))
+	require.Equal(t, "server1", servers[0].ServerID)
+	require.Equal(t, "server1_address", servers[0].HeartbeatState.Address)
+	require.Equal(t, 10, servers[0].HeartbeatState.NumActivatedActors)
+	require.Equal(t, "server2", servers[1].ServerID)
+	require.Equal(t, "server2_address", servers[1].HeartbeatState.Address)
+
 	// Keep checking the activation of the existing actor, it should remain sticky to
 	// server 1.
 	for i := 0; i < 10; i++ {
@@ -203,6 +291,16 @@ func testRegistryServiceDiscoveryAndEnsureActivation(t *testing.T, registry Regi
 	})
 	require.NoError(t, err)
 
+	servers, err = registry.ListServers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(servers))
+	require.Equal(t, "server2", servers[0].ServerID)
+
+	// server1 is dead so the actor is no longer considered activated anywhere.
+	info, err = registry.DescribeActor(ctx, "ns1", "a")
+	require.NoError(t, err)
+	require.Nil(t, info.Activation)
+
 	// Even though server2's NumActivatedActors value is very high, all activations will go to
 	// server2 because its the only one available.
 	for i := 0; i < 10; i++ {
@@ -226,7 +324,7 @@ func testKVSimple(t *testing.T, registry Registry) {
 		require.Error(t, err)
 
 		// Create the module/actor.
-		_, err = registry.RegisterModule(ctx, ns, "test-module", []byte("wasm"), ModuleOptions{})
+		_, err = registry.RegisterModule(ctx, ns, "test-module", testModuleBytes, ModuleOptions{})
 		require.NoError(t, err)
 
 		for actorIdx, actor := range []string{"1", "2", "3", "4", "5"} {
@@ -314,3 +412,1110 @@ func testKVSimple(t *testing.T, registry Registry) {
 		}
 	}
 }
+
+// testTopics tests that actors can subscribe and unsubscribe from topics, and that
+// subscriptions are namespaced.
+func testTopics(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	// Can't subscribe an actor that doesn't exist.
+	err := registry.Subscribe(ctx, "ns1", "topic1", "a", "onMessage")
+	require.Error(t, err)
+	require.True(t, IsActorDoesNotExistErr(err))
+
+	_, err = registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b"} {
+		_, err = registry.CreateActor(ctx, "ns1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+
+	subs, err := registry.GetSubscriptions(ctx, "ns1", "topic1")
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	require.NoError(t, registry.Subscribe(ctx, "ns1", "topic1", "b", "onMessage"))
+	require.NoError(t, registry.Subscribe(ctx, "ns1", "topic1", "a", "onMessage"))
+	// Resubscribing replaces the existing subscription.
+	require.NoError(t, registry.Subscribe(ctx, "ns1", "topic1", "a", "onOtherMessage"))
+	// Topics with a shared prefix should not be confused with each other.
+	require.NoError(t, registry.Subscribe(ctx, "ns1", "topic11", "a", "onMessage"))
+
+	subs, err = registry.GetSubscriptions(ctx, "ns1", "topic1")
+	require.NoError(t, err)
+	require.Equal(t, []TopicSubscription{
+		{ActorID: "a", Operation: "onOtherMessage"},
+		{ActorID: "b", Operation: "onMessage"},
+	}, subs)
+
+	// Subscriptions are namespaced.
+	subs, err = registry.GetSubscriptions(ctx, "ns2", "topic1")
+	require.NoError(t, err)
+	require.Empty(t, subs)
+
+	require.NoError(t, registry.Unsubscribe(ctx, "ns1", "topic1", "a"))
+	// Unsubscribing twice is a no-op.
+	require.NoError(t, registry.Unsubscribe(ctx, "ns1", "topic1", "a"))
+
+	subs, err = registry.GetSubscriptions(ctx, "ns1", "topic1")
+	require.NoError(t, err)
+	require.Equal(t, []TopicSubscription{{ActorID: "b", Operation: "onMessage"}}, subs)
+
+	subs, err = registry.GetSubscriptions(ctx, "ns1", "topic11")
+	require.NoError(t, err)
+	require.Equal(t, []TopicSubscription{{ActorID: "a", Operation: "onMessage"}}, subs)
+}
+
+func testInbox(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b"} {
+		_, err = registry.CreateActor(ctx, "ns1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		NumActivatedActors: 0,
+		Address:            "server1_address",
+	})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b"} {
+		_, err = registry.EnsureActivation(ctx, "ns1", actor)
+		require.NoError(t, err)
+	}
+
+	pending, err := registry.ListActorsWithPendingMessages(ctx, "server1", 10)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	// Send messages from a to b.
+	tr, err := registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	// Can't send messages to actors that don't exist.
+	err = tr.EnqueueMessage(ctx, "c", InboxMessage{ID: "0", Operation: "op"})
+	require.Error(t, err)
+	require.True(t, IsActorDoesNotExistErr(err))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, tr.EnqueueMessage(ctx, "b", InboxMessage{
+			ID:        fmt.Sprintf("%d", i),
+			Operation: "op",
+			Payload:   []byte(fmt.Sprintf("payload-%d", i)),
+		}))
+	}
+	// Messages with duplicate IDs are ignored.
+	require.NoError(t, tr.EnqueueMessage(ctx, "b", InboxMessage{
+		ID:        "1",
+		Operation: "op",
+		Payload:   []byte("duplicate"),
+	}))
+	require.NoError(t, tr.Commit(ctx))
+
+	pending, err = registry.ListActorsWithPendingMessages(ctx, "server1", 10)
+	require.NoError(t, err)
+	require.Equal(t, []types.NamespacedIDNoType{types.NewNamespacedIDNoType("ns1", "b")}, pending)
+
+	// Messages enqueued in a transaction that is canceled are never delivered.
+	tr, err = registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	require.NoError(t, tr.EnqueueMessage(ctx, "a", InboxMessage{ID: "canceled", Operation: "op"}))
+	require.NoError(t, tr.Cancel(ctx))
+
+	tr, err = registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	_, ok, err := tr.PeekInbox(ctx)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, tr.Commit(ctx))
+
+	// Drain b's inbox in order.
+	for i := 0; i < 3; i++ {
+		tr, err = registry.BeginTransaction(ctx, "ns1", "b", "server1", 1)
+		require.NoError(t, err)
+		msg, ok, err := tr.PeekInbox(ctx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, InboxMessage{
+			ID:        fmt.Sprintf("%d", i),
+			Operation: "op",
+			Payload:   []byte(fmt.Sprintf("payload-%d", i)),
+			Seq:       int64(i + 1),
+		}, msg)
+		require.NoError(t, tr.AckInboxMessage(ctx, msg.Seq))
+		require.NoError(t, tr.Commit(ctx))
+	}
+
+	tr, err = registry.BeginTransaction(ctx, "ns1", "b", "server1", 1)
+	require.NoError(t, err)
+	_, ok, err = tr.PeekInbox(ctx)
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, tr.Commit(ctx))
+
+	pending, err = registry.ListActorsWithPendingMessages(ctx, "server1", 10)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	// Messages that fail to be delivered are retried after a backoff, and moved to the
+	// dead letter queue eventually so they don't block the rest of the inbox.
+	tr, err = registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	for _, id := range []string{"poison", "next"} {
+		require.NoError(t, tr.EnqueueMessage(ctx, "b", InboxMessage{ID: id, Operation: "op"}))
+	}
+	require.NoError(t, tr.Commit(ctx))
+
+	tr, err = registry.BeginTransaction(ctx, "ns1", "b", "server1", 1)
+	require.NoError(t, err)
+	msg, ok, err := tr.PeekInbox(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "poison", msg.ID)
+	retryAt := time.Now().Add(time.Hour)
+	require.NoError(t, tr.RetryInboxMessage(ctx, msg.Seq, "some error", retryAt))
+	require.NoError(t, tr.Commit(ctx))
+
+	// The inbox is skipped while it backs off, even if more messages are enqueued.
+	tr, err = registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	require.NoError(t, tr.EnqueueMessage(ctx, "b", InboxMessage{ID: "last", Operation: "op"}))
+	require.NoError(t, tr.Commit(ctx))
+	pending, err = registry.ListActorsWithPendingMessages(ctx, "server1", 10)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	tr, err = registry.BeginTransaction(ctx, "ns1", "b", "server1", 1)
+	require.NoError(t, err)
+	msg, ok, err = tr.PeekInbox(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "poison", msg.ID)
+	require.Equal(t, 1, msg.Attempts)
+	require.Equal(t, "some error", msg.LastError)
+	require.True(t, msg.RetryAt.Equal(retryAt))
+	require.NoError(t, tr.DeadLetterInboxMessage(ctx, msg.Seq, "another error"))
+	require.NoError(t, tr.Commit(ctx))
+
+	pending, err = registry.ListActorsWithPendingMessages(ctx, "server1", 10)
+	require.NoError(t, err)
+	require.Equal(t, []types.NamespacedIDNoType{types.NewNamespacedIDNoType("ns1", "b")}, pending)
+
+	deadLetters, err := registry.ListDeadLetters(ctx, "ns1", "b")
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 1)
+	require.Equal(t, "poison", deadLetters[0].ID)
+	require.Equal(t, 2, deadLetters[0].Attempts)
+	require.Equal(t, "another error", deadLetters[0].LastError)
+
+	tr, err = registry.BeginTransaction(ctx, "ns1", "b", "server1", 1)
+	require.NoError(t, err)
+	msg, ok, err = tr.PeekInbox(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "next", msg.ID)
+	require.Equal(t, 0, msg.Attempts)
+	require.NoError(t, tr.Commit(ctx))
+
+	// Only the server that b is activated on, or any server if that server is dead,
+	// should deliver b's inbox.
+	_, err = registry.Heartbeat(ctx, "server2", HeartbeatState{
+		NumActivatedActors: 0,
+		Address:            "server2_address",
+	})
+	require.NoError(t, err)
+	pending, err = registry.ListActorsWithPendingMessages(ctx, "server2", 10)
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	// Inboxes of actors that aren't activated anywhere can be delivered by any server, and
+	// the number of inboxes returned is capped by the limit.
+	_, err = registry.CreateActor(ctx, "ns1", "c", "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+	tr, err = registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "c"} {
+		require.NoError(t, tr.EnqueueMessage(ctx, actor, InboxMessage{ID: "unowned", Operation: "op"}))
+	}
+	require.NoError(t, tr.Commit(ctx))
+
+	pending, err = registry.ListActorsWithPendingMessages(ctx, "server2", 10)
+	require.NoError(t, err)
+	require.Equal(t, []types.NamespacedIDNoType{types.NewNamespacedIDNoType("ns1", "c")}, pending)
+	pending, err = registry.ListActorsWithPendingMessages(ctx, "server1", 10)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+	pending, err = registry.ListActorsWithPendingMessages(ctx, "server1", 2)
+	require.NoError(t, err)
+	require.Equal(t, []types.NamespacedIDNoType{
+		types.NewNamespacedIDNoType("ns1", "a"),
+		types.NewNamespacedIDNoType("ns1", "b"),
+	}, pending)
+
+	// The inbox moves to the index of the server the actor is activated on.
+	refs, err := registry.EnsureActivation(ctx, "ns1", "c")
+	require.NoError(t, err)
+	owner := refs[0].ServerID()
+	for _, serverID := range []string{"server1", "server2"} {
+		pending, err = registry.ListActorsWithPendingMessages(ctx, serverID, 10)
+		require.NoError(t, err)
+		require.Equal(t, serverID == owner, containsNamespacedID(pending, "ns1", "c"), serverID)
+	}
+
+	// Deleting the actor removes it from the index.
+	require.NoError(t, registry.DeleteActor(ctx, "ns1", "c"))
+	pending, err = registry.ListActorsWithPendingMessages(ctx, owner, 10)
+	require.NoError(t, err)
+	require.False(t, containsNamespacedID(pending, "ns1", "c"))
+}
+
+func containsNamespacedID(ids []types.NamespacedIDNoType, namespace, id string) bool {
+	for _, curr := range ids {
+		if curr == types.NewNamespacedIDNoType(namespace, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func testMultiActorTransactions(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b", "c"} {
+		_, err = registry.CreateActor(ctx, "ns1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+
+	refs := make([]types.ActorReference, 0, 2)
+	for i, actor := range []string{"a", "b"} {
+		// Heartbeat such that each actor is activated on a different server.
+		for j, server := range []string{"server1", "server2"} {
+			numActivatedActors := 0
+			if i != j {
+				numActivatedActors = 100
+			}
+			_, err = registry.Heartbeat(ctx, server, HeartbeatState{
+				NumActivatedActors: numActivatedActors,
+				Address:            server + "_address",
+			})
+			require.NoError(t, err)
+		}
+
+		actorRefs, err := registry.EnsureActivation(ctx, "ns1", actor)
+		require.NoError(t, err)
+		refs = append(refs, actorRefs[0])
+	}
+	// Make sure the test actually covers participants on different servers.
+	require.NotEqual(t, refs[0].ServerID(), refs[1].ServerID())
+
+	// begin begins a transaction for a and joins the participants to it.
+	begin := func(serverVersion int64, participants ...TransactionParticipant) (ActorKVTransaction, MultiActorKV, error) {
+		tr, err := registry.BeginTransaction(ctx, "ns1", "a", refs[0].ServerID(), serverVersion)
+		if err != nil {
+			return nil, nil, err
+		}
+		kv, err := tr.JoinActors(ctx, participants)
+		if err != nil {
+			tr.Cancel(ctx)
+			return nil, nil, err
+		}
+		return tr, kv, nil
+	}
+	b := TransactionParticipant{
+		ActorID:       "b",
+		ServerID:      refs[1].ServerID(),
+		ServerVersion: refs[1].ServerVersion(),
+	}
+
+	// The fencing tokens of the transaction's actor and of every participant must be
+	// valid, and every participant must exist.
+	_, _, err = begin(refs[0].ServerVersion()+1, b)
+	require.Error(t, err)
+	stale := b
+	stale.ServerVersion++
+	_, _, err = begin(refs[0].ServerVersion(), stale)
+	require.Error(t, err)
+	stale = b
+	stale.ServerID = refs[0].ServerID()
+	_, _, err = begin(refs[0].ServerVersion(), stale)
+	require.Error(t, err)
+	_, _, err = begin(refs[0].ServerVersion(), b, TransactionParticipant{
+		ActorID:       "does-not-exist",
+		ServerID:      refs[1].ServerID(),
+		ServerVersion: refs[1].ServerVersion(),
+	})
+	require.True(t, IsActorDoesNotExistErr(err))
+
+	// Canceled transactions should not be visible.
+	tr, kv, err := begin(refs[0].ServerVersion(), b)
+	require.NoError(t, err)
+	require.NoError(t, kv.Put(ctx, "a", []byte("key"), []byte("canceled")))
+	require.NoError(t, tr.Cancel(ctx))
+
+	tr, kv, err = begin(refs[0].ServerVersion(), b, b)
+	require.NoError(t, err)
+	_, ok, err := kv.Get(ctx, "a", []byte("key"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	for _, actor := range []string{"a", "b"} {
+		require.NoError(t, kv.Put(ctx, actor, []byte("key"), []byte("value-"+actor)))
+	}
+	// Can't touch the KV of actors that are not participants.
+	require.Error(t, kv.Put(ctx, "c", []byte("key"), []byte("value")))
+	_, _, err = kv.Get(ctx, "c", []byte("key"))
+	require.Error(t, err)
+	require.NoError(t, tr.Commit(ctx))
+
+	// Writes should be visible to the regular per-actor transactions.
+	for _, ref := range refs {
+		tr, err := registry.BeginTransaction(ctx, "ns1", ref.ActorID().ID, ref.ServerID(), ref.ServerVersion())
+		require.NoError(t, err)
+		v, ok, err := tr.Get(ctx, []byte("key"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, "value-"+ref.ActorID().ID, string(v))
+		require.NoError(t, tr.Commit(ctx))
+	}
+
+	// The transaction fails to commit if a participant's record changes concurrently.
+	tr, kv, err = begin(refs[0].ServerVersion(), b)
+	require.NoError(t, err)
+	require.NoError(t, kv.Put(ctx, "b", []byte("key"), []byte("joined")))
+	require.NoError(t, tr.Put(ctx, []byte("key"), []byte("joined")))
+	require.NoError(t, registry.IncGeneration(ctx, "ns1", "b"))
+	require.Error(t, tr.Commit(ctx))
+
+	tr, kv, err = begin(refs[0].ServerVersion(), b)
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b"} {
+		v, _, err := kv.Get(ctx, actor, []byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, "value-"+actor, string(v))
+	}
+	require.NoError(t, tr.Cancel(ctx))
+}
+
+func testInvocationResults(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		NumActivatedActors: 0,
+		Address:            "server1_address",
+	})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b"} {
+		_, err = registry.CreateActor(ctx, "ns1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+		_, err = registry.EnsureActivation(ctx, "ns1", actor)
+		require.NoError(t, err)
+	}
+
+	// Results stored in canceled transactions should not be visible.
+	tr, err := registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	require.NoError(t, tr.PutInvocationResult(ctx, "key", InvocationResult{Operation: "op", Result: []byte("canceled")}))
+	require.NoError(t, tr.Cancel(ctx))
+
+	tr, err = registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	_, ok, err := tr.GetInvocationResult(ctx, "key")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, tr.PutInvocationResult(ctx, "key", InvocationResult{Operation: "op", Result: []byte("result")}))
+	require.NoError(t, tr.Commit(ctx))
+
+	tr, err = registry.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	result, ok, err := tr.GetInvocationResult(ctx, "key")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "op", result.Operation)
+	require.Equal(t, []byte("result"), result.Result)
+	require.True(t, result.ExpiresAt.After(time.Now()))
+	require.NoError(t, tr.Commit(ctx))
+
+	// Results are scoped to the actor.
+	tr, err = registry.BeginTransaction(ctx, "ns1", "b", "server1", 1)
+	require.NoError(t, err)
+	_, ok, err = tr.GetInvocationResult(ctx, "key")
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.NoError(t, tr.Commit(ctx))
+}
+
+func testWatchActorKV(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	// Can't watch actors that don't exist.
+	_, err := registry.WatchActorKV(ctx, "ns1", "a", nil, nil)
+	require.Error(t, err)
+	require.True(t, IsActorDoesNotExistErr(err))
+
+	// Or actors in namespaces that haven't enabled the change log.
+	_, err = registry.RegisterModule(ctx, "ns2", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	_, err = registry.CreateActor(ctx, "ns2", "a", "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+	require.NoError(t, registry.PutActorKV(ctx, "ns2", "a", []byte("key"), []byte("value")))
+	_, err = registry.WatchActorKV(ctx, "ns2", "a", nil, nil)
+	require.Error(t, err)
+
+	require.NoError(t, registry.CreateNamespace(ctx, "ns1", NamespaceOptions{KVChangeLog: true}))
+
+	_, err = registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{
+		NumActivatedActors: 0,
+		Address:            "server1_address",
+	})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b"} {
+		_, err = registry.CreateActor(ctx, "ns1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+		_, err = registry.EnsureActivation(ctx, "ns1", actor)
+		require.NoError(t, err)
+	}
+
+	put := func(actor string, kvs ...string) {
+		tr, err := registry.BeginTransaction(ctx, "ns1", actor, "server1", 1)
+		require.NoError(t, err)
+		for i := 0; i < len(kvs); i += 2 {
+			require.NoError(t, tr.Put(ctx, []byte(kvs[i]), []byte(kvs[i+1])))
+		}
+		require.NoError(t, tr.Commit(ctx))
+	}
+
+	// Nothing has been written yet so the watch should block until ctx is canceled.
+	timeoutCtx, cc := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cc()
+	_, err = registry.WatchActorKV(timeoutCtx, "ns1", "a", nil, nil)
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// Start watching before anything is written to make sure the watch is woken up.
+	var (
+		changesCh = make(chan []ActorKVChange, 1)
+		errCh     = make(chan error, 1)
+	)
+	go func() {
+		changes, err := registry.WatchActorKV(ctx, "ns1", "a", []byte("watched-"), nil)
+		changesCh <- changes
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Writes to other actors or keys without the prefix should not wake the watch up.
+	put("b", "watched-1", "b")
+	put("a", "other-1", "a")
+	put("a", "watched-1", "v1", "watched-2", "v2")
+
+	require.NoError(t, <-errCh)
+	changes := <-changesCh
+	require.Len(t, changes, 2)
+	require.Equal(t, "watched-1", string(changes[0].Key))
+	require.Equal(t, "v1", string(changes[0].Value))
+	require.Equal(t, "watched-2", string(changes[1].Key))
+	require.Equal(t, "v2", string(changes[1].Value))
+	require.True(t, bytes.Compare(changes[0].Version, changes[1].Version) < 0)
+
+	// Resume from the last version.
+	put("a", "watched-1", "v3")
+	changes, err = registry.WatchActorKV(ctx, "ns1", "a", []byte("watched-"), changes[1].Version)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, "watched-1", string(changes[0].Key))
+	require.Equal(t, "v3", string(changes[0].Value))
+
+	// Watching without a prefix returns every change.
+	changes, err = registry.WatchActorKV(ctx, "ns1", "a", nil, nil)
+	require.NoError(t, err)
+	require.Len(t, changes, 4)
+	require.Equal(t, "other-1", string(changes[0].Key))
+}
+
+func testExportImport(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	for _, ns := range []string{"ns1", "ns2"} {
+		_, err := registry.RegisterModule(ctx, ns, "test-module", testModuleBytes, ModuleOptions{})
+		require.NoError(t, err)
+	}
+	_, err := registry.Heartbeat(ctx, "server1", HeartbeatState{
+		NumActivatedActors: 0,
+		Address:            "server1_address",
+	})
+	require.NoError(t, err)
+
+	for _, actor := range []string{"a", "b", "c"} {
+		_, err = registry.CreateActor(ctx, "ns1", actor, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+		_, err = registry.EnsureActivation(ctx, "ns1", actor)
+		require.NoError(t, err)
+
+		tr, err := registry.BeginTransaction(ctx, "ns1", actor, "server1", 1)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			require.NoError(t, tr.Put(ctx, []byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("%s-%d", actor, i))))
+		}
+		require.NoError(t, tr.Commit(ctx))
+	}
+
+	// Can't export actors that don't exist.
+	err = registry.ExportActorKV(ctx, "ns1", "d", &bytes.Buffer{})
+	require.Error(t, err)
+	require.True(t, IsActorDoesNotExistErr(err))
+
+	var actorExport, namespaceExport bytes.Buffer
+	require.NoError(t, registry.ExportActorKV(ctx, "ns1", "a", &actorExport))
+	require.NoError(t, registry.ExportNamespaceKV(ctx, "ns1", &namespaceExport))
+
+	// Corrupted or truncated exports should be rejected without importing anything.
+	corrupted := bytes.Replace(namespaceExport.Bytes(), []byte(`"actor_id":"b"`), []byte(`"actor_id":"x"`), 1)
+	_, err = registry.ImportActorKV(ctx, "ns2", bytes.NewReader(corrupted))
+	require.Error(t, err)
+	truncated := namespaceExport.Bytes()[:namespaceExport.Len()/2]
+	_, err = registry.ImportActorKV(ctx, "ns2", bytes.NewReader(truncated))
+	require.Error(t, err)
+	_, err = registry.EnsureActivation(ctx, "ns2", "a")
+	require.Error(t, err)
+
+	result, err := registry.ImportActorKV(ctx, "ns2", bytes.NewReader(actorExport.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, ImportResult{NumActors: 1, NumKeys: 10}, result)
+
+	// Actors that already exist are rejected instead of having the imported keys merged
+	// into their existing keys.
+	_, err = registry.ImportActorKV(ctx, "ns2", bytes.NewReader(namespaceExport.Bytes()))
+	require.Error(t, err)
+	_, err = registry.EnsureActivation(ctx, "ns2", "b")
+	require.Error(t, err)
+	require.NoError(t, registry.DeleteActor(ctx, "ns2", "a"))
+
+	result, err = registry.ImportActorKV(ctx, "ns2", bytes.NewReader(namespaceExport.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, ImportResult{NumActors: 3, NumKeys: 30}, result)
+
+	// Importing into a namespace where the module doesn't exist should fail.
+	_, err = registry.ImportActorKV(ctx, "ns3", bytes.NewReader(actorExport.Bytes()))
+	require.Error(t, err)
+
+	for _, actor := range []string{"a", "b", "c"} {
+		refs, err := registry.EnsureActivation(ctx, "ns2", actor)
+		require.NoError(t, err)
+		tr, err := registry.BeginTransaction(ctx, "ns2", actor, refs[0].ServerID(), refs[0].ServerVersion())
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			v, ok, err := tr.Get(ctx, []byte(fmt.Sprintf("key-%d", i)))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, fmt.Sprintf("%s-%d", actor, i), string(v))
+		}
+		require.NoError(t, tr.Commit(ctx))
+	}
+
+	// Exporting the imported namespace should produce the same actor and kv records as
+	// the original export. The header (and therefore the footer checksum) differs since
+	// it includes the namespace.
+	var reexport bytes.Buffer
+	require.NoError(t, registry.ExportNamespaceKV(ctx, "ns2", &reexport))
+	original := bytes.Split(bytes.TrimSpace(namespaceExport.Bytes()), []byte("\n"))
+	reexported := bytes.Split(bytes.TrimSpace(reexport.Bytes()), []byte("\n"))
+	require.Equal(t, original[1:len(original)-1], reexported[1:len(reexported)-1])
+}
+
+func testModules(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	// 20MiB module padded with random data followed by a bunch of repeated data so that
+	// some of the chunks are duplicates.
+	padding := make([]byte, 20<<20)
+	_, err := rand.New(rand.NewSource(0)).Read(padding[:10<<20])
+	require.NoError(t, err)
+	moduleBytes := withCustomSection(testModuleBytes, "padding", padding)
+
+	result, err := registry.RegisterModuleStream(ctx, "ns1", "large", bytes.NewReader(moduleBytes), ModuleOptions{})
+	require.NoError(t, err)
+	fetched, _, err := registry.GetModule(ctx, "ns1", "large")
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(moduleBytes, fetched))
+
+	expectedHash := sha256.Sum256(moduleBytes)
+	require.Equal(t, hex.EncodeToString(expectedHash[:]), result.Hash)
+	info, err := registry.GetModuleInfo(ctx, "ns1", "large")
+	require.NoError(t, err)
+	require.Equal(t, ModuleInfo{Hash: result.Hash, Size: int64(len(moduleBytes))}, info)
+
+	// Registering the same bytes in a different namespace, or under a different module
+	// ID, should result in the same hash.
+	for _, ns := range []string{"ns1", "ns3"} {
+		result, err := registry.RegisterModuleStream(ctx, ns, "large-copy", bytes.NewReader(moduleBytes), ModuleOptions{})
+		require.NoError(t, err)
+		require.Equal(t, info.Hash, result.Hash)
+		fetched, _, err := registry.GetModule(ctx, ns, "large-copy")
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(moduleBytes, fetched))
+	}
+
+	// Modules can't be registered twice, regardless of how they were registered.
+	_, err = registry.RegisterModule(ctx, "ns1", "large", testModuleBytes, ModuleOptions{})
+	require.Error(t, err)
+	_, err = registry.RegisterModuleStream(ctx, "ns1", "large", bytes.NewReader(testModuleBytes), ModuleOptions{})
+	require.Error(t, err)
+
+	// Same module ID in a different namespace is a different module.
+	_, err = registry.RegisterModule(ctx, "ns2", "large", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	fetched, _, err = registry.GetModule(ctx, "ns2", "large")
+	require.NoError(t, err)
+	require.Equal(t, testModuleBytes, fetched)
+
+	// Empty modules are only allowed if explicitly requested.
+	_, err = registry.RegisterModuleStream(ctx, "ns1", "empty", bytes.NewReader(nil), ModuleOptions{})
+	require.Error(t, err)
+	_, err = registry.RegisterModuleStream(ctx, "ns1", "empty", bytes.NewReader(nil), ModuleOptions{
+		AllowEmptyModuleBytes: true,
+	})
+	require.NoError(t, err)
+	fetched, opts, err := registry.GetModule(ctx, "ns1", "empty")
+	require.NoError(t, err)
+	require.Empty(t, fetched)
+	require.True(t, opts.AllowEmptyModuleBytes)
+
+	// Modules that are too large are rejected without being registered.
+	tooLarge := io.LimitReader(zeroReader{}, maxModuleSizeBytes+1)
+	_, err = registry.RegisterModuleStream(ctx, "ns1", "too-large", tooLarge, ModuleOptions{})
+	require.Error(t, err)
+	_, _, err = registry.GetModule(ctx, "ns1", "too-large")
+	require.Error(t, err)
+	_, err = registry.CreateActor(ctx, "ns1", "a", "too-large", types.ActorOptions{})
+	require.Error(t, err)
+
+	// Failed uploads are also not registered.
+	failing := io.MultiReader(bytes.NewReader(moduleBytes[:1<<20]), iotest.ErrReader(errors.New("some error")))
+	_, err = registry.RegisterModuleStream(ctx, "ns1", "failed", failing, ModuleOptions{})
+	require.Error(t, err)
+	_, _, err = registry.GetModule(ctx, "ns1", "failed")
+	require.Error(t, err)
+	_, err = registry.CreateActor(ctx, "ns1", "a", "large", types.ActorOptions{})
+	require.NoError(t, err)
+}
+
+// testNamespaces tests namespace management, usage tracking and quota enforcement.
+func testNamespaces(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	_, err := registry.GetNamespace(ctx, "ns1")
+	require.True(t, IsNamespaceDoesNotExistErr(err))
+	require.True(t, IsNamespaceDoesNotExistErr(registry.UpdateNamespace(ctx, "ns1", NamespaceOptions{})))
+
+	// Invalid quotas are rejected.
+	invalid := NamespaceOptions{Quotas: NamespaceQuotas{MaxActors: -1}}
+	require.Error(t, registry.CreateNamespace(ctx, "ns1", invalid))
+	invalid = NamespaceOptions{RateLimits: NamespaceRateLimits{Actors: map[string]RateLimit{"a": {}}}}
+	require.Error(t, registry.CreateNamespace(ctx, "ns1", invalid))
+	invalid = NamespaceOptions{LogLevel: "verbose"}
+	require.Error(t, registry.CreateNamespace(ctx, "ns1", invalid))
+
+	// Namespaces can't collide with the prefixes of cluster-wide data.
+	for _, reserved := range []string{"servers", "module_blobs", "module_chunks", "namespaces", "pending_inboxes", "server_pending_inboxes"} {
+		require.Error(t, registry.CreateNamespace(ctx, reserved, NamespaceOptions{}))
+		require.Error(t, registry.UpdateNamespace(ctx, reserved, NamespaceOptions{}))
+		require.Error(t, registry.DeleteNamespace(ctx, reserved))
+		_, err = registry.RegisterModule(ctx, reserved, "test-module", testModuleBytes, ModuleOptions{})
+		require.Error(t, err)
+	}
+
+	quotas := NamespaceQuotas{MaxActors: 2, MaxModules: 1}
+	require.NoError(t, registry.CreateNamespace(ctx, "ns1", NamespaceOptions{Quotas: quotas}))
+	require.Error(t, registry.CreateNamespace(ctx, "ns1", NamespaceOptions{}))
+	info, err := registry.GetNamespace(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, NamespaceInfo{Namespace: "ns1", Opts: NamespaceOptions{Quotas: quotas}}, info)
+
+	// Namespaces are created implicitly when modules are registered in them.
+	_, err = registry.RegisterModule(ctx, "ns2", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	namespaces, err := registry.ListNamespaces(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []NamespaceInfo{
+		{Namespace: "ns1", Opts: NamespaceOptions{Quotas: quotas}},
+		{Namespace: "ns2"},
+	}, namespaces)
+
+	// Module quotas.
+	_, err = registry.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	_, err = registry.RegisterModule(ctx, "ns1", "test-module-2", testModuleBytes, ModuleOptions{})
+	require.True(t, IsQuotaExceededErr(err))
+
+	// Actor quotas.
+	for _, actorID := range []string{"a", "b"} {
+		_, err = registry.CreateActor(ctx, "ns1", actorID, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+	_, err = registry.CreateActor(ctx, "ns1", "c", "test-module", types.ActorOptions{})
+	require.True(t, IsQuotaExceededErr(err))
+
+	// Quotas can be raised.
+	quotas.MaxActors = 3
+	require.NoError(t, registry.UpdateNamespace(ctx, "ns1", NamespaceOptions{Quotas: quotas}))
+	_, err = registry.CreateActor(ctx, "ns1", "c", "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+
+	// Concurrent creates can't exceed the quotas together.
+	require.NoError(t, registry.CreateNamespace(ctx, "ns3", NamespaceOptions{
+		Quotas: NamespaceQuotas{MaxActors: 3},
+	}))
+	_, err = registry.RegisterModule(ctx, "ns3", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	var (
+		wg      sync.WaitGroup
+		created atomic.Int64
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := registry.CreateActor(ctx, "ns3", fmt.Sprint(i), "test-module", types.ActorOptions{})
+			if err == nil {
+				created.Add(1)
+			} else if !IsQuotaExceededErr(err) {
+				t.Errorf("unexpected error creating actor: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int64(3), created.Load())
+	require.NoError(t, registry.DeleteNamespace(ctx, "ns3"))
+
+	// KV usage is tracked per namespace, and overwriting a key replaces its size.
+	_, err = registry.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	for _, actorID := range []string{"a", "b"} {
+		_, err = registry.EnsureActivation(ctx, "ns1", actorID)
+		require.NoError(t, err)
+		tr, err := registry.BeginTransaction(ctx, "ns1", actorID, "server1", 1)
+		require.NoError(t, err)
+		require.NoError(t, tr.Put(ctx, []byte("key"), []byte("a-long-value")))
+		require.NoError(t, tr.Put(ctx, []byte("key"), []byte("value")))
+		require.NoError(t, tr.Commit(ctx))
+	}
+
+	usage, err := registry.GetNamespaceUsage(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, NamespaceUsage{
+		NumActors:   3,
+		NumModules:  1,
+		ModuleBytes: int64(len(testModuleBytes)),
+		KVBytes:     2 * int64(len("key")+len("value")),
+	}, usage)
+	usage, err = registry.GetNamespaceUsage(ctx, "ns2")
+	require.NoError(t, err)
+	require.Equal(t, NamespaceUsage{NumModules: 1, ModuleBytes: int64(len(testModuleBytes))}, usage)
+
+	// Imports can't exceed the quotas either.
+	var export bytes.Buffer
+	require.NoError(t, registry.ExportActorKV(ctx, "ns1", "a", &export))
+	require.NoError(t, registry.CreateNamespace(ctx, "ns4", NamespaceOptions{
+		Quotas: NamespaceQuotas{MaxKVBytes: int64(len("key") + len("value") - 1)},
+	}))
+	_, err = registry.RegisterModule(ctx, "ns4", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	_, err = registry.ImportActorKV(ctx, "ns4", bytes.NewReader(export.Bytes()))
+	require.True(t, IsQuotaExceededErr(err))
+	usage, err = registry.GetNamespaceUsage(ctx, "ns4")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), usage.NumActors)
+	require.Equal(t, int64(0), usage.KVBytes)
+
+	require.NoError(t, registry.UpdateNamespace(ctx, "ns4", NamespaceOptions{
+		Quotas: NamespaceQuotas{MaxActors: 1, MaxKVBytes: int64(len("key") + len("value"))},
+	}))
+	_, err = registry.ImportActorKV(ctx, "ns4", bytes.NewReader(export.Bytes()))
+	require.NoError(t, err)
+	require.NoError(t, registry.DeleteActor(ctx, "ns4", "a"))
+	_, err = registry.CreateActor(ctx, "ns4", "b", "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+	_, err = registry.ImportActorKV(ctx, "ns4", bytes.NewReader(export.Bytes()))
+	require.True(t, IsQuotaExceededErr(err))
+	require.NoError(t, registry.DeleteNamespace(ctx, "ns4"))
+
+	// Deleting a namespace deletes its modules and actors, but not other namespaces'.
+	require.NoError(t, registry.DeleteNamespace(ctx, "ns1"))
+	_, err = registry.GetNamespace(ctx, "ns1")
+	require.True(t, IsNamespaceDoesNotExistErr(err))
+	_, _, err = registry.GetModule(ctx, "ns1", "test-module")
+	require.Error(t, err)
+	_, err = registry.EnsureActivation(ctx, "ns1", "a")
+	require.Error(t, err)
+	usage, err = registry.GetNamespaceUsage(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, NamespaceUsage{}, usage)
+	_, _, err = registry.GetModule(ctx, "ns2", "test-module")
+	require.NoError(t, err)
+}
+
+func testModuleValidation(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	result, err := registry.RegisterModule(ctx, "ns1", "valid", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	require.Contains(t, result.Exports, "__guest_call")
+	require.Contains(t, result.Imports, "wapc.__host_call")
+	require.Contains(t, result.Imports, "wasi_snapshot_preview1.fd_write")
+
+	result, err = registry.RegisterModule(ctx, "ns1", "minimal", testWASMModule("", "", "__guest_call"), ModuleOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"__guest_call"}, result.Exports)
+	require.Empty(t, result.Imports)
+	result, err = registry.RegisterModule(ctx, "ns1", "wapc-import", testWASMModule("wapc", "__host_call", "__guest_call"), ModuleOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"wapc.__host_call"}, result.Imports)
+
+	// Manifests are validated and stored with the module.
+	manifest := &ModuleManifest{Operations: []OperationManifest{
+		{Name: "inc"},
+		{Name: "getCount", ReadOnly: true, ResponseSchema: json.RawMessage(`{"type":"integer"}`)},
+	}}
+	_, err = registry.RegisterModule(ctx, "ns1", "with-manifest", testModuleBytes, ModuleOptions{Manifest: manifest})
+	require.NoError(t, err)
+	info, err := registry.GetModuleInfo(ctx, "ns1", "with-manifest")
+	require.NoError(t, err)
+	require.Equal(t, manifest, info.Opts.Manifest)
+	_, opts, err := registry.GetModule(ctx, "ns1", "with-manifest")
+	require.NoError(t, err)
+	require.Equal(t, manifest, opts.Manifest)
+
+	invalidManifest := &ModuleManifest{Operations: []OperationManifest{{Name: "inc"}, {Name: "inc"}}}
+	_, err = registry.RegisterModule(ctx, "ns1", "invalid-manifest", testModuleBytes, ModuleOptions{Manifest: invalidManifest})
+	require.Error(t, err)
+
+	// Host policies are validated and stored with the module.
+	policy := &HostPolicy{
+		AllowedOperations: []string{"KV-PUT", "KV-GET", "KV-PUT-ACTOR", "KV-GET-ACTOR"},
+		AllowedTargets:    []HostPolicyTarget{{Namespace: "ns1", ModuleID: HostPolicyWildcard}},
+		AllowedCustomFns:  []string{"testCustomFn"},
+	}
+	_, err = registry.RegisterModule(ctx, "ns1", "with-host-policy", testModuleBytes, ModuleOptions{HostPolicy: policy})
+	require.NoError(t, err)
+	info, err = registry.GetModuleInfo(ctx, "ns1", "with-host-policy")
+	require.NoError(t, err)
+	require.Equal(t, policy, info.Opts.HostPolicy)
+
+	invalidPolicies := []*HostPolicy{
+		{AllowedOperations: []string{"UNKNOWN-OP"}},
+		{AllowedTargets: []HostPolicyTarget{{Namespace: "ns1"}}},
+		{AllowedCustomFns: []string{""}},
+	}
+	for _, policy := range invalidPolicies {
+		_, err = registry.RegisterModule(ctx, "ns1", "invalid-host-policy", testModuleBytes, ModuleOptions{HostPolicy: policy})
+		require.Error(t, err)
+	}
+
+	invalid := map[string][]byte{
+		"not-wasm":        []byte("wasm"),
+		"truncated":       testModuleBytes[:len(testModuleBytes)/2],
+		"no-guest-call":   testWASMModule("", "", "some_function"),
+		"unknown-import":  testWASMModule("env", "unknown_function", "__guest_call"),
+		"unknown-module":  testWASMModule("unknown_module", "__host_call", "__guest_call"),
+		"unknown-wapc-fn": testWASMModule("wapc", "__unknown", "__guest_call"),
+	}
+	for moduleID, moduleBytes := range invalid {
+		_, err := registry.RegisterModule(ctx, "ns1", moduleID, moduleBytes, ModuleOptions{})
+		require.Error(t, err, moduleID)
+		_, err = registry.RegisterModuleStream(ctx, "ns1", moduleID, bytes.NewReader(moduleBytes), ModuleOptions{})
+		require.Error(t, err, moduleID)
+		_, _, err = registry.GetModule(ctx, "ns1", moduleID)
+		require.Error(t, err, moduleID)
+	}
+}
+
+// withCustomSection returns a copy of moduleBytes with a custom section appended to it.
+// Custom sections are ignored by WASM runtimes, so this is useful for creating valid
+// modules of arbitrary sizes.
+func withCustomSection(moduleBytes []byte, name string, payload []byte) []byte {
+	var content []byte
+	content = binary.AppendUvarint(content, uint64(len(name)))
+	content = append(content, name...)
+	content = append(content, payload...)
+
+	result := append([]byte(nil), moduleBytes...)
+	result = append(result, 0) // Custom section ID.
+	result = binary.AppendUvarint(result, uint64(len(content)))
+	return append(result, content...)
+}
+
+// testWASMModule returns a minimal WASM module that exports a single function of type
+// (i32, i32) -> i32 with the provided name. If importModule is not empty, the module
+// also imports a function of the same type.
+func testWASMModule(importModule, importName, exportName string) []byte {
+	var (
+		result       = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+		exportedFunc = byte(0)
+	)
+	appendSection := func(id byte, content []byte) {
+		result = append(result, id)
+		result = binary.AppendUvarint(result, uint64(len(content)))
+		result = append(result, content...)
+	}
+	appendName := func(b []byte, name string) []byte {
+		b = binary.AppendUvarint(b, uint64(len(name)))
+		return append(b, name...)
+	}
+
+	// Type section: (i32, i32) -> i32.
+	appendSection(1, []byte{0x01, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f})
+	if importModule != "" {
+		// Import section.
+		content := appendName([]byte{0x01}, importModule)
+		content = appendName(content, importName)
+		appendSection(2, append(content, 0x00, 0x00))
+		exportedFunc++
+	}
+	// Function section.
+	appendSection(3, []byte{0x01, 0x00})
+	// Export section.
+	appendSection(7, append(appendName([]byte{0x01}, exportName), 0x00, exportedFunc))
+	// Code section: return 0.
+	appendSection(10, []byte{0x01, 0x04, 0x00, 0x41, 0x00, 0x0b})
+	return result
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// testAdmin tests listing and deleting modules and actors, and accessing actors' KV
+// storage directly.
+func testAdmin(t *testing.T, registry Registry) {
+	ctx := context.Background()
+
+	for _, moduleID := range []string{"test-module-b", "test-module-a"} {
+		_, err := registry.RegisterModule(ctx, "ns1", moduleID, testModuleBytes, ModuleOptions{})
+		require.NoError(t, err)
+	}
+	_, err := registry.RegisterModule(ctx, "ns2", "test-module-c", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	moduleIDs, err := registry.ListModules(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"test-module-a", "test-module-b"}, moduleIDs)
+
+	for _, actorID := range []string{"b", "a", "ab"} {
+		_, err = registry.CreateActor(ctx, "ns1", actorID, "test-module-a", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+	actorIDs, err := registry.ListActors(ctx, "ns1", "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "ab", "b"}, actorIDs)
+	actorIDs, err = registry.ListActors(ctx, "ns3", "", 10)
+	require.NoError(t, err)
+	require.Empty(t, actorIDs)
+	_, err = registry.ListActors(ctx, "ns1", "", 0)
+	require.Error(t, err)
+
+	// Actors are listed in pages that start after the last actor of the previous page.
+	actorIDs, err = registry.ListActors(ctx, "ns1", "", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "ab"}, actorIDs)
+	actorIDs, err = registry.ListActors(ctx, "ns1", "ab", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, actorIDs)
+	actorIDs, err = registry.ListActors(ctx, "ns1", "b", 2)
+	require.NoError(t, err)
+	require.Empty(t, actorIDs)
+
+	// KV get, put and scan.
+	_, ok, err := registry.GetActorKV(ctx, "ns1", "a", []byte("key-1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	for _, key := range []string{"key-2", "key-1", "other", "key\x00"} {
+		require.NoError(t, registry.PutActorKV(ctx, "ns1", "a", []byte(key), []byte("value-"+key)))
+	}
+	require.NoError(t, registry.PutActorKV(ctx, "ns1", "ab", []byte("key-3"), []byte("value")))
+	value, ok, err := registry.GetActorKV(ctx, "ns1", "a", []byte("key-1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("value-key-1"), value)
+
+	kvs, err := registry.ScanActorKV(ctx, "ns1", "a", []byte("key"), 10)
+	require.NoError(t, err)
+	require.Equal(t, []ActorKV{
+		{Key: []byte("key\x00"), Value: []byte("value-key\x00")},
+		{Key: []byte("key-1"), Value: []byte("value-key-1")},
+		{Key: []byte("key-2"), Value: []byte("value-key-2")},
+	}, kvs)
+	kvs, err = registry.ScanActorKV(ctx, "ns1", "a", nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(kvs))
+	_, err = registry.ScanActorKV(ctx, "ns1", "a", nil, 0)
+	require.Error(t, err)
+
+	// Writes are tracked for namespace quotas, same as writes by actors.
+	info, err := registry.DescribeActor(ctx, "ns1", "a")
+	require.NoError(t, err)
+	require.True(t, info.KVBytes > 0)
+
+	_, _, err = registry.GetActorKV(ctx, "ns1", "does-not-exist", []byte("key-1"))
+	require.True(t, IsActorDoesNotExistErr(err))
+	err = registry.PutActorKV(ctx, "ns1", "does-not-exist", []byte("key-1"), nil)
+	require.True(t, IsActorDoesNotExistErr(err))
+
+	// Deleting an actor deletes its KV storage and subscriptions but not other actors'.
+	require.NoError(t, registry.Subscribe(ctx, "ns1", "topic", "a", "inc"))
+	require.NoError(t, registry.Subscribe(ctx, "ns1", "topic", "ab", "inc"))
+	require.NoError(t, registry.DeleteActor(ctx, "ns1", "a"))
+	require.True(t, IsActorDoesNotExistErr(registry.DeleteActor(ctx, "ns1", "a")))
+	_, err = registry.DescribeActor(ctx, "ns1", "a")
+	require.True(t, IsActorDoesNotExistErr(err))
+	actorIDs, err = registry.ListActors(ctx, "ns1", "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ab", "b"}, actorIDs)
+	subscriptions, err := registry.GetSubscriptions(ctx, "ns1", "topic")
+	require.NoError(t, err)
+	require.Equal(t, []TopicSubscription{{ActorID: "ab", Operation: "inc"}}, subscriptions)
+	value, ok, err = registry.GetActorKV(ctx, "ns1", "ab", []byte("key-3"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("value"), value)
+
+	usage, err := registry.GetNamespaceUsage(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), usage.NumActors)
+	require.Equal(t, int64(len("key-3")+len("value")), usage.KVBytes)
+
+	// Recreating a deleted actor starts from scratch.
+	_, err = registry.CreateActor(ctx, "ns1", "a", "test-module-a", types.ActorOptions{})
+	require.NoError(t, err)
+	_, ok, err = registry.GetActorKV(ctx, "ns1", "a", []byte("key-1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Modules can't be deleted while actors that were created from them exist.
+	err = registry.DeleteModule(ctx, "ns1", "test-module-a")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "used by 3 actors")
+	_, err = registry.GetModuleInfo(ctx, "ns1", "test-module-a")
+	require.NoError(t, err)
+	for _, actorID := range []string{"a", "ab", "b"} {
+		require.NoError(t, registry.DeleteActor(ctx, "ns1", actorID))
+	}
+
+	// Deleting a module doesn't affect other modules with the same bytes.
+	require.NoError(t, registry.DeleteModule(ctx, "ns1", "test-module-a"))
+	require.Error(t, registry.DeleteModule(ctx, "ns1", "test-module-a"))
+	_, err = registry.GetModuleInfo(ctx, "ns1", "test-module-a")
+	require.Error(t, err)
+	moduleIDs, err = registry.ListModules(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"test-module-b"}, moduleIDs)
+	moduleBytes, _, err := registry.GetModule(ctx, "ns2", "test-module-c")
+	require.NoError(t, err)
+	require.Equal(t, testModuleBytes, moduleBytes)
+}
@@ -0,0 +1,304 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	exportFormatVersion = 1
+
+	exportRecordTypeHeader = "header"
+	exportRecordTypeActor  = "actor"
+	exportRecordTypeKV     = "kv"
+	exportRecordTypeFooter = "footer"
+
+	// maxExportRecordSize is the maximum size of a single encoded record in an export.
+	// Actor KV keys and values are small enough that this should never be hit.
+	maxExportRecordSize = 1 << 26
+)
+
+// exportRecord is a single line in an export. Exports are encoded as NDJSON so they can
+// be streamed, and consist of:
+//
+//  1. A header record.
+//  2. For every exported actor, an actor record followed by one kv record for every key
+//     in the actor's KV storage.
+//  3. A footer record that contains the number of records that preceded it and the hex
+//     encoded SHA-256 checksum of all the bytes that preceded it.
+type exportRecord struct {
+	Type string `json:"type"`
+
+	// Header fields.
+	FormatVersion int    `json:"format_version,omitempty"`
+	Namespace     string `json:"namespace,omitempty"`
+
+	// Actor and KV fields.
+	ActorID string             `json:"actor_id,omitempty"`
+	Actor   *exportActorRecord `json:"actor,omitempty"`
+	Key     []byte             `json:"key,omitempty"`
+	Value   []byte             `json:"value,omitempty"`
+
+	// Footer fields.
+	NumRecords int    `json:"num_records,omitempty"`
+	Checksum   string `json:"checksum,omitempty"`
+}
+
+type exportActorRecord struct {
+	ModuleID string             `json:"module_id"`
+	Opts     types.ActorOptions `json:"opts"`
+}
+
+// exportWriter encodes exportRecords to an underlying writer while keeping track of the
+// checksum. The header is written lazily along with the first record so that nothing is
+// written to the underlying writer if the export fails before any actors are exported.
+type exportWriter struct {
+	w          io.Writer
+	h          hash.Hash
+	namespace  string
+	numRecords int
+}
+
+func newExportWriter(w io.Writer, namespace string) *exportWriter {
+	return &exportWriter{
+		w:         w,
+		h:         sha256.New(),
+		namespace: namespace,
+	}
+}
+
+func (e *exportWriter) writeActor(actorID string, ra registeredActor, kvs []exportKV) error {
+	if err := e.maybeWriteHeader(); err != nil {
+		return err
+	}
+	err := e.write(exportRecord{
+		Type:    exportRecordTypeActor,
+		ActorID: actorID,
+		Actor: &exportActorRecord{
+			ModuleID: ra.ModuleID,
+			Opts:     ra.Opts,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		err := e.write(exportRecord{
+			Type:    exportRecordTypeKV,
+			ActorID: actorID,
+			Key:     kv.key,
+			Value:   kv.value,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *exportWriter) close() error {
+	if err := e.maybeWriteHeader(); err != nil {
+		return err
+	}
+	// Write the footer directly since it must not be included in the checksum.
+	marshaled, err := json.Marshal(&exportRecord{
+		Type:       exportRecordTypeFooter,
+		NumRecords: e.numRecords,
+		Checksum:   hex.EncodeToString(e.h.Sum(nil)),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling export footer: %w", err)
+	}
+	if _, err := e.w.Write(append(marshaled, '\n')); err != nil {
+		return fmt.Errorf("error writing export footer: %w", err)
+	}
+	return nil
+}
+
+func (e *exportWriter) maybeWriteHeader() error {
+	if e.numRecords > 0 {
+		return nil
+	}
+	return e.write(exportRecord{
+		Type:          exportRecordTypeHeader,
+		FormatVersion: exportFormatVersion,
+		Namespace:     e.namespace,
+	})
+}
+
+func (e *exportWriter) write(record exportRecord) error {
+	marshaled, err := json.Marshal(&record)
+	if err != nil {
+		return fmt.Errorf("error marshaling export record: %w", err)
+	}
+	marshaled = append(marshaled, '\n')
+	if _, err := e.w.Write(marshaled); err != nil {
+		return fmt.Errorf("error writing export record: %w", err)
+	}
+	e.h.Write(marshaled)
+	e.numRecords++
+	return nil
+}
+
+type exportKV struct {
+	key   []byte
+	value []byte
+}
+
+// exportReader reads and verifies the records of an export one at a time so that exports
+// can be processed without buffering them in memory. Since the checksum is in the footer,
+// an export is only known to be valid once next returns io.EOF, so callers that apply an
+// export should read it through once first (see verifyExport).
+type exportReader struct {
+	reader      *bufio.Reader
+	h           hash.Hash
+	numRecords  int
+	sawHeader   bool
+	sawFooter   bool
+	currActorID string
+}
+
+func newExportReader(r io.Reader) *exportReader {
+	return &exportReader{
+		reader: bufio.NewReaderSize(r, 1<<16),
+		h:      sha256.New(),
+	}
+}
+
+// next returns the next actor or kv record in the export, or io.EOF once the footer has
+// been read and verified.
+func (e *exportReader) next() (exportRecord, error) {
+	for {
+		if e.sawFooter {
+			return exportRecord{}, io.EOF
+		}
+
+		line, err := readExportLine(e.reader)
+		if err == io.EOF {
+			return exportRecord{}, errors.New("export is truncated: missing footer")
+		}
+		if err != nil {
+			return exportRecord{}, err
+		}
+
+		var record exportRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return exportRecord{}, fmt.Errorf("error unmarshaling export record: %w", err)
+		}
+
+		if record.Type == exportRecordTypeFooter {
+			if record.NumRecords != e.numRecords {
+				return exportRecord{}, fmt.Errorf(
+					"export is corrupt: footer expected %d records, but read %d",
+					record.NumRecords, e.numRecords)
+			}
+			if checksum := hex.EncodeToString(e.h.Sum(nil)); record.Checksum != checksum {
+				return exportRecord{}, fmt.Errorf(
+					"export is corrupt: footer checksum %s does not match computed checksum %s",
+					record.Checksum, checksum)
+			}
+			e.sawFooter = true
+			return exportRecord{}, io.EOF
+		}
+
+		e.h.Write(line)
+		e.numRecords++
+
+		switch record.Type {
+		case exportRecordTypeHeader:
+			if e.sawHeader {
+				return exportRecord{}, errors.New("export is corrupt: duplicate header")
+			}
+			if record.FormatVersion != exportFormatVersion {
+				return exportRecord{}, fmt.Errorf("unsupported export format version: %d", record.FormatVersion)
+			}
+			e.sawHeader = true
+		case exportRecordTypeActor:
+			if !e.sawHeader {
+				return exportRecord{}, errors.New("export is corrupt: missing header")
+			}
+			if err := validateString("actorID", record.ActorID); err != nil {
+				return exportRecord{}, fmt.Errorf("export is corrupt: %w", err)
+			}
+			if record.Actor == nil {
+				return exportRecord{}, fmt.Errorf(
+					"export is corrupt: actor record for: %s is missing actor", record.ActorID)
+			}
+			e.currActorID = record.ActorID
+			return record, nil
+		case exportRecordTypeKV:
+			if e.currActorID == "" || e.currActorID != record.ActorID {
+				return exportRecord{}, fmt.Errorf(
+					"export is corrupt: kv record for actor: %s does not follow its actor record",
+					record.ActorID)
+			}
+			if err := validateKey(record.Key); err != nil {
+				return exportRecord{}, fmt.Errorf("export is corrupt: %w", err)
+			}
+			return record, nil
+		default:
+			return exportRecord{}, fmt.Errorf("export is corrupt: unknown record type: %s", record.Type)
+		}
+	}
+}
+
+// exportSize is the number of actors in an export and the total size of their keys and
+// values.
+type exportSize struct {
+	numActors int64
+	kvBytes   int64
+}
+
+// verifyExport reads the entire export from r and verifies it while copying it to w,
+// so that it can be applied from w afterwards knowing that it's complete and valid. It
+// returns the size of the export so that it can be checked against the quotas of the
+// namespace it's imported into.
+func verifyExport(r io.Reader, w io.Writer) (exportSize, error) {
+	var (
+		reader = newExportReader(io.TeeReader(r, w))
+		size   exportSize
+	)
+	for {
+		record, err := reader.next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return exportSize{}, err
+		}
+		switch record.Type {
+		case exportRecordTypeActor:
+			size.numActors++
+		case exportRecordTypeKV:
+			size.kvBytes += int64(len(record.Key) + len(record.Value))
+		}
+	}
+}
+
+func readExportLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxExportRecordSize {
+			return nil, fmt.Errorf("export record exceeds maximum size of %d bytes", maxExportRecordSize)
+		}
+		if !isPrefix {
+			// ReadLine strips the newline, add it back so the checksum matches what was
+			// written.
+			return append(bytes.TrimSuffix(line, []byte("\r")), '\n'), nil
+		}
+	}
+}
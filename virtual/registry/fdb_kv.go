@@ -2,11 +2,22 @@ package registry
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 )
 
+// fdbErrCodeNotCommitted is the FoundationDB error code for transactions that failed to
+// commit due to a conflict with another transaction.
+const fdbErrCodeNotCommitted = 1020
+
+// fdbMaxTransactionDuration is the maximum duration of a FoundationDB transaction.
+const fdbMaxTransactionDuration = 5 * time.Second
+
 // fdbKV is an implementation of kv backed by FoundationDB.
 type fdbKV struct {
 	db fdb.Database
@@ -31,10 +42,42 @@ func (f *fdbKV) beginTransaction(ctx context.Context) (transaction, error) {
 
 func (f *fdbKV) transact(fn func(tr transaction) (any, error)) (any, error) {
 	return f.db.Transact(func(tr fdb.Transaction) (any, error) {
-		return fn(&fdbTransaction{tr})
+		return fn(&fdbTransaction{tr: tr})
 	})
 }
 
+func (f *fdbKV) watch(ctx context.Context, key []byte) (<-chan struct{}, error) {
+	future, err := f.db.Transact(func(tr fdb.Transaction) (any, error) {
+		return tr.Watch(fdb.Key(key)), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fdbKV: watch: error creating watch: %w", err)
+	}
+
+	var (
+		watch = future.(fdb.FutureNil)
+		ch    = make(chan struct{})
+	)
+	go func() {
+		defer close(ch)
+		// The watch is canceled if ctx is canceled first, in which case Get() will return
+		// an error. Either way the caller should stop waiting.
+		watch.Get()
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			watch.Cancel()
+		case <-ch:
+		}
+	}()
+	return ch, nil
+}
+
+func (f *fdbKV) maxTransactionDuration() time.Duration {
+	return fdbMaxTransactionDuration
+}
+
 func (f *fdbKV) close(ctx context.Context) error {
 	// TODO: Why does f.db.Close() not exist?
 	// https://pkg.go.dev/github.com/apple/foundationdb/bindings/go/src/fdb#Database.Close
@@ -51,6 +94,10 @@ func (f *fdbKV) unsafeWipeAll() error {
 
 type fdbTransaction struct {
 	tr fdb.Transaction
+	// numVersionstamped is the number of versionstamped keys written in the transaction
+	// so far. It is used as the versionstamp's user version so that multiple keys
+	// written in the same transaction are still ordered.
+	numVersionstamped uint16
 }
 
 func (tr *fdbTransaction) put(
@@ -77,6 +124,14 @@ func (tr *fdbTransaction) get(
 	return v, true, nil
 }
 
+func (tr *fdbTransaction) delete(
+	ctx context.Context,
+	k []byte,
+) error {
+	tr.tr.Clear(fdb.Key(k))
+	return nil
+}
+
 func (tr *fdbTransaction) iterPrefix(
 	ctx context.Context,
 	prefix []byte,
@@ -99,6 +154,70 @@ func (tr *fdbTransaction) iterPrefix(
 	return nil
 }
 
+func (tr *fdbTransaction) iterRange(
+	ctx context.Context,
+	start, end []byte,
+	fn func(k, v []byte) error,
+) error {
+	iter := tr.tr.GetRange(fdb.KeyRange{Begin: fdb.Key(start), End: fdb.Key(end)}, fdb.RangeOptions{}).Iterator()
+	for iter.Advance() {
+		kv, err := iter.Get()
+		if err != nil {
+			return err
+		}
+		if err := fn(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tr *fdbTransaction) putVersionstamped(
+	ctx context.Context,
+	key tuple.Tuple,
+	value []byte,
+) error {
+	if len(key) == 0 {
+		return fmt.Errorf("key must end with an incomplete versionstamp")
+	}
+	if _, ok := key[len(key)-1].(tuple.Versionstamp); !ok {
+		return fmt.Errorf("key must end with an incomplete versionstamp")
+	}
+
+	withUserVersion := append(tuple.Tuple(nil), key...)
+	withUserVersion[len(withUserVersion)-1] = tuple.IncompleteVersionstamp(tr.numVersionstamped)
+	tr.numVersionstamped++
+
+	packed, err := withUserVersion.PackWithVersionstamp(nil)
+	if err != nil {
+		return fmt.Errorf("error packing versionstamped key: %w", err)
+	}
+	tr.tr.SetVersionstampedKey(fdb.Key(packed), value)
+	return nil
+}
+
+func (tr *fdbTransaction) touch(
+	ctx context.Context,
+	key []byte,
+) error {
+	// Set the value to the commit versionstamp which is guaranteed to change on every
+	// commit without having to read the existing value. The param is a 10 byte placeholder
+	// for the versionstamp, followed by the little-endian offset of the placeholder.
+	param := make([]byte, 14)
+	binary.LittleEndian.PutUint32(param[10:], 0)
+	tr.tr.SetVersionstampedValue(fdb.Key(key), param)
+	return nil
+}
+
+func (tr *fdbTransaction) add(
+	ctx context.Context,
+	key []byte,
+	delta int64,
+) error {
+	tr.tr.Add(fdb.Key(key), binary.LittleEndian.AppendUint64(nil, uint64(delta)))
+	return nil
+}
+
 func (tr *fdbTransaction) getVersionStamp() (int64, error) {
 	readV, err := tr.tr.GetReadVersion().Get()
 	if err != nil {
@@ -108,7 +227,12 @@ func (tr *fdbTransaction) getVersionStamp() (int64, error) {
 }
 
 func (tr *fdbTransaction) commit(ctx context.Context) error {
-	return tr.tr.Commit().Get()
+	err := tr.tr.Commit().Get()
+	var fdbErr fdb.Error
+	if errors.As(err, &fdbErr) && fdbErr.Code == fdbErrCodeNotCommitted {
+		return fmt.Errorf("%v: %w", err, errTransactionConflict)
+	}
+	return err
 }
 
 func (tr *fdbTransaction) cancel(ctx context.Context) error {
@@ -0,0 +1,570 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/google/btree"
+)
+
+const (
+	fileKVWALFileName      = "wal"
+	fileKVOldWALFileName   = "wal.old"
+	fileKVSnapshotFileName = "snapshot"
+	fileKVLockFileName     = "LOCK"
+
+	// defaultFileKVSnapshotThresholdBytes is the size the WAL can grow to before the
+	// entire btree is snapshotted and the WAL is truncated.
+	defaultFileKVSnapshotThresholdBytes = 64 << 20
+
+	// fileKVRecordHeaderSize is the size of the length and CRC that precede every record.
+	fileKVRecordHeaderSize = 8
+	// maxFileKVRecordSize is the maximum size of a single encoded record. Anything larger
+	// is assumed to be corruption.
+	maxFileKVRecordSize = 1 << 30
+	// maxFileKVSnapshotRecordKVs is the maximum number of key/value pairs that are encoded
+	// in a single snapshot record.
+	maxFileKVSnapshotRecordKVs = 1024
+)
+
+var fileKVCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+type fileKVOptions struct {
+	snapshotThresholdBytes int64
+	// logger logs snapshot failures since they happen in the background.
+	logger types.Logger
+}
+
+// newFileKV creates a new kv that is durably stored in dir. It is implemented as a
+// localKV where every committed transaction is appended to a write-ahead log (WAL) and
+// fsync'd before the commit returns. Once the WAL grows large enough, it's rotated and
+// the btree is snapshotted to a new file in the background, after which the rotated WAL
+// is deleted.
+//
+// Both files are a sequence of records where each record is a batch of mutations (one
+// transaction for the WAL) encoded as:
+//
+//	[uint32 length][uint32 CRC32-C of payload][payload]
+//
+// On startup, the snapshot (if any) is loaded and then the rotated WAL (if any) and the
+// WAL are replayed on top of it. Replaying is idempotent since every mutation is a blind
+// put or delete so it doesn't matter if a crash happened after the snapshot was written,
+// but before the rotated WAL was deleted. A record at the end of the WAL that was only
+// partially written (or is corrupt) is assumed to be from a transaction that never
+// committed and is discarded.
+//
+// Only a single process may open dir at a time, which is enforced with an flock on a
+// lock file in dir.
+func newFileKV(dir string, opts fileKVOptions) (kv, error) {
+	if opts.snapshotThresholdBytes <= 0 {
+		opts.snapshotThresholdBytes = defaultFileKVSnapshotThresholdBytes
+	}
+	if opts.logger == nil {
+		opts.logger = types.NewWriterLogger(os.Stderr)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating directory: %s, err: %w", dir, err)
+	}
+
+	lock, err := lockFileKVDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l, err := openFileKV(dir, opts, lock)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func openFileKV(dir string, opts fileKVOptions, lock *os.File) (kv, error) {
+	l := newLocalKV().(*localKV)
+	w := &fileKVWAL{
+		dir:  dir,
+		opts: opts,
+		lock: lock,
+	}
+
+	var (
+		maxVersion      uint64
+		maxVersionStamp int64
+		apply           = func(b fileKVBatch) {
+			for _, m := range b.mutations {
+				switch m.typ {
+				case localKVMutationPut:
+					l.b.ReplaceOrInsert(btreeKV{m.k, m.v})
+				case localKVMutationDelete:
+					l.b.Delete(btreeKV{m.k, nil})
+				}
+			}
+			if b.version > maxVersion {
+				maxVersion = b.version
+			}
+			if b.versionStamp > maxVersionStamp {
+				maxVersionStamp = b.versionStamp
+			}
+		}
+	)
+
+	snapshotPath := filepath.Join(dir, fileKVSnapshotFileName)
+	if _, err := readFileKVRecords(snapshotPath, apply); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading snapshot: %w", err)
+		}
+	}
+
+	// The rotated WAL was fully synced before it was rotated so, unlike the WAL, it can't
+	// end with a partially written record.
+	oldWALPath := filepath.Join(dir, fileKVOldWALFileName)
+	if _, err := readFileKVRecords(oldWALPath, apply); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading rotated WAL: %w", err)
+		}
+	}
+
+	walPath := filepath.Join(dir, fileKVWALFileName)
+	validSize, err := readFileKVRecords(walPath, apply)
+	if err != nil && !errors.Is(err, errFileKVTornRecord) && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading WAL: %w", err)
+	}
+
+	f, err := os.OpenFile(walPath, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening WAL: %w", err)
+	}
+	// Discard any partially written record at the end of the WAL so that new records are
+	// appended immediately after the last valid one.
+	if err := f.Truncate(validSize); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error truncating WAL: %w", err)
+	}
+	if _, err := f.Seek(validSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error seeking WAL: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.f = f
+	w.size = validSize
+
+	// Versionstamps must never go backwards, even across restarts, so resume from
+	// whichever is greater: the last persisted versionstamp or the wall clock (which
+	// also accounts for however long the process was down for).
+	startVersionStamp := time.Now().UnixMicro()
+	if maxVersionStamp >= startVersionStamp {
+		startVersionStamp = maxVersionStamp + 1
+	}
+	l.t = time.Now().Add(-time.Duration(startVersionStamp) * time.Microsecond)
+	l.version = maxVersion
+	l.wal = w
+
+	return l, nil
+}
+
+// lockFileKVDir takes an exclusive flock on the lock file in dir so that a second process
+// can't open dir and corrupt it. The lock is held until the returned file is closed, or
+// the process exits.
+func lockFileKVDir(dir string) (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(dir, fileKVLockFileName), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %w", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("directory: %s is already in use by another process", dir)
+		}
+		return nil, fmt.Errorf("error locking directory: %s, err: %w", dir, err)
+	}
+	return lock, nil
+}
+
+// fileKVWAL is the durability layer for a file-backed localKV. Its methods must only be
+// called with the localKV lock held.
+type fileKVWAL struct {
+	dir  string
+	opts fileKVOptions
+	lock *os.File
+	f    *os.File
+	size int64
+	// sizeAtLastSnapshot is the size of the WAL when the last snapshot started. It's only
+	// non-zero if the WAL couldn't be rotated for that snapshot.
+	sizeAtLastSnapshot int64
+	// err is set once a write to the WAL fails. Once that happens, the state of the WAL
+	// on disk is unknown (the record may or may not have made it) so every subsequent
+	// commit fails until the kv is reopened and recovered.
+	err error
+
+	// snapshotting is set while a snapshot is being written in the background, which
+	// happens without holding the localKV lock.
+	snapshotting atomic.Bool
+	snapshotWG   sync.WaitGroup
+}
+
+// fileKVSnapshot is a point in time view of a localKV that is being snapshotted.
+type fileKVSnapshot struct {
+	b            *btree.BTreeG[btreeKV]
+	version      uint64
+	versionStamp int64
+}
+
+type fileKVBatch struct {
+	version      uint64
+	versionStamp int64
+	mutations    []localKVMutation
+}
+
+// append durably appends batch to the WAL.
+func (w *fileKVWAL) append(batch fileKVBatch) error {
+	if w.err != nil {
+		return fmt.Errorf("WAL is unusable due to previous error: %w", w.err)
+	}
+
+	record := encodeFileKVRecord(batch)
+	if _, err := w.f.Write(record); err != nil {
+		w.err = err
+		return fmt.Errorf("error writing to WAL: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		w.err = err
+		return fmt.Errorf("error syncing WAL: %w", err)
+	}
+	w.size += int64(len(record))
+	return nil
+}
+
+// maybeSnapshot starts snapshotting l in the background if the WAL is large enough and
+// a snapshot isn't already in progress. It must be called after the mutations that were
+// appended to the WAL have been applied to l.
+func (w *fileKVWAL) maybeSnapshot(l *localKV) {
+	if w.size-w.sizeAtLastSnapshot < w.opts.snapshotThresholdBytes || w.snapshotting.Load() {
+		return
+	}
+	// The transactions in the WAL are already durable so failing to snapshot shouldn't
+	// fail anything. The WAL will just keep growing until a snapshot succeeds.
+	snapshot, err := w.beginSnapshot(l)
+	if err != nil {
+		w.opts.logger.Log(types.LogLevelError, "error snapshotting file KV", "dir", w.dir, "error", err)
+		return
+	}
+	w.snapshotting.Store(true)
+	w.snapshotWG.Add(1)
+	go func() {
+		defer w.snapshotWG.Done()
+		defer w.snapshotting.Store(false)
+		if err := w.writeSnapshot(snapshot); err != nil {
+			w.opts.logger.Log(types.LogLevelError, "error snapshotting file KV", "dir", w.dir, "error", err)
+		}
+	}()
+}
+
+// snapshot synchronously snapshots l.
+func (w *fileKVWAL) snapshot(l *localKV) error {
+	w.snapshotWG.Wait()
+	snapshot, err := w.beginSnapshot(l)
+	if err != nil {
+		return err
+	}
+	return w.writeSnapshot(snapshot)
+}
+
+// beginSnapshot clones l's btree (which is cheap since it's copy-on-write) and rotates
+// the WAL so that the snapshot can be written without holding the localKV lock.
+func (w *fileKVWAL) beginSnapshot(l *localKV) (fileKVSnapshot, error) {
+	if w.err != nil {
+		return fileKVSnapshot{}, fmt.Errorf("WAL is unusable due to previous error: %w", w.err)
+	}
+
+	versionStamp, err := l.getVersionStamp()
+	if err != nil {
+		return fileKVSnapshot{}, err
+	}
+	snapshot := fileKVSnapshot{
+		b:            l.b.Clone(),
+		version:      l.version,
+		versionStamp: versionStamp,
+	}
+
+	oldWALPath := filepath.Join(w.dir, fileKVOldWALFileName)
+	if _, err := os.Stat(oldWALPath); err == nil {
+		// A previous snapshot failed (or the process crashed) after the WAL was rotated.
+		// The rotated WAL is still needed until a snapshot succeeds so don't rotate again,
+		// the snapshot will include the contents of both WALs anyway.
+		w.sizeAtLastSnapshot = w.size
+		return snapshot, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fileKVSnapshot{}, fmt.Errorf("error checking for rotated WAL: %w", err)
+	}
+
+	walPath := filepath.Join(w.dir, fileKVWALFileName)
+	if err := os.Rename(walPath, oldWALPath); err != nil {
+		return fileKVSnapshot{}, fmt.Errorf("error rotating WAL: %w", err)
+	}
+	// From here on w.f refers to the rotated WAL which the snapshot will delete, so the
+	// WAL must not be used again if the new one can't be created.
+	f, err := os.OpenFile(walPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0o644)
+	if err != nil {
+		w.err = err
+		return fileKVSnapshot{}, fmt.Errorf("error creating WAL: %w", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		f.Close()
+		w.err = err
+		return fileKVSnapshot{}, err
+	}
+	w.f.Close()
+	w.f = f
+	w.size = 0
+	w.sizeAtLastSnapshot = 0
+	return snapshot, nil
+}
+
+// writeSnapshot writes the entire contents of snapshot to a new snapshot file, atomically
+// replaces the previous snapshot with it, and then deletes the rotated WAL. It does not
+// require the localKV lock to be held.
+func (w *fileKVWAL) writeSnapshot(snapshot fileKVSnapshot) error {
+	tmpPath := filepath.Join(w.dir, fileKVSnapshotFileName+".tmp")
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	var (
+		bw    = bufio.NewWriterSize(f, 1<<20)
+		batch = fileKVBatch{
+			version:      snapshot.version,
+			versionStamp: snapshot.versionStamp,
+		}
+		writeErr error
+		flush    = func() {
+			if _, err := bw.Write(encodeFileKVRecord(batch)); err != nil && writeErr == nil {
+				writeErr = err
+			}
+			batch.mutations = batch.mutations[:0]
+		}
+	)
+	// Always write at least one record so the version and versionstamp are persisted
+	// even if the kv is empty.
+	flush()
+	snapshot.b.Ascend(func(kv btreeKV) bool {
+		batch.mutations = append(batch.mutations, localKVMutation{
+			typ: localKVMutationPut,
+			k:   kv.k,
+			v:   kv.v,
+		})
+		if len(batch.mutations) >= maxFileKVSnapshotRecordKVs {
+			flush()
+		}
+		return writeErr == nil
+	})
+	if len(batch.mutations) > 0 {
+		flush()
+	}
+	if writeErr != nil {
+		return fmt.Errorf("error writing snapshot: %w", writeErr)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing snapshot: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(w.dir, fileKVSnapshotFileName)); err != nil {
+		return fmt.Errorf("error renaming snapshot: %w", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	// The snapshot contains everything in the rotated WAL now so it can be deleted. If we
+	// crash before this is durable then the rotated WAL will just be replayed on top of
+	// the snapshot which is harmless.
+	if err := os.Remove(filepath.Join(w.dir, fileKVOldWALFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error deleting rotated WAL: %w", err)
+	}
+	return syncDir(w.dir)
+}
+
+// close waits for any in progress snapshot and then closes the WAL and releases the lock
+// on the directory.
+func (w *fileKVWAL) close() error {
+	w.snapshotWG.Wait()
+	err := w.f.Close()
+	if lockErr := w.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+func encodeFileKVRecord(batch fileKVBatch) []byte {
+	payload := make([]byte, 0, 64)
+	payload = binary.AppendUvarint(payload, batch.version)
+	payload = binary.AppendVarint(payload, batch.versionStamp)
+	payload = binary.AppendUvarint(payload, uint64(len(batch.mutations)))
+	for _, m := range batch.mutations {
+		payload = append(payload, m.typ)
+		payload = binary.AppendUvarint(payload, uint64(len(m.k)))
+		payload = append(payload, m.k...)
+		if m.typ == localKVMutationPut {
+			payload = binary.AppendUvarint(payload, uint64(len(m.v)))
+			payload = append(payload, m.v...)
+		}
+	}
+
+	record := make([]byte, fileKVRecordHeaderSize, fileKVRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, fileKVCRCTable))
+	return append(record, payload...)
+}
+
+func decodeFileKVBatch(payload []byte) (fileKVBatch, error) {
+	var (
+		batch fileKVBatch
+		n     int
+	)
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return 0, errors.New("invalid uvarint")
+		}
+		payload = payload[n:]
+		return v, nil
+	}
+	readBytes := func() ([]byte, error) {
+		l, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(payload)) < l {
+			return nil, errors.New("length exceeds remaining payload")
+		}
+		b := payload[:l:l]
+		payload = payload[l:]
+		return b, nil
+	}
+
+	var err error
+	if batch.version, err = readUvarint(); err != nil {
+		return fileKVBatch{}, err
+	}
+	batch.versionStamp, n = binary.Varint(payload)
+	if n <= 0 {
+		return fileKVBatch{}, errors.New("invalid varint")
+	}
+	payload = payload[n:]
+
+	numMutations, err := readUvarint()
+	if err != nil {
+		return fileKVBatch{}, err
+	}
+	for i := uint64(0); i < numMutations; i++ {
+		if len(payload) == 0 {
+			return fileKVBatch{}, errors.New("missing mutation")
+		}
+		m := localKVMutation{typ: payload[0]}
+		payload = payload[1:]
+		if m.k, err = readBytes(); err != nil {
+			return fileKVBatch{}, err
+		}
+		switch m.typ {
+		case localKVMutationPut:
+			if m.v, err = readBytes(); err != nil {
+				return fileKVBatch{}, err
+			}
+		case localKVMutationDelete:
+		default:
+			return fileKVBatch{}, fmt.Errorf("unknown mutation type: %d", m.typ)
+		}
+		batch.mutations = append(batch.mutations, m)
+	}
+	if len(payload) != 0 {
+		return fileKVBatch{}, fmt.Errorf("%d unexpected trailing bytes", len(payload))
+	}
+	return batch, nil
+}
+
+var errFileKVTornRecord = errors.New("torn or corrupt record")
+
+// readFileKVRecords calls fn with every record in the file at path, in order. It returns
+// the offset immediately after the last valid record. If it encounters a record that is
+// incomplete or corrupt then it stops and returns an error that wraps
+// errFileKVTornRecord.
+func readFileKVRecords(path string, fn func(fileKVBatch)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var (
+		r      = bufio.NewReaderSize(f, 1<<20)
+		header = make([]byte, fileKVRecordHeaderSize)
+		offset int64
+	)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("%w: error reading header at offset: %d, err: %v",
+				errFileKVTornRecord, offset, err)
+		}
+
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxFileKVRecordSize {
+			return offset, fmt.Errorf("%w: record at offset: %d has invalid size: %d",
+				errFileKVTornRecord, offset, size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return offset, fmt.Errorf("%w: error reading payload at offset: %d, err: %v",
+				errFileKVTornRecord, offset, err)
+		}
+		if crc32.Checksum(payload, fileKVCRCTable) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, fmt.Errorf("%w: record at offset: %d has invalid checksum",
+				errFileKVTornRecord, offset)
+		}
+		batch, err := decodeFileKVBatch(payload)
+		if err != nil {
+			return offset, fmt.Errorf("%w: error decoding record at offset: %d, err: %v",
+				errFileKVTornRecord, offset, err)
+		}
+
+		fn(batch)
+		offset += int64(fileKVRecordHeaderSize + len(payload))
+	}
+}
+
+// syncDir fsyncs dir so that files that were created, renamed or truncated in it are
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("error opening directory: %s, err: %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("error syncing directory: %s, err: %w", dir, err)
+	}
+	return nil
+}
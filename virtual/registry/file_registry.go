@@ -0,0 +1,22 @@
+package registry
+
+import "github.com/richardartoul/nola/virtual/types"
+
+// FileRegistryOptions contains the options for NewFileRegistry.
+type FileRegistryOptions struct {
+	// Logger logs errors that happen in the background, such as failed snapshots. If
+	// it's nil then errors are logged to stderr.
+	Logger types.Logger
+}
+
+// NewFileRegistry creates a new registry that is durably stored in dir on the local
+// filesystem. It is intended for single-node deployments and local development where
+// running FoundationDB is overkill, but the registry must survive restarts. Only a
+// single process may use dir at a time.
+func NewFileRegistry(dir string, opts FileRegistryOptions) (Registry, error) {
+	kv, err := newFileKV(dir, fileKVOptions{logger: opts.Logger})
+	if err != nil {
+		return nil, err
+	}
+	return newValidatedRegistry(newKVRegistry(kv)), nil
+}
@@ -0,0 +1,311 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRegistry(t *testing.T) {
+	testAllCommon(t, func() Registry {
+		registry, err := NewFileRegistry(t.TempDir(), FileRegistryOptions{})
+		require.NoError(t, err)
+		return registry
+	})
+}
+
+// TestFileRegistryRecovery tests that everything committed to a file registry survives
+// being reopened, both after a clean shutdown and after a "crash" (the registry is never
+// closed).
+func TestFileRegistryRecovery(t *testing.T) {
+	for _, clean := range []bool{true, false} {
+		t.Run(fmt.Sprintf("clean_%v", clean), func(t *testing.T) {
+			var (
+				ctx = context.Background()
+				dir = t.TempDir()
+			)
+			reg, err := NewFileRegistry(dir, FileRegistryOptions{})
+			require.NoError(t, err)
+			_, err = reg.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+			require.NoError(t, err)
+			writeTestActorKV(t, reg, "a", 10)
+			vs, err := reg.GetVersionStamp(ctx)
+			require.NoError(t, err)
+			if clean {
+				require.NoError(t, reg.Close(ctx))
+			} else {
+				crashFileKV(reg.(*validator).r.(*kvRegistry).kv.(instrumentedKV).kv)
+			}
+
+			reg, err = NewFileRegistry(dir, FileRegistryOptions{})
+			require.NoError(t, err)
+			defer reg.Close(ctx)
+			requireTestActorKV(t, reg, "a", 10)
+
+			// Versionstamps must never go backwards, even across restarts.
+			vs2, err := reg.GetVersionStamp(ctx)
+			require.NoError(t, err)
+			require.Greater(t, vs2, vs)
+
+			// The server's version should be preserved as well.
+			result, err := reg.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+			require.NoError(t, err)
+			require.Equal(t, int64(1), result.ServerVersion)
+		})
+	}
+}
+
+// TestFileKVTornWAL tests that a partially written record at the end of the WAL (from a
+// transaction that was being committed when the process crashed) is discarded, and that
+// the WAL can be appended to afterwards.
+func TestFileKVTornWAL(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+	kv, err := newFileKV(dir, fileKVOptions{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		putTestKey(t, kv, i)
+	}
+
+	walPath := filepath.Join(dir, fileKVWALFileName)
+	stat, err := os.Stat(walPath)
+	require.NoError(t, err)
+	// Chop off part of the last record and then append some garbage.
+	require.NoError(t, os.Truncate(walPath, stat.Size()-3))
+	f, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("garbage"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	crashFileKV(kv)
+	kv, err = newFileKV(dir, fileKVOptions{})
+	require.NoError(t, err)
+	requireTestKeys(t, kv, 2)
+	putTestKey(t, kv, 2)
+	putTestKey(t, kv, 3)
+	require.NoError(t, kv.close(ctx))
+
+	kv, err = newFileKV(dir, fileKVOptions{})
+	require.NoError(t, err)
+	defer kv.close(ctx)
+	requireTestKeys(t, kv, 4)
+}
+
+// TestFileKVSnapshot tests that the WAL is rotated and snapshotted once it is large
+// enough, and that recovery works from a snapshot and the WALs, including when the
+// process crashed after the snapshot was written, but before the rotated WAL was deleted.
+func TestFileKVSnapshot(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		dir  = t.TempDir()
+		opts = fileKVOptions{snapshotThresholdBytes: 1024}
+	)
+	kv, err := newFileKV(dir, opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		putTestKey(t, kv, i)
+	}
+	// Deletes should be persisted as well.
+	_, err = kv.transact(func(tr transaction) (any, error) {
+		return nil, tr.delete(ctx, []byte("key-99"))
+	})
+	require.NoError(t, err)
+	waitForFileKVSnapshot(kv)
+
+	// Commits keep being appended to the WAL while a snapshot is written in the
+	// background so it may have grown past the threshold again, but it must have been
+	// rotated since the first key was written.
+	walPath := filepath.Join(dir, fileKVWALFileName)
+	_, err = readFileKVRecords(walPath, func(b fileKVBatch) {
+		for _, m := range b.mutations {
+			require.NotEqual(t, "key-0", string(m.k))
+		}
+	})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, fileKVSnapshotFileName))
+	require.NoError(t, err)
+	// The rotated WAL is deleted once the snapshot has been written.
+	oldWALPath := filepath.Join(dir, fileKVOldWALFileName)
+	_, err = os.Stat(oldWALPath)
+	require.True(t, errors.Is(err, os.ErrNotExist))
+
+	// Save the WAL right before it is rotated so we can simulate a crash before the
+	// rotated WAL was deleted.
+	var rotatedWAL []byte
+	for i := 100; ; i++ {
+		wal, err := os.ReadFile(walPath)
+		require.NoError(t, err)
+		putTestKey(t, kv, i)
+		waitForFileKVSnapshot(kv)
+		stat, err := os.Stat(walPath)
+		require.NoError(t, err)
+		if stat.Size() == 0 {
+			rotatedWAL = wal
+			break
+		}
+	}
+	numKeys := 0
+	_, err = kv.transact(func(tr transaction) (any, error) {
+		return nil, tr.iterPrefix(ctx, []byte("key-"), func(k, v []byte) error {
+			numKeys++
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	crashFileKV(kv)
+	require.NoError(t, os.WriteFile(oldWALPath, rotatedWAL, 0o644))
+
+	kv, err = newFileKV(dir, opts)
+	require.NoError(t, err)
+	defer kv.close(ctx)
+	_, err = kv.transact(func(tr transaction) (any, error) {
+		_, ok, err := tr.get(ctx, []byte("key-99"))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		recovered := 0
+		err = tr.iterPrefix(ctx, []byte("key-"), func(k, v []byte) error {
+			recovered++
+			require.Equal(t, "value-"+string(k[len("key-"):]), string(v))
+			return nil
+		})
+		require.Equal(t, numKeys, recovered)
+		return nil, err
+	})
+	require.NoError(t, err)
+
+	// The leftover rotated WAL is deleted by the next snapshot, without rotating the WAL
+	// again since the snapshot includes it.
+	for i := 0; ; i++ {
+		putTestKey(t, kv, numKeys+i)
+		waitForFileKVSnapshot(kv)
+		if _, err := os.Stat(oldWALPath); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+}
+
+// TestFileKVLock tests that a directory can't be opened by more than one kv at a time.
+func TestFileKVLock(t *testing.T) {
+	var (
+		ctx = context.Background()
+		dir = t.TempDir()
+	)
+	kv, err := newFileKV(dir, fileKVOptions{})
+	require.NoError(t, err)
+	putTestKey(t, kv, 0)
+
+	_, err = newFileKV(dir, fileKVOptions{})
+	require.Error(t, err)
+	_, err = NewFileRegistry(dir, FileRegistryOptions{})
+	require.Error(t, err)
+
+	require.NoError(t, kv.close(ctx))
+	kv, err = newFileKV(dir, fileKVOptions{})
+	require.NoError(t, err)
+	defer kv.close(ctx)
+	requireTestKeys(t, kv, 1)
+}
+
+// TestFileKVCorruptSnapshot tests that a corrupt snapshot is reported instead of silently
+// losing data.
+func TestFileKVCorruptSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	kv, err := newFileKV(dir, fileKVOptions{})
+	require.NoError(t, err)
+	putTestKey(t, kv, 0)
+	require.NoError(t, kv.unsafeWipeAll())
+	require.NoError(t, kv.close(context.Background()))
+
+	snapshotPath := filepath.Join(dir, fileKVSnapshotFileName)
+	snapshot, err := os.ReadFile(snapshotPath)
+	require.NoError(t, err)
+	snapshot[len(snapshot)-1] ^= 0xFF
+	require.NoError(t, os.WriteFile(snapshotPath, snapshot, 0o644))
+
+	_, err = newFileKV(dir, fileKVOptions{})
+	require.Error(t, err)
+}
+
+// waitForFileKVSnapshot waits for the snapshot that's being written in the background
+// by kv, if any.
+func waitForFileKVSnapshot(kv kv) {
+	kv.(*localKV).wal.snapshotWG.Wait()
+}
+
+// crashFileKV simulates the process that opened kv crashing by releasing its lock on the
+// directory without closing anything else.
+func crashFileKV(kv kv) {
+	waitForFileKVSnapshot(kv)
+	kv.(*localKV).wal.lock.Close()
+}
+
+func putTestKey(t *testing.T, kv kv, i int) {
+	_, err := kv.transact(func(tr transaction) (any, error) {
+		return nil, tr.put(
+			context.Background(),
+			[]byte(fmt.Sprintf("key-%d", i)),
+			[]byte(fmt.Sprintf("value-%d", i)))
+	})
+	require.NoError(t, err)
+}
+
+func requireTestKeys(t *testing.T, kv kv, n int) {
+	ctx := context.Background()
+	_, err := kv.transact(func(tr transaction) (any, error) {
+		for i := 0; i < n+1; i++ {
+			v, ok, err := tr.get(ctx, []byte(fmt.Sprintf("key-%d", i)))
+			require.NoError(t, err)
+			if i == n {
+				require.False(t, ok)
+				continue
+			}
+			require.True(t, ok)
+			require.Equal(t, fmt.Sprintf("value-%d", i), string(v))
+		}
+		return nil, nil
+	})
+	require.NoError(t, err)
+}
+
+// writeTestActorKV creates actorID (activated on server1) and writes n keys to its KV
+// storage. The test module must already be registered.
+func writeTestActorKV(t *testing.T, reg Registry, actorID string, n int) {
+	ctx := context.Background()
+	_, err := reg.CreateActor(ctx, "ns1", actorID, "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+	_, err = reg.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+	_, err = reg.EnsureActivation(ctx, "ns1", actorID)
+	require.NoError(t, err)
+
+	tr, err := reg.BeginTransaction(ctx, "ns1", actorID, "server1", 1)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		require.NoError(t, tr.Put(ctx, []byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.NoError(t, tr.Commit(ctx))
+}
+
+func requireTestActorKV(t *testing.T, reg Registry, actorID string, n int) {
+	ctx := context.Background()
+	tr, err := reg.BeginTransaction(ctx, "ns1", actorID, "server1", 1)
+	require.NoError(t, err)
+	defer tr.Cancel(ctx)
+	for i := 0; i < n; i++ {
+		v, ok, err := tr.Get(ctx, []byte(fmt.Sprintf("key-%d", i)))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("value-%d", i), string(v))
+	}
+}
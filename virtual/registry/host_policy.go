@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+// HostPolicyWildcard matches any namespace or module ID in a HostPolicyTarget.
+const HostPolicyWildcard = "*"
+
+// HostPolicy restricts the host functions that a module's actors are allowed to call.
+// Modules without a policy can call every host function.
+type HostPolicy struct {
+	// AllowedOperations contains the host operations that the module's actors are allowed
+	// to perform, for example: KV-PUT or INVOKE-ACTOR. See the *OperationName constants in
+	// the wapcutils package. Actors are always allowed to emit the chunks of streaming
+	// invocations.
+	AllowedOperations []string `json:"allowed_operations,omitempty"`
+	// AllowedTargets restricts which actors the module's actors are allowed to create,
+	// invoke (immediately or scheduled), send messages to, or include in multi-actor
+	// transactions, based on the target actor's module. An actor is always allowed to
+	// target itself.
+	AllowedTargets []HostPolicyTarget `json:"allowed_targets,omitempty"`
+	// AllowedCustomFns contains the custom host functions (see
+	// EnvironmentOptions.CustomHostFns) that the module's actors are allowed to call.
+	AllowedCustomFns []string `json:"allowed_custom_fns,omitempty"`
+}
+
+// HostPolicyTarget matches the actors of a module. Either field can be
+// HostPolicyWildcard to match any namespace or module ID.
+type HostPolicyTarget struct {
+	Namespace string `json:"namespace"`
+	ModuleID  string `json:"module_id"`
+}
+
+// hostPolicyOperations contains every host operation that can be restricted by a
+// HostPolicy.
+var hostPolicyOperations = map[string]struct{}{
+	wapcutils.KVPutOperationName:              {},
+	wapcutils.KVGetOperationName:              {},
+	wapcutils.KVPutActorOperationName:         {},
+	wapcutils.KVGetActorOperationName:         {},
+	wapcutils.CreateActorOperationName:        {},
+	wapcutils.InvokeActorOperationName:        {},
+	wapcutils.ScheduleInvocationOperationName: {},
+	wapcutils.SubscribeOperationName:          {},
+	wapcutils.UnsubscribeOperationName:        {},
+	wapcutils.PublishOperationName:            {},
+	wapcutils.SendMessageOperationName:        {},
+}
+
+// Validate validates the policy.
+func (p *HostPolicy) Validate() error {
+	for _, op := range p.AllowedOperations {
+		if _, ok := hostPolicyOperations[op]; !ok {
+			return fmt.Errorf("unknown host operation: %s", op)
+		}
+	}
+	for _, target := range p.AllowedTargets {
+		if target.Namespace == "" || target.ModuleID == "" {
+			return errors.New("host policy targets must specify a namespace and module ID")
+		}
+	}
+	for _, fn := range p.AllowedCustomFns {
+		if fn == "" {
+			return errors.New("host policy custom function names must not be empty")
+		}
+	}
+	return nil
+}
+
+// AllowsOperation returns whether the policy allows the provided host operation.
+func (p *HostPolicy) AllowsOperation(op string) bool {
+	if op == wapcutils.StreamEmitOperationName {
+		return true
+	}
+	return containsString(p.AllowedOperations, op)
+}
+
+// AllowsCustomFn returns whether the policy allows the provided custom host function.
+func (p *HostPolicy) AllowsCustomFn(fn string) bool {
+	return containsString(p.AllowedCustomFns, fn)
+}
+
+// AllowsTarget returns whether the policy allows targeting the actors of the provided
+// module.
+func (p *HostPolicy) AllowsTarget(namespace, moduleID string) bool {
+	for _, target := range p.AllowedTargets {
+		if (target.Namespace == HostPolicyWildcard || target.Namespace == namespace) &&
+			(target.ModuleID == HostPolicyWildcard || target.ModuleID == moduleID) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAllTargets returns whether the policy allows targeting the actors of every
+// module.
+func (p *HostPolicy) AllowsAllTargets() bool {
+	for _, target := range p.AllowedTargets {
+		if target.Namespace == HostPolicyWildcard && target.ModuleID == HostPolicyWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
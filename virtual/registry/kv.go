@@ -1,6 +1,11 @@
 package registry
 
-import "context"
+import (
+	"context"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
 
 // kv is a generic interface for a transactional, sorted KV. It is used to
 // abstract over various KV implementation so we can implement the registry
@@ -9,6 +14,13 @@ import "context"
 type kv interface {
 	beginTransaction(ctx context.Context) (transaction, error)
 	transact(func(transaction) (any, error)) (any, error)
+	// watch returns a channel that will be closed once key is modified by a committed
+	// transaction. Implementations may close the channel spuriously so callers should
+	// always recheck whatever they're waiting for.
+	watch(ctx context.Context, key []byte) (<-chan struct{}, error)
+	// maxTransactionDuration returns the maximum amount of time a transaction can stay
+	// open for, or 0 if the implementation doesn't limit it.
+	maxTransactionDuration() time.Duration
 	close(ctx context.Context) error
 	unsafeWipeAll() error
 }
@@ -16,7 +28,22 @@ type kv interface {
 type transaction interface {
 	put(ctx context.Context, key []byte, value []byte) error
 	get(ctx context.Context, key []byte) ([]byte, bool, error)
+	delete(ctx context.Context, key []byte) error
 	iterPrefix(ctx context.Context, prefix []byte, fn func(k, v []byte) error) error
+	// iterRange iterates all the keys in [start, end).
+	iterRange(ctx context.Context, start, end []byte, fn func(k, v []byte) error) error
+	// putVersionstamped stores value at key, which must end with an incomplete versionstamp
+	// (tuple.IncompleteVersionstamp()). The versionstamp is completed when the transaction
+	// commits such that it is greater than the versionstamp of every previously committed
+	// key.
+	putVersionstamped(ctx context.Context, key tuple.Tuple, value []byte) error
+	// touch modifies the value of key (without reading it) so that watchers of key are
+	// notified when the transaction commits.
+	touch(ctx context.Context, key []byte) error
+	// add atomically adds delta to the little-endian int64 stored at key (which is treated
+	// as zero if it doesn't exist) without reading it, so that concurrent transactions that
+	// add to the same key don't conflict with each other.
+	add(ctx context.Context, key []byte, delta int64) error
 	// Monotonically increase number that should increase at a rate of ~ 1 million
 	// per second.
 	getVersionStamp() (int64, error)
@@ -1,11 +1,20 @@
 package registry
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/richardartoul/nola/virtual/types"
@@ -15,6 +24,34 @@ import (
 )
 
 const (
+	// maxActorKVChangesPerRead is the maximum number of change log entries WatchActorKV
+	// will read in a single transaction.
+	maxActorKVChangesPerRead = 1000
+	// maxImportKeysPerTransaction is the maximum number of keys ImportActorKV will write
+	// in a single transaction.
+	maxImportKeysPerTransaction = 1000
+	// maxExportActorsPerTransaction is the maximum number of actor IDs ExportNamespaceKV
+	// will list in a single transaction.
+	maxExportActorsPerTransaction = 1000
+	// actorKVChangeLogRetention is how long entries are retained in an actor's KV change
+	// log. Watchers that fall further behind than this have to start watching again.
+	actorKVChangeLogRetention = 24 * time.Hour
+	// maxActorKVChangeLogTrimsPerPut is the maximum number of expired change log entries
+	// that are deleted by each write to an actor's KV storage. It's greater than one so
+	// that the log shrinks back to the retention period after bursts of writes.
+	maxActorKVChangeLogTrimsPerPut = 10
+	// invocationResultRetention is how long the results of invocations that were
+	// performed with an idempotency key are retained. Retrying an invocation after that
+	// invokes the actor again.
+	invocationResultRetention = 24 * time.Hour
+	// inboxDedupRetention is how long the IDs of enqueued messages are retained for
+	// deduplication. Enqueueing a message with the same ID after that enqueues it again.
+	inboxDedupRetention = 24 * time.Hour
+	// maxExpiredActorKeysTrimsPerPut is the maximum number of expired invocation results
+	// and dedup entries that are deleted each time one is written, for the same reason as
+	// maxActorKVChangeLogTrimsPerPut.
+	maxExpiredActorKeysTrimsPerPut = 10
+
 	// HeartbeatTTL is the maximum amount of time between server heartbeats before
 	// the registry will consider a server as dead.
 	//
@@ -23,7 +60,16 @@ const (
 )
 
 var (
-	errActorDoesNotExist = errors.New("actor does not exist")
+	errActorDoesNotExist   = errors.New("actor does not exist")
+	errModuleAlreadyExists = errors.New("module already exists")
+	// errActorKVChangesTruncated is returned by WatchActorKV when changes after the
+	// requested version have already been deleted from the change log.
+	errActorKVChangesTruncated = errors.New("actor KV changes have been truncated")
+	// errStopIteration is returned by iterPrefix callbacks to stop iterating early.
+	errStopIteration = errors.New("stop iteration")
+	// errTransactionConflict is returned when a transaction fails to commit because it
+	// conflicted with a concurrent transaction. The transaction can be retried.
+	errTransactionConflict = errors.New("transaction conflicted with a concurrent transaction")
 )
 
 // IsActorDoesNotExistErr returns a boolean indicating whether the error is an
@@ -32,20 +78,42 @@ func IsActorDoesNotExistErr(err error) bool {
 	return errors.Is(err, errActorDoesNotExist)
 }
 
+// IsActorKVChangesTruncatedErr returns a boolean indicating whether the error is an
+// instance of (or wraps) errActorKVChangesTruncated. Watchers that receive it have
+// missed changes and should re-read the actor's KV storage before watching again.
+func IsActorKVChangesTruncatedErr(err error) bool {
+	return errors.Is(err, errActorKVChangesTruncated)
+}
+
+// IsTransactionConflictErr returns a boolean indicating whether the error is an
+// instance of (or wraps) errTransactionConflict. Transactions that fail with a conflict
+// error can be safely retried.
+func IsTransactionConflictErr(err error) bool {
+	return errors.Is(err, errTransactionConflict)
+}
+
 type kvRegistry struct {
 	versionStampBatcher singleflight.Group
+	// indexBuilds deduplicates the background builds of namespace indexes, and
+	// indexBuildsWG tracks them so that Close can wait for them after canceling ctx.
+	indexBuilds   singleflight.Group
+	indexBuildsWG sync.WaitGroup
+	ctx           context.Context
+	cancel        func()
 
 	// State.
 	kv kv
 }
 
 func newKVRegistry(kv kv) Registry {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &kvRegistry{
-		kv: kv,
+		ctx:    ctx,
+		cancel: cancel,
+		kv:     newInstrumentedKV(kv),
 	}
 }
 
-// TODO: Add compression?
 func (k *kvRegistry) RegisterModule(
 	ctx context.Context,
 	namespace,
@@ -53,53 +121,118 @@ func (k *kvRegistry) RegisterModule(
 	moduleBytes []byte,
 	opts ModuleOptions,
 ) (RegisterModuleResult, error) {
-	r, err := k.kv.transact(func(tr transaction) (any, error) {
-		_, ok, err := tr.get(ctx, getModulePartKey(namespace, moduleID, 0))
+	return k.RegisterModuleStream(ctx, namespace, moduleID, bytes.NewReader(moduleBytes), opts)
+}
+
+// RegisterModuleStream stores the module's bytes in the content-addressed module store
+// (see module_store.go) over multiple transactions so that modules aren't limited by the
+// maximum size of a single transaction. Once the module's bytes have been stored, a
+// reference from the namespace and module ID to the module's hash is committed
+// atomically which is what actually makes the module visible.
+func (k *kvRegistry) RegisterModuleStream(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+	r io.Reader,
+	opts ModuleOptions,
+) (RegisterModuleResult, error) {
+	exists, err := k.kv.transact(func(tr transaction) (any, error) {
+		exists, err := moduleExists(ctx, tr, namespace, moduleID)
+		if err != nil || exists {
+			return exists, err
+		}
+		// Fail fast before storing the module's bytes if the namespace can't have any
+		// more modules. The quotas are checked again when the module is committed.
+		return false, checkNamespaceQuotas(ctx, tr, namespace, 0, 1, 0, 0)
+	})
+	if err != nil {
+		return RegisterModuleResult{}, fmt.Errorf("RegisterModule: error: %w", err)
+	}
+	if exists.(bool) {
+		return k.moduleAlreadyExists(namespace, moduleID, opts)
+	}
+
+	blob, err := writeModuleBlob(ctx, k.kv, r)
+	if err != nil {
+		return RegisterModuleResult{}, fmt.Errorf("RegisterModule: error: %w", err)
+	}
+
+	marshaledRef, err := json.Marshal(&moduleRef{
+		Hash: blob.hash,
+		Size: blob.Size,
+		Opts: opts,
+	})
+	if err != nil {
+		return RegisterModuleResult{}, fmt.Errorf("RegisterModule: error marshaling module: %w", err)
+	}
+	marshaledBlob, err := json.Marshal(&blob)
+	if err != nil {
+		return RegisterModuleResult{}, fmt.Errorf("RegisterModule: error marshaling module blob: %w", err)
+	}
+	var stored bool
+	_, err = k.kv.transact(func(tr transaction) (any, error) {
+		// Transactions may be retried.
+		stored = false
+
+		// Check again in case the module was registered concurrently.
+		exists, err := moduleExists(ctx, tr, namespace, moduleID)
 		if err != nil {
 			return nil, err
 		}
-		if ok {
-			if opts.AllowEmptyModuleBytes {
-				// If empty module bytes are allowed then the fact that the
-				// module already exists doesn't matter and we can just return
-				// success. This makes it easier to register pure Go modules
-				// on process startup each time without having to explicitly
-				// handle "module already exists" errors.
-				return RegisterModuleResult{}, nil
-			}
-
-			return RegisterModuleResult{}, fmt.Errorf(
-				"error creating module: %s in namespace: %s, already exists",
-				moduleID, namespace)
+		if exists {
+			return nil, errModuleAlreadyExists
 		}
-
-		rm := registeredModule{
-			Bytes: moduleBytes,
-			Opts:  opts,
+		if err := checkNamespaceQuotas(ctx, tr, namespace, 0, 1, blob.Size, 0); err != nil {
+			return nil, err
 		}
-		marshaled, err := json.Marshal(&rm)
-		if err != nil {
+		if err := ensureNamespace(ctx, tr, namespace); err != nil {
 			return nil, err
 		}
 
-		for i := 0; len(marshaled) > 0; i++ {
-			// Maximum value size in FoundationDB is 100_000, so split anything larger
-			// over multiple KV pairs.
-			numBytes := 99_999
-			if len(marshaled) < numBytes {
-				numBytes = len(marshaled)
-			}
-			toWrite := marshaled[:numBytes]
-			tr.put(ctx, getModulePartKey(namespace, moduleID, i), toWrite)
-			marshaled = marshaled[numBytes:]
+		// The blob may already exist if the same module was registered previously (in
+		// any namespace).
+		stored, err = storeModuleBlob(ctx, tr, blob, marshaledBlob)
+		if err != nil {
+			return nil, err
 		}
-		return RegisterModuleResult{}, err
+		return nil, tr.put(ctx, getModuleRefKey(namespace, moduleID), marshaledRef)
 	})
+	if !stored {
+		// The existing blob (if there is one) already references the chunks. If the
+		// module was registered anyways then errors releasing them are ignored since
+		// the only consequence is that the chunks won't be deleted along with the blob.
+		releaseErr := releaseModuleChunks(ctx, k.kv, blob.distinctChunks())
+		if releaseErr != nil && err != nil {
+			err = fmt.Errorf("%w (error releasing module chunks: %v)", err, releaseErr)
+		}
+	}
+	if errors.Is(err, errModuleAlreadyExists) {
+		return k.moduleAlreadyExists(namespace, moduleID, opts)
+	}
 	if err != nil {
-		return RegisterModuleResult{}, fmt.Errorf("RegisterModule: error: %w", err)
+		return RegisterModuleResult{}, fmt.Errorf("RegisterModule: error writing module: %w", err)
+	}
+
+	return RegisterModuleResult{Hash: blob.hash}, nil
+}
+
+func (k *kvRegistry) moduleAlreadyExists(
+	namespace,
+	moduleID string,
+	opts ModuleOptions,
+) (RegisterModuleResult, error) {
+	if opts.AllowEmptyModuleBytes {
+		// If empty module bytes are allowed then the fact that the
+		// module already exists doesn't matter and we can just return
+		// success. This makes it easier to register pure Go modules
+		// on process startup each time without having to explicitly
+		// handle "module already exists" errors.
+		return RegisterModuleResult{}, nil
 	}
 
-	return r.(RegisterModuleResult), nil
+	return RegisterModuleResult{}, fmt.Errorf(
+		"RegisterModule: error: error creating module: %s in namespace: %s, already exists",
+		moduleID, namespace)
 }
 
 // GetModule gets the bytes and options associated with the provided module.
@@ -108,38 +241,123 @@ func (k *kvRegistry) GetModule(
 	namespace,
 	moduleID string,
 ) ([]byte, ModuleOptions, error) {
-	key := getModulePrefix(namespace, moduleID)
+	ref, legacy, err := k.getModuleRef(ctx, namespace, moduleID)
+	if err != nil {
+		return nil, ModuleOptions{}, fmt.Errorf("GetModule: error: %w", err)
+	}
+	if legacy != nil {
+		return legacy.Bytes, legacy.Opts, nil
+	}
+
+	moduleBytes, err := readModuleBlob(ctx, k.kv, ref.Hash)
+	if err != nil {
+		return nil, ModuleOptions{}, fmt.Errorf(
+			"GetModule: error reading module: %s in namespace: %s, err: %w",
+			moduleID, namespace, err)
+	}
+	return moduleBytes, ref.Opts, nil
+}
+
+func (k *kvRegistry) GetModuleInfo(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+) (ModuleInfo, error) {
+	ref, legacy, err := k.getModuleRef(ctx, namespace, moduleID)
+	if err != nil {
+		return ModuleInfo{}, fmt.Errorf("GetModuleInfo: error: %w", err)
+	}
+	if legacy != nil {
+		hash := sha256.Sum256(legacy.Bytes)
+		return ModuleInfo{
+			Hash: hex.EncodeToString(hash[:]),
+			Size: int64(len(legacy.Bytes)),
+			Opts: legacy.Opts,
+		}, nil
+	}
+	return ModuleInfo{
+		Hash: ref.Hash,
+		Size: ref.Size,
+		Opts: ref.Opts,
+	}, nil
+}
+
+// getModuleRef returns the reference for the provided module. If the module was stored
+// by an older version then the entire module is returned instead.
+func (k *kvRegistry) getModuleRef(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+) (moduleRef, *registeredModule, error) {
 	r, err := k.kv.transact(func(tr transaction) (any, error) {
-		var (
-			moduleBytes []byte
-			i           = 0
-		)
-		err := tr.iterPrefix(ctx, key, func(k, v []byte) error {
-			moduleBytes = append(moduleBytes, v...)
-			i++
-			return nil
-		})
+		v, ok, err := tr.get(ctx, getModuleRefKey(namespace, moduleID))
 		if err != nil {
-			return ModuleOptions{}, err
+			return nil, err
 		}
-		if i == 0 {
-			return ModuleOptions{}, fmt.Errorf(
-				"error getting module: %s, does not exist in namespace: %s",
-				moduleID, namespace)
+		if !ok {
+			return getLegacyModule(ctx, tr, namespace, moduleID)
 		}
 
-		rm := registeredModule{}
-		if err := json.Unmarshal(moduleBytes, &rm); err != nil {
-			return ModuleOptions{}, fmt.Errorf("error unmarshaling stored module: %w", err)
+		var ref moduleRef
+		if err := json.Unmarshal(v, &ref); err != nil {
+			return nil, fmt.Errorf("error unmarshaling module: %w", err)
 		}
-		return rm, nil
+		return ref, nil
 	})
 	if err != nil {
-		return nil, ModuleOptions{}, fmt.Errorf("GetModule: error: %w", err)
+		return moduleRef{}, nil, err
+	}
+	if legacy, ok := r.(registeredModule); ok {
+		return moduleRef{}, &legacy, nil
+	}
+	return r.(moduleRef), nil, nil
+}
+
+// getLegacyModule reads a module that was stored by older versions as a JSON encoded
+// registeredModule split over multiple keys.
+func getLegacyModule(
+	ctx context.Context,
+	tr transaction,
+	namespace,
+	moduleID string,
+) (registeredModule, error) {
+	var moduleBytes []byte
+	for i := 0; ; i++ {
+		v, ok, err := tr.get(ctx, getModulePartKey(namespace, moduleID, i))
+		if err != nil {
+			return registeredModule{}, err
+		}
+		if !ok {
+			if i == 0 {
+				return registeredModule{}, fmt.Errorf(
+					"error getting module: %s, does not exist in namespace: %s",
+					moduleID, namespace)
+			}
+			break
+		}
+		moduleBytes = append(moduleBytes, v...)
+	}
+
+	rm := registeredModule{}
+	if err := json.Unmarshal(moduleBytes, &rm); err != nil {
+		return registeredModule{}, fmt.Errorf("error unmarshaling stored module: %w", err)
 	}
+	return rm, nil
+}
 
-	result := r.(registeredModule)
-	return result.Bytes, result.Opts, nil
+// moduleExists returns whether the module has been registered.
+func moduleExists(
+	ctx context.Context,
+	tr transaction,
+	namespace,
+	moduleID string,
+) (bool, error) {
+	_, ok, err := tr.get(ctx, getModuleRefKey(namespace, moduleID))
+	if err != nil || ok {
+		return ok, err
+	}
+	_, ok, err = tr.get(ctx, getModulePartKey(namespace, moduleID, 0))
+	return ok, err
 }
 
 func (k *kvRegistry) CreateActor(
@@ -149,10 +367,7 @@ func (k *kvRegistry) CreateActor(
 	moduleID string,
 	opts types.ActorOptions,
 ) (CreateActorResult, error) {
-	var (
-		actorKey  = getActorKey(namespace, actorID)
-		moduleKey = getModulePartKey(namespace, moduleID, 0)
-	)
+	actorKey := getActorKey(namespace, actorID)
 	r, err := k.kv.transact(func(tr transaction) (any, error) {
 		_, ok, err := k.getActorBytes(ctx, tr, actorKey)
 		if err != nil {
@@ -164,7 +379,7 @@ func (k *kvRegistry) CreateActor(
 				actorID, namespace)
 		}
 
-		_, ok, err = tr.get(ctx, moduleKey)
+		ok, err = moduleExists(ctx, tr, namespace, moduleID)
 		if err != nil {
 			return nil, err
 		}
@@ -173,6 +388,9 @@ func (k *kvRegistry) CreateActor(
 				"error creating actor, module: %s does not exist in namespace: %s",
 				moduleID, namespace)
 		}
+		if err := checkNamespaceQuotas(ctx, tr, namespace, 1, 0, 0, 0); err != nil {
+			return nil, err
+		}
 
 		ra := registeredActor{
 			Opts:       opts,
@@ -184,8 +402,19 @@ func (k *kvRegistry) CreateActor(
 			return nil, err
 		}
 
-		tr.put(ctx, actorKey, marshaled)
-		return CreateActorResult{}, err
+		if err := tr.put(ctx, actorKey, marshaled); err != nil {
+			return nil, err
+		}
+		if err := addToCounter(ctx, tr, getNamespaceActorCountKey(namespace), 1); err != nil {
+			return nil, err
+		}
+		if err := addToCounter(ctx, tr, getModuleActorCountKey(namespace, moduleID), 1); err != nil {
+			return nil, err
+		}
+		if err := tr.put(ctx, getActorIndexKey(namespace, actorID), []byte{}); err != nil {
+			return nil, err
+		}
+		return CreateActorResult{}, nil
 	})
 	if err != nil {
 		return CreateActorResult{}, fmt.Errorf("CreateActor: error: %w", err)
@@ -327,6 +556,10 @@ func (k *kvRegistry) EnsureActivation(
 			}
 
 			tr.put(ctx, actorKey, marshaled)
+
+			if err := movePendingInbox(ctx, tr, namespace, actorID, serverID); err != nil {
+				return nil, err
+			}
 		}
 
 		ref, err := types.NewActorReference(serverID, serverVersion, serverAddress, namespace, ra.ModuleID, actorID, ra.Generation)
@@ -344,6 +577,73 @@ func (k *kvRegistry) EnsureActivation(
 	return references.([]types.ActorReference), nil
 }
 
+func (k *kvRegistry) DescribeActor(
+	ctx context.Context,
+	namespace,
+	actorID string,
+) (ActorInfo, error) {
+	actorKey := getActorKey(namespace, actorID)
+	info, err := k.kv.transact(func(tr transaction) (any, error) {
+		ra, ok, err := k.getActor(ctx, tr, actorKey)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf(
+				"error describing actor with ID: %s, does not exist in namespace: %s, err: %w",
+				actorID, namespace, errActorDoesNotExist)
+		}
+
+		info := ActorInfo{
+			Namespace:  namespace,
+			ActorID:    actorID,
+			ModuleID:   ra.ModuleID,
+			Generation: ra.Generation,
+			Opts:       ra.Opts,
+		}
+		if ra.Activation.ServerID != "" {
+			v, ok, err := tr.get(ctx, getServerKey(ra.Activation.ServerID))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				var server serverState
+				if err := json.Unmarshal(v, &server); err != nil {
+					return nil, fmt.Errorf(
+						"error unmarshaling server state with ID: %s, err: %w", ra.Activation.ServerID, err)
+				}
+				vs, err := tr.getVersionStamp()
+				if err != nil {
+					return nil, fmt.Errorf("error getting versionstamp: %w", err)
+				}
+				// Same as EnsureActivation, the activation is only current if its server
+				// is still alive.
+				if versionSince(vs, server.LastHeartbeatedAt) < HeartbeatTTL {
+					info.Activation = &ActorActivation{
+						ServerID:      server.ServerID,
+						ServerVersion: server.ServerVersion,
+						ServerAddress: server.HeartbeatState.Address,
+					}
+				}
+			}
+		}
+
+		info.KVBytes, err = getAtomicCounter(ctx, tr, getActorKVBytesKey(namespace, actorID))
+		if err != nil {
+			return nil, fmt.Errorf("error getting KV bytes of actor: %s, err: %w", actorID, err)
+		}
+		return info, nil
+	})
+	if err != nil {
+		return ActorInfo{}, fmt.Errorf("DescribeActor: error: %w", err)
+	}
+	return info.(ActorInfo), nil
+}
+
+func (k *kvRegistry) MaxTransactionDuration() time.Duration {
+	return k.kv.maxTransactionDuration()
+}
+
 func (k *kvRegistry) GetVersionStamp(
 	ctx context.Context,
 ) (int64, error) {
@@ -388,13 +688,32 @@ func (k *kvRegistry) BeginTransaction(
 		}
 	}()
 
+	if err := k.checkFencingToken(ctx, kvTr, namespace, actorID, serverID, serverVersion); err != nil {
+		return nil, fmt.Errorf("kvRegistry: beginTransaction: %w", err)
+	}
+
+	tr := newKVTransaction(ctx, k, namespace, actorID, kvTr)
+	return tr, nil
+}
+
+// checkFencingToken checks that the actor is currently activated on the server with the
+// provided ID and version.
+func (k *kvRegistry) checkFencingToken(
+	ctx context.Context,
+	kvTr transaction,
+	namespace string,
+	actorID string,
+	serverID string,
+	serverVersion int64,
+) error {
 	actorKey := getActorKey(namespace, actorID)
 	ra, ok, err := k.getActor(ctx, kvTr, actorKey)
 	if err != nil {
-		return nil, fmt.Errorf("kvRegistry: beginTransaction: error getting actor key: %w", err)
+		return fmt.Errorf("error getting actor key: %w", err)
 	}
 	if !ok {
-		return nil, fmt.Errorf("kvRegistry: beginTransaction: cannot perform KV Get for actor: %s that does not exist", actorID)
+		return fmt.Errorf(
+			"cannot begin transaction for actor: %s, err: %w", actorID, errActorDoesNotExist)
 	}
 
 	// We treat the tuple of <ServerID, ServerVersion> as a fencing token for all
@@ -404,228 +723,1720 @@ func (k *kvRegistry) BeginTransaction(
 	// as we check that the server performing the KV storage transaction is also the
 	// server responsible for the actor's current activation.
 	if ra.Activation.ServerID != serverID {
-		return nil, fmt.Errorf(
-			"kvRegistry: beginTransaction: cannot begin transaction because server IDs do not match: %s != %s",
+		return fmt.Errorf(
+			"cannot begin transaction because server IDs do not match: %s != %s",
 			ra.Activation.ServerID, serverID)
 	}
 	if ra.Activation.ServerVersion != serverVersion {
-		return nil, fmt.Errorf(
-			"kvRegistry: beginTransaction: cannot begin transaction because server versions do not match: %d != %d",
+		return fmt.Errorf(
+			"cannot begin transaction because server versions do not match: %d != %d",
 			ra.Activation.ServerVersion, serverVersion)
 	}
-
-	tr := newKVTransaction(ctx, namespace, actorID, kvTr)
-	return tr, nil
+	return nil
 }
 
-func (k *kvRegistry) Heartbeat(
+func (k *kvRegistry) WatchActorKV(
 	ctx context.Context,
-	serverID string,
-	heartbeatState HeartbeatState,
-) (HeartbeatResult, error) {
-	key := getServerKey(serverID)
-	var serverVersion int64
-	versionStamp, err := k.kv.transact(func(tr transaction) (any, error) {
-		v, ok, err := tr.get(ctx, key)
+	namespace string,
+	actorID string,
+	prefix []byte,
+	afterVersion []byte,
+) ([]ActorKVChange, error) {
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		_, ok, err := k.getActor(ctx, tr, getActorKey(namespace, actorID))
 		if err != nil {
-			return nil, fmt.Errorf("error getting server state: %w", err)
+			return nil, err
 		}
-
-		var state serverState
 		if !ok {
-			serverVersion = 1
-			state = serverState{
-				ServerID:      serverID,
-				ServerVersion: serverVersion,
-			}
-			vs, err := tr.getVersionStamp()
-			if err != nil {
-				return nil, fmt.Errorf("error getting versionstamp: %w", err)
-			}
-			state.LastHeartbeatedAt = vs
-		} else {
-			if err := json.Unmarshal(v, &state); err != nil {
-				return nil, fmt.Errorf("error unmarshaling server state: %w", err)
-			}
+			return nil, fmt.Errorf("error watching actor: %s, err: %w", actorID, errActorDoesNotExist)
 		}
-
-		vs, err := tr.getVersionStamp()
+		enabled, err := isKVChangeLogEnabled(ctx, tr, namespace)
 		if err != nil {
-			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+			return nil, err
 		}
-		timeSinceLastHeartbeat := versionSince(vs, state.LastHeartbeatedAt)
-		if timeSinceLastHeartbeat >= HeartbeatTTL {
-			state.ServerVersion++
+		if !enabled {
+			return nil, fmt.Errorf(
+				"error watching actor: %s, the KV change log is not enabled for namespace: %s",
+				actorID, namespace)
+		}
+		if len(afterVersion) == 0 {
+			return nil, nil
 		}
 
-		serverVersion = state.ServerVersion
-		state.LastHeartbeatedAt = vs
-		state.HeartbeatState = heartbeatState
-
-		marshaled, err := json.Marshal(&state)
+		trimmedVersion, ok, err := tr.get(ctx, getActorKVChangeLogTrimmedKey(namespace, actorID))
 		if err != nil {
-			return nil, fmt.Errorf("error marshaling server state: %w", err)
+			return nil, err
 		}
-
-		tr.put(ctx, key, marshaled)
-
-		return tr.getVersionStamp()
+		if ok && bytes.Compare(afterVersion, trimmedVersion) < 0 {
+			return nil, fmt.Errorf(
+				"error watching actor: %s, changes up to version: %x have been deleted, err: %w",
+				actorID, trimmedVersion, errActorKVChangesTruncated)
+		}
+		return nil, nil
 	})
 	if err != nil {
-		return HeartbeatResult{}, fmt.Errorf("Heartbeat: error: %w", err)
+		return nil, fmt.Errorf("WatchActorKV: error: %w", err)
 	}
-	return HeartbeatResult{
-		VersionStamp: versionStamp.(int64),
-		// VersionStamp corresponds to ~ 1 million increments per second.
-		HeartbeatTTL:  int64(HeartbeatTTL.Microseconds()),
-		ServerVersion: serverVersion,
-	}, nil
-}
 
-func (k *kvRegistry) Close(ctx context.Context) error {
-	return k.kv.close(ctx)
-}
+	var (
+		logPrefix = getActorKVChangeLogPrefix(namespace, actorID)
+		start     = logPrefix
+		// Every element in the change log is a versionstamp which are encoded with a type
+		// code that is < 0xFF so this is an exclusive upper bound for the change log.
+		end = append(append([]byte(nil), logPrefix...), 0xFF)
+	)
+	if len(afterVersion) > 0 {
+		vs, err := versionstampFromBytes(afterVersion)
+		if err != nil {
+			return nil, fmt.Errorf("WatchActorKV: error decoding afterVersion: %w", err)
+		}
+		start = append(getActorKVChangeLogEntryKey(namespace, actorID, vs), 0x00)
+	}
 
-func (k *kvRegistry) UnsafeWipeAll() error {
-	return k.kv.unsafeWipeAll()
+	for {
+		changes, numRead, lastKey, err := k.readActorKVChanges(ctx, start, end, logPrefix, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("WatchActorKV: error reading change log: %w", err)
+		}
+		if len(changes) > 0 {
+			return changes, nil
+		}
+		if numRead > 0 {
+			// None of the changes matched the prefix, skip over them.
+			start = append(lastKey, 0x00)
+		}
+		if numRead == maxActorKVChangesPerRead {
+			// There may be more changes available already.
+			continue
+		}
+
+		if err := k.waitForActorKVChange(ctx, namespace, actorID, start, end); err != nil {
+			return nil, fmt.Errorf("WatchActorKV: error waiting for change: %w", err)
+		}
+	}
 }
 
-func (k *kvRegistry) getActorBytes(
+// readActorKVChanges reads up to maxActorKVChangesPerRead entries of the change log in
+// [start, end) and returns the ones that match prefix, as well as the number of entries
+// that were read and the key of the last one.
+func (k *kvRegistry) readActorKVChanges(
 	ctx context.Context,
-	tr transaction,
-	actorKey []byte,
-) ([]byte, bool, error) {
-	actorBytes, ok, err := tr.get(ctx, actorKey)
-	if err != nil {
-		return nil, false, fmt.Errorf(
-			"error getting actor bytes for key: %s", string(actorBytes))
-	}
-	if !ok {
-		return nil, false, nil
+	start, end []byte,
+	logPrefix []byte,
+	prefix []byte,
+) ([]ActorKVChange, int, []byte, error) {
+	var (
+		changes []ActorKVChange
+		numRead int
+		lastKey []byte
+	)
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		changes, numRead, lastKey = nil, 0, nil
+		err := tr.iterRange(ctx, start, end, func(key, v []byte) error {
+			numRead++
+			lastKey = append([]byte(nil), key...)
+
+			var change ActorKVChange
+			if err := json.Unmarshal(v, &change); err != nil {
+				return fmt.Errorf("error unmarshaling actor KV change: %w", err)
+			}
+			if bytes.HasPrefix(change.Key, prefix) {
+				suffix, err := tuple.Unpack(key[len(logPrefix):])
+				if err != nil {
+					return fmt.Errorf("error unpacking change log key: %w", err)
+				}
+				if len(suffix) != 1 {
+					return fmt.Errorf("unexpected change log key suffix: %v", suffix)
+				}
+				vs, ok := suffix[0].(tuple.Versionstamp)
+				if !ok {
+					return fmt.Errorf("unexpected change log key suffix: %v", suffix)
+				}
+				change.Version = vs.Bytes()
+				changes = append(changes, change)
+			}
+
+			if numRead >= maxActorKVChangesPerRead {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			return nil, err
+		}
+		return nil, nil
+	})
+	return changes, numRead, lastKey, err
+}
+
+// waitForActorKVChange blocks until the actor's KV change log has an entry in [start, end)
+// or ctx is canceled.
+func (k *kvRegistry) waitForActorKVChange(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	start, end []byte,
+) error {
+	ctx, cc := context.WithCancel(ctx)
+	defer cc()
+
+	for {
+		// Create the watch *before* checking for new entries so that we can't miss
+		// entries that are committed in between.
+		watchCh, err := k.kv.watch(ctx, getActorKVChangeLogNotifyKey(namespace, actorID))
+		if err != nil {
+			return err
+		}
+
+		hasChanges, err := k.kv.transact(func(tr transaction) (any, error) {
+			hasChanges := false
+			err := tr.iterRange(ctx, start, end, func(k, v []byte) error {
+				hasChanges = true
+				return errStopIteration
+			})
+			if err != nil && err != errStopIteration {
+				return nil, err
+			}
+			return hasChanges, nil
+		})
+		if err != nil {
+			return err
+		}
+		if hasChanges.(bool) {
+			return nil
+		}
+
+		select {
+		case <-watchCh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (k *kvRegistry) ExportActorKV(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	w io.Writer,
+) error {
+	ew := newExportWriter(w, namespace)
+	if err := k.exportActor(ctx, ew, namespace, actorID); err != nil {
+		return fmt.Errorf("ExportActorKV: %w", err)
+	}
+	if err := ew.close(); err != nil {
+		return fmt.Errorf("ExportActorKV: %w", err)
+	}
+	return nil
+}
+
+func (k *kvRegistry) ExportNamespaceKV(
+	ctx context.Context,
+	namespace string,
+	w io.Writer,
+) error {
+	ew := newExportWriter(w, namespace)
+	for after := ""; ; {
+		actorIDs, err := k.kv.transact(func(tr transaction) (any, error) {
+			return k.listActorIDs(ctx, tr, namespace, after, maxExportActorsPerTransaction)
+		})
+		if err != nil {
+			return fmt.Errorf("ExportNamespaceKV: error listing actors: %w", err)
+		}
+		if len(actorIDs.([]string)) == 0 {
+			break
+		}
+		for _, actorID := range actorIDs.([]string) {
+			if err := k.exportActor(ctx, ew, namespace, actorID); err != nil {
+				return fmt.Errorf("ExportNamespaceKV: %w", err)
+			}
+			after = actorID
+		}
+	}
+	if err := ew.close(); err != nil {
+		return fmt.Errorf("ExportNamespaceKV: %w", err)
+	}
+	return nil
+}
+
+// exportActor exports a single actor from a consistent snapshot.
+//
+// TODO: FDB transactions are limited to 5 seconds so this will fail for actors with a
+// lot of data.
+func (k *kvRegistry) exportActor(
+	ctx context.Context,
+	ew *exportWriter,
+	namespace,
+	actorID string,
+) error {
+	var (
+		ra  registeredActor
+		kvs []exportKV
+	)
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		var (
+			ok  bool
+			err error
+		)
+		ra, ok, err = k.getActor(ctx, tr, getActorKey(namespace, actorID))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("error exporting actor: %s, err: %w", actorID, errActorDoesNotExist)
+		}
+
+		kvs = nil
+		kvPrefix := getActorKVPrefix(namespace, actorID)
+		err = tr.iterPrefix(ctx, kvPrefix, func(key, v []byte) error {
+			suffix, err := tuple.Unpack(key[len(kvPrefix):])
+			if err != nil {
+				return fmt.Errorf("error unpacking actor KV key: %w", err)
+			}
+			if len(suffix) != 1 {
+				return fmt.Errorf("unexpected actor KV key: %v", suffix)
+			}
+			actorKey, ok := suffix[0].([]byte)
+			if !ok {
+				return fmt.Errorf("unexpected actor KV key: %v", suffix)
+			}
+			kvs = append(kvs, exportKV{key: actorKey, value: append([]byte(nil), v...)})
+			return nil
+		})
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	return ew.writeActor(actorID, ra, kvs)
+}
+
+func (k *kvRegistry) ImportActorKV(
+	ctx context.Context,
+	namespace string,
+	r io.Reader,
+) (ImportResult, error) {
+	// The entire export has to be verified before anything is written, so spool it to a
+	// temporary file while verifying it instead of buffering it in memory, and then
+	// import it from the file one actor at a time.
+	f, err := ioutil.TempFile("", "nola-import-*.ndjson")
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("ImportActorKV: error creating temporary file for export: %w", err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	size, err := verifyExport(r, f)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("ImportActorKV: error reading export: %w", err)
+	}
+	// Fail fast if the whole export doesn't fit in the namespace's quotas instead of
+	// failing once some of it has been imported. The actor quota is checked again when
+	// each actor is created since other actors may be created concurrently.
+	_, err = k.kv.transact(func(tr transaction) (any, error) {
+		return nil, checkNamespaceQuotas(ctx, tr, namespace, size.numActors, 0, 0, size.kvBytes)
+	})
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("ImportActorKV: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return ImportResult{}, fmt.Errorf("ImportActorKV: error seeking temporary export file: %w", err)
+	}
+
+	var (
+		reader = newExportReader(f)
+		result ImportResult
+		// curr is the actor that is currently being imported and kvs are its keys that
+		// haven't been written yet.
+		curr *exportRecord
+		kvs  []exportKV
+	)
+	flushKVs := func() error {
+		if err := k.importActorKVs(ctx, namespace, curr.ActorID, kvs); err != nil {
+			return fmt.Errorf("ImportActorKV: error importing actor: %s, err: %w", curr.ActorID, err)
+		}
+		result.NumKeys += len(kvs)
+		kvs = kvs[:0]
+		return nil
+	}
+	finishActor := func() error {
+		if curr == nil {
+			return nil
+		}
+		if err := flushKVs(); err != nil {
+			return err
+		}
+		if err := k.createImportedActor(ctx, namespace, curr.ActorID, *curr.Actor); err != nil {
+			return fmt.Errorf("ImportActorKV: error importing actor: %s, err: %w", curr.ActorID, err)
+		}
+		result.NumActors++
+		return nil
+	}
+	for {
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("ImportActorKV: error reading export: %w", err)
+		}
+
+		switch record.Type {
+		case exportRecordTypeActor:
+			if err := finishActor(); err != nil {
+				return result, err
+			}
+			if err := k.checkImportedActor(ctx, namespace, record.ActorID, *record.Actor); err != nil {
+				return result, fmt.Errorf("ImportActorKV: error importing actor: %s, err: %w", record.ActorID, err)
+			}
+			curr = &record
+		case exportRecordTypeKV:
+			kvs = append(kvs, exportKV{key: record.Key, value: record.Value})
+			// Write the keys in batches so that importing actors with a lot of data doesn't
+			// exceed transaction limits.
+			if len(kvs) >= maxImportKeysPerTransaction {
+				if err := flushKVs(); err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+	if err := finishActor(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// checkImportedActor checks that the actor can be imported into the namespace. Actors
+// are only imported if they don't exist yet since the imported keys would otherwise be
+// merged with the keys of the existing actor while it may be activated.
+func (k *kvRegistry) checkImportedActor(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	actor exportActorRecord,
+) error {
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		return nil, checkImportedActor(ctx, tr, namespace, actorID, actor.ModuleID)
+	})
+	return err
+}
+
+func checkImportedActor(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	actorID string,
+	moduleID string,
+) error {
+	_, ok, err := tr.get(ctx, getActorKey(namespace, actorID))
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("actor: %s already exists in namespace: %s", actorID, namespace)
+	}
+
+	ok, err = moduleExists(ctx, tr, namespace, moduleID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("module: %s does not exist in namespace: %s", moduleID, namespace)
+	}
+	return nil
+}
+
+// importActorKVs writes a batch of an imported actor's keys. The actor's record is only
+// created once all of its keys have been written so that the actor can't be activated
+// (and observe a partial import) in the meantime. Every batch checks that the actor
+// still doesn't exist so that an import that races with the creation of the same actor
+// fails instead of merging keys into it.
+func (k *kvRegistry) importActorKVs(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	kvs []exportKV,
+) error {
+	if len(kvs) == 0 {
+		return nil
+	}
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		_, ok, err := tr.get(ctx, getActorKey(namespace, actorID))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return nil, fmt.Errorf("actor: %s was created while it was being imported", actorID)
+		}
+		for _, kv := range kvs {
+			if err := putActorKV(ctx, tr, namespace, actorID, kv.key, kv.value); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error importing keys: %w", err)
+	}
+	return nil
+}
+
+func (k *kvRegistry) createImportedActor(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	actor exportActorRecord,
+) error {
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		if err := checkImportedActor(ctx, tr, namespace, actorID, actor.ModuleID); err != nil {
+			return nil, err
+		}
+		if err := checkNamespaceQuotas(ctx, tr, namespace, 1, 0, 0, 0); err != nil {
+			return nil, err
+		}
+
+		marshaled, err := json.Marshal(&registeredActor{
+			Opts:       actor.Opts,
+			ModuleID:   actor.ModuleID,
+			Generation: 1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		actorKey := getActorKey(namespace, actorID)
+		if err := tr.put(ctx, actorKey, marshaled); err != nil {
+			return nil, err
+		}
+		if err := addToCounter(ctx, tr, getNamespaceActorCountKey(namespace), 1); err != nil {
+			return nil, err
+		}
+		if err := addToCounter(ctx, tr, getModuleActorCountKey(namespace, actor.ModuleID), 1); err != nil {
+			return nil, err
+		}
+		return nil, tr.put(ctx, getActorIndexKey(namespace, actorID), []byte{})
+	})
+	return err
+}
+
+func (k *kvRegistry) ListActorsWithPendingMessages(
+	ctx context.Context,
+	serverID string,
+	limit int,
+) ([]types.NamespacedIDNoType, error) {
+	actors, err := k.kv.transact(func(tr transaction) (any, error) {
+		var (
+			now    = time.Now()
+			actors = []types.NamespacedIDNoType{}
+		)
+		scan := func(owner string) error {
+			if len(actors) >= limit {
+				return nil
+			}
+			err := tr.iterPrefix(ctx, getServerPendingInboxesPrefix(owner), func(k, v []byte) error {
+				var pending pendingInbox
+				if err := json.Unmarshal(v, &pending); err != nil {
+					return fmt.Errorf("error unmarshaling pending inbox: %w", err)
+				}
+				if now.Before(pending.RetryAt) {
+					// The message at the head of the inbox is backing off after a failed
+					// delivery attempt.
+					return nil
+				}
+				actors = append(actors, types.NewNamespacedIDNoType(pending.Namespace, pending.ID))
+				if len(actors) >= limit {
+					return errStopIteration
+				}
+				return nil
+			})
+			if err != nil && err != errStopIteration {
+				return err
+			}
+			return nil
+		}
+
+		// Only return actors that this server owns, or that no live server owns, so that
+		// every server doesn't try to deliver every pending inbox. The index is keyed by
+		// the owning server so this doesn't have to scan (or read the actors of) inboxes
+		// that are owned by other live servers.
+		if err := scan(serverID); err != nil {
+			return nil, err
+		}
+		if err := scan(""); err != nil {
+			return nil, err
+		}
+		if len(actors) >= limit {
+			return actors, nil
+		}
+
+		vs, err := tr.getVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		var deadServers []string
+		err = tr.iterPrefix(ctx, getServersPrefix(), func(k, v []byte) error {
+			var server serverState
+			if err := json.Unmarshal(v, &server); err != nil {
+				return fmt.Errorf("error unmarshaling server state: %w", err)
+			}
+			if server.ServerID != serverID && versionSince(vs, server.LastHeartbeatedAt) >= HeartbeatTTL {
+				deadServers = append(deadServers, server.ServerID)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, dead := range deadServers {
+			if err := scan(dead); err != nil {
+				return nil, err
+			}
+		}
+		return actors, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListActorsWithPendingMessages: error: %w", err)
+	}
+
+	return actors.([]types.NamespacedIDNoType), nil
+}
+
+func (k *kvRegistry) ListDeadLetters(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+) ([]InboxMessage, error) {
+	messages, err := k.kv.transact(func(tr transaction) (any, error) {
+		messages := []InboxMessage{}
+		err := tr.iterPrefix(ctx, getInboxDeadLettersPrefix(namespace, actorID), func(k, v []byte) error {
+			var msg InboxMessage
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return fmt.Errorf("error unmarshaling dead letter: %w", err)
+			}
+			messages = append(messages, msg)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return messages, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListDeadLetters: error: %w", err)
+	}
+
+	return messages.([]InboxMessage), nil
+}
+
+func (k *kvRegistry) Heartbeat(
+	ctx context.Context,
+	serverID string,
+	heartbeatState HeartbeatState,
+) (HeartbeatResult, error) {
+	key := getServerKey(serverID)
+	var serverVersion int64
+	versionStamp, err := k.kv.transact(func(tr transaction) (any, error) {
+		v, ok, err := tr.get(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("error getting server state: %w", err)
+		}
+
+		var state serverState
+		if !ok {
+			serverVersion = 1
+			state = serverState{
+				ServerID:      serverID,
+				ServerVersion: serverVersion,
+			}
+			vs, err := tr.getVersionStamp()
+			if err != nil {
+				return nil, fmt.Errorf("error getting versionstamp: %w", err)
+			}
+			state.LastHeartbeatedAt = vs
+		} else {
+			if err := json.Unmarshal(v, &state); err != nil {
+				return nil, fmt.Errorf("error unmarshaling server state: %w", err)
+			}
+		}
+
+		vs, err := tr.getVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+		timeSinceLastHeartbeat := versionSince(vs, state.LastHeartbeatedAt)
+		if timeSinceLastHeartbeat >= HeartbeatTTL {
+			state.ServerVersion++
+		}
+
+		serverVersion = state.ServerVersion
+		state.LastHeartbeatedAt = vs
+		state.HeartbeatState = heartbeatState
+
+		marshaled, err := json.Marshal(&state)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling server state: %w", err)
+		}
+
+		tr.put(ctx, key, marshaled)
+
+		return tr.getVersionStamp()
+	})
+	if err != nil {
+		return HeartbeatResult{}, fmt.Errorf("Heartbeat: error: %w", err)
+	}
+	return HeartbeatResult{
+		VersionStamp: versionStamp.(int64),
+		// VersionStamp corresponds to ~ 1 million increments per second.
+		HeartbeatTTL:  int64(HeartbeatTTL.Microseconds()),
+		ServerVersion: serverVersion,
+	}, nil
+}
+
+func (k *kvRegistry) ListServers(ctx context.Context) ([]ServerInfo, error) {
+	servers, err := k.kv.transact(func(tr transaction) (any, error) {
+		vs, err := tr.getVersionStamp()
+		if err != nil {
+			return nil, fmt.Errorf("error getting versionstamp: %w", err)
+		}
+
+		servers := []ServerInfo{}
+		err = tr.iterPrefix(ctx, getServersPrefix(), func(k, v []byte) error {
+			var server serverState
+			if err := json.Unmarshal(v, &server); err != nil {
+				return fmt.Errorf("error unmarshaling server state: %w", err)
+			}
+
+			sinceLastHeartbeat := versionSince(vs, server.LastHeartbeatedAt)
+			if sinceLastHeartbeat >= HeartbeatTTL {
+				return nil
+			}
+			servers = append(servers, ServerInfo{
+				ServerID:               server.ServerID,
+				ServerVersion:          server.ServerVersion,
+				HeartbeatState:         server.HeartbeatState,
+				LastHeartbeatedAt:      server.LastHeartbeatedAt,
+				TimeSinceLastHeartbeat: sinceLastHeartbeat,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return servers, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListServers: error: %w", err)
+	}
+	return servers.([]ServerInfo), nil
+}
+
+func (k *kvRegistry) Subscribe(
+	ctx context.Context,
+	namespace,
+	topic,
+	actorID,
+	operation string,
+) error {
+	var (
+		actorKey        = getActorKey(namespace, actorID)
+		subscriptionKey = getTopicSubscriptionKey(namespace, topic, actorID)
+	)
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		_, ok, err := k.getActorBytes(ctx, tr, actorKey)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf(
+				"error subscribing actor with ID: %s to topic: %s, err: %w",
+				actorID, topic, errActorDoesNotExist)
+		}
+
+		ts := TopicSubscription{
+			ActorID:   actorID,
+			Operation: operation,
+		}
+		marshaled, err := json.Marshal(&ts)
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling topic subscription: %w", err)
+		}
+
+		if err := tr.put(ctx, subscriptionKey, marshaled); err != nil {
+			return nil, err
+		}
+		return nil, tr.put(ctx, getActorSubscriptionKey(namespace, actorID, topic), []byte{})
+	})
+	if err != nil {
+		return fmt.Errorf("Subscribe: error: %w", err)
+	}
+
+	return nil
+}
+
+func (k *kvRegistry) Unsubscribe(
+	ctx context.Context,
+	namespace,
+	topic,
+	actorID string,
+) error {
+	subscriptionKey := getTopicSubscriptionKey(namespace, topic, actorID)
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		if err := tr.delete(ctx, subscriptionKey); err != nil {
+			return nil, err
+		}
+		return nil, tr.delete(ctx, getActorSubscriptionKey(namespace, actorID, topic))
+	})
+	if err != nil {
+		return fmt.Errorf("Unsubscribe: error: %w", err)
+	}
+
+	return nil
+}
+
+func (k *kvRegistry) GetSubscriptions(
+	ctx context.Context,
+	namespace,
+	topic string,
+) ([]TopicSubscription, error) {
+	prefix := getTopicSubscriptionsPrefix(namespace, topic)
+	subscriptions, err := k.kv.transact(func(tr transaction) (any, error) {
+		subscriptions := []TopicSubscription{}
+		err := tr.iterPrefix(ctx, prefix, func(k, v []byte) error {
+			var ts TopicSubscription
+			if err := json.Unmarshal(v, &ts); err != nil {
+				return fmt.Errorf("error unmarshaling topic subscription: %w", err)
+			}
+			subscriptions = append(subscriptions, ts)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return subscriptions, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetSubscriptions: error: %w", err)
+	}
+
+	return subscriptions.([]TopicSubscription), nil
+}
+
+func (k *kvRegistry) Close(ctx context.Context) error {
+	k.cancel()
+	k.indexBuildsWG.Wait()
+	return k.kv.close(ctx)
+}
+
+func (k *kvRegistry) UnsafeWipeAll() error {
+	return k.kv.unsafeWipeAll()
+}
+
+func (k *kvRegistry) getActorBytes(
+	ctx context.Context,
+	tr transaction,
+	actorKey []byte,
+) ([]byte, bool, error) {
+	actorBytes, ok, err := tr.get(ctx, actorKey)
+	if err != nil {
+		return nil, false, fmt.Errorf(
+			"error getting actor bytes for key: %s", string(actorBytes))
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	return actorBytes, true, nil
+}
+
+func (k *kvRegistry) getActor(
+	ctx context.Context,
+	tr transaction,
+	actorKey []byte,
+) (registeredActor, bool, error) {
+	actorBytes, ok, err := k.getActorBytes(ctx, tr, actorKey)
+	if err != nil {
+		return registeredActor{}, false, err
+	}
+	if !ok {
+		return registeredActor{}, false, nil
+	}
+
+	var ra registeredActor
+	if err := json.Unmarshal(actorBytes, &ra); err != nil {
+		return registeredActor{}, false, fmt.Errorf("error unmarshaling registered actor: %w", err)
+	}
+
+	return ra, true, nil
+}
+
+func getModulePartKey(namespace, moduleID string, part int) []byte {
+	return tuple.Tuple{namespace, "modules", moduleID, part}.Pack()
+}
+
+// getModuleRefKey returns the key of the reference from a namespace and module ID to the
+// module's hash.
+func getModuleRefKey(namespace, moduleID string) []byte {
+	return tuple.Tuple{namespace, "modules", moduleID, "ref"}.Pack()
+}
+
+func getActorKey(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "state"}.Pack()
+}
+
+func getActorsPrefix(namespace string) []byte {
+	return tuple.Tuple{namespace, "actors"}.Pack()
+}
+
+func getActorKVPrefix(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "kv"}.Pack()
+}
+
+func getActoKVKey(namespace, actorID string, key []byte) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "kv", key}.Pack()
+}
+
+func getTopicSubscriptionsPrefix(namespace, topic string) []byte {
+	return tuple.Tuple{namespace, "topics", topic, "subscriptions"}.Pack()
+}
+
+func getTopicSubscriptionKey(namespace, topic, actorID string) []byte {
+	return tuple.Tuple{namespace, "topics", topic, "subscriptions", actorID}.Pack()
+}
+
+func getInboxMessagesPrefix(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "inbox", "messages"}.Pack()
+}
+
+func getInboxMessageKey(namespace, actorID string, seq int64) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "inbox", "messages", seq}.Pack()
+}
+
+func getInboxDeadLettersPrefix(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "inbox", "dead_letters"}.Pack()
+}
+
+func getInboxDeadLetterKey(namespace, actorID string, seq int64) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "inbox", "dead_letters", seq}.Pack()
+}
+
+func getInboxSeqKey(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "inbox", "seq"}.Pack()
+}
+
+// getActorKeyExpiryKey returns the key that records when the actor's key expires. The
+// expiry keys of an actor are ordered by expiration time.
+func getActorKeyExpiryKey(namespace, actorID string, expiresAt time.Time, key []byte) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "expiry", expiresAt.UnixNano(), key}.Pack()
+}
+
+func getActorKeyExpiryPrefix(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "expiry"}.Pack()
+}
+
+func getInboxDedupKey(namespace, actorID, id string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "inbox", "dedup", id}.Pack()
+}
+
+func getInvocationResultKey(namespace, actorID, idempotencyKey string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "idempotency", idempotencyKey}.Pack()
+}
+
+func getActorKVChangeLogPrefix(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "kv_changelog", "entries"}.Pack()
+}
+
+func getActorKVChangeLogKey(namespace, actorID string) tuple.Tuple {
+	return tuple.Tuple{namespace, "actors", actorID, "kv_changelog", "entries", tuple.IncompleteVersionstamp(0)}
+}
+
+func getActorKVChangeLogEntryKey(namespace, actorID string, vs tuple.Versionstamp) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "kv_changelog", "entries", vs}.Pack()
+}
+
+func getActorKVChangeLogTrimmedKey(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "kv_changelog", "trimmed"}.Pack()
+}
+
+func getActorKVChangeLogNotifyKey(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "actors", actorID, "kv_changelog", "notify"}.Pack()
+}
+
+// versionstampFromBytes is the inverse of tuple.Versionstamp.Bytes().
+func versionstampFromBytes(b []byte) (tuple.Versionstamp, error) {
+	var vs tuple.Versionstamp
+	if len(b) != len(vs.TransactionVersion)+2 {
+		return tuple.Versionstamp{}, fmt.Errorf("invalid version length: %d", len(b))
+	}
+	copy(vs.TransactionVersion[:], b)
+	vs.UserVersion = binary.BigEndian.Uint16(b[len(vs.TransactionVersion):])
+	return vs, nil
+}
+
+func getPendingInboxKey(namespace, actorID string) []byte {
+	return tuple.Tuple{"pending_inboxes", namespace, actorID}.Pack()
+}
+
+func getPendingInboxesPrefix(namespace string) []byte {
+	return tuple.Tuple{"pending_inboxes", namespace}.Pack()
+}
+
+// getServerPendingInboxKey returns the key of an actor's entry in the index of pending
+// inboxes by the ID of the server the actor is activated on, or "" if it isn't activated.
+func getServerPendingInboxKey(serverID, namespace, actorID string) []byte {
+	return tuple.Tuple{"server_pending_inboxes", serverID, namespace, actorID}.Pack()
+}
+
+func getServerPendingInboxesPrefix(serverID string) []byte {
+	return tuple.Tuple{"server_pending_inboxes", serverID}.Pack()
+}
+
+func getServerKey(serverID string) []byte {
+	return tuple.Tuple{"servers", serverID}.Pack()
+}
+
+func getServersPrefix() []byte {
+	return tuple.Tuple{"servers"}.Pack()
+}
+
+type registeredActor struct {
+	Opts       types.ActorOptions
+	ModuleID   string
+	Generation uint64
+	Activation activation
+}
+
+// registeredModule is how modules were stored before they were split into chunks. It is
+// only used to read modules that were registered by older versions.
+type registeredModule struct {
+	Bytes []byte
+	Opts  ModuleOptions
+}
+
+// moduleRef is stored for every registered module and references the module's bytes in
+// the content-addressed module store by their hash.
+type moduleRef struct {
+	Hash string
+	Size int64
+	Opts ModuleOptions
+}
+
+type serverState struct {
+	ServerID          string
+	LastHeartbeatedAt int64
+	HeartbeatState    HeartbeatState
+	ServerVersion     int64
+}
+
+type activation struct {
+	ServerID      string
+	ServerVersion int64
+}
+
+func newActivation(serverID string, serverVersion int64) activation {
+	return activation{
+		ServerID:      serverID,
+		ServerVersion: serverVersion,
+	}
+}
+
+func versionSince(curr, prev int64) time.Duration {
+	since := curr - prev
+	if since < 0 {
+		panic(fmt.Sprintf(
+			"prev: %d, curr: %d, versionstamp did not increase monotonically",
+			prev, curr))
+	}
+	return time.Duration(since) * time.Microsecond
+}
+
+type kvTransaction struct {
+	k         *kvRegistry
+	namespace string
+	actorID   string
+	tr        transaction
+
+	// participants contains the actors that joined the transaction, see JoinActors.
+	participants map[string]struct{}
+}
+
+func newKVTransaction(
+	ctx context.Context,
+	k *kvRegistry,
+	namespace string,
+	actorID string,
+	tr transaction,
+) *kvTransaction {
+	return &kvTransaction{
+		k:         k,
+		namespace: namespace,
+		actorID:   actorID,
+		tr:        tr,
+	}
+}
+
+func (tr *kvTransaction) Get(
+	ctx context.Context,
+	key []byte,
+) ([]byte, bool, error) {
+	actorKVKey := getActoKVKey(tr.namespace, tr.actorID, key)
+	return tr.tr.get(ctx, actorKVKey)
+}
+
+func (tr *kvTransaction) Put(
+	ctx context.Context,
+	key []byte,
+	value []byte,
+) error {
+	return putActorKV(ctx, tr.tr, tr.namespace, tr.actorID, key, value)
+}
+
+// putActorKV stores the value at the provided key in the actor's KV storage and appends
+// the change to the actor's KV change log so that it can be observed by WatchActorKV.
+func putActorKV(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	actorID string,
+	key []byte,
+	value []byte,
+) error {
+	kvKey := getActoKVKey(namespace, actorID, key)
+	prev, ok, err := tr.get(ctx, kvKey)
+	if err != nil {
+		return err
+	}
+	if err := tr.put(ctx, kvKey, value); err != nil {
+		return err
+	}
+
+	// Keep track of the size of the actor's KV storage for namespace quotas.
+	delta := int64(len(key) + len(value))
+	if ok {
+		delta -= int64(len(key) + len(prev))
+	}
+	if err := addToActorKVBytes(ctx, tr, namespace, actorID, delta); err != nil {
+		return fmt.Errorf("error updating actor KV size: %w", err)
+	}
+
+	enabled, err := isKVChangeLogEnabled(ctx, tr, namespace)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+
+	// Trim before appending since the new entry's versionstamped key can't be read by
+	// this transaction.
+	if err := trimActorKVChangeLog(ctx, tr, namespace, actorID, time.Now()); err != nil {
+		return fmt.Errorf("error trimming actor KV change log: %w", err)
+	}
+	change, err := json.Marshal(&actorKVChangeLogEntry{
+		Key:       key,
+		Value:     value,
+		Timestamp: time.Now().UnixNano(),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling actor KV change: %w", err)
+	}
+	if err := tr.putVersionstamped(ctx, getActorKVChangeLogKey(namespace, actorID), change); err != nil {
+		return fmt.Errorf("error appending to actor KV change log: %w", err)
+	}
+	return tr.touch(ctx, getActorKVChangeLogNotifyKey(namespace, actorID))
+}
+
+// actorKVChangeLogEntry is how ActorKVChanges are stored in the change log. The version
+// of each change is the versionstamp in its key.
+type actorKVChangeLogEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	// Timestamp is when the change was written (in unix nanoseconds), it's used to
+	// expire the entry.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// putActorKeyExpiry records that the actor's key expires at expiresAt so that it's deleted
+// by trimExpiredActorKeys after that.
+func putActorKeyExpiry(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	actorID string,
+	key []byte,
+	expiresAt time.Time,
+) error {
+	return tr.put(ctx, getActorKeyExpiryKey(namespace, actorID, expiresAt, key), []byte{})
+}
+
+// trimExpiredActorKeys deletes up to maxExpiredActorKeysTrimsPerPut of the actor's keys
+// that expired before now, oldest first.
+func trimExpiredActorKeys(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	actorID string,
+	now time.Time,
+) error {
+	var (
+		expiryPrefix = getActorKeyExpiryPrefix(namespace, actorID)
+		end          = append(append([]byte(nil), expiryPrefix...), 0xFF)
+		expired      [][]byte
+		expiredKeys  [][]byte
+	)
+	err := tr.iterRange(ctx, expiryPrefix, end, func(k, v []byte) error {
+		suffix, err := tuple.Unpack(k[len(expiryPrefix):])
+		if err != nil {
+			return fmt.Errorf("error unpacking expiry key: %w", err)
+		}
+		if len(suffix) != 2 {
+			return fmt.Errorf("unexpected expiry key suffix: %v", suffix)
+		}
+		expiresAt, ok1 := suffix[0].(int64)
+		key, ok2 := suffix[1].([]byte)
+		if !ok1 || !ok2 {
+			return fmt.Errorf("unexpected expiry key suffix: %v", suffix)
+		}
+		if expiresAt > now.UnixNano() {
+			return errStopIteration
+		}
+		expired = append(expired, append([]byte(nil), k...))
+		expiredKeys = append(expiredKeys, key)
+		if len(expired) >= maxExpiredActorKeysTrimsPerPut {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return err
 	}
-	return actorBytes, true, nil
+
+	for i := range expired {
+		if err := tr.delete(ctx, expired[i]); err != nil {
+			return err
+		}
+		if err := tr.delete(ctx, expiredKeys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (k *kvRegistry) getActor(
+// trimActorKVChangeLog deletes up to maxActorKVChangeLogTrimsPerPut of the oldest entries
+// of the actor's KV change log that are older than actorKVChangeLogRetention, and records
+// the version of the last deleted entry so that WatchActorKV can tell watchers that they
+// missed changes.
+func trimActorKVChangeLog(
 	ctx context.Context,
 	tr transaction,
-	actorKey []byte,
-) (registeredActor, bool, error) {
-	actorBytes, ok, err := k.getActorBytes(ctx, tr, actorKey)
+	namespace string,
+	actorID string,
+	now time.Time,
+) error {
+	var (
+		logPrefix   = getActorKVChangeLogPrefix(namespace, actorID)
+		end         = append(append([]byte(nil), logPrefix...), 0xFF)
+		expiredAt   = now.Add(-actorKVChangeLogRetention).UnixNano()
+		expired     [][]byte
+		lastExpired tuple.Versionstamp
+	)
+	err := tr.iterRange(ctx, logPrefix, end, func(key, v []byte) error {
+		var entry actorKVChangeLogEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return fmt.Errorf("error unmarshaling actor KV change: %w", err)
+		}
+		if entry.Timestamp >= expiredAt {
+			return errStopIteration
+		}
+
+		suffix, err := tuple.Unpack(key[len(logPrefix):])
+		if err != nil {
+			return fmt.Errorf("error unpacking change log key: %w", err)
+		}
+		if len(suffix) != 1 {
+			return fmt.Errorf("unexpected change log key suffix: %v", suffix)
+		}
+		vs, ok := suffix[0].(tuple.Versionstamp)
+		if !ok {
+			return fmt.Errorf("unexpected change log key suffix: %v", suffix)
+		}
+		expired = append(expired, append([]byte(nil), key...))
+		lastExpired = vs
+		if len(expired) >= maxActorKVChangeLogTrimsPerPut {
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return err
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	for _, key := range expired {
+		if err := tr.delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return tr.put(ctx, getActorKVChangeLogTrimmedKey(namespace, actorID), lastExpired.Bytes())
+}
+
+func (tr *kvTransaction) EnqueueMessage(
+	ctx context.Context,
+	actorID string,
+	msg InboxMessage,
+) error {
+	ra, ok, err := tr.k.getActor(ctx, tr.tr, getActorKey(tr.namespace, actorID))
 	if err != nil {
-		return registeredActor{}, false, err
+		return fmt.Errorf("error getting actor: %s, err: %w", actorID, err)
 	}
 	if !ok {
-		return registeredActor{}, false, nil
+		return fmt.Errorf(
+			"error enqueueing message: %s for actor: %s, err: %w",
+			msg.ID, actorID, errActorDoesNotExist)
 	}
 
-	var ra registeredActor
-	if err := json.Unmarshal(actorBytes, &ra); err != nil {
-		return registeredActor{}, false, fmt.Errorf("error unmarshaling registered actor: %w", err)
+	// Dedup entries that have expired but haven't been trimmed yet still dedup messages,
+	// which is harmless.
+	dedupKey := getInboxDedupKey(tr.namespace, actorID, msg.ID)
+	_, ok, err = tr.tr.get(ctx, dedupKey)
+	if err != nil {
+		return fmt.Errorf("error checking dedup key for message: %s, err: %w", msg.ID, err)
+	}
+	if ok {
+		// Already enqueued (and possibly delivered) previously.
+		return nil
 	}
 
-	return ra, true, nil
-}
+	// Use an explicit per-inbox sequence number instead of something like a versionstamp
+	// so that ordering is consistent across KV implementations. This means concurrent
+	// senders to the same inbox will conflict with each other, but that is the price of
+	// a total order.
+	var (
+		seqKey = getInboxSeqKey(tr.namespace, actorID)
+		seq    int64
+	)
+	v, ok, err := tr.tr.get(ctx, seqKey)
+	if err != nil {
+		return fmt.Errorf("error getting inbox sequence number: %w", err)
+	}
+	if ok {
+		seq, err = strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing inbox sequence number: %w", err)
+		}
+	}
+	seq++
+	msg.Seq = seq
+
+	marshaled, err := json.Marshal(&msg)
+	if err != nil {
+		return fmt.Errorf("error marshaling inbox message: %w", err)
+	}
+
+	if err := tr.tr.put(ctx, seqKey, []byte(strconv.FormatInt(seq, 10))); err != nil {
+		return err
+	}
+	if err := tr.tr.put(ctx, dedupKey, []byte(strconv.FormatInt(seq, 10))); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := trimExpiredActorKeys(ctx, tr.tr, tr.namespace, actorID, now); err != nil {
+		return fmt.Errorf("error trimming expired keys: %w", err)
+	}
+	if err := putActorKeyExpiry(ctx, tr.tr, tr.namespace, actorID, dedupKey, now.Add(inboxDedupRetention)); err != nil {
+		return err
+	}
+	if err := tr.tr.put(ctx, getInboxMessageKey(tr.namespace, actorID, seq), marshaled); err != nil {
+		return err
+	}
 
-func getModulePrefix(namespace, moduleID string) []byte {
-	return tuple.Tuple{namespace, "modules", moduleID}.Pack()
+	pendingKey := getPendingInboxKey(tr.namespace, actorID)
+	_, ok, err = tr.tr.get(ctx, pendingKey)
+	if err != nil {
+		return fmt.Errorf("error getting pending inbox: %w", err)
+	}
+	if ok {
+		// Don't overwrite the pending entry of an inbox whose head message is backing off.
+		return nil
+	}
+	return putPendingInbox(ctx, tr.tr, pendingInbox{
+		Namespace: tr.namespace,
+		ID:        actorID,
+		ServerID:  ra.Activation.ServerID,
+	})
 }
 
-func getModulePartKey(namespace, moduleID string, part int) []byte {
-	return tuple.Tuple{namespace, "modules", moduleID, part}.Pack()
+func (tr *kvTransaction) PeekInbox(
+	ctx context.Context,
+) (InboxMessage, bool, error) {
+	var (
+		msg InboxMessage
+		ok  bool
+	)
+	err := tr.tr.iterPrefix(ctx, getInboxMessagesPrefix(tr.namespace, tr.actorID), func(k, v []byte) error {
+		if err := json.Unmarshal(v, &msg); err != nil {
+			return fmt.Errorf("error unmarshaling inbox message: %w", err)
+		}
+		ok = true
+		return errStopIteration
+	})
+	if err != nil && err != errStopIteration {
+		return InboxMessage{}, false, err
+	}
+	return msg, ok, nil
 }
 
-func getActorKey(namespace, actorID string) []byte {
-	return tuple.Tuple{namespace, "actors", actorID, "state"}.Pack()
+func (tr *kvTransaction) AckInboxMessage(
+	ctx context.Context,
+	seq int64,
+) error {
+	if err := tr.tr.delete(ctx, getInboxMessageKey(tr.namespace, tr.actorID, seq)); err != nil {
+		return err
+	}
+	return tr.maybeDeletePendingInbox(ctx)
 }
 
-func getActoKVKey(namespace, actorID string, key []byte) []byte {
-	return tuple.Tuple{namespace, "actors", actorID, "kv", key}.Pack()
+func (tr *kvTransaction) RetryInboxMessage(
+	ctx context.Context,
+	seq int64,
+	reason string,
+	retryAt time.Time,
+) error {
+	msg, err := tr.getInboxMessage(ctx, seq)
+	if err != nil {
+		return err
+	}
+	msg.Attempts++
+	msg.LastError = reason
+	msg.RetryAt = retryAt
+
+	marshaled, err := json.Marshal(&msg)
+	if err != nil {
+		return fmt.Errorf("error marshaling inbox message: %w", err)
+	}
+	if err := tr.tr.put(ctx, getInboxMessageKey(tr.namespace, tr.actorID, seq), marshaled); err != nil {
+		return err
+	}
+	serverID, err := tr.getActivationServerID(ctx)
+	if err != nil {
+		return err
+	}
+	return putPendingInbox(ctx, tr.tr, pendingInbox{
+		Namespace: tr.namespace,
+		ID:        tr.actorID,
+		ServerID:  serverID,
+		RetryAt:   retryAt,
+	})
 }
 
-func getServerKey(serverID string) []byte {
-	return tuple.Tuple{"servers", serverID}.Pack()
+func (tr *kvTransaction) DeadLetterInboxMessage(
+	ctx context.Context,
+	seq int64,
+	reason string,
+) error {
+	msg, err := tr.getInboxMessage(ctx, seq)
+	if err != nil {
+		return err
+	}
+	msg.Attempts++
+	msg.LastError = reason
+	msg.RetryAt = time.Time{}
+
+	marshaled, err := json.Marshal(&msg)
+	if err != nil {
+		return fmt.Errorf("error marshaling dead letter: %w", err)
+	}
+	if err := tr.tr.put(ctx, getInboxDeadLetterKey(tr.namespace, tr.actorID, seq), marshaled); err != nil {
+		return err
+	}
+	if err := tr.tr.delete(ctx, getInboxMessageKey(tr.namespace, tr.actorID, seq)); err != nil {
+		return err
+	}
+
+	_, ok, err := tr.PeekInbox(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return deletePendingInbox(ctx, tr.tr, tr.namespace, tr.actorID)
+	}
+	// The next message hasn't failed yet so it shouldn't inherit the backoff.
+	serverID, err := tr.getActivationServerID(ctx)
+	if err != nil {
+		return err
+	}
+	return putPendingInbox(ctx, tr.tr, pendingInbox{
+		Namespace: tr.namespace,
+		ID:        tr.actorID,
+		ServerID:  serverID,
+	})
 }
 
-func getServersPrefix() []byte {
-	return tuple.Tuple{"servers"}.Pack()
+func (tr *kvTransaction) getInboxMessage(
+	ctx context.Context,
+	seq int64,
+) (InboxMessage, error) {
+	v, ok, err := tr.tr.get(ctx, getInboxMessageKey(tr.namespace, tr.actorID, seq))
+	if err != nil {
+		return InboxMessage{}, fmt.Errorf("error getting inbox message: %d, err: %w", seq, err)
+	}
+	if !ok {
+		return InboxMessage{}, fmt.Errorf("inbox message: %d does not exist", seq)
+	}
+	var msg InboxMessage
+	if err := json.Unmarshal(v, &msg); err != nil {
+		return InboxMessage{}, fmt.Errorf("error unmarshaling inbox message: %w", err)
+	}
+	return msg, nil
 }
 
-type registeredActor struct {
-	Opts       types.ActorOptions
-	ModuleID   string
-	Generation uint64
-	Activation activation
+func (tr *kvTransaction) maybeDeletePendingInbox(ctx context.Context) error {
+	_, ok, err := tr.PeekInbox(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Inbox is empty now so remove it from the pending index.
+		return deletePendingInbox(ctx, tr.tr, tr.namespace, tr.actorID)
+	}
+	return nil
 }
 
-type registeredModule struct {
-	Bytes []byte
-	Opts  ModuleOptions
+// getActivationServerID returns the ID of the server the transaction's actor is activated
+// on, or "" if it isn't activated.
+func (tr *kvTransaction) getActivationServerID(ctx context.Context) (string, error) {
+	ra, ok, err := tr.k.getActor(ctx, tr.tr, getActorKey(tr.namespace, tr.actorID))
+	if err != nil {
+		return "", fmt.Errorf("error getting actor: %s, err: %w", tr.actorID, err)
+	}
+	if !ok {
+		return "", fmt.Errorf("actor: %s, err: %w", tr.actorID, errActorDoesNotExist)
+	}
+	return ra.Activation.ServerID, nil
 }
 
-type serverState struct {
-	ServerID          string
-	LastHeartbeatedAt int64
-	HeartbeatState    HeartbeatState
-	ServerVersion     int64
+// pendingInbox is the value of an actor's entry in the pending inboxes index.
+//
+// Every pending inbox has an entry keyed by the actor (getPendingInboxKey) and another
+// keyed by the server the actor is activated on (getServerPendingInboxKey) so that
+// servers only have to scan the inboxes they're responsible for delivering.
+type pendingInbox struct {
+	Namespace string
+	ID        string
+	// ServerID is the ID of the server the actor was activated on when the entry was
+	// written, and is kept in sync by EnsureActivation.
+	ServerID string
+	// RetryAt is copied from the message at the head of the inbox so that servers
+	// polling the index can skip inboxes that are backing off without reading them.
+	RetryAt time.Time
 }
 
-type activation struct {
-	ServerID      string
-	ServerVersion int64
+func putPendingInbox(ctx context.Context, tr transaction, pending pendingInbox) error {
+	prev, ok, err := getPendingInbox(ctx, tr, pending.Namespace, pending.ID)
+	if err != nil {
+		return err
+	}
+	if ok && prev.ServerID != pending.ServerID {
+		if err := tr.delete(ctx, getServerPendingInboxKey(prev.ServerID, prev.Namespace, prev.ID)); err != nil {
+			return err
+		}
+	}
+
+	marshaled, err := json.Marshal(&pending)
+	if err != nil {
+		return fmt.Errorf("error marshaling pending inbox: %w", err)
+	}
+	if err := tr.put(ctx, getPendingInboxKey(pending.Namespace, pending.ID), marshaled); err != nil {
+		return err
+	}
+	return tr.put(ctx, getServerPendingInboxKey(pending.ServerID, pending.Namespace, pending.ID), marshaled)
 }
 
-func newActivation(serverID string, serverVersion int64) activation {
-	return activation{
-		ServerID:      serverID,
-		ServerVersion: serverVersion,
+func getPendingInbox(
+	ctx context.Context,
+	tr transaction,
+	namespace, actorID string,
+) (pendingInbox, bool, error) {
+	v, ok, err := tr.get(ctx, getPendingInboxKey(namespace, actorID))
+	if err != nil {
+		return pendingInbox{}, false, fmt.Errorf("error getting pending inbox: %w", err)
+	}
+	if !ok {
+		return pendingInbox{}, false, nil
 	}
+	var pending pendingInbox
+	if err := json.Unmarshal(v, &pending); err != nil {
+		return pendingInbox{}, false, fmt.Errorf("error unmarshaling pending inbox: %w", err)
+	}
+	return pending, true, nil
 }
 
-func versionSince(curr, prev int64) time.Duration {
-	since := curr - prev
-	if since < 0 {
-		panic(fmt.Sprintf(
-			"prev: %d, curr: %d, versionstamp did not increase monotonically",
-			prev, curr))
+func deletePendingInbox(ctx context.Context, tr transaction, namespace, actorID string) error {
+	pending, ok, err := getPendingInbox(ctx, tr, namespace, actorID)
+	if err != nil {
+		return err
 	}
-	return time.Duration(since) * time.Microsecond
+	if !ok {
+		return nil
+	}
+	if err := tr.delete(ctx, getServerPendingInboxKey(pending.ServerID, namespace, actorID)); err != nil {
+		return err
+	}
+	return tr.delete(ctx, getPendingInboxKey(namespace, actorID))
 }
 
-type kvTransaction struct {
-	namespace string
-	actorID   string
-	tr        transaction
+// movePendingInbox moves an actor's pending inbox (if any) to the index of the server it
+// was just activated on.
+func movePendingInbox(ctx context.Context, tr transaction, namespace, actorID, serverID string) error {
+	pending, ok, err := getPendingInbox(ctx, tr, namespace, actorID)
+	if err != nil {
+		return err
+	}
+	if !ok || pending.ServerID == serverID {
+		return nil
+	}
+	pending.ServerID = serverID
+	return putPendingInbox(ctx, tr, pending)
 }
 
-func newKVTransaction(
+func (tr *kvTransaction) JoinActors(
 	ctx context.Context,
-	namespace string,
-	actorID string,
-	tr transaction,
-) *kvTransaction {
-	return &kvTransaction{
-		namespace: namespace,
-		actorID:   actorID,
-		tr:        tr,
+	participants []TransactionParticipant,
+) (MultiActorKV, error) {
+	for _, p := range participants {
+		if p.ActorID == tr.actorID {
+			continue
+		}
+		if _, ok := tr.participants[p.ActorID]; ok {
+			continue
+		}
+
+		// Checking the participant's fencing token reads its record which also adds it to
+		// the transaction's read set, so the transaction fails to commit if the
+		// participant is reactivated concurrently.
+		err := tr.k.checkFencingToken(
+			ctx, tr.tr, tr.namespace, p.ActorID, p.ServerID, p.ServerVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error joining participant: %s, err: %w", p.ActorID, err)
+		}
+		if tr.participants == nil {
+			tr.participants = make(map[string]struct{})
+		}
+		tr.participants[p.ActorID] = struct{}{}
 	}
+	return kvMultiActorKV{tr}, nil
 }
 
-func (tr *kvTransaction) Get(
+// kvMultiActorKV reads and writes the KV storage of the participants of a kvTransaction.
+type kvMultiActorKV struct {
+	tr *kvTransaction
+}
+
+func (m kvMultiActorKV) Get(
 	ctx context.Context,
+	actorID string,
 	key []byte,
 ) ([]byte, bool, error) {
-	actorKVKey := getActoKVKey(tr.namespace, tr.actorID, key)
-	return tr.tr.get(ctx, actorKVKey)
+	if err := m.checkParticipant(actorID); err != nil {
+		return nil, false, err
+	}
+	return m.tr.tr.get(ctx, getActoKVKey(m.tr.namespace, actorID, key))
 }
 
-func (tr *kvTransaction) Put(
+func (m kvMultiActorKV) Put(
 	ctx context.Context,
+	actorID string,
 	key []byte,
 	value []byte,
 ) error {
-	actorKVKey := getActoKVKey(tr.namespace, tr.actorID, key)
-	return tr.tr.put(ctx, actorKVKey, value)
+	if err := m.checkParticipant(actorID); err != nil {
+		return err
+	}
+	return putActorKV(ctx, m.tr.tr, m.tr.namespace, actorID, key, value)
+}
+
+func (m kvMultiActorKV) checkParticipant(actorID string) error {
+	if actorID == m.tr.actorID {
+		return nil
+	}
+	if _, ok := m.tr.participants[actorID]; !ok {
+		return fmt.Errorf(
+			"actor: %s is not a participant in the transaction", actorID)
+	}
+	return nil
+}
+
+func (tr *kvTransaction) GetInvocationResult(
+	ctx context.Context,
+	idempotencyKey string,
+) (InvocationResult, bool, error) {
+	result, ok, err := getInvocationResult(ctx, tr.tr, tr.namespace, tr.actorID, idempotencyKey)
+	if err != nil || !ok {
+		return InvocationResult{}, false, err
+	}
+	// Results that have expired but haven't been trimmed yet are ignored so that they
+	// expire consistently.
+	if !result.ExpiresAt.IsZero() && !time.Now().Before(result.ExpiresAt) {
+		return InvocationResult{}, false, nil
+	}
+	return result, true, nil
+}
+
+func (tr *kvTransaction) PutInvocationResult(
+	ctx context.Context,
+	idempotencyKey string,
+	result InvocationResult,
+) error {
+	key := getInvocationResultKey(tr.namespace, tr.actorID, idempotencyKey)
+	// An expired result that hasn't been trimmed yet is overwritten, so its expiry has to
+	// be deleted so that trimming it doesn't delete the new result.
+	prev, ok, err := getInvocationResult(ctx, tr.tr, tr.namespace, tr.actorID, idempotencyKey)
+	if err != nil {
+		return err
+	}
+	if ok && !prev.ExpiresAt.IsZero() {
+		if err := tr.tr.delete(ctx, getActorKeyExpiryKey(tr.namespace, tr.actorID, prev.ExpiresAt, key)); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if err := trimExpiredActorKeys(ctx, tr.tr, tr.namespace, tr.actorID, now); err != nil {
+		return fmt.Errorf("error trimming expired keys: %w", err)
+	}
+	result.ExpiresAt = now.Add(invocationResultRetention)
+	marshaled, err := json.Marshal(&result)
+	if err != nil {
+		return fmt.Errorf("error marshaling invocation result: %w", err)
+	}
+	if err := tr.tr.put(ctx, key, marshaled); err != nil {
+		return err
+	}
+	return putActorKeyExpiry(ctx, tr.tr, tr.namespace, tr.actorID, key, result.ExpiresAt)
+}
+
+func getInvocationResult(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	actorID string,
+	idempotencyKey string,
+) (InvocationResult, bool, error) {
+	v, ok, err := tr.get(ctx, getInvocationResultKey(namespace, actorID, idempotencyKey))
+	if err != nil {
+		return InvocationResult{}, false, fmt.Errorf("error getting invocation result: %w", err)
+	}
+	if !ok {
+		return InvocationResult{}, false, nil
+	}
+
+	var result InvocationResult
+	if err := json.Unmarshal(v, &result); err != nil {
+		return InvocationResult{}, false, fmt.Errorf("error unmarshaling invocation result: %w", err)
+	}
+	return result, true, nil
 }
 
 func (tr *kvTransaction) Commit(ctx context.Context) error {
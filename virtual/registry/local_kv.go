@@ -3,20 +3,61 @@ package registry
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
 	"github.com/google/btree"
 )
 
-// localKV is an implementation of kv backed by local memory.
+const (
+	// maxLocalKVConflictHistory is the maximum number of committed transactions whose
+	// write sets are retained for conflict detection. Transactions that began before the
+	// oldest retained commit can't be checked for conflicts so they always fail to commit
+	// with a conflict, similar to FoundationDB's "transaction too old" error.
+	maxLocalKVConflictHistory = 10_000
+
+	localKVMutationPut               = byte(1)
+	localKVMutationDelete            = byte(2)
+	localKVMutationPutVersionstamped = byte(3)
+	localKVMutationTouch             = byte(4)
+	localKVMutationAdd               = byte(5)
+)
+
+// localKV is an implementation of kv backed by local memory. It can optionally be made
+// durable by attaching a WAL, see newFileKV().
+//
+// Transactions are implemented with optimistic concurrency control in the same manner as
+// FoundationDB. Every transaction reads from a (lazy, copy-on-write) clone of the btree
+// taken when it began and buffers its writes. When a transaction commits it is checked
+// against every transaction that committed after it began, and if any of them wrote a
+// key that it read then it fails with a retryable conflict error. Otherwise its writes
+// are applied to the btree. Read-only transactions and blind writes never conflict.
 type localKV struct {
 	sync.Mutex
 	t time.Time
 	b *btree.BTreeG[btreeKV]
-	// clone of b for current transaction, if any.
-	trClone *btree.BTreeG[btreeKV]
+	// commitVersion is incremented every time a transaction that wrote something
+	// commits.
+	commitVersion uint64
+	// commits contains the write sets of recently committed transactions in ascending
+	// order of commitVersion.
+	commits []localKVCommit
 	closed  bool
+	// version is incremented for every versionstamp that is generated.
+	version uint64
+	// watchers contains the channels of the watchers of each key. They're closed (and
+	// removed) when a transaction that wrote the key commits, or when the watch's context
+	// is canceled.
+	watchers map[string]map[chan struct{}]struct{}
+
+	// wal is only set for file-backed instances (see file_kv.go), in which case the
+	// mutations of every transaction are appended to it when the transaction commits.
+	wal *fileKVWAL
 }
 
 func newLocalKV() kv {
@@ -25,46 +66,100 @@ func newLocalKV() kv {
 		b: btree.NewG(16, func(a, b btreeKV) bool {
 			return bytes.Compare(a.k, b.k) < 0
 		}),
+		watchers: make(map[string]map[chan struct{}]struct{}),
 	}
 }
 
 func (l *localKV) beginTransaction(ctx context.Context) (transaction, error) {
 	l.Lock()
-	l.trClone = l.b.Clone()
-	return l, nil
-}
-
-func (l *localKV) commit(ctx context.Context) error {
 	defer l.Unlock()
-	if l.trClone == nil {
-		panic("trClone should not be nil")
+
+	if l.closed {
+		panic("KV already closed")
 	}
+	return &localKVTransaction{
+		l:           l,
+		b:           l.b.Clone(),
+		readVersion: l.commitVersion,
+		reads:       make(map[string]struct{}),
+	}, nil
+}
 
-	l.trClone = nil
-	return nil
+func (l *localKV) transact(fn func(transaction) (any, error)) (any, error) {
+	// Retry conflicts automatically just like FoundationDB's Transact() does.
+	for {
+		tr, err := l.beginTransaction(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := fn(tr)
+		if err != nil {
+			tr.cancel(context.Background())
+			return nil, err
+		}
+
+		if err := tr.commit(context.Background()); err != nil {
+			if IsTransactionConflictErr(err) {
+				continue
+			}
+			return nil, err
+		}
+		return result, nil
+	}
 }
 
-func (l *localKV) cancel(ctx context.Context) error {
+func (l *localKV) watch(ctx context.Context, key []byte) (<-chan struct{}, error) {
+	l.Lock()
 	defer l.Unlock()
-	if l.trClone == nil {
-		panic("trClone should not be nil")
+
+	k := string(key)
+	ch := make(chan struct{})
+	if l.watchers[k] == nil {
+		l.watchers[k] = make(map[chan struct{}]struct{})
 	}
+	l.watchers[k][ch] = struct{}{}
 
-	l.b = l.trClone
-	l.trClone = nil
-	return nil
+	// Stop tracking the watch once its context is canceled so that watches of keys that
+	// are never written don't accumulate.
+	go func() {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			l.Lock()
+			defer l.Unlock()
+			if _, ok := l.watchers[k][ch]; ok {
+				delete(l.watchers[k], ch)
+				if len(l.watchers[k]) == 0 {
+					delete(l.watchers, k)
+				}
+			}
+		}
+	}()
+	return ch, nil
 }
 
-func (l *localKV) transact(fn func(transaction) (any, error)) (any, error) {
-	l.Lock()
-	defer l.Unlock()
+// notifyWatchers notifies the watchers of the provided keys. It must be called with the
+// lock held.
+func (l *localKV) notifyWatchers(keys [][]byte) {
+	for _, key := range keys {
+		k := string(key)
+		for ch := range l.watchers[k] {
+			close(ch)
+		}
+		delete(l.watchers, k)
+	}
+}
 
-	clone := l.b.Clone()
-	result, err := fn(l)
-	if err != nil {
-		l.b = clone
+// notifyAllWatchers notifies the watchers of every key. It must be called with the lock
+// held.
+func (l *localKV) notifyAllWatchers() {
+	for k, chs := range l.watchers {
+		for ch := range chs {
+			close(ch)
+		}
+		delete(l.watchers, k)
 	}
-	return result, err
 }
 
 func (l *localKV) unsafeWipeAll() error {
@@ -72,58 +167,286 @@ func (l *localKV) unsafeWipeAll() error {
 	defer l.Unlock()
 
 	l.b.Clear(false)
+	// Every in-flight transaction should conflict since everything was deleted.
+	l.commitVersion++
+	l.commits = append(l.commits, localKVCommit{
+		commitVersion: l.commitVersion,
+		all:           true,
+	})
+	l.notifyAllWatchers()
+	if l.wal != nil {
+		return l.wal.snapshot(l)
+	}
 	return nil
 }
 
+func (l *localKV) maxTransactionDuration() time.Duration {
+	return 0
+}
+
 func (l *localKV) close(ctx context.Context) error {
 	l.Lock()
 	defer l.Unlock()
 
+	if l.closed {
+		return nil
+	}
 	l.closed = true
+	if l.wal != nil {
+		return l.wal.close()
+	}
 	return nil
 }
 
-// "transaction" method so no lock because we're already locked.
-func (l *localKV) put(
-	ctx context.Context,
-	k, v []byte,
-) error {
+// commit checks tr for conflicts and then applies its mutations.
+func (l *localKV) commit(tr *localKVTransaction) error {
+	l.Lock()
+	defer l.Unlock()
+
 	if l.closed {
 		panic("KV already closed")
 	}
+	if len(tr.mutations) == 0 {
+		// Read-only transactions are always serializable at their read version.
+		return nil
+	}
+
+	if err := l.checkConflicts(tr); err != nil {
+		return err
+	}
+
+	// Complete versionstamps now that the transaction is guaranteed to commit so that
+	// they're ordered by commit.
+	var (
+		mutations = make([]localKVMutation, 0, len(tr.mutations))
+		writes    = make([][]byte, 0, len(tr.mutations))
+	)
+	for _, m := range tr.mutations {
+		switch m.typ {
+		case localKVMutationPutVersionstamped:
+			l.version++
+			var vs tuple.Versionstamp
+			binary.BigEndian.PutUint64(vs.TransactionVersion[:], l.version)
+			completed := append(tuple.Tuple(nil), m.tupleKey...)
+			completed[len(completed)-1] = vs
+			m = localKVMutation{typ: localKVMutationPut, k: completed.Pack(), v: m.v}
+		case localKVMutationTouch:
+			l.version++
+			m = localKVMutation{typ: localKVMutationPut, k: m.k, v: []byte(strconv.FormatUint(l.version, 10))}
+		case localKVMutationAdd:
+			// Add to the latest committed value (or the value written earlier in this
+			// transaction) since the key wasn't read when the transaction added to it.
+			var n int64
+			if v, ok := l.latestValue(mutations, m.k); ok && len(v) == 8 {
+				n = int64(binary.LittleEndian.Uint64(v))
+			}
+			m = localKVMutation{
+				typ: localKVMutationPut,
+				k:   m.k,
+				v:   binary.LittleEndian.AppendUint64(nil, uint64(n+m.delta)),
+			}
+		}
+		mutations = append(mutations, m)
+		writes = append(writes, m.k)
+	}
 
-	// Copy v in case the caller reuses it or mutates it.
-	l.b.ReplaceOrInsert(btreeKV{k, append([]byte(nil), v...)})
+	if err := l.persist(mutations); err != nil {
+		return err
+	}
+
+	for _, m := range mutations {
+		switch m.typ {
+		case localKVMutationPut:
+			l.b.ReplaceOrInsert(btreeKV{m.k, m.v})
+		case localKVMutationDelete:
+			l.b.Delete(btreeKV{m.k, nil})
+		}
+	}
+
+	l.commitVersion++
+	l.commits = append(l.commits, localKVCommit{
+		commitVersion: l.commitVersion,
+		writes:        writes,
+	})
+	if len(l.commits) > maxLocalKVConflictHistory {
+		l.commits = append(l.commits[:0:0], l.commits[len(l.commits)-maxLocalKVConflictHistory:]...)
+	}
+	if l.wal != nil {
+		l.wal.maybeSnapshot(l)
+	}
+	l.notifyWatchers(writes)
 	return nil
 }
 
-// "transaction" method so no lock because we're already locked.
-func (l *localKV) get(
+// latestValue returns the value of k after applying mutations, which must already be
+// resolved to puts and deletes, to the committed data. It must be called with the lock
+// held.
+func (l *localKV) latestValue(mutations []localKVMutation, k []byte) ([]byte, bool) {
+	for i := len(mutations) - 1; i >= 0; i-- {
+		if !bytes.Equal(mutations[i].k, k) {
+			continue
+		}
+		if mutations[i].typ == localKVMutationDelete {
+			return nil, false
+		}
+		return mutations[i].v, true
+	}
+	v, ok := l.b.Get(btreeKV{k, nil})
+	return v.v, ok
+}
+
+// checkConflicts must be called with the lock held.
+func (l *localKV) checkConflicts(tr *localKVTransaction) error {
+	if tr.readVersion == l.commitVersion {
+		return nil
+	}
+	if len(l.commits) == 0 || l.commits[0].commitVersion > tr.readVersion+1 {
+		return fmt.Errorf(
+			"transaction is too old to check for conflicts: %w", errTransactionConflict)
+	}
+
+	for i := len(l.commits) - 1; i >= 0 && l.commits[i].commitVersion > tr.readVersion; i-- {
+		commit := l.commits[i]
+		if commit.all {
+			return errTransactionConflict
+		}
+		for _, k := range commit.writes {
+			if tr.didRead(k) {
+				return fmt.Errorf(
+					"key: %x was modified by a concurrent transaction: %w",
+					k, errTransactionConflict)
+			}
+		}
+	}
+	return nil
+}
+
+// persist makes mutations durable if l is file-backed. It must be called with the lock
+// held.
+func (l *localKV) persist(mutations []localKVMutation) error {
+	if l.wal == nil {
+		return nil
+	}
+
+	versionStamp, err := l.getVersionStamp()
+	if err != nil {
+		return err
+	}
+	return l.wal.append(fileKVBatch{
+		version:      l.version,
+		versionStamp: versionStamp,
+		mutations:    mutations,
+	})
+}
+
+func (l *localKV) getVersionStamp() (int64, error) {
+	// Return microseconds since l.t since that will automatically increase at
+	// a rate of ~ 1 million/s just like FDB's versionstamp.
+	return time.Since(l.t).Microseconds(), nil
+}
+
+// localKVCommit is the write set of a committed transaction.
+type localKVCommit struct {
+	commitVersion uint64
+	writes        [][]byte
+	// all is true if the commit modified every key.
+	all bool
+}
+
+type localKVMutation struct {
+	typ  byte
+	k, v []byte
+	// tupleKey is only set for localKVMutationPutVersionstamped.
+	tupleKey tuple.Tuple
+	// delta is only set for localKVMutationAdd.
+	delta int64
+}
+
+type btreeKV struct {
+	k []byte
+	v []byte
+}
+
+// localKVTransaction is a transaction against a localKV. Reads are served from a clone of
+// the btree taken when the transaction began (with the transaction's own writes applied
+// to it) and the keys/ranges that were read are tracked for conflict detection.
+type localKVTransaction struct {
+	sync.Mutex
+
+	l           *localKV
+	b           *btree.BTreeG[btreeKV]
+	readVersion uint64
+	reads       map[string]struct{}
+	readRanges  []localKVRange
+	mutations   []localKVMutation
+	done        bool
+}
+
+type localKVRange struct {
+	start []byte
+	// end is exclusive, nil means unbounded.
+	end []byte
+}
+
+func (tr *localKVTransaction) put(
+	ctx context.Context,
+	k, v []byte,
+) error {
+	tr.Lock()
+	defer tr.Unlock()
+
+	// Copy k and v in case the caller reuses or mutates them.
+	k = append([]byte(nil), k...)
+	v = append([]byte(nil), v...)
+	tr.b.ReplaceOrInsert(btreeKV{k, v})
+	tr.mutations = append(tr.mutations, localKVMutation{typ: localKVMutationPut, k: k, v: v})
+	return nil
+}
+
+func (tr *localKVTransaction) get(
 	ctx context.Context,
 	k []byte,
 ) ([]byte, bool, error) {
-	if l.closed {
-		panic("KV already closed")
-	}
+	tr.Lock()
+	defer tr.Unlock()
 
-	v, ok := l.b.Get(btreeKV{k, nil})
+	tr.reads[string(k)] = struct{}{}
+	v, ok := tr.b.Get(btreeKV{k, nil})
 	if !ok {
 		return nil, false, nil
 	}
 	return v.v, true, nil
 }
 
-// "transaction" method so no lock because we're already locked.
-func (l *localKV) iterPrefix(
+func (tr *localKVTransaction) delete(
+	ctx context.Context,
+	k []byte,
+) error {
+	tr.Lock()
+	defer tr.Unlock()
+
+	k = append([]byte(nil), k...)
+	tr.b.Delete(btreeKV{k, nil})
+	tr.mutations = append(tr.mutations, localKVMutation{typ: localKVMutationDelete, k: k})
+	return nil
+}
+
+func (tr *localKVTransaction) iterPrefix(
 	ctx context.Context,
 	prefix []byte, fn func(k, v []byte) error,
 ) error {
-	if l.closed {
-		panic("KV already closed")
-	}
+	tr.Lock()
+	defer tr.Unlock()
+
+	// The entire prefix is marked as read even if fn stops iterating early. This may
+	// cause spurious conflicts, but never misses any.
+	tr.readRanges = append(tr.readRanges, localKVRange{
+		start: append([]byte(nil), prefix...),
+		end:   prefixEnd(prefix),
+	})
 
 	var globalErr error
-	l.b.AscendGreaterOrEqual(btreeKV{prefix, nil}, func(currKV btreeKV) bool {
+	tr.b.AscendGreaterOrEqual(btreeKV{prefix, nil}, func(currKV btreeKV) bool {
 		if bytes.HasPrefix(currKV.k, prefix) {
 			if err := fn(currKV.k, currKV.v); err != nil {
 				globalErr = err
@@ -136,17 +459,134 @@ func (l *localKV) iterPrefix(
 	return globalErr
 }
 
-// "transaction" method so no lock because we're already locked.
-func (l *localKV) getVersionStamp() (int64, error) {
-	// Return microseconds since l.t since that will automatically increase at
-	// a rate of ~ 1 million/s just like FDB's versionstamp.
-	return time.Since(l.t).Microseconds(), nil
+func (tr *localKVTransaction) iterRange(
+	ctx context.Context,
+	start, end []byte,
+	fn func(k, v []byte) error,
+) error {
+	tr.Lock()
+	defer tr.Unlock()
+
+	tr.readRanges = append(tr.readRanges, localKVRange{
+		start: append([]byte(nil), start...),
+		end:   append([]byte(nil), end...),
+	})
+
+	var globalErr error
+	tr.b.AscendRange(btreeKV{start, nil}, btreeKV{end, nil}, func(currKV btreeKV) bool {
+		if err := fn(currKV.k, currKV.v); err != nil {
+			globalErr = err
+			return false
+		}
+		return true
+	})
+	return globalErr
 }
 
-type btreeKV struct {
-	k []byte
-	v []byte
+func (tr *localKVTransaction) putVersionstamped(
+	ctx context.Context,
+	key tuple.Tuple,
+	value []byte,
+) error {
+	if len(key) == 0 {
+		return errors.New("key must end with an incomplete versionstamp")
+	}
+	if _, ok := key[len(key)-1].(tuple.Versionstamp); !ok {
+		return errors.New("key must end with an incomplete versionstamp")
+	}
+
+	tr.Lock()
+	defer tr.Unlock()
+
+	// The versionstamp is completed when the transaction commits so, just like
+	// FoundationDB, the key can't be read back by this transaction.
+	tr.mutations = append(tr.mutations, localKVMutation{
+		typ:      localKVMutationPutVersionstamped,
+		tupleKey: append(tuple.Tuple(nil), key...),
+		v:        append([]byte(nil), value...),
+	})
+	return nil
 }
 
-type localKVTransaction struct {
+func (tr *localKVTransaction) touch(
+	ctx context.Context,
+	key []byte,
+) error {
+	tr.Lock()
+	defer tr.Unlock()
+
+	tr.mutations = append(tr.mutations, localKVMutation{
+		typ: localKVMutationTouch,
+		k:   append([]byte(nil), key...),
+	})
+	return nil
+}
+
+func (tr *localKVTransaction) add(
+	ctx context.Context,
+	key []byte,
+	delta int64,
+) error {
+	tr.Lock()
+	defer tr.Unlock()
+
+	// Just like FoundationDB, the key is not added to the transaction's read set so the
+	// result is only known once the transaction commits.
+	k := append([]byte(nil), key...)
+	var n int64
+	if v, ok := tr.b.Get(btreeKV{k, nil}); ok && len(v.v) == 8 {
+		n = int64(binary.LittleEndian.Uint64(v.v))
+	}
+	tr.b.ReplaceOrInsert(btreeKV{k, binary.LittleEndian.AppendUint64(nil, uint64(n+delta))})
+	tr.mutations = append(tr.mutations, localKVMutation{typ: localKVMutationAdd, k: k, delta: delta})
+	return nil
+}
+
+func (tr *localKVTransaction) getVersionStamp() (int64, error) {
+	return tr.l.getVersionStamp()
+}
+
+func (tr *localKVTransaction) commit(ctx context.Context) error {
+	tr.Lock()
+	defer tr.Unlock()
+
+	if tr.done {
+		return errors.New("transaction already committed or canceled")
+	}
+	tr.done = true
+	return tr.l.commit(tr)
+}
+
+func (tr *localKVTransaction) cancel(ctx context.Context) error {
+	tr.Lock()
+	defer tr.Unlock()
+
+	tr.done = true
+	return nil
+}
+
+// didRead must be called with the transaction's lock held.
+func (tr *localKVTransaction) didRead(k []byte) bool {
+	if _, ok := tr.reads[string(k)]; ok {
+		return true
+	}
+	for _, r := range tr.readRanges {
+		if bytes.Compare(k, r.start) >= 0 && (r.end == nil || bytes.Compare(k, r.end) < 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixEnd returns the smallest key that is greater than every key with the provided
+// prefix, or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
 }
@@ -1,9 +1,602 @@
 package registry
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLocalRegistry(t *testing.T) {
 	testAllCommon(t, func() Registry { return NewLocalRegistry() })
 }
+
+// TestLocalKVConflicts tests that localKV transactions are isolated from each other and
+// that conflicts are detected the same way FoundationDB detects them.
+func TestLocalKVConflicts(t *testing.T) {
+	var (
+		ctx = context.Background()
+		kv  = newLocalKV()
+	)
+	begin := func() transaction {
+		tr, err := kv.beginTransaction(ctx)
+		require.NoError(t, err)
+		return tr
+	}
+	get := func(tr transaction, k string) string {
+		v, _, err := tr.get(ctx, []byte(k))
+		require.NoError(t, err)
+		return string(v)
+	}
+	put := func(tr transaction, k, v string) {
+		require.NoError(t, tr.put(ctx, []byte(k), []byte(v)))
+	}
+
+	// Transactions read from a snapshot and can read their own writes.
+	tr1, tr2 := begin(), begin()
+	put(tr1, "a", "1")
+	require.Equal(t, "1", get(tr1, "a"))
+	require.Equal(t, "", get(tr2, "a"))
+	require.NoError(t, tr1.commit(ctx))
+	require.Equal(t, "", get(tr2, "a"))
+	// tr2 is read-only so it doesn't conflict.
+	require.NoError(t, tr2.commit(ctx))
+
+	// Reading a key that was modified by a concurrent transaction is a conflict.
+	tr1, tr2 = begin(), begin()
+	put(tr2, "b", get(tr2, "a")+"2")
+	put(tr1, "a", "3")
+	require.NoError(t, tr1.commit(ctx))
+	err := tr2.commit(ctx)
+	require.Error(t, err)
+	require.True(t, IsTransactionConflictErr(err))
+
+	// Blind writes never conflict.
+	tr1, tr2 = begin(), begin()
+	put(tr1, "a", "4")
+	put(tr2, "a", "5")
+	require.NoError(t, tr1.commit(ctx))
+	require.NoError(t, tr2.commit(ctx))
+
+	// Iterating a prefix conflicts with writes to any key in the prefix, even ones that
+	// didn't exist yet.
+	tr1, tr2 = begin(), begin()
+	require.NoError(t, tr2.iterPrefix(ctx, []byte("prefix-"), func(k, v []byte) error {
+		return nil
+	}))
+	put(tr2, "c", "6")
+	put(tr1, "prefix-a", "7")
+	require.NoError(t, tr1.commit(ctx))
+	err = tr2.commit(ctx)
+	require.True(t, IsTransactionConflictErr(err))
+
+	// But not with writes outside of the prefix.
+	tr1, tr2 = begin(), begin()
+	require.NoError(t, tr2.iterPrefix(ctx, []byte("prefix-"), func(k, v []byte) error {
+		return nil
+	}))
+	put(tr2, "c", "8")
+	put(tr1, "prefix", "9")
+	put(tr1, "prefiy", "10")
+	require.NoError(t, tr1.commit(ctx))
+	require.NoError(t, tr2.commit(ctx))
+
+	// Atomic adds to the same key never conflict and are applied to the latest value.
+	add := func(tr transaction, k string, delta int64) {
+		require.NoError(t, tr.add(ctx, []byte(k), delta))
+	}
+	tr1, tr2 = begin(), begin()
+	add(tr1, "counter", 2)
+	add(tr2, "counter", 3)
+	add(tr2, "counter", -1)
+	require.NoError(t, tr1.commit(ctx))
+	require.NoError(t, tr2.commit(ctx))
+	tr1 = begin()
+	n, err := getAtomicCounter(ctx, tr1, []byte("counter"))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), n)
+	require.NoError(t, tr1.cancel(ctx))
+
+	// Canceled transactions are discarded.
+	tr1 = begin()
+	put(tr1, "d", "11")
+	require.NoError(t, tr1.cancel(ctx))
+	require.Equal(t, "", get(begin(), "d"))
+}
+
+// TestLocalKVWatch tests that watchers are only notified when the key they watch is
+// written, and that watches are cleaned up when their context is canceled.
+func TestLocalKVWatch(t *testing.T) {
+	ctx := context.Background()
+	l := newLocalKV().(*localKV)
+	put := func(k string) {
+		_, err := l.transact(func(tr transaction) (any, error) {
+			return nil, tr.put(ctx, []byte(k), []byte("v"))
+		})
+		require.NoError(t, err)
+	}
+	isClosed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	ch1, err := l.watch(ctx, []byte("a"))
+	require.NoError(t, err)
+	ch2, err := l.watch(ctx, []byte("a"))
+	require.NoError(t, err)
+	put("b")
+	require.False(t, isClosed(ch1))
+	require.False(t, isClosed(ch2))
+	put("a")
+	require.True(t, isClosed(ch1))
+	require.True(t, isClosed(ch2))
+
+	watchCtx, cc := context.WithCancel(ctx)
+	ch, err := l.watch(watchCtx, []byte("c"))
+	require.NoError(t, err)
+	cc()
+	require.Eventually(t, func() bool {
+		l.Lock()
+		defer l.Unlock()
+		return len(l.watchers) == 0
+	}, 5*time.Second, time.Millisecond)
+	put("c")
+	require.False(t, isClosed(ch))
+}
+
+// TestLocalKVConcurrentTransact tests that transact() automatically retries conflicts.
+func TestLocalKVConcurrentTransact(t *testing.T) {
+	var (
+		ctx           = context.Background()
+		kv            = newLocalKV()
+		wg            sync.WaitGroup
+		numGoroutines = 10
+		numIncrements = 100
+	)
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numIncrements; j++ {
+				_, err := kv.transact(func(tr transaction) (any, error) {
+					v, _, err := tr.get(ctx, []byte("counter"))
+					if err != nil {
+						return nil, err
+					}
+					count, _ := strconv.Atoi(string(v))
+					return nil, tr.put(ctx, []byte("counter"), []byte(strconv.Itoa(count+1)))
+				})
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := kv.transact(func(tr transaction) (any, error) {
+		v, _, err := tr.get(ctx, []byte("counter"))
+		return v, err
+	})
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(numGoroutines*numIncrements), string(v.([]byte)))
+}
+
+// TestLocalRegistryConcurrentActorTransactions tests that actor KV transactions in the
+// local registry don't block each other and that conflicting transactions fail with a
+// retryable error.
+func TestLocalRegistryConcurrentActorTransactions(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = NewLocalRegistry()
+	)
+	_, err := reg.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	for _, actor := range []string{"a", "b"} {
+		writeTestActorKV(t, reg, actor, 0)
+	}
+
+	trA1, err := reg.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	_, _, err = trA1.Get(ctx, []byte("key"))
+	require.NoError(t, err)
+	require.NoError(t, trA1.Put(ctx, []byte("key"), []byte("a1")))
+
+	// Transactions for other actors (and other registry operations) can proceed while
+	// trA1 is still open.
+	trB, err := reg.BeginTransaction(ctx, "ns1", "b", "server1", 1)
+	require.NoError(t, err)
+	require.NoError(t, trB.Put(ctx, []byte("key"), []byte("b")))
+	require.NoError(t, trB.Commit(ctx))
+	_, err = reg.Heartbeat(ctx, "server1", HeartbeatState{Address: "server1_address"})
+	require.NoError(t, err)
+
+	// A concurrent transaction for the same actor that modifies a key trA1 read causes
+	// trA1 to conflict.
+	trA2, err := reg.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	require.NoError(t, trA2.Put(ctx, []byte("key"), []byte("a2")))
+	require.NoError(t, trA2.Commit(ctx))
+
+	err = trA1.Commit(ctx)
+	require.Error(t, err)
+	require.True(t, IsTransactionConflictErr(err))
+}
+
+// TestLocalRegistryActorKVChangeLogRetention tests that expired entries are trimmed from
+// actor KV change logs and that watchers which missed them are told so.
+func TestLocalRegistryActorKVChangeLogRetention(t *testing.T) {
+	var (
+		ctx = context.Background()
+		kv  = newLocalKV()
+		reg = newValidatedRegistry(newKVRegistry(kv))
+	)
+	require.NoError(t, reg.CreateNamespace(ctx, "ns1", NamespaceOptions{KVChangeLog: true}))
+	_, err := reg.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	writeTestActorKV(t, reg, "a", maxActorKVChangeLogTrimsPerPut+2)
+
+	changes, err := reg.WatchActorKV(ctx, "ns1", "a", nil, nil)
+	require.NoError(t, err)
+	require.Len(t, changes, maxActorKVChangeLogTrimsPerPut+2)
+
+	// Entries that haven't expired yet are not trimmed.
+	trim := func(now time.Time) {
+		_, err := kv.transact(func(tr transaction) (any, error) {
+			return nil, trimActorKVChangeLog(ctx, tr, "ns1", "a", now)
+		})
+		require.NoError(t, err)
+	}
+	trim(time.Now())
+	remaining, err := reg.WatchActorKV(ctx, "ns1", "a", nil, nil)
+	require.NoError(t, err)
+	require.Len(t, remaining, maxActorKVChangeLogTrimsPerPut+2)
+
+	// At most maxActorKVChangeLogTrimsPerPut expired entries are trimmed at a time.
+	trim(time.Now().Add(2 * actorKVChangeLogRetention))
+	remaining, err = reg.WatchActorKV(ctx, "ns1", "a", nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, changes[maxActorKVChangeLogTrimsPerPut:], remaining)
+
+	// Watchers that are behind the trimmed entries missed changes, but watchers that saw
+	// the last trimmed entry didn't.
+	_, err = reg.WatchActorKV(ctx, "ns1", "a", nil, changes[0].Version)
+	require.True(t, IsActorKVChangesTruncatedErr(err))
+	remaining, err = reg.WatchActorKV(ctx, "ns1", "a", nil, changes[maxActorKVChangeLogTrimsPerPut-1].Version)
+	require.NoError(t, err)
+	require.Equal(t, changes[maxActorKVChangeLogTrimsPerPut:], remaining)
+}
+
+// TestLocalRegistryExpiredActorKeys tests that expired invocation results and inbox dedup
+// entries are trimmed.
+func TestLocalRegistryExpiredActorKeys(t *testing.T) {
+	var (
+		ctx = context.Background()
+		kv  = newLocalKV()
+		reg = newValidatedRegistry(newKVRegistry(kv))
+	)
+	_, err := reg.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	writeTestActorKV(t, reg, "a", 0)
+
+	tr, err := reg.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	require.NoError(t, tr.PutInvocationResult(ctx, "key", InvocationResult{Operation: "op", Result: []byte("result")}))
+	require.NoError(t, tr.EnqueueMessage(ctx, "a", InboxMessage{ID: "msg", Operation: "op"}))
+	require.NoError(t, tr.Commit(ctx))
+
+	trim := func(now time.Time) {
+		_, err := kv.transact(func(tr transaction) (any, error) {
+			return nil, trimExpiredActorKeys(ctx, tr, "ns1", "a", now)
+		})
+		require.NoError(t, err)
+	}
+	getResult := func() bool {
+		tr, err := reg.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+		require.NoError(t, err)
+		defer tr.Cancel(ctx)
+		result, ok, err := tr.GetInvocationResult(ctx, "key")
+		require.NoError(t, err)
+		if ok {
+			require.Equal(t, []byte("result"), result.Result)
+			require.True(t, result.ExpiresAt.After(time.Now()))
+		}
+		return ok
+	}
+
+	// Keys that haven't expired yet are not trimmed.
+	trim(time.Now())
+	require.True(t, getResult())
+
+	trim(time.Now().Add(2 * invocationResultRetention))
+	require.False(t, getResult())
+	var numExpiryKeys int
+	_, err = kv.transact(func(tr transaction) (any, error) {
+		return nil, tr.iterPrefix(ctx, getActorKeyExpiryPrefix("ns1", "a"), func(k, v []byte) error {
+			numExpiryKeys++
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, numExpiryKeys)
+
+	// Once its dedup entry is trimmed, a message with the same ID is enqueued again.
+	tr, err = reg.BeginTransaction(ctx, "ns1", "a", "server1", 1)
+	require.NoError(t, err)
+	require.NoError(t, tr.EnqueueMessage(ctx, "a", InboxMessage{ID: "msg", Operation: "op"}))
+	require.NoError(t, tr.AckInboxMessage(ctx, 1))
+	msg, ok, err := tr.PeekInbox(ctx)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(2), msg.Seq)
+	require.NoError(t, tr.Commit(ctx))
+}
+
+// TestLocalRegistryLegacyModules tests that modules stored in the format used before
+// modules were split into content-addressed chunks can still be read.
+func TestLocalRegistryLegacyModules(t *testing.T) {
+	var (
+		ctx = context.Background()
+		kv  = newLocalKV()
+		reg = newValidatedRegistry(newKVRegistry(kv))
+	)
+	marshaled, err := json.Marshal(&registeredModule{
+		Bytes: []byte("legacy wasm"),
+		Opts:  ModuleOptions{AllowEmptyModuleBytes: true},
+	})
+	require.NoError(t, err)
+	_, err = kv.transact(func(tr transaction) (any, error) {
+		// Split over multiple parts like the old implementation did.
+		require.NoError(t, tr.put(ctx, getModulePartKey("ns1", "legacy", 0), marshaled[:10]))
+		require.NoError(t, tr.put(ctx, getModulePartKey("ns1", "legacy", 1), marshaled[10:]))
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	moduleBytes, opts, err := reg.GetModule(ctx, "ns1", "legacy")
+	require.NoError(t, err)
+	require.Equal(t, []byte("legacy wasm"), moduleBytes)
+	require.True(t, opts.AllowEmptyModuleBytes)
+
+	_, err = reg.RegisterModule(ctx, "ns1", "legacy", testModuleBytes, ModuleOptions{})
+	require.Error(t, err)
+	_, err = reg.CreateActor(ctx, "ns1", "a", "legacy", types.ActorOptions{})
+	require.NoError(t, err)
+
+	// Legacy modules are listed once and all of their parts are deleted.
+	moduleIDs, err := reg.ListModules(ctx, "ns1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"legacy"}, moduleIDs)
+	require.NoError(t, reg.DeleteActor(ctx, "ns1", "a"))
+	require.NoError(t, reg.DeleteModule(ctx, "ns1", "legacy"))
+	moduleIDs, err = reg.ListModules(ctx, "ns1")
+	require.NoError(t, err)
+	require.Empty(t, moduleIDs)
+	_, _, err = reg.GetModule(ctx, "ns1", "legacy")
+	require.Error(t, err)
+}
+
+// TestLocalRegistryLegacyIndexes tests that the actor and subscription indexes are built
+// in the background for namespaces whose actors and subscriptions were created before
+// the indexes existed.
+func TestLocalRegistryLegacyIndexes(t *testing.T) {
+	var (
+		ctx = context.Background()
+		kv  = newLocalKV()
+		reg = newValidatedRegistry(newKVRegistry(kv))
+	)
+	_, err := reg.RegisterModule(ctx, "ns1", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	// More actors than are indexed in a single transaction.
+	var expected []string
+	for i := 0; i < maxIndexKeysPerTransaction; i++ {
+		actorID := fmt.Sprintf("actor-%04d", i)
+		expected = append(expected, actorID)
+		_, err = reg.CreateActor(ctx, "ns1", actorID, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+	for _, actorID := range expected[:2] {
+		require.NoError(t, reg.Subscribe(ctx, "ns1", "topic", actorID, "inc"))
+	}
+
+	// Remove the indexes to simulate data written by older versions.
+	require.NoError(t, deleteIndexes(ctx, kv, "ns1"))
+
+	// Actors can be deleted before the indexes are built.
+	require.NoError(t, reg.DeleteActor(ctx, "ns1", expected[0]))
+	subscriptions, err := reg.GetSubscriptions(ctx, "ns1", "topic")
+	require.NoError(t, err)
+	require.Equal(t, []TopicSubscription{{ActorID: expected[1], Operation: "inc"}}, subscriptions)
+	expected = expected[1:]
+
+	// The actors can be listed once the indexes are built in the background.
+	var actorIDs []string
+	require.Eventually(t, func() bool {
+		actorIDs, err = reg.ListActors(ctx, "ns1", "", len(expected)+1)
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, expected, actorIDs)
+
+	require.NoError(t, reg.DeleteActor(ctx, "ns1", expected[0]))
+	actorIDs, err = reg.ListActors(ctx, "ns1", "", 1)
+	require.NoError(t, err)
+	require.Equal(t, expected[1:2], actorIDs)
+	subscriptions, err = reg.GetSubscriptions(ctx, "ns1", "topic")
+	require.NoError(t, err)
+	require.Empty(t, subscriptions)
+
+	// New namespaces are indexed as soon as they're created.
+	_, err = reg.RegisterModule(ctx, "ns2", "test-module", testModuleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	require.NoError(t, reg.CreateNamespace(ctx, "ns3", NamespaceOptions{}))
+	_, err = kv.transact(func(tr transaction) (any, error) {
+		for _, ns := range []string{"ns2", "ns3"} {
+			_, ok, err := tr.get(ctx, getNamespaceIndexesBuiltKey(ns))
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+		return nil, nil
+	})
+	require.NoError(t, err)
+}
+
+// deleteIndexes deletes the namespace's actor and subscription indexes and the marker
+// that they were built.
+func deleteIndexes(ctx context.Context, kv kv, namespace string) error {
+	_, err := kv.transact(func(tr transaction) (any, error) {
+		var keys [][]byte
+		err := tr.iterPrefix(ctx, getActorIndexPrefix(namespace), func(k, v []byte) error {
+			keys = append(keys, append([]byte(nil), k...))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		actorsPrefix := getActorsPrefix(namespace)
+		err = tr.iterPrefix(ctx, actorsPrefix, func(k, v []byte) error {
+			suffix, err := tuple.Unpack(k[len(actorsPrefix):])
+			if err != nil {
+				return err
+			}
+			if len(suffix) == 3 && suffix[1] == "subscriptions" {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, getNamespaceIndexesBuiltKey(namespace))
+		for _, k := range keys {
+			if err := tr.delete(ctx, k); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// TestLocalRegistryModuleStoreDedupe tests that modules are deduplicated and compressed
+// in the module store.
+func TestLocalRegistryModuleStoreDedupe(t *testing.T) {
+	var (
+		ctx = context.Background()
+		kv  = newLocalKV()
+		reg = newValidatedRegistry(newKVRegistry(kv))
+	)
+	moduleBytes := paddedTestModule()
+	_, err := reg.RegisterModule(ctx, "ns1", "module", moduleBytes, ModuleOptions{})
+	require.NoError(t, err)
+	numKeys, numBytes := moduleStoreSize(t, kv)
+	require.Less(t, numBytes, len(moduleBytes)/2)
+
+	for _, ns := range []string{"ns1", "ns2", "ns3"} {
+		_, err := reg.RegisterModule(ctx, ns, "module-copy", moduleBytes, ModuleOptions{})
+		require.NoError(t, err)
+	}
+	numKeys2, numBytes2 := moduleStoreSize(t, kv)
+	require.Equal(t, numKeys, numKeys2)
+	require.Equal(t, numBytes, numBytes2)
+
+	for _, ns := range []string{"ns1", "ns2", "ns3"} {
+		fetched, _, err := reg.GetModule(ctx, ns, "module-copy")
+		require.NoError(t, err)
+		require.Equal(t, moduleBytes, fetched)
+	}
+}
+
+// TestLocalRegistryModuleStoreDelete tests that blobs and chunks are deleted from the
+// module store once nothing references them anymore.
+func TestLocalRegistryModuleStoreDelete(t *testing.T) {
+	var (
+		ctx = context.Background()
+		kv  = newLocalKV()
+		reg = newValidatedRegistry(newKVRegistry(kv))
+	)
+
+	// Failed uploads don't leave anything behind.
+	moduleBytes := paddedTestModule()
+	failing := io.MultiReader(bytes.NewReader(moduleBytes), iotest.ErrReader(errors.New("some error")))
+	_, err := reg.RegisterModuleStream(ctx, "ns1", "failed", failing, ModuleOptions{})
+	require.Error(t, err)
+	numKeys, _ := moduleStoreSize(t, kv)
+	require.Equal(t, 0, numKeys)
+
+	// The second module shares most of the first module's chunks.
+	extendedBytes := withCustomSection(moduleBytes, "extra", make([]byte, moduleChunkSize))
+	_, err = reg.RegisterModule(ctx, "ns1", "extended", extendedBytes, ModuleOptions{})
+	require.NoError(t, err)
+	for _, ns := range []string{"ns1", "ns2", "ns3"} {
+		_, err := reg.RegisterModule(ctx, ns, "module", moduleBytes, ModuleOptions{})
+		require.NoError(t, err)
+	}
+	numKeys, numBytes := moduleStoreSize(t, kv)
+
+	require.NoError(t, reg.DeleteModule(ctx, "ns1", "module"))
+	require.NoError(t, reg.DeleteNamespace(ctx, "ns2"))
+	numKeys2, numBytes2 := moduleStoreSize(t, kv)
+	require.Equal(t, numKeys, numKeys2)
+	require.Equal(t, numBytes, numBytes2)
+
+	require.NoError(t, reg.DeleteModule(ctx, "ns3", "module"))
+	numKeys2, numBytes2 = moduleStoreSize(t, kv)
+	require.Less(t, numKeys2, numKeys)
+	require.Less(t, numBytes2, numBytes)
+	fetched, _, err := reg.GetModule(ctx, "ns1", "extended")
+	require.NoError(t, err)
+	require.Equal(t, extendedBytes, fetched)
+
+	require.NoError(t, reg.DeleteModule(ctx, "ns1", "extended"))
+	numKeys, _ = moduleStoreSize(t, kv)
+	require.Equal(t, 0, numKeys)
+}
+
+// paddedTestModule returns testModuleBytes padded to about a megabyte with data that's
+// highly compressible, but not identical in every chunk.
+func paddedTestModule() []byte {
+	var padding []byte
+	for i := 0; len(padding) < 1<<20; i++ {
+		padding = append(padding, []byte(fmt.Sprintf("some padding %d\n", i))...)
+	}
+	return withCustomSection(testModuleBytes, "padding", padding)
+}
+
+// moduleStoreSize returns the number of keys in the module store (including reference
+// counts) and the total size of their values.
+func moduleStoreSize(t *testing.T, kv kv) (numKeys, numBytes int) {
+	_, err := kv.transact(func(tr transaction) (any, error) {
+		for _, prefix := range [][]byte{
+			tuple.Tuple{"module_chunks"}.Pack(),
+			tuple.Tuple{"module_blobs"}.Pack(),
+			tuple.Tuple{"module_chunk_refs"}.Pack(),
+			tuple.Tuple{"module_blob_refs"}.Pack(),
+		} {
+			err := tr.iterPrefix(context.Background(), prefix, func(k, v []byte) error {
+				numKeys++
+				numBytes += len(v)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	require.NoError(t, err)
+	return numKeys, numBytes
+}
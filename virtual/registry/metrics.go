@@ -0,0 +1,93 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/metrics"
+)
+
+const (
+	// transactionTypeTransact is the type of transactions that are run (and retried) with
+	// kv.transact().
+	transactionTypeTransact = "transact"
+	// transactionTypeActor is the type of actor KV transactions, which are started with
+	// kv.beginTransaction() and committed by their actor's invocation.
+	transactionTypeActor = "actor"
+)
+
+var (
+	transactionDuration = metrics.NewHistogramVec(
+		"nola_registry_transaction_duration_seconds",
+		"Latency of registry transactions, including retries.",
+		metrics.DefaultLatencyBuckets,
+		"type", "result")
+	transactionConflicts = metrics.NewCounterVec(
+		"nola_registry_transaction_conflicts_total",
+		"Number of registry transactions that conflicted with another transaction.",
+		"type")
+)
+
+// instrumentedKV wraps a kv and records metrics for its transactions.
+type instrumentedKV struct {
+	kv
+}
+
+func newInstrumentedKV(kv kv) kv {
+	return instrumentedKV{kv: kv}
+}
+
+func (i instrumentedKV) beginTransaction(ctx context.Context) (transaction, error) {
+	tr, err := i.kv.beginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTransaction{transaction: tr, start: time.Now()}, nil
+}
+
+func (i instrumentedKV) transact(fn func(transaction) (any, error)) (any, error) {
+	var (
+		start    = time.Now()
+		attempts = 0
+	)
+	result, err := i.kv.transact(func(tr transaction) (any, error) {
+		// Every backend retries conflicts by calling fn again.
+		attempts++
+		return fn(tr)
+	})
+	if attempts > 1 {
+		transactionConflicts.WithLabels(transactionTypeTransact).Add(float64(attempts - 1))
+	}
+	observeTransaction(transactionTypeTransact, start, err)
+	return result, err
+}
+
+// instrumentedTransaction records the latency of a transaction from when it was begun
+// until it's committed or canceled.
+type instrumentedTransaction struct {
+	transaction
+	start time.Time
+}
+
+func (i *instrumentedTransaction) commit(ctx context.Context) error {
+	err := i.transaction.commit(ctx)
+	if IsTransactionConflictErr(err) {
+		transactionConflicts.WithLabels(transactionTypeActor).Inc()
+	}
+	observeTransaction(transactionTypeActor, i.start, err)
+	return err
+}
+
+func (i *instrumentedTransaction) cancel(ctx context.Context) error {
+	err := i.transaction.cancel(ctx)
+	transactionDuration.WithLabels(transactionTypeActor, "canceled").Observe(time.Since(i.start).Seconds())
+	return err
+}
+
+func observeTransaction(typ string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	transactionDuration.WithLabels(typ, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,265 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ModuleManifest declares the operations that a module implements. It's optional, but
+// if a module has a manifest then invocations of operations that aren't declared in it
+// are rejected before they're dispatched to the module.
+type ModuleManifest struct {
+	Operations []OperationManifest `json:"operations"`
+}
+
+// OperationManifest describes a single operation implemented by a module.
+type OperationManifest struct {
+	Name string `json:"name"`
+	// PayloadSchema is an optional JSON schema that the payloads of invocations of the
+	// operation must conform to. Payloads are not required to be JSON if it's not set.
+	// See jsonSchema for the supported subset of JSON schema.
+	PayloadSchema json.RawMessage `json:"payload_schema,omitempty"`
+	// ResponseSchema is an optional JSON schema that describes the operation's response.
+	// It's not enforced, but is useful for generating clients.
+	ResponseSchema json.RawMessage `json:"response_schema,omitempty"`
+	// ReadOnly indicates that the operation does not modify the actor's state. Read-only
+	// operations are not allowed to write to the actor's KV storage.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// Validate validates the manifest.
+func (m *ModuleManifest) Validate() error {
+	seen := make(map[string]struct{}, len(m.Operations))
+	for _, op := range m.Operations {
+		if op.Name == "" {
+			return errors.New("manifest operation name must not be empty")
+		}
+		if _, ok := seen[op.Name]; ok {
+			return fmt.Errorf("manifest operation: %s is declared more than once", op.Name)
+		}
+		seen[op.Name] = struct{}{}
+
+		if _, err := parseJSONSchema(op.PayloadSchema); err != nil {
+			return fmt.Errorf("invalid payload schema for operation: %s, err: %w", op.Name, err)
+		}
+		if _, err := parseJSONSchema(op.ResponseSchema); err != nil {
+			return fmt.Errorf("invalid response schema for operation: %s, err: %w", op.Name, err)
+		}
+	}
+	return nil
+}
+
+// Operation returns the manifest for the operation with the provided name and a
+// boolean indicating whether it's declared in the manifest.
+func (m *ModuleManifest) Operation(name string) (OperationManifest, bool) {
+	for _, op := range m.Operations {
+		if op.Name == name {
+			return op, true
+		}
+	}
+	return OperationManifest{}, false
+}
+
+// ValidatePayload validates payload against the operation's payload schema, if it has
+// one.
+func (o OperationManifest) ValidatePayload(payload []byte) error {
+	schema, err := parseJSONSchema(o.PayloadSchema)
+	if err != nil {
+		return fmt.Errorf("invalid payload schema for operation: %s, err: %w", o.Name, err)
+	}
+	if schema == nil {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("payload for operation: %s is not valid JSON: %w", o.Name, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("payload for operation: %s contains more than one JSON value", o.Name)
+	}
+	if err := schema.validate("payload", v); err != nil {
+		return fmt.Errorf("payload for operation: %s does not match schema: %w", o.Name, err)
+	}
+	return nil
+}
+
+// jsonSchema implements the subset of JSON schema that is supported for operation
+// payloads: the type, enum, properties, required, additionalProperties and items
+// keywords. Any other keywords are ignored.
+type jsonSchema struct {
+	Type                 jsonSchemaTypes        `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+}
+
+// jsonSchemaTypes is the value of the type keyword, which may be a single type or a
+// list of them.
+type jsonSchemaTypes []string
+
+func (t *jsonSchemaTypes) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*t = jsonSchemaTypes{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = multiple
+	return nil
+}
+
+var validJSONSchemaTypes = map[string]struct{}{
+	"null":    {},
+	"boolean": {},
+	"object":  {},
+	"array":   {},
+	"number":  {},
+	"integer": {},
+	"string":  {},
+}
+
+// parseJSONSchema parses a JSON schema. It returns nil if the schema is empty.
+func parseJSONSchema(b json.RawMessage) (*jsonSchema, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var schema jsonSchema
+	if err := dec.Decode(&schema); err != nil {
+		return nil, fmt.Errorf("error unmarshaling JSON schema: %w", err)
+	}
+	if err := schema.check(); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// check verifies that the schema itself is valid.
+func (s *jsonSchema) check() error {
+	for _, t := range s.Type {
+		if _, ok := validJSONSchemaTypes[t]; !ok {
+			return fmt.Errorf("unknown JSON schema type: %s", t)
+		}
+	}
+	for _, property := range s.Properties {
+		if property == nil {
+			continue
+		}
+		if err := property.check(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check()
+	}
+	return nil
+}
+
+// validate validates v, which must have been decoded with json.Decoder.UseNumber, against
+// the schema. path is used to identify v in errors.
+func (s *jsonSchema) validate(path string, v any) error {
+	if len(s.Type) > 0 {
+		matches := false
+		for _, t := range s.Type {
+			if jsonSchemaTypeMatches(t, v) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return fmt.Errorf("%s must be of type: %v", path, []string(s.Type))
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		matches := false
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(allowed, v) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return fmt.Errorf("%s must be one of: %v", path, s.Enum)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, required := range s.Required {
+			if _, ok := v[required]; !ok {
+				return fmt.Errorf("%s is missing required property: %s", path, required)
+			}
+		}
+		// Iterate in a deterministic order so errors are deterministic.
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			property, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s has unexpected property: %s", path, k)
+				}
+				continue
+			}
+			if property == nil {
+				continue
+			}
+			if err := property.validate(path+"."+k, v[k]); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func jsonSchemaTypeMatches(t string, v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case map[string]any:
+		return t == "object"
+	case []any:
+		return t == "array"
+	case string:
+		return t == "string"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		if t == "integer" {
+			_, err := v.Int64()
+			return err == nil
+		}
+		return false
+	default:
+		return false
+	}
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleManifestValidate(t *testing.T) {
+	testCases := []struct {
+		manifest ModuleManifest
+		valid    bool
+	}{
+		{manifest: ModuleManifest{}, valid: true},
+		{
+			manifest: ModuleManifest{Operations: []OperationManifest{
+				{Name: "a"},
+				{Name: "b", ReadOnly: true, PayloadSchema: json.RawMessage(`{"type": "object"}`)},
+			}},
+			valid: true,
+		},
+		{manifest: ModuleManifest{Operations: []OperationManifest{{Name: ""}}}},
+		{manifest: ModuleManifest{Operations: []OperationManifest{{Name: "a"}, {Name: "a"}}}},
+		{manifest: ModuleManifest{Operations: []OperationManifest{
+			{Name: "a", PayloadSchema: json.RawMessage(`{"type": "unknown"}`)},
+		}}},
+		{manifest: ModuleManifest{Operations: []OperationManifest{
+			{Name: "a", ResponseSchema: json.RawMessage(`not json`)},
+		}}},
+		{manifest: ModuleManifest{Operations: []OperationManifest{
+			{Name: "a", PayloadSchema: json.RawMessage(`{"items": {"type": 1}}`)},
+		}}},
+	}
+
+	for i, tc := range testCases {
+		err := tc.manifest.Validate()
+		if tc.valid {
+			require.NoError(t, err, i)
+		} else {
+			require.Error(t, err, i)
+		}
+	}
+}
+
+func TestOperationManifestValidatePayload(t *testing.T) {
+	op := OperationManifest{
+		Name: "op",
+		PayloadSchema: json.RawMessage(`{
+			"type": "object",
+			"required": ["name", "count"],
+			"additionalProperties": false,
+			"properties": {
+				"name": {"type": "string", "enum": ["a", "b"]},
+				"count": {"type": "integer"},
+				"ratio": {"type": ["number", "null"]},
+				"tags": {"type": "array", "items": {"type": "string"}}
+			}
+		}`),
+	}
+
+	testCases := []struct {
+		payload string
+		valid   bool
+	}{
+		{payload: `{"name": "a", "count": 1}`, valid: true},
+		{payload: `{"name": "b", "count": 2, "ratio": 0.5, "tags": ["x", "y"]}`, valid: true},
+		{payload: `{"name": "b", "count": 2, "ratio": null}`, valid: true},
+		{payload: ``},
+		{payload: `not json`},
+		{payload: `{"name": "a", "count": 1} {}`},
+		{payload: `[]`},
+		{payload: `{"name": "a"}`},
+		{payload: `{"name": "c", "count": 1}`},
+		{payload: `{"name": "a", "count": 1.5}`},
+		{payload: `{"name": "a", "count": 1, "ratio": "1"}`},
+		{payload: `{"name": "a", "count": 1, "tags": ["x", 1]}`},
+		{payload: `{"name": "a", "count": 1, "other": true}`},
+	}
+	for _, tc := range testCases {
+		err := op.ValidatePayload([]byte(tc.payload))
+		if tc.valid {
+			require.NoError(t, err, tc.payload)
+		} else {
+			require.Error(t, err, tc.payload)
+		}
+	}
+
+	// Payloads aren't validated if there's no schema.
+	require.NoError(t, OperationManifest{Name: "op"}.ValidatePayload([]byte("not json")))
+}
@@ -0,0 +1,388 @@
+package registry
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// The module store is a content-addressed store for module bytes that is shared by every
+// namespace. A module's bytes are split into chunks that are stored by the SHA-256 hash
+// of their (uncompressed) contents, and each module is stored as a blob that lists its
+// chunks and is keyed by the SHA-256 hash of the module's bytes. Registering the same
+// module in multiple namespaces (or under multiple module IDs) therefore only stores its
+// bytes once.
+//
+// Blobs and chunks are reference counted so that they can be deleted once nothing uses
+// them anymore. A blob is referenced by every module reference with its hash, and a chunk
+// is referenced by every blob that contains it as well as by every in-progress upload that
+// wrote it. Uploads hand their references over to the blob if they're the first to store
+// it, otherwise they release them, so a chunk can never be deleted while an upload that
+// depends on it is in progress.
+
+const (
+	// moduleChunkSize is the (uncompressed) size of the chunks that modules are split into.
+	// The maximum value size in FoundationDB is 100_000 bytes so this leaves room for
+	// incompressible chunks growing slightly when they're encoded.
+	moduleChunkSize = 1 << 16
+	// maxModuleChunksPerTransaction is the maximum number of module chunks that will be
+	// written or read in a single transaction.
+	maxModuleChunksPerTransaction = 16
+
+	// Every stored chunk is prefixed with a single byte that indicates how it's encoded.
+	moduleChunkEncodingRaw   = byte(0)
+	moduleChunkEncodingFlate = byte(1)
+)
+
+// moduleBlob is stored for every module in the module store.
+type moduleBlob struct {
+	Size int64
+	// Chunks contains the IDs (hex encoded SHA-256 hashes) of the module's chunks in order.
+	// A chunk may appear more than once.
+	Chunks []string
+
+	// hash is the hex encoded SHA-256 hash of the module's bytes. It is not stored since
+	// the blob is keyed by it.
+	hash string
+}
+
+// writeModuleBlob reads a module from r and writes any of its chunks that don't already
+// exist to the module store over multiple transactions, taking a reference to each of
+// them. It returns the module's blob, but does not store it since it's up to the caller to
+// do that atomically with whatever references it (see storeModuleBlob). If the blob isn't
+// stored then the caller must release the chunks with releaseModuleChunks.
+func writeModuleBlob(ctx context.Context, kv kv, r io.Reader) (moduleBlob, error) {
+	var pinned []string
+	blob, err := writeModuleChunks(ctx, kv, r, &pinned)
+	if err != nil {
+		// Release the chunks that were already written so they're deleted if nothing
+		// else references them.
+		if releaseErr := releaseModuleChunks(ctx, kv, pinned); releaseErr != nil {
+			return moduleBlob{}, fmt.Errorf(
+				"%w (error releasing module chunks: %v)", err, releaseErr)
+		}
+		return moduleBlob{}, err
+	}
+	return blob, nil
+}
+
+// writeModuleChunks implements writeModuleBlob, and appends the ID of every chunk that
+// it took a reference to to pinned.
+func writeModuleChunks(
+	ctx context.Context,
+	kv kv,
+	r io.Reader,
+	pinned *[]string,
+) (moduleBlob, error) {
+	var (
+		blob    moduleBlob
+		h       = sha256.New()
+		buf     = make([]byte, moduleChunkSize)
+		written = make(map[string]struct{})
+		batch   = make(map[string][]byte, maxModuleChunksPerTransaction)
+		eof     = false
+	)
+	for !eof {
+		for chunkID := range batch {
+			delete(batch, chunkID)
+		}
+		for len(batch) < maxModuleChunksPerTransaction {
+			n, err := io.ReadFull(r, buf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return moduleBlob{}, fmt.Errorf("error reading module: %w", err)
+			}
+			if n == 0 {
+				break
+			}
+
+			chunk := buf[:n]
+			h.Write(chunk)
+			chunkHash := sha256.Sum256(chunk)
+			chunkID := hex.EncodeToString(chunkHash[:])
+			blob.Size += int64(n)
+			blob.Chunks = append(blob.Chunks, chunkID)
+			if _, ok := written[chunkID]; !ok {
+				written[chunkID] = struct{}{}
+				encoded, err := encodeModuleChunk(chunk)
+				if err != nil {
+					return moduleBlob{}, err
+				}
+				batch[chunkID] = encoded
+			}
+			if eof {
+				break
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		_, err := kv.transact(func(tr transaction) (any, error) {
+			for chunkID, encoded := range batch {
+				refsKey := getModuleChunkRefsKey(chunkID)
+				refs, err := getCounter(ctx, tr, refsKey)
+				if err != nil {
+					return nil, err
+				}
+				if err := addToCounter(ctx, tr, refsKey, 1); err != nil {
+					return nil, err
+				}
+				if refs > 0 {
+					// Already stored by a different module (or a concurrent attempt to
+					// register this one).
+					continue
+				}
+				if err := tr.put(ctx, getModuleChunkKey(chunkID), encoded); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return moduleBlob{}, fmt.Errorf("error writing module chunks: %w", err)
+		}
+		for chunkID := range batch {
+			*pinned = append(*pinned, chunkID)
+		}
+	}
+
+	blob.hash = hex.EncodeToString(h.Sum(nil))
+	return blob, nil
+}
+
+// storeModuleBlob takes a reference to blob within tr, and stores it if it doesn't exist
+// already. It returns whether the blob was stored, in which case the references to its
+// chunks that were taken by writeModuleBlob now belong to the blob.
+func storeModuleBlob(
+	ctx context.Context,
+	tr transaction,
+	blob moduleBlob,
+	marshaledBlob []byte,
+) (bool, error) {
+	refsKey := getModuleBlobRefsKey(blob.hash)
+	refs, err := getCounter(ctx, tr, refsKey)
+	if err != nil {
+		return false, err
+	}
+	if refs == 0 {
+		if err := tr.put(ctx, getModuleBlobKey(blob.hash), marshaledBlob); err != nil {
+			return false, err
+		}
+	}
+	return refs == 0, addToCounter(ctx, tr, refsKey, 1)
+}
+
+// releaseModuleBlob releases a reference to the blob with the provided hash within tr,
+// and deletes the blob if that was the last one. If the blob was deleted then it returns
+// the IDs of its chunks, which the caller must release with releaseModuleChunks once tr
+// commits.
+func releaseModuleBlob(ctx context.Context, tr transaction, hash string) ([]string, error) {
+	refsKey := getModuleBlobRefsKey(hash)
+	refs, err := getCounter(ctx, tr, refsKey)
+	if err != nil {
+		return nil, err
+	}
+	if refs > 1 {
+		return nil, addToCounter(ctx, tr, refsKey, -1)
+	}
+
+	blobKey := getModuleBlobKey(hash)
+	v, ok, err := tr.get(ctx, blobKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	var blob moduleBlob
+	if err := json.Unmarshal(v, &blob); err != nil {
+		return nil, fmt.Errorf("error unmarshaling module blob: %w", err)
+	}
+	if err := tr.delete(ctx, refsKey); err != nil {
+		return nil, err
+	}
+	if err := tr.delete(ctx, blobKey); err != nil {
+		return nil, err
+	}
+	return blob.distinctChunks(), nil
+}
+
+// releaseModuleChunks releases a reference to each of the provided chunks over multiple
+// transactions, and deletes the chunks that are no longer referenced.
+func releaseModuleChunks(ctx context.Context, kv kv, chunkIDs []string) error {
+	for start := 0; start < len(chunkIDs); start += maxModuleChunksPerTransaction {
+		end := start + maxModuleChunksPerTransaction
+		if end > len(chunkIDs) {
+			end = len(chunkIDs)
+		}
+		_, err := kv.transact(func(tr transaction) (any, error) {
+			for _, chunkID := range chunkIDs[start:end] {
+				refsKey := getModuleChunkRefsKey(chunkID)
+				refs, err := getCounter(ctx, tr, refsKey)
+				if err != nil {
+					return nil, err
+				}
+				if refs > 1 {
+					if err := addToCounter(ctx, tr, refsKey, -1); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if err := tr.delete(ctx, refsKey); err != nil {
+					return nil, err
+				}
+				if err := tr.delete(ctx, getModuleChunkKey(chunkID)); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return fmt.Errorf("error releasing module chunks: %w", err)
+		}
+	}
+	return nil
+}
+
+// distinctChunks returns the IDs of the blob's chunks without duplicates.
+func (b moduleBlob) distinctChunks() []string {
+	var (
+		seen     = make(map[string]struct{}, len(b.Chunks))
+		chunkIDs = make([]string, 0, len(b.Chunks))
+	)
+	for _, chunkID := range b.Chunks {
+		if _, ok := seen[chunkID]; ok {
+			continue
+		}
+		seen[chunkID] = struct{}{}
+		chunkIDs = append(chunkIDs, chunkID)
+	}
+	return chunkIDs
+}
+
+// readModuleBlob reads the bytes of the module with the provided hash from the module
+// store.
+func readModuleBlob(ctx context.Context, kv kv, hash string) ([]byte, error) {
+	v, err := kv.transact(func(tr transaction) (any, error) {
+		v, ok, err := tr.get(ctx, getModuleBlobKey(hash))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("module blob: %s does not exist", hash)
+		}
+		return v, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var blob moduleBlob
+	if err := json.Unmarshal(v.([]byte), &blob); err != nil {
+		return nil, fmt.Errorf("error unmarshaling module blob: %w", err)
+	}
+
+	// Chunks are immutable so it's safe to read them over multiple transactions.
+	moduleBytes := make([]byte, 0, blob.Size)
+	for start := 0; start < len(blob.Chunks); start += maxModuleChunksPerTransaction {
+		end := start + maxModuleChunksPerTransaction
+		if end > len(blob.Chunks) {
+			end = len(blob.Chunks)
+		}
+		base := len(moduleBytes)
+		_, err := kv.transact(func(tr transaction) (any, error) {
+			// Transactions may be retried.
+			moduleBytes = moduleBytes[:base]
+			for _, chunkID := range blob.Chunks[start:end] {
+				encoded, ok, err := tr.get(ctx, getModuleChunkKey(chunkID))
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					return nil, fmt.Errorf("chunk: %s is missing", chunkID)
+				}
+				moduleBytes, err = decodeModuleChunk(moduleBytes, encoded)
+				if err != nil {
+					return nil, fmt.Errorf("error decoding chunk: %s, err: %w", chunkID, err)
+				}
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading module chunks: %w", err)
+		}
+	}
+
+	checksum := sha256.Sum256(moduleBytes)
+	if hex.EncodeToString(checksum[:]) != hash {
+		return nil, fmt.Errorf("checksum of module blob: %s does not match", hash)
+	}
+	return moduleBytes, nil
+}
+
+// encodeModuleChunk compresses chunk if doing so makes it smaller, otherwise it's stored
+// as is.
+func encodeModuleChunk(chunk []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(moduleChunkEncodingFlate)
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, fmt.Errorf("error creating flate writer: %w", err)
+	}
+	if _, err := w.Write(chunk); err != nil {
+		return nil, fmt.Errorf("error compressing module chunk: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing module chunk: %w", err)
+	}
+	if buf.Len() < len(chunk)+1 {
+		return buf.Bytes(), nil
+	}
+
+	encoded := make([]byte, 0, len(chunk)+1)
+	encoded = append(encoded, moduleChunkEncodingRaw)
+	return append(encoded, chunk...), nil
+}
+
+// decodeModuleChunk appends the decoded contents of encoded to dst.
+func decodeModuleChunk(dst, encoded []byte) ([]byte, error) {
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("empty chunk")
+	}
+	switch encoded[0] {
+	case moduleChunkEncodingRaw:
+		return append(dst, encoded[1:]...), nil
+	case moduleChunkEncodingFlate:
+		buf := bytes.NewBuffer(dst)
+		if _, err := io.Copy(buf, flate.NewReader(bytes.NewReader(encoded[1:]))); err != nil {
+			return nil, fmt.Errorf("error decompressing chunk: %w", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown chunk encoding: %d", encoded[0])
+	}
+}
+
+func getModuleBlobKey(hash string) []byte {
+	return tuple.Tuple{"module_blobs", hash}.Pack()
+}
+
+func getModuleChunkKey(chunkID string) []byte {
+	return tuple.Tuple{"module_chunks", chunkID}.Pack()
+}
+
+func getModuleBlobRefsKey(hash string) []byte {
+	return tuple.Tuple{"module_blob_refs", hash}.Pack()
+}
+
+func getModuleChunkRefsKey(chunkID string) []byte {
+	return tuple.Tuple{"module_chunk_refs", chunkID}.Pack()
+}
@@ -0,0 +1,156 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/richardartoul/nola/durable/durablewazero"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const (
+	// wapcHostModuleName is the name of the host module that the WAPC host functions
+	// are imported from.
+	wapcHostModuleName = "wapc"
+	// wapcGuestCallExport is the function that every WAPC guest must export. The host
+	// invokes all of the guest's operations through it.
+	wapcGuestCallExport = "__guest_call"
+)
+
+// wapcHostFunctions contains the functions that the WAPC host module provides to guests.
+//
+// See: https://wapc.io/docs/spec/#required-host-exports
+var wapcHostFunctions = map[string]struct{}{
+	"__host_call":         {},
+	"__console_log":       {},
+	"__guest_request":     {},
+	"__host_response":     {},
+	"__host_response_len": {},
+	"__guest_response":    {},
+	"__guest_error":       {},
+	"__host_error":        {},
+	"__host_error_len":    {},
+}
+
+// moduleMetadata contains the metadata that is extracted from a module's WASM bytes
+// when it's validated.
+type moduleMetadata struct {
+	// Exports contains the names of the functions exported by the module, sorted.
+	Exports []string
+	// Imports contains the host functions imported by the module in the form
+	// <module>.<function>, sorted.
+	Imports []string
+}
+
+// validateModuleBytes compiles moduleBytes to verify that they're a valid WASM program
+// that implements the WAPC guest ABI and doesn't import any host functions that NOLA
+// doesn't provide, so that broken modules are rejected when they're registered instead
+// of when the first actor that uses them is activated.
+func validateModuleBytes(ctx context.Context, moduleBytes []byte) (moduleMetadata, error) {
+	// Use the same host modules that actors run with so that we accept exactly the set of
+	// (non-WAPC) host functions that will be available when the module is instantiated.
+	// The interpreter is used since the module is only compiled to validate it, and the
+	// interpreter compiles much faster.
+	r, err := durablewazero.NewRuntime(ctx, durablewazero.RuntimeInterpreter)
+	if err != nil {
+		return moduleMetadata{}, fmt.Errorf("error creating WASM runtime: %w", err)
+	}
+	defer r.Close(ctx)
+
+	compiled, err := r.CompileModule(ctx, moduleBytes)
+	if err != nil {
+		return moduleMetadata{}, fmt.Errorf("error compiling WASM module: %w", err)
+	}
+	defer compiled.Close(ctx)
+
+	var metadata moduleMetadata
+	exports := compiled.ExportedFunctions()
+	for name := range exports {
+		metadata.Exports = append(metadata.Exports, name)
+	}
+	sort.Strings(metadata.Exports)
+
+	guestCall, ok := exports[wapcGuestCallExport]
+	if !ok {
+		return moduleMetadata{}, fmt.Errorf(
+			"WASM module does not export WAPC function: %s", wapcGuestCallExport)
+	}
+	var (
+		guestCallParams  = []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}
+		guestCallResults = []api.ValueType{api.ValueTypeI32}
+	)
+	if !hasSignature(guestCall, guestCallParams, guestCallResults) {
+		return moduleMetadata{}, fmt.Errorf(
+			"WASM module exports WAPC function: %s with wrong signature", wapcGuestCallExport)
+	}
+
+	for _, fn := range compiled.ImportedFunctions() {
+		moduleName, name, _ := fn.Import()
+		if !isProvidedHostFunction(r, moduleName, name) {
+			return moduleMetadata{}, fmt.Errorf(
+				"WASM module imports host function: %s.%s which is not provided", moduleName, name)
+		}
+		metadata.Imports = append(metadata.Imports, fmt.Sprintf("%s.%s", moduleName, name))
+	}
+	sort.Strings(metadata.Imports)
+
+	if len(compiled.ImportedMemories()) > 0 {
+		return moduleMetadata{}, fmt.Errorf("WASM module imports memory which is not provided")
+	}
+
+	return metadata, nil
+}
+
+// validateModuleFile is the same as validateModuleBytes, but for a module that was spooled
+// to a file. wazero can only compile modules that are in memory so the file is mapped into
+// memory instead of being read onto the heap, which lets the OS page it in and out as
+// needed.
+func validateModuleFile(ctx context.Context, f *os.File) (moduleMetadata, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return moduleMetadata{}, fmt.Errorf("error getting size of module file: %w", err)
+	}
+	if stat.Size() == 0 {
+		return validateModuleBytes(ctx, nil)
+	}
+	if int64(int(stat.Size())) != stat.Size() {
+		return moduleMetadata{}, fmt.Errorf("module file is too large: %d bytes", stat.Size())
+	}
+
+	moduleBytes, err := syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return moduleMetadata{}, fmt.Errorf("error mapping module file: %w", err)
+	}
+	defer syscall.Munmap(moduleBytes)
+	return validateModuleBytes(ctx, moduleBytes)
+}
+
+func isProvidedHostFunction(r wazero.Runtime, moduleName, name string) bool {
+	if moduleName == wapcHostModuleName {
+		_, ok := wapcHostFunctions[name]
+		return ok
+	}
+	m := r.Module(moduleName)
+	return m != nil && m.ExportedFunction(name) != nil
+}
+
+func hasSignature(fn api.FunctionDefinition, params, results []api.ValueType) bool {
+	return equalValueTypes(fn.ParamTypes(), params) && equalValueTypes(fn.ResultTypes(), results)
+}
+
+func equalValueTypes(a, b []api.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
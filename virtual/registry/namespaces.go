@@ -0,0 +1,598 @@
+package registry
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+)
+
+// numNamespaceKVBytesShards is the number of counters the total size of a namespace's
+// actors' KV storage is split across. Every KV write atomically adds to one of them so
+// they never conflict, and the shards keep every write in the namespace from hitting
+// the same key.
+const numNamespaceKVBytesShards = 16
+
+// maxDeleteKeysPerTransaction is the maximum number of keys DeleteNamespace will delete
+// in a single transaction.
+const maxDeleteKeysPerTransaction = 1000
+
+// reservedNamespaces are the top-level key prefixes that hold cluster-wide data. A
+// namespace's data is stored under a prefix of the namespace's name so namespaces with
+// these names would collide with (and DeleteNamespace would wipe) the cluster-wide data.
+var reservedNamespaces = map[string]struct{}{
+	"servers":                {},
+	"module_blobs":           {},
+	"module_chunks":          {},
+	"namespaces":             {},
+	"pending_inboxes":        {},
+	"server_pending_inboxes": {},
+}
+
+var (
+	errNamespaceDoesNotExist = errors.New("namespace does not exist")
+	// errQuotaExceeded is returned when a request would exceed one of a namespace's
+	// quotas.
+	errQuotaExceeded = errors.New("namespace quota exceeded")
+)
+
+// IsNamespaceDoesNotExistErr returns a boolean indicating whether the error is an
+// instance of (or wraps) errNamespaceDoesNotExist.
+func IsNamespaceDoesNotExistErr(err error) bool {
+	return errors.Is(err, errNamespaceDoesNotExist)
+}
+
+// IsQuotaExceededErr returns a boolean indicating whether the error is an instance of
+// (or wraps) errQuotaExceeded.
+func IsQuotaExceededErr(err error) bool {
+	return errors.Is(err, errQuotaExceeded)
+}
+
+// NewQuotaExceededErr returns an error that wraps errQuotaExceeded. It is exported so
+// that quotas which are enforced outside of the registry (see NamespaceQuotas) return
+// errors that IsQuotaExceededErr recognizes.
+func NewQuotaExceededErr(namespace, format string, args ...any) error {
+	return fmt.Errorf(
+		"%w: namespace: %s: %s", errQuotaExceeded, namespace, fmt.Sprintf(format, args...))
+}
+
+func (k *kvRegistry) CreateNamespace(
+	ctx context.Context,
+	namespace string,
+	opts NamespaceOptions,
+) error {
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		_, ok, err := tr.get(ctx, getNamespaceKey(namespace))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return nil, fmt.Errorf("namespace: %s already exists", namespace)
+		}
+		if err := markNewNamespaceIndexed(ctx, tr, namespace); err != nil {
+			return nil, err
+		}
+		return nil, putNamespace(ctx, tr, namespace, opts)
+	})
+	if err != nil {
+		return fmt.Errorf("CreateNamespace: error: %w", err)
+	}
+	return nil
+}
+
+func (k *kvRegistry) UpdateNamespace(
+	ctx context.Context,
+	namespace string,
+	opts NamespaceOptions,
+) error {
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		_, ok, err := tr.get(ctx, getNamespaceKey(namespace))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("error updating namespace: %s, err: %w", namespace, errNamespaceDoesNotExist)
+		}
+		return nil, putNamespace(ctx, tr, namespace, opts)
+	})
+	if err != nil {
+		return fmt.Errorf("UpdateNamespace: error: %w", err)
+	}
+	return nil
+}
+
+func (k *kvRegistry) GetNamespace(
+	ctx context.Context,
+	namespace string,
+) (NamespaceInfo, error) {
+	opts, err := k.kv.transact(func(tr transaction) (any, error) {
+		v, ok, err := tr.get(ctx, getNamespaceKey(namespace))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("error getting namespace: %s, err: %w", namespace, errNamespaceDoesNotExist)
+		}
+		var opts NamespaceOptions
+		if err := json.Unmarshal(v, &opts); err != nil {
+			return nil, fmt.Errorf("error unmarshaling namespace: %w", err)
+		}
+		return opts, nil
+	})
+	if err != nil {
+		return NamespaceInfo{}, fmt.Errorf("GetNamespace: error: %w", err)
+	}
+	return NamespaceInfo{Namespace: namespace, Opts: opts.(NamespaceOptions)}, nil
+}
+
+func (k *kvRegistry) ListNamespaces(ctx context.Context) ([]NamespaceInfo, error) {
+	namespaces, err := k.kv.transact(func(tr transaction) (any, error) {
+		var (
+			prefix     = getNamespacesPrefix()
+			namespaces = []NamespaceInfo{}
+		)
+		err := tr.iterPrefix(ctx, prefix, func(key, v []byte) error {
+			suffix, err := tuple.Unpack(key[len(prefix):])
+			if err != nil {
+				return fmt.Errorf("error unpacking namespace key: %w", err)
+			}
+			if len(suffix) != 1 {
+				return fmt.Errorf("unexpected namespace key: %v", suffix)
+			}
+			namespace, ok := suffix[0].(string)
+			if !ok {
+				return fmt.Errorf("unexpected namespace key: %v", suffix)
+			}
+			var opts NamespaceOptions
+			if err := json.Unmarshal(v, &opts); err != nil {
+				return fmt.Errorf("error unmarshaling namespace: %w", err)
+			}
+			namespaces = append(namespaces, NamespaceInfo{Namespace: namespace, Opts: opts})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return namespaces, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListNamespaces: error: %w", err)
+	}
+	return namespaces.([]NamespaceInfo), nil
+}
+
+func (k *kvRegistry) DeleteNamespace(
+	ctx context.Context,
+	namespace string,
+) error {
+	if isReservedNamespace(namespace) {
+		return fmt.Errorf("DeleteNamespace: error deleting namespace: %s, namespace is reserved", namespace)
+	}
+
+	// Delete the namespace's data before the namespace itself so that a failed delete
+	// can be retried.
+	if err := k.deletePendingInboxes(ctx, namespace); err != nil {
+		return fmt.Errorf("DeleteNamespace: error deleting namespace: %s, err: %w", namespace, err)
+	}
+	if err := k.deleteModuleRefs(ctx, namespace); err != nil {
+		return fmt.Errorf("DeleteNamespace: error deleting namespace: %s, err: %w", namespace, err)
+	}
+	if err := k.deletePrefix(ctx, tuple.Tuple{namespace}.Pack()); err != nil {
+		return fmt.Errorf("DeleteNamespace: error deleting namespace: %s, err: %w", namespace, err)
+	}
+
+	_, err := k.kv.transact(func(tr transaction) (any, error) {
+		return nil, tr.delete(ctx, getNamespaceKey(namespace))
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteNamespace: error deleting namespace: %s, err: %w", namespace, err)
+	}
+	return nil
+}
+
+// deletePrefix deletes every key with the provided prefix in batches so that deleting a
+// lot of keys doesn't exceed transaction limits.
+func (k *kvRegistry) deletePrefix(ctx context.Context, prefix []byte) error {
+	for {
+		numDeleted, err := k.kv.transact(func(tr transaction) (any, error) {
+			var keys [][]byte
+			err := tr.iterPrefix(ctx, prefix, func(k, v []byte) error {
+				if len(keys) >= maxDeleteKeysPerTransaction {
+					return errStopIteration
+				}
+				keys = append(keys, append([]byte(nil), k...))
+				return nil
+			})
+			if err != nil && err != errStopIteration {
+				return nil, err
+			}
+			for _, key := range keys {
+				if err := tr.delete(ctx, key); err != nil {
+					return nil, err
+				}
+			}
+			return len(keys), nil
+		})
+		if err != nil {
+			return err
+		}
+		if numDeleted.(int) == 0 {
+			return nil
+		}
+	}
+}
+
+// deleteModuleRefs deletes the references of all the namespace's modules one at a time
+// so that the module store can delete the blobs that are no longer used.
+func (k *kvRegistry) deleteModuleRefs(ctx context.Context, namespace string) error {
+	moduleIDs, err := k.ListModules(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	for _, moduleID := range moduleIDs {
+		var chunkIDs []string
+		_, err := k.kv.transact(func(tr transaction) (any, error) {
+			var err error
+			chunkIDs, err = deleteModuleRef(ctx, tr, namespace, moduleID)
+			return nil, err
+		})
+		if err != nil {
+			return err
+		}
+		if err := releaseModuleChunks(ctx, k.kv, chunkIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePendingInboxes deletes the namespace's entries in both pending inbox indexes in
+// batches. The by-server index isn't prefixed by namespace so it can't use deletePrefix.
+func (k *kvRegistry) deletePendingInboxes(ctx context.Context, namespace string) error {
+	for {
+		numDeleted, err := k.kv.transact(func(tr transaction) (any, error) {
+			var pending []pendingInbox
+			err := tr.iterPrefix(ctx, getPendingInboxesPrefix(namespace), func(k, v []byte) error {
+				if len(pending) >= maxDeleteKeysPerTransaction/2 {
+					return errStopIteration
+				}
+				var p pendingInbox
+				if err := json.Unmarshal(v, &p); err != nil {
+					return fmt.Errorf("error unmarshaling pending inbox: %w", err)
+				}
+				pending = append(pending, p)
+				return nil
+			})
+			if err != nil && err != errStopIteration {
+				return nil, err
+			}
+			for _, p := range pending {
+				if err := tr.delete(ctx, getServerPendingInboxKey(p.ServerID, namespace, p.ID)); err != nil {
+					return nil, err
+				}
+				if err := tr.delete(ctx, getPendingInboxKey(namespace, p.ID)); err != nil {
+					return nil, err
+				}
+			}
+			return len(pending), nil
+		})
+		if err != nil {
+			return err
+		}
+		if numDeleted.(int) == 0 {
+			return nil
+		}
+	}
+}
+
+func (k *kvRegistry) GetNamespaceUsage(
+	ctx context.Context,
+	namespace string,
+) (NamespaceUsage, error) {
+	// The modules of the namespace are scanned, but its KV bytes are read from sharded
+	// counters so that the cost doesn't grow with the number of actors.
+	usage, err := k.kv.transact(func(tr transaction) (any, error) {
+		var usage NamespaceUsage
+
+		numActors, err := getCounter(ctx, tr, getNamespaceActorCountKey(namespace))
+		if err != nil {
+			return nil, err
+		}
+		usage.NumActors = numActors
+
+		if err := getNamespaceModuleUsage(ctx, tr, namespace, &usage); err != nil {
+			return nil, err
+		}
+
+		usage.KVBytes, err = getNamespaceKVBytes(ctx, tr, namespace)
+		if err != nil {
+			return nil, err
+		}
+		return usage, nil
+	})
+	if err != nil {
+		return NamespaceUsage{}, fmt.Errorf("GetNamespaceUsage: error: %w", err)
+	}
+	return usage.(NamespaceUsage), nil
+}
+
+// getNamespaceModuleUsage adds the number and total size of the namespace's modules to
+// usage.
+func getNamespaceModuleUsage(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	usage *NamespaceUsage,
+) error {
+	modulesPrefix := getModulesPrefix(namespace)
+	return tr.iterPrefix(ctx, modulesPrefix, func(key, v []byte) error {
+		suffix, err := tuple.Unpack(key[len(modulesPrefix):])
+		if err != nil {
+			return fmt.Errorf("error unpacking module key: %w", err)
+		}
+		if len(suffix) != 2 {
+			return nil
+		}
+		switch suffix[1] {
+		case "ref":
+			var ref moduleRef
+			if err := json.Unmarshal(v, &ref); err != nil {
+				return fmt.Errorf("error unmarshaling module: %w", err)
+			}
+			usage.NumModules++
+			usage.ModuleBytes += ref.Size
+		case int64(0):
+			// Modules stored by older versions are split into parts, count each
+			// module once. Their size is approximated by the size of their parts.
+			usage.NumModules++
+			usage.ModuleBytes += int64(len(v))
+		default:
+			if _, ok := suffix[1].(int64); ok {
+				usage.ModuleBytes += int64(len(v))
+			}
+		}
+		return nil
+	})
+}
+
+// getNamespaceKVBytes returns the total size of the KV storage of the namespace's actors.
+func getNamespaceKVBytes(ctx context.Context, tr transaction, namespace string) (int64, error) {
+	var kvBytes int64
+	err := tr.iterPrefix(ctx, getNamespaceKVBytesShardsPrefix(namespace), func(key, v []byte) error {
+		n, err := decodeAtomicCounter(v)
+		if err != nil {
+			return err
+		}
+		kvBytes += n
+		return nil
+	})
+	return kvBytes, err
+}
+
+// checkNamespaceQuotas returns an error if adding the provided number of actors, modules,
+// module bytes and KV bytes to the namespace would exceed its quotas. It is called in the same
+// transaction that adds them so that concurrent requests can't exceed the quotas
+// together: they all read the usage they check, so all but one of them conflict.
+func checkNamespaceQuotas(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	actors int64,
+	modules int64,
+	moduleBytes int64,
+	kvBytes int64,
+) error {
+	opts, ok, err := getNamespaceOptions(ctx, tr, namespace)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Namespaces that don't exist yet have the default options, I.E no quotas.
+		return nil
+	}
+	quotas := opts.Quotas
+
+	if actors > 0 && quotas.MaxActors > 0 {
+		numActors, err := getCounter(ctx, tr, getNamespaceActorCountKey(namespace))
+		if err != nil {
+			return err
+		}
+		if numActors+actors > quotas.MaxActors {
+			return NewQuotaExceededErr(namespace, "max actors: %d", quotas.MaxActors)
+		}
+	}
+	if modules > 0 && (quotas.MaxModules > 0 || quotas.MaxModuleBytes > 0) {
+		var usage NamespaceUsage
+		if err := getNamespaceModuleUsage(ctx, tr, namespace, &usage); err != nil {
+			return err
+		}
+		if quotas.MaxModules > 0 && usage.NumModules+modules > quotas.MaxModules {
+			return NewQuotaExceededErr(namespace, "max modules: %d", quotas.MaxModules)
+		}
+		if quotas.MaxModuleBytes > 0 && usage.ModuleBytes+moduleBytes > quotas.MaxModuleBytes {
+			return NewQuotaExceededErr(namespace, "max module bytes: %d", quotas.MaxModuleBytes)
+		}
+	}
+	if kvBytes > 0 && quotas.MaxKVBytes > 0 {
+		usage, err := getNamespaceKVBytes(ctx, tr, namespace)
+		if err != nil {
+			return err
+		}
+		if usage+kvBytes > quotas.MaxKVBytes {
+			return NewQuotaExceededErr(namespace, "max KV bytes: %d", quotas.MaxKVBytes)
+		}
+	}
+	return nil
+}
+
+func putNamespace(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	opts NamespaceOptions,
+) error {
+	marshaled, err := json.Marshal(&opts)
+	if err != nil {
+		return fmt.Errorf("error marshaling namespace: %w", err)
+	}
+	return tr.put(ctx, getNamespaceKey(namespace), marshaled)
+}
+
+// ensureNamespace creates the namespace with the default options if it doesn't exist.
+func ensureNamespace(ctx context.Context, tr transaction, namespace string) error {
+	_, ok, err := tr.get(ctx, getNamespaceKey(namespace))
+	if err != nil || ok {
+		return err
+	}
+	if err := markNewNamespaceIndexed(ctx, tr, namespace); err != nil {
+		return err
+	}
+	return putNamespace(ctx, tr, namespace, NamespaceOptions{})
+}
+
+// isKVChangeLogEnabled returns whether the KV change log is enabled for the namespace, see
+// NamespaceOptions.KVChangeLog.
+func isKVChangeLogEnabled(ctx context.Context, tr transaction, namespace string) (bool, error) {
+	opts, _, err := getNamespaceOptions(ctx, tr, namespace)
+	if err != nil {
+		return false, err
+	}
+	return opts.KVChangeLog, nil
+}
+
+// getNamespaceOptions returns the options of the namespace, and whether it exists.
+func getNamespaceOptions(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+) (NamespaceOptions, bool, error) {
+	v, ok, err := tr.get(ctx, getNamespaceKey(namespace))
+	if err != nil {
+		return NamespaceOptions{}, false, fmt.Errorf("error getting namespace: %w", err)
+	}
+	if !ok {
+		return NamespaceOptions{}, false, nil
+	}
+	var opts NamespaceOptions
+	if err := json.Unmarshal(v, &opts); err != nil {
+		return NamespaceOptions{}, false, fmt.Errorf("error unmarshaling namespace: %w", err)
+	}
+	return opts, true, nil
+}
+
+// addToCounter adds delta to the counter stored at key.
+func addToCounter(ctx context.Context, tr transaction, key []byte, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	n, err := getCounter(ctx, tr, key)
+	if err != nil {
+		return err
+	}
+	return tr.put(ctx, key, binary.BigEndian.AppendUint64(nil, uint64(n+delta)))
+}
+
+func getCounter(ctx context.Context, tr transaction, key []byte) (int64, error) {
+	v, ok, err := tr.get(ctx, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return decodeCounter(v)
+}
+
+func decodeCounter(v []byte) (int64, error) {
+	if len(v) != 8 {
+		return 0, fmt.Errorf("counter has invalid length: %d", len(v))
+	}
+	return int64(binary.BigEndian.Uint64(v)), nil
+}
+
+// addToAtomicCounter adds delta to the atomic counter stored at key. Unlike addToCounter
+// it doesn't read the counter so concurrent transactions that add to the same counter
+// don't conflict with each other.
+func addToAtomicCounter(ctx context.Context, tr transaction, key []byte, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+	return tr.add(ctx, key, delta)
+}
+
+func getAtomicCounter(ctx context.Context, tr transaction, key []byte) (int64, error) {
+	v, ok, err := tr.get(ctx, key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return decodeAtomicCounter(v)
+}
+
+func decodeAtomicCounter(v []byte) (int64, error) {
+	if len(v) != 8 {
+		return 0, fmt.Errorf("atomic counter has invalid length: %d", len(v))
+	}
+	return int64(binary.LittleEndian.Uint64(v)), nil
+}
+
+func isReservedNamespace(namespace string) bool {
+	_, ok := reservedNamespaces[namespace]
+	return ok
+}
+
+func getNamespaceKey(namespace string) []byte {
+	return tuple.Tuple{"namespaces", namespace}.Pack()
+}
+
+func getNamespacesPrefix() []byte {
+	return tuple.Tuple{"namespaces"}.Pack()
+}
+
+func getModulesPrefix(namespace string) []byte {
+	return tuple.Tuple{namespace, "modules"}.Pack()
+}
+
+func getNamespaceActorCountKey(namespace string) []byte {
+	return tuple.Tuple{namespace, "usage", "num_actors"}.Pack()
+}
+
+// getModuleActorCountKey returns the key of the counter that tracks the number of actors
+// that were created from the module.
+func getModuleActorCountKey(namespace, moduleID string) []byte {
+	return tuple.Tuple{namespace, "usage", "module_actors", moduleID}.Pack()
+}
+
+// getActorKVBytesKey returns the key of the counter that tracks the total size of the
+// keys and values in the actor's KV storage.
+func getActorKVBytesKey(namespace, actorID string) []byte {
+	return tuple.Tuple{namespace, "usage", "kv_bytes", actorID}.Pack()
+}
+
+// addToActorKVBytes adds delta to the counter of the actor's KV storage size, and to the
+// namespace's KV bytes shard the actor belongs to.
+func addToActorKVBytes(
+	ctx context.Context,
+	tr transaction,
+	namespace string,
+	actorID string,
+	delta int64,
+) error {
+	if err := addToAtomicCounter(ctx, tr, getActorKVBytesKey(namespace, actorID), delta); err != nil {
+		return err
+	}
+	return addToAtomicCounter(ctx, tr, getNamespaceKVBytesShardKey(namespace, actorID), delta)
+}
+
+// getNamespaceKVBytesShardKey returns the key of the namespace's KV bytes shard that the
+// actor's writes are counted in.
+func getNamespaceKVBytesShardKey(namespace, actorID string) []byte {
+	h := fnv.New32a()
+	h.Write([]byte(actorID))
+	shard := int64(h.Sum32() % numNamespaceKVBytesShards)
+	return tuple.Tuple{namespace, "usage", "kv_bytes_shards", shard}.Pack()
+}
+
+func getNamespaceKVBytesShardsPrefix(namespace string) []byte {
+	return tuple.Tuple{namespace, "usage", "kv_bytes_shards"}.Pack()
+}
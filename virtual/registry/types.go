@@ -2,6 +2,10 @@ package registry
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
 
 	"github.com/richardartoul/nola/virtual/types"
 )
@@ -10,6 +14,10 @@ import (
 type Registry interface {
 	ActorStorage
 	ServiceDiscovery
+	Topics
+	Backup
+	Namespaces
+	Admin
 
 	// RegisterModule registers the provided module []byte and options with the
 	// provided module ID for subsequent calls to CreateActor().
@@ -21,6 +29,16 @@ type Registry interface {
 		opts ModuleOptions,
 	) (RegisterModuleResult, error)
 
+	// RegisterModuleStream is the same as RegisterModule except the module's bytes are
+	// read from r, which allows much larger modules to be registered.
+	RegisterModuleStream(
+		ctx context.Context,
+		namespace,
+		moduleID string,
+		r io.Reader,
+		opts ModuleOptions,
+	) (RegisterModuleResult, error)
+
 	// GetModule gets the bytes and options associated with the provided module.
 	GetModule(
 		ctx context.Context,
@@ -28,6 +46,14 @@ type Registry interface {
 		moduleID string,
 	) ([]byte, ModuleOptions, error)
 
+	// GetModuleInfo gets the metadata associated with the provided module without
+	// reading its bytes.
+	GetModuleInfo(
+		ctx context.Context,
+		namespace,
+		moduleID string,
+	) (ModuleInfo, error)
+
 	// CreateActor creates a new actor in the given namespace from the provided module
 	// ID.
 	CreateActor(
@@ -62,10 +88,24 @@ type Registry interface {
 		actorID string,
 	) ([]types.ActorReference, error)
 
+	// DescribeActor returns the actor's registry record, its current activation (if it's
+	// activated on a live server) and the size of its KV storage. Unlike EnsureActivation,
+	// it never activates the actor. It returns an error that wraps errActorDoesNotExist
+	// (see IsActorDoesNotExistErr) if the actor does not exist.
+	DescribeActor(
+		ctx context.Context,
+		namespace,
+		actorID string,
+	) (ActorInfo, error)
+
 	// GetVersionStamp() returns a monotonically increasing integer that should increase
 	// at a rate of ~ 1 million/s.
 	GetVersionStamp(ctx context.Context) (int64, error)
 
+	// MaxTransactionDuration returns the maximum amount of time a transaction can stay
+	// open for, or 0 if the registry doesn't limit it.
+	MaxTransactionDuration() time.Duration
+
 	// Close closes the registry and releases any resources associated (DB connections, etc).
 	Close(ctx context.Context) error
 
@@ -86,6 +126,42 @@ type ActorStorage interface {
 		serverID string,
 		serverVersion int64,
 	) (ActorKVTransaction, error)
+
+	// WatchActorKV returns the changes that were committed to the KV storage of the
+	// provided actor for keys with the provided prefix. Only changes that were committed
+	// after afterVersion are returned (all retained changes are returned if afterVersion
+	// is nil). If there are no such changes then WatchActorKV blocks until there are,
+	// or ctx is canceled. Callers can watch continuously by passing the Version of the
+	// last change they received as afterVersion to the next call. Changes are retained
+	// for a limited time, an error for which IsActorKVChangesTruncatedErr returns true is
+	// returned if changes after afterVersion have already been deleted. The change log
+	// has to be enabled for the namespace, see NamespaceOptions.KVChangeLog.
+	WatchActorKV(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		prefix []byte,
+		afterVersion []byte,
+	) ([]ActorKVChange, error)
+
+	// ListActorsWithPendingMessages returns up to limit actors (across all namespaces)
+	// that have at least one message in their inbox that is ready to be delivered, and
+	// that are either activated on the server with the provided ID or not activated on
+	// any live server. The latter can be delivered by any server, and whichever server
+	// does so first will activate them.
+	ListActorsWithPendingMessages(
+		ctx context.Context,
+		serverID string,
+		limit int,
+	) ([]types.NamespacedIDNoType, error)
+
+	// ListDeadLetters returns the messages that were moved to the dead letter queue of
+	// the actor with the provided ID after repeatedly failing to be delivered.
+	ListDeadLetters(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+	) ([]InboxMessage, error)
 }
 
 // ActorKVTransaction is the interface exposed by the Registry to Actors so they can perform
@@ -95,12 +171,114 @@ type ActorKVTransaction interface {
 	Put(ctx context.Context, key []byte, value []byte) error
 	// Get is the inverse of Put.
 	Get(ctx context.Context, key []byte) ([]byte, bool, error)
+	// EnqueueMessage appends msg to the inbox of the actor with the provided ID (in the
+	// same namespace) atomically with the rest of the transaction. If a message with the
+	// same ID was enqueued in that actor's inbox within the dedup retention period (a day)
+	// then EnqueueMessage is a no-op so that senders can safely retry.
+	EnqueueMessage(ctx context.Context, actorID string, msg InboxMessage) error
+	// PeekInbox returns the oldest undelivered message in the transaction's actor's inbox.
+	PeekInbox(ctx context.Context) (InboxMessage, bool, error)
+	// AckInboxMessage removes the message with the provided sequence number from the
+	// transaction's actor's inbox. Acknowledging the message in the same transaction that
+	// processed it guarantees it is processed exactly once.
+	AckInboxMessage(ctx context.Context, seq int64) error
+	// RetryInboxMessage records a failed attempt to deliver the message with the provided
+	// sequence number. The message stays at the head of the inbox and will not be
+	// delivered again until retryAt.
+	RetryInboxMessage(ctx context.Context, seq int64, reason string, retryAt time.Time) error
+	// DeadLetterInboxMessage records a failed attempt to deliver the message with the
+	// provided sequence number and moves it from the inbox to the actor's dead letter
+	// queue so the messages behind it can be delivered.
+	DeadLetterInboxMessage(ctx context.Context, seq int64, reason string) error
+	// GetInvocationResult returns the result that was stored for the provided
+	// idempotency key by a previous invocation of the transaction's actor, if any, and
+	// hasn't expired yet.
+	GetInvocationResult(ctx context.Context, idempotencyKey string) (InvocationResult, bool, error)
+	// PutInvocationResult stores the result of an invocation of the transaction's actor
+	// under the provided idempotency key. Since the result is stored in the same
+	// transaction as the invocation's other writes, the result will exist if and only if
+	// the invocation's writes were committed. Results expire after a retention period.
+	PutInvocationResult(ctx context.Context, idempotencyKey string, result InvocationResult) error
+	// JoinActors makes the provided actors (which must exist in the same namespace)
+	// participants of the transaction and returns a MultiActorKV that reads and writes the
+	// KV storage of the transaction's actor and every participant within this
+	// transaction, so their writes are committed (or rolled back) atomically with the rest
+	// of the transaction. Every participant's fencing token is validated within the
+	// transaction, the same as BeginTransaction does for the transaction's actor, so the
+	// transaction can only succeed if every participant is still activated on the server
+	// specified by its fencing token. Joining an actor more than once is a no-op.
+	JoinActors(ctx context.Context, participants []TransactionParticipant) (MultiActorKV, error)
 	// Commit commits the transaction, persisting all Put/Get operations.
 	Commit(ctx context.Context) error
 	// Cancel cancels the transaction, rolling back all Put/Get operations.
 	Cancel(ctx context.Context) error
 }
 
+// ActorKVChange is a change that was committed to an actor's KV storage.
+type ActorKVChange struct {
+	// Key is the key that was modified.
+	Key []byte `json:"key"`
+	// Value is the value the key was set to.
+	Value []byte `json:"value"`
+	// Version is an opaque version that totally orders the changes to an actor's KV
+	// storage.
+	Version []byte `json:"version"`
+}
+
+// InvocationResult is the stored result of an invocation that was performed with an
+// idempotency key.
+type InvocationResult struct {
+	// Operation is the operation that was invoked. It is stored so that reusing an
+	// idempotency key for a different operation can be detected.
+	Operation string
+	// Result is the result that the invocation returned.
+	Result []byte
+	// ExpiresAt is when the result expires. It's set by PutInvocationResult.
+	ExpiresAt time.Time
+}
+
+// TransactionParticipant is a participant in a multi-actor transaction, see
+// ActorKVTransaction.JoinActors.
+type TransactionParticipant struct {
+	// ActorID is the ID of the participating actor.
+	ActorID string
+	// ServerID and ServerVersion are the participant's fencing token, I.E the server
+	// that the caller believes the participant is currently activated on.
+	ServerID      string
+	ServerVersion int64
+}
+
+// MultiActorKV reads and writes the KV storage of the participants of a transaction, see
+// ActorKVTransaction.JoinActors.
+type MultiActorKV interface {
+	// Put stores the value at the provided key in the KV storage of the provided actor,
+	// which must be one of the transaction's participants.
+	Put(ctx context.Context, actorID string, key []byte, value []byte) error
+	// Get is the inverse of Put.
+	Get(ctx context.Context, actorID string, key []byte) ([]byte, bool, error)
+}
+
+// InboxMessage is a message in an actor's durable inbox.
+type InboxMessage struct {
+	// ID is a sender-provided ID that is used to deduplicate messages.
+	ID string
+	// Operation is the operation that will be invoked on the receiving actor to deliver
+	// the message.
+	Operation string
+	// Payload is the payload that the operation will be invoked with.
+	Payload []byte
+	// Seq is assigned by the registry when the message is enqueued and determines the
+	// order in which messages are delivered.
+	Seq int64
+	// Attempts is the number of failed attempts to deliver the message so far.
+	Attempts int
+	// LastError is the error returned by the most recent failed delivery attempt.
+	LastError string
+	// RetryAt is the time before which the message will not be delivered again after a
+	// failed delivery attempt.
+	RetryAt time.Time
+}
+
 // ServiceDiscovery contains the methods for interacting with the Registry's service
 // discovery mechanism.
 type ServiceDiscovery interface {
@@ -112,6 +290,51 @@ type ServiceDiscovery interface {
 		serverID string,
 		state HeartbeatState,
 	) (HeartbeatResult, error)
+
+	// ListServers returns every live server, I.E every server that has heartbeated within
+	// the HeartbeatTTL, ordered by server ID.
+	ListServers(ctx context.Context) ([]ServerInfo, error)
+}
+
+// Topics contains the methods for managing actor subscriptions to pub/sub topics.
+type Topics interface {
+	// Subscribe subscribes the provided actor to the topic such that every message
+	// published to the topic will be delivered to the actor by invoking operation with
+	// the published payload. Subscribing an actor that is already subscribed to the
+	// topic replaces its existing subscription.
+	Subscribe(
+		ctx context.Context,
+		namespace,
+		topic,
+		actorID,
+		operation string,
+	) error
+
+	// Unsubscribe is the inverse of Subscribe. Unsubscribing an actor that is not
+	// subscribed to the topic is a no-op.
+	Unsubscribe(
+		ctx context.Context,
+		namespace,
+		topic,
+		actorID string,
+	) error
+
+	// GetSubscriptions returns all the subscriptions for the provided topic ordered by
+	// actor ID.
+	GetSubscriptions(
+		ctx context.Context,
+		namespace,
+		topic string,
+	) ([]TopicSubscription, error)
+}
+
+// TopicSubscription represents a single actor's subscription to a topic.
+type TopicSubscription struct {
+	// ActorID is the ID of the subscribed actor.
+	ActorID string
+	// Operation is the operation that will be invoked on the actor for every message
+	// published to the topic.
+	Operation string
 }
 
 // CreateActorResult is the result of a call to CreateActor().
@@ -123,10 +346,59 @@ type ModuleOptions struct {
 	// useful in the scenario where NOLA is being used as a library and the Actor's are
 	// implemented in Go instead of WASM.
 	AllowEmptyModuleBytes bool
+	// Manifest optionally declares the operations that the module implements.
+	Manifest *ModuleManifest
+	// WASMRuntime is the runtime that the module's WASM bytes should be executed with.
+	// See the durablewazero package for the valid options. The environment's default
+	// runtime is used if it's empty.
+	WASMRuntime string
+	// HostPolicy optionally restricts the host functions that the module's actors are
+	// allowed to call.
+	HostPolicy *HostPolicy
 }
 
 // RegisterModuleResult is the result of a call to RegisterModule().
-type RegisterModuleResult struct{}
+type RegisterModuleResult struct {
+	// Hash is the hex encoded SHA-256 hash of the module's bytes. It is empty if the
+	// module already existed and AllowEmptyModuleBytes was set.
+	Hash string `json:"hash,omitempty"`
+	// Exports contains the names of the functions exported by the module's WASM bytes.
+	Exports []string `json:"exports,omitempty"`
+	// Imports contains the host functions imported by the module's WASM bytes in the
+	// form <module>.<function>.
+	Imports []string `json:"imports,omitempty"`
+}
+
+// ActorInfo describes an actor that is registered with the registry.
+type ActorInfo struct {
+	Namespace  string             `json:"namespace"`
+	ActorID    string             `json:"actor_id"`
+	ModuleID   string             `json:"module_id"`
+	Generation uint64             `json:"generation"`
+	Opts       types.ActorOptions `json:"opts"`
+	// Activation is the actor's current activation, or nil if it isn't activated on a
+	// live server.
+	Activation *ActorActivation `json:"activation,omitempty"`
+	// KVBytes is the total size of the keys and values in the actor's KV storage. Like
+	// NamespaceUsage, it only includes data written after namespaces were introduced.
+	KVBytes int64 `json:"kv_bytes"`
+}
+
+// ActorActivation describes the server that an actor is activated on.
+type ActorActivation struct {
+	ServerID      string `json:"server_id"`
+	ServerVersion int64  `json:"server_version"`
+	ServerAddress string `json:"server_address"`
+}
+
+// ModuleInfo contains the metadata associated with a module.
+type ModuleInfo struct {
+	// Hash is the hex encoded SHA-256 hash of the module's bytes. Modules with the same
+	// hash are identical, even if they're in different namespaces.
+	Hash string
+	Size int64
+	Opts ModuleOptions
+}
 
 // HeartbeatState contains information that accompanies a server's heartbeat. It contains
 // various information about the current state of the server that might be useful to the
@@ -144,6 +416,18 @@ type HeartbeatState struct {
 	Address string
 }
 
+// ServerInfo describes a server that is registered with the registry.
+type ServerInfo struct {
+	ServerID       string         `json:"server_id"`
+	ServerVersion  int64          `json:"server_version"`
+	HeartbeatState HeartbeatState `json:"heartbeat_state"`
+	// LastHeartbeatedAt is the versionstamp of the server's last heartbeat.
+	LastHeartbeatedAt int64 `json:"last_heartbeated_at"`
+	// TimeSinceLastHeartbeat is how long ago the server last heartbeated, as measured by
+	// the registry's versionstamp.
+	TimeSinceLastHeartbeat time.Duration `json:"time_since_last_heartbeat"`
+}
+
 // HeartbeatResult is the result returned by the Heartbeat() method.
 type HeartbeatResult struct {
 	// VersionStamp associated with the successful heartbeat.
@@ -155,3 +439,314 @@ type HeartbeatResult struct {
 	// guaranteeing the server's ability to identify periods of inactivity/death for correctness purposes.
 	ServerVersion int64
 }
+
+// Backup contains the methods for exporting and importing actor state so it can be
+// backed up and restored, or moved between clusters.
+type Backup interface {
+	// ExportActorKV writes the actor's record and every key/value pair in its KV storage
+	// to w in a portable, checksummed format that can be imported with ImportActorKV.
+	// The export is a consistent snapshot of the actor's state.
+	ExportActorKV(
+		ctx context.Context,
+		namespace,
+		actorID string,
+		w io.Writer,
+	) error
+
+	// ExportNamespaceKV is the same as ExportActorKV except it exports every actor in the
+	// namespace. Each actor is exported from a consistent snapshot, but the snapshots of
+	// different actors may differ.
+	ExportNamespaceKV(
+		ctx context.Context,
+		namespace string,
+		w io.Writer,
+	) error
+
+	// ImportActorKV imports an export produced by ExportActorKV or ExportNamespaceKV into
+	// the provided namespace, which does not have to be the namespace the export was
+	// produced from. The entire export is verified before anything is written, and then
+	// it is imported one actor at a time. The exported actors must not exist in the
+	// namespace yet and their modules must already be registered in it. Each actor is
+	// only created once all of its keys have been imported so it can't be activated
+	// while its import is in progress.
+	ImportActorKV(
+		ctx context.Context,
+		namespace string,
+		r io.Reader,
+	) (ImportResult, error)
+}
+
+// ImportResult is the result of calling ImportActorKV.
+type ImportResult struct {
+	NumActors int `json:"num_actors"`
+	NumKeys   int `json:"num_keys"`
+}
+
+// Namespaces contains the methods for managing namespaces. Namespaces are created
+// implicitly (with the default options) when the first module is registered in them,
+// but they can also be created explicitly ahead of time so that they have quotas from
+// the start.
+type Namespaces interface {
+	// CreateNamespace creates a namespace with the provided options. It returns an error
+	// if the namespace already exists.
+	CreateNamespace(
+		ctx context.Context,
+		namespace string,
+		opts NamespaceOptions,
+	) error
+
+	// UpdateNamespace replaces the options of an existing namespace.
+	UpdateNamespace(
+		ctx context.Context,
+		namespace string,
+		opts NamespaceOptions,
+	) error
+
+	// GetNamespace returns the namespace's options. It returns an error that wraps
+	// errNamespaceDoesNotExist (see IsNamespaceDoesNotExistErr) if the namespace
+	// does not exist.
+	GetNamespace(
+		ctx context.Context,
+		namespace string,
+	) (NamespaceInfo, error)
+
+	// ListNamespaces returns every namespace ordered by name.
+	ListNamespaces(ctx context.Context) ([]NamespaceInfo, error)
+
+	// DeleteNamespace deletes the namespace and everything in it: its modules, actors
+	// (including their KV storage and inboxes) and topic subscriptions. Actors that are
+	// still activated will fail to access the registry once it's deleted. Deleting a
+	// large namespace requires many transactions so it's not atomic, but retrying a
+	// failed delete is safe.
+	DeleteNamespace(
+		ctx context.Context,
+		namespace string,
+	) error
+
+	// GetNamespaceUsage returns the namespace's current usage of the resources that
+	// NamespaceQuotas limits. Usage is only tracked for data written after namespaces
+	// were introduced.
+	GetNamespaceUsage(
+		ctx context.Context,
+		namespace string,
+	) (NamespaceUsage, error)
+}
+
+// Admin contains the methods for administering and debugging a namespace's modules,
+// actors and their KV storage directly, I.E without invoking the actors.
+type Admin interface {
+	// ListModules returns the IDs of the modules registered in the namespace, ordered by
+	// ID.
+	ListModules(
+		ctx context.Context,
+		namespace string,
+	) ([]string, error)
+
+	// DeleteModule deletes the module. It returns an error if actors that were created
+	// from the module still exist, they have to be deleted first.
+	DeleteModule(
+		ctx context.Context,
+		namespace,
+		moduleID string,
+	) error
+
+	// ListActors returns up to limit IDs of the actors in the namespace whose IDs are
+	// greater than after, ordered by ID. All the actors can be listed by passing the last
+	// ID of each page as after until an empty page is returned. The actors of namespaces
+	// that were created by older versions can only be listed once the namespace's index
+	// is built in the background, until then ListActors returns an error.
+	ListActors(
+		ctx context.Context,
+		namespace string,
+		after string,
+		limit int,
+	) ([]string, error)
+
+	// DeleteActor deletes the actor and everything associated with it: its KV storage,
+	// inbox, stored invocation results and topic subscriptions. If the actor is still
+	// activated then it will fail to access the registry once it's deleted. Deleting an
+	// actor with a lot of data requires many transactions so it's not atomic, but
+	// retrying a failed delete is safe.
+	DeleteActor(
+		ctx context.Context,
+		namespace,
+		actorID string,
+	) error
+
+	// GetActorKV returns the value of the key in the actor's KV storage and whether it
+	// exists.
+	GetActorKV(
+		ctx context.Context,
+		namespace,
+		actorID string,
+		key []byte,
+	) ([]byte, bool, error)
+
+	// PutActorKV stores the value at the key in the actor's KV storage. Same as
+	// ImportActorKV, the key is written without regard for the actor's current
+	// activation so it should only be used for debugging.
+	PutActorKV(
+		ctx context.Context,
+		namespace,
+		actorID string,
+		key []byte,
+		value []byte,
+	) error
+
+	// ScanActorKV returns up to limit key/value pairs from the actor's KV storage whose
+	// keys start with prefix, ordered by key. Every key matches an empty prefix.
+	ScanActorKV(
+		ctx context.Context,
+		namespace,
+		actorID string,
+		prefix []byte,
+		limit int,
+	) ([]ActorKV, error)
+}
+
+// ActorKV is a key/value pair in an actor's KV storage.
+type ActorKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// NamespaceOptions contains the options for a given namespace.
+type NamespaceOptions struct {
+	Quotas     NamespaceQuotas     `json:"quotas"`
+	RateLimits NamespaceRateLimits `json:"rate_limits"`
+	// LogLevel is the minimum level of the messages that are logged for the namespace's
+	// actors: debug, info, warn or error. The environment's level is used if empty.
+	LogLevel string `json:"log_level,omitempty"`
+	// KVChangeLog enables the change log of the namespace's actors' KV storage which
+	// WatchActorKV reads from. It's disabled by default since it makes every write more
+	// expensive. Changes that are made while it's disabled are never recorded, so
+	// watchers should start over after it's enabled.
+	KVChangeLog bool `json:"kv_change_log,omitempty"`
+}
+
+// Validate validates the options.
+func (n *NamespaceOptions) Validate() error {
+	if err := n.Quotas.Validate(); err != nil {
+		return err
+	}
+	if err := n.RateLimits.Validate(); err != nil {
+		return fmt.Errorf("invalid rate limits: %w", err)
+	}
+	switch n.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf(
+			"invalid log level: %s, valid options are: debug|info|warn|error", n.LogLevel)
+	}
+	return nil
+}
+
+// NamespaceQuotas limits the resources that a namespace can use. A zero value means
+// the resource is unlimited.
+//
+// The limits on actors and modules are enforced by the registry in the same transaction
+// that creates actors and registers modules, so they're never exceeded. The limits on KV
+// bytes and invocation rate are enforced by each environment based on periodically
+// refreshed usage, so they may be exceeded briefly.
+type NamespaceQuotas struct {
+	// MaxActors is the maximum number of actors in the namespace.
+	MaxActors int64 `json:"max_actors,omitempty"`
+	// MaxModules is the maximum number of modules registered in the namespace.
+	MaxModules int64 `json:"max_modules,omitempty"`
+	// MaxModuleBytes is the maximum total size of the modules registered in the
+	// namespace.
+	MaxModuleBytes int64 `json:"max_module_bytes,omitempty"`
+	// MaxKVBytes is the maximum total size of the keys and values stored in the KV
+	// storage of all the actors in the namespace.
+	MaxKVBytes int64 `json:"max_kv_bytes,omitempty"`
+	// MaxInvocationsPerSecond is the maximum rate at which each server accepts
+	// invocations of actors and workers in the namespace.
+	MaxInvocationsPerSecond float64 `json:"max_invocations_per_second,omitempty"`
+}
+
+// Validate validates the quotas.
+func (q *NamespaceQuotas) Validate() error {
+	if q.MaxActors < 0 || q.MaxModules < 0 || q.MaxModuleBytes < 0 ||
+		q.MaxKVBytes < 0 || q.MaxInvocationsPerSecond < 0 {
+		return errors.New("namespace quotas must not be negative")
+	}
+	return nil
+}
+
+// NamespaceRateLimits contains the rate limits on invocations of the actors and workers
+// in a namespace. The rate limits are enforced by each environment before invocations are
+// dispatched to activated actors, so per-actor limits apply cluster-wide (since an actor
+// is only activated on one server at a time) while namespace and module limits apply to
+// each server independently.
+type NamespaceRateLimits struct {
+	// Namespace limits the invocations of all the actors and workers in the namespace.
+	Namespace *RateLimit `json:"namespace,omitempty"`
+	// Modules limits the invocations of all the actors and workers of each module, keyed
+	// by module ID.
+	Modules map[string]RateLimit `json:"modules,omitempty"`
+	// Actors limits the invocations of individual actors, keyed by actor ID.
+	Actors map[string]RateLimit `json:"actors,omitempty"`
+	// DefaultActor limits the invocations of each actor that doesn't have an entry in
+	// Actors.
+	DefaultActor *RateLimit `json:"default_actor,omitempty"`
+}
+
+// Validate validates the rate limits.
+func (n *NamespaceRateLimits) Validate() error {
+	if n.Namespace != nil {
+		if err := n.Namespace.Validate(); err != nil {
+			return fmt.Errorf("namespace: %w", err)
+		}
+	}
+	for moduleID, limit := range n.Modules {
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("module: %s: %w", moduleID, err)
+		}
+	}
+	for actorID, limit := range n.Actors {
+		if err := limit.Validate(); err != nil {
+			return fmt.Errorf("actor: %s: %w", actorID, err)
+		}
+	}
+	if n.DefaultActor != nil {
+		if err := n.DefaultActor.Validate(); err != nil {
+			return fmt.Errorf("default actor: %w", err)
+		}
+	}
+	return nil
+}
+
+// RateLimit is a token bucket rate limit.
+type RateLimit struct {
+	// PerSecond is the rate at which invocations are allowed.
+	PerSecond float64 `json:"per_second"`
+	// Burst is the maximum number of invocations that are allowed at once. It defaults to
+	// one second worth of invocations (and at least one).
+	Burst int64 `json:"burst,omitempty"`
+}
+
+// Validate validates the rate limit.
+func (r *RateLimit) Validate() error {
+	if r.PerSecond <= 0 {
+		return errors.New("rate limit must be positive")
+	}
+	if r.Burst < 0 {
+		return errors.New("rate limit burst must not be negative")
+	}
+	return nil
+}
+
+// NamespaceInfo contains a namespace's metadata.
+type NamespaceInfo struct {
+	Namespace string           `json:"namespace"`
+	Opts      NamespaceOptions `json:"opts"`
+}
+
+// NamespaceUsage contains a namespace's usage of the resources that NamespaceQuotas
+// limits.
+type NamespaceUsage struct {
+	NumActors   int64 `json:"num_actors"`
+	NumModules  int64 `json:"num_modules"`
+	ModuleBytes int64 `json:"module_bytes"`
+	KVBytes     int64 `json:"kv_bytes"`
+}
@@ -4,11 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/richardartoul/nola/durable/durablewazero"
 	"github.com/richardartoul/nola/virtual/types"
 )
 
+// maxModuleSizeBytes is the maximum size of a module's WASM bytes.
+const maxModuleSizeBytes = 1 << 27
+
 // validator wraps a Registry and ensures that all the arguments to it are
 // validated properly. This helps us ensure that validation occurs uniformly
 // across all registry implementations.
@@ -31,25 +39,120 @@ func (v *validator) RegisterModule(
 	moduleBytes []byte,
 	opts ModuleOptions,
 ) (RegisterModuleResult, error) {
-	if err := validateString("namespace", namespace); err != nil {
+	if err := v.validateRegisterModule(ctx, namespace, moduleID, int64(len(moduleBytes)), opts); err != nil {
+		return RegisterModuleResult{}, err
+	}
+
+	var metadata moduleMetadata
+	if len(moduleBytes) > 0 {
+		var err error
+		metadata, err = validateModuleBytes(ctx, moduleBytes)
+		if err != nil {
+			return RegisterModuleResult{}, fmt.Errorf("invalid module: %s, err: %w", moduleID, err)
+		}
+	}
+
+	result, err := v.r.RegisterModule(ctx, namespace, moduleID, moduleBytes, opts)
+	if err != nil {
+		return RegisterModuleResult{}, err
+	}
+	result.Exports = metadata.Exports
+	result.Imports = metadata.Imports
+	return result, nil
+}
+
+func (v *validator) RegisterModuleStream(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+	r io.Reader,
+	opts ModuleOptions,
+) (RegisterModuleResult, error) {
+	if err := validateNamespace(namespace); err != nil {
 		return RegisterModuleResult{}, err
 	}
 	if err := validateString("moduleID", moduleID); err != nil {
 		return RegisterModuleResult{}, err
 	}
-	if len(moduleBytes) == 0 && !opts.AllowEmptyModuleBytes {
-		return RegisterModuleResult{}, errors.New("moduleBytes must not be empty")
+
+	// The module has to be validated before it's registered, so spool it to a temporary
+	// file instead of buffering it in memory while it's read, validated and then written
+	// to the registry over multiple transactions.
+	f, err := ioutil.TempFile("", "nola-module-*.wasm")
+	if err != nil {
+		return RegisterModuleResult{}, fmt.Errorf("error creating temporary file for module: %w", err)
 	}
-	if len(moduleBytes) > 1<<22 {
-		// TODO: 4MiB is a ridiculous low limit, we need to find a way to increase this. Probably
-		//       need to store the modules in an external store or just split them across a bunch
-		//       of keys in the registry and multiple transactions.
-		return RegisterModuleResult{}, fmt.Errorf("moduleBytes must not be > 1<<22, but was: %d", len(moduleBytes))
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	size, err := io.Copy(f, &moduleReader{r: r, opts: opts})
+	if err != nil {
+		return RegisterModuleResult{}, fmt.Errorf("error reading module: %w", err)
 	}
 
-	// TODO: We could try compiling the WASM bytes here to make sure they're a valid program.
+	if err := v.validateRegisterModule(ctx, namespace, moduleID, size, opts); err != nil {
+		return RegisterModuleResult{}, err
+	}
 
-	return v.r.RegisterModule(ctx, namespace, moduleID, moduleBytes, opts)
+	var metadata moduleMetadata
+	if size > 0 {
+		metadata, err = validateModuleFile(ctx, f)
+		if err != nil {
+			return RegisterModuleResult{}, fmt.Errorf("invalid module: %s, err: %w", moduleID, err)
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return RegisterModuleResult{}, fmt.Errorf("error seeking temporary module file: %w", err)
+	}
+	result, err := v.r.RegisterModuleStream(ctx, namespace, moduleID, f, opts)
+	if err != nil {
+		return RegisterModuleResult{}, err
+	}
+	result.Exports = metadata.Exports
+	result.Imports = metadata.Imports
+	return result, nil
+}
+
+// validateRegisterModule validates everything about the registration of a module of the
+// provided size except for the module's bytes themselves.
+func (v *validator) validateRegisterModule(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+	size int64,
+	opts ModuleOptions,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateString("moduleID", moduleID); err != nil {
+		return err
+	}
+	if size == 0 && !opts.AllowEmptyModuleBytes {
+		return errors.New("moduleBytes must not be empty")
+	}
+	if size > maxModuleSizeBytes {
+		return fmt.Errorf(
+			"moduleBytes must not be > %d, but was: %d", maxModuleSizeBytes, size)
+	}
+
+	if err := durablewazero.ValidateRuntime(opts.WASMRuntime); err != nil {
+		return err
+	}
+	if opts.HostPolicy != nil {
+		if err := opts.HostPolicy.Validate(); err != nil {
+			return fmt.Errorf("invalid host policy for module: %s, err: %w", moduleID, err)
+		}
+	}
+	if opts.Manifest != nil {
+		if err := opts.Manifest.Validate(); err != nil {
+			return fmt.Errorf("invalid manifest for module: %s, err: %w", moduleID, err)
+		}
+	}
+
+	return nil
 }
 
 func (v *validator) GetModule(
@@ -57,7 +160,7 @@ func (v *validator) GetModule(
 	namespace,
 	moduleID string,
 ) ([]byte, ModuleOptions, error) {
-	if err := validateString("namespace", namespace); err != nil {
+	if err := validateNamespace(namespace); err != nil {
 		return nil, ModuleOptions{}, err
 	}
 	if err := validateString("moduleID", moduleID); err != nil {
@@ -66,6 +169,20 @@ func (v *validator) GetModule(
 	return v.r.GetModule(ctx, namespace, moduleID)
 }
 
+func (v *validator) GetModuleInfo(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+) (ModuleInfo, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return ModuleInfo{}, err
+	}
+	if err := validateString("moduleID", moduleID); err != nil {
+		return ModuleInfo{}, err
+	}
+	return v.r.GetModuleInfo(ctx, namespace, moduleID)
+}
+
 func (v *validator) CreateActor(
 	ctx context.Context,
 	namespace,
@@ -73,7 +190,7 @@ func (v *validator) CreateActor(
 	moduleID string,
 	opts types.ActorOptions,
 ) (CreateActorResult, error) {
-	if err := validateString("namespace", namespace); err != nil {
+	if err := validateNamespace(namespace); err != nil {
 		return CreateActorResult{}, err
 	}
 	if err := validateString("actorID", actorID); err != nil {
@@ -82,7 +199,6 @@ func (v *validator) CreateActor(
 	if err := validateString("moduleID", moduleID); err != nil {
 		return CreateActorResult{}, err
 	}
-
 	return v.r.CreateActor(ctx, namespace, actorID, moduleID, opts)
 }
 
@@ -91,7 +207,7 @@ func (v *validator) IncGeneration(
 	namespace,
 	actorID string,
 ) error {
-	if err := validateString("namespace", namespace); err != nil {
+	if err := validateNamespace(namespace); err != nil {
 		return err
 	}
 	if err := validateString("actorID", actorID); err != nil {
@@ -105,7 +221,7 @@ func (v *validator) EnsureActivation(
 	namespace,
 	actorID string,
 ) ([]types.ActorReference, error) {
-	if err := validateString("namespace", namespace); err != nil {
+	if err := validateNamespace(namespace); err != nil {
 		return nil, err
 	}
 	if err := validateString("actorID", actorID); err != nil {
@@ -114,12 +230,30 @@ func (v *validator) EnsureActivation(
 	return v.r.EnsureActivation(ctx, namespace, actorID)
 }
 
+func (v *validator) DescribeActor(
+	ctx context.Context,
+	namespace,
+	actorID string,
+) (ActorInfo, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return ActorInfo{}, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return ActorInfo{}, err
+	}
+	return v.r.DescribeActor(ctx, namespace, actorID)
+}
+
 func (v *validator) GetVersionStamp(
 	ctx context.Context,
 ) (int64, error) {
 	return v.r.GetVersionStamp(ctx)
 }
 
+func (v *validator) MaxTransactionDuration() time.Duration {
+	return v.r.MaxTransactionDuration()
+}
+
 func (v *validator) BeginTransaction(
 	ctx context.Context,
 	namespace string,
@@ -128,7 +262,7 @@ func (v *validator) BeginTransaction(
 	serverID string,
 	serverVersion int64,
 ) (ActorKVTransaction, error) {
-	if err := validateString("namespace", namespace); err != nil {
+	if err := validateNamespace(namespace); err != nil {
 		return nil, err
 	}
 	if err := validateString("actorID", namespace); err != nil {
@@ -143,6 +277,91 @@ func (v *validator) BeginTransaction(
 	return &kvValidator{tr}, nil
 }
 
+func (v *validator) WatchActorKV(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+	prefix []byte,
+	afterVersion []byte,
+) ([]ActorKVChange, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, err
+	}
+
+	return v.r.WatchActorKV(ctx, namespace, actorID, prefix, afterVersion)
+}
+
+func (v *validator) ExportActorKV(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	w io.Writer,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return err
+	}
+
+	return v.r.ExportActorKV(ctx, namespace, actorID, w)
+}
+
+func (v *validator) ExportNamespaceKV(
+	ctx context.Context,
+	namespace string,
+	w io.Writer,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+
+	return v.r.ExportNamespaceKV(ctx, namespace, w)
+}
+
+func (v *validator) ImportActorKV(
+	ctx context.Context,
+	namespace string,
+	r io.Reader,
+) (ImportResult, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return ImportResult{}, err
+	}
+
+	return v.r.ImportActorKV(ctx, namespace, r)
+}
+
+func (v *validator) ListActorsWithPendingMessages(
+	ctx context.Context,
+	serverID string,
+	limit int,
+) ([]types.NamespacedIDNoType, error) {
+	if err := validateString("serverID", serverID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be > 0, but was: %d", limit)
+	}
+	return v.r.ListActorsWithPendingMessages(ctx, serverID, limit)
+}
+
+func (v *validator) ListDeadLetters(
+	ctx context.Context,
+	namespace string,
+	actorID string,
+) ([]InboxMessage, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, err
+	}
+	return v.r.ListDeadLetters(ctx, namespace, actorID)
+}
+
 func (v *validator) Heartbeat(
 	ctx context.Context,
 	serverID string,
@@ -157,6 +376,64 @@ func (v *validator) Heartbeat(
 	return v.r.Heartbeat(ctx, serverID, state)
 }
 
+func (v *validator) ListServers(ctx context.Context) ([]ServerInfo, error) {
+	return v.r.ListServers(ctx)
+}
+
+func (v *validator) Subscribe(
+	ctx context.Context,
+	namespace,
+	topic,
+	actorID,
+	operation string,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateString("topic", topic); err != nil {
+		return err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return err
+	}
+	if err := validateString("operation", operation); err != nil {
+		return err
+	}
+	return v.r.Subscribe(ctx, namespace, topic, actorID, operation)
+}
+
+func (v *validator) Unsubscribe(
+	ctx context.Context,
+	namespace,
+	topic,
+	actorID string,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateString("topic", topic); err != nil {
+		return err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return err
+	}
+	return v.r.Unsubscribe(ctx, namespace, topic, actorID)
+}
+
+func (v *validator) GetSubscriptions(
+	ctx context.Context,
+	namespace,
+	topic string,
+) ([]TopicSubscription, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if err := validateString("topic", topic); err != nil {
+		return nil, err
+	}
+	return v.r.GetSubscriptions(ctx, namespace, topic)
+}
+
 func (v *validator) Close(ctx context.Context) error {
 	return v.r.Close(ctx)
 }
@@ -165,6 +442,177 @@ func (v *validator) UnsafeWipeAll() error {
 	return v.r.UnsafeWipeAll()
 }
 
+func (v *validator) CreateNamespace(
+	ctx context.Context,
+	namespace string,
+	opts NamespaceOptions,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	return v.r.CreateNamespace(ctx, namespace, opts)
+}
+
+func (v *validator) UpdateNamespace(
+	ctx context.Context,
+	namespace string,
+	opts NamespaceOptions,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	return v.r.UpdateNamespace(ctx, namespace, opts)
+}
+
+func (v *validator) GetNamespace(
+	ctx context.Context,
+	namespace string,
+) (NamespaceInfo, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return NamespaceInfo{}, err
+	}
+	return v.r.GetNamespace(ctx, namespace)
+}
+
+func (v *validator) ListNamespaces(ctx context.Context) ([]NamespaceInfo, error) {
+	return v.r.ListNamespaces(ctx)
+}
+
+func (v *validator) DeleteNamespace(
+	ctx context.Context,
+	namespace string,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	return v.r.DeleteNamespace(ctx, namespace)
+}
+
+func (v *validator) GetNamespaceUsage(
+	ctx context.Context,
+	namespace string,
+) (NamespaceUsage, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return NamespaceUsage{}, err
+	}
+	return v.r.GetNamespaceUsage(ctx, namespace)
+}
+
+func (v *validator) ListModules(
+	ctx context.Context,
+	namespace string,
+) ([]string, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	return v.r.ListModules(ctx, namespace)
+}
+
+func (v *validator) DeleteModule(
+	ctx context.Context,
+	namespace,
+	moduleID string,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateString("moduleID", moduleID); err != nil {
+		return err
+	}
+	return v.r.DeleteModule(ctx, namespace, moduleID)
+}
+
+func (v *validator) ListActors(
+	ctx context.Context,
+	namespace string,
+	after string,
+	limit int,
+) ([]string, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be > 0, but was: %d", limit)
+	}
+	return v.r.ListActors(ctx, namespace, after, limit)
+}
+
+func (v *validator) DeleteActor(
+	ctx context.Context,
+	namespace,
+	actorID string,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return err
+	}
+	return v.r.DeleteActor(ctx, namespace, actorID)
+}
+
+func (v *validator) GetActorKV(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	key []byte,
+) ([]byte, bool, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, false, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, false, err
+	}
+	if err := validateKey(key); err != nil {
+		return nil, false, err
+	}
+	return v.r.GetActorKV(ctx, namespace, actorID, key)
+}
+
+func (v *validator) PutActorKV(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	key []byte,
+	value []byte,
+) error {
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return err
+	}
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	return v.r.PutActorKV(ctx, namespace, actorID, key, value)
+}
+
+func (v *validator) ScanActorKV(
+	ctx context.Context,
+	namespace,
+	actorID string,
+	prefix []byte,
+	limit int,
+) ([]ActorKV, error) {
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	if err := validateString("actorID", actorID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be > 0, but was: %d", limit)
+	}
+	return v.r.ScanActorKV(ctx, namespace, actorID, prefix, limit)
+}
+
 func validateString(name, x string) error {
 	if x == "" {
 		return fmt.Errorf("%s cannot be empty", name)
@@ -180,32 +628,104 @@ func validateString(name, x string) error {
 	return nil
 }
 
-type kvValidator struct {
-	tr ActorKVTransaction
+func validateNamespace(namespace string) error {
+	if err := validateString("namespace", namespace); err != nil {
+		return err
+	}
+	if isReservedNamespace(namespace) {
+		return fmt.Errorf("namespace: %s is reserved", namespace)
+	}
+	return nil
 }
 
-func (k *kvValidator) Put(ctx context.Context, key []byte, value []byte) error {
+func validateKey(key []byte) error {
 	if len(key) == 0 {
 		return errors.New("key cannot be empty")
 	}
 	if len(key) > 1<<10 {
 		return fmt.Errorf("key cannot be > 1<<10, but was: %d", len(key))
 	}
+	return nil
+}
+
+type kvValidator struct {
+	tr ActorKVTransaction
+}
+
+func (k *kvValidator) Put(ctx context.Context, key []byte, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
 
 	return k.tr.Put(ctx, key, value)
 }
 
 func (k *kvValidator) Get(ctx context.Context, key []byte) ([]byte, bool, error) {
-	if len(key) == 0 {
-		return nil, false, errors.New("key cannot be empty")
-	}
-	if len(key) > 1<<10 {
-		return nil, false, fmt.Errorf("key cannot be > 1<<10, but was: %d", len(key))
+	if err := validateKey(key); err != nil {
+		return nil, false, err
 	}
 
 	return k.tr.Get(ctx, key)
 }
 
+func (k *kvValidator) EnqueueMessage(ctx context.Context, actorID string, msg InboxMessage) error {
+	if err := validateString("actorID", actorID); err != nil {
+		return err
+	}
+	if err := validateString("message ID", msg.ID); err != nil {
+		return err
+	}
+	if err := validateString("operation", msg.Operation); err != nil {
+		return err
+	}
+
+	return k.tr.EnqueueMessage(ctx, actorID, msg)
+}
+
+func (k *kvValidator) PeekInbox(ctx context.Context) (InboxMessage, bool, error) {
+	return k.tr.PeekInbox(ctx)
+}
+
+func (k *kvValidator) AckInboxMessage(ctx context.Context, seq int64) error {
+	if seq <= 0 {
+		return fmt.Errorf("seq must be > 0, but was: %d", seq)
+	}
+
+	return k.tr.AckInboxMessage(ctx, seq)
+}
+
+func (k *kvValidator) RetryInboxMessage(ctx context.Context, seq int64, reason string, retryAt time.Time) error {
+	if seq <= 0 {
+		return fmt.Errorf("seq must be > 0, but was: %d", seq)
+	}
+
+	return k.tr.RetryInboxMessage(ctx, seq, reason, retryAt)
+}
+
+func (k *kvValidator) DeadLetterInboxMessage(ctx context.Context, seq int64, reason string) error {
+	if seq <= 0 {
+		return fmt.Errorf("seq must be > 0, but was: %d", seq)
+	}
+
+	return k.tr.DeadLetterInboxMessage(ctx, seq, reason)
+}
+
+func (k *kvValidator) GetInvocationResult(ctx context.Context, idempotencyKey string) (InvocationResult, bool, error) {
+	if err := validateString("idempotencyKey", idempotencyKey); err != nil {
+		return InvocationResult{}, false, err
+	}
+
+	return k.tr.GetInvocationResult(ctx, idempotencyKey)
+}
+
+func (k *kvValidator) PutInvocationResult(ctx context.Context, idempotencyKey string, result InvocationResult) error {
+	if err := validateString("idempotencyKey", idempotencyKey); err != nil {
+		return err
+	}
+
+	return k.tr.PutInvocationResult(ctx, idempotencyKey, result)
+}
+
 func (k *kvValidator) Commit(ctx context.Context) error {
 	return k.tr.Commit(ctx)
 }
@@ -213,3 +733,70 @@ func (k *kvValidator) Commit(ctx context.Context) error {
 func (k *kvValidator) Cancel(ctx context.Context) error {
 	return k.tr.Cancel(ctx)
 }
+
+func (k *kvValidator) JoinActors(
+	ctx context.Context,
+	participants []TransactionParticipant,
+) (MultiActorKV, error) {
+	if err := validateParticipants(participants); err != nil {
+		return nil, err
+	}
+
+	kv, err := k.tr.JoinActors(ctx, participants)
+	if err != nil {
+		return nil, err
+	}
+	return multiActorKVValidator{kv}, nil
+}
+
+func validateParticipants(participants []TransactionParticipant) error {
+	for _, p := range participants {
+		if err := validateString("actorID", p.ActorID); err != nil {
+			return err
+		}
+		if err := validateString("serverID", p.ServerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type multiActorKVValidator struct {
+	kv MultiActorKV
+}
+
+func (k multiActorKVValidator) Put(ctx context.Context, actorID string, key []byte, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	return k.kv.Put(ctx, actorID, key, value)
+}
+
+func (k multiActorKVValidator) Get(ctx context.Context, actorID string, key []byte) ([]byte, bool, error) {
+	if err := validateKey(key); err != nil {
+		return nil, false, err
+	}
+
+	return k.kv.Get(ctx, actorID, key)
+}
+
+// moduleReader wraps the reader passed to RegisterModuleStream so that the module's size
+// can be validated as it's read.
+type moduleReader struct {
+	r    io.Reader
+	opts ModuleOptions
+	n    int64
+}
+
+func (m *moduleReader) Read(b []byte) (int, error) {
+	n, err := m.r.Read(b)
+	m.n += int64(n)
+	if m.n > maxModuleSizeBytes {
+		return n, fmt.Errorf("moduleBytes must not be > %d", maxModuleSizeBytes)
+	}
+	if err == io.EOF && m.n == 0 && !m.opts.AllowEmptyModuleBytes {
+		return n, errors.New("moduleBytes must not be empty")
+	}
+	return n, err
+}
@@ -1,76 +1,1021 @@
 package virtual
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/richardartoul/nola/virtual/metrics"
 	"github.com/richardartoul/nola/virtual/registry"
 	"github.com/richardartoul/nola/virtual/types"
+	"github.com/richardartoul/nola/wapcutils"
+)
+
+const (
+	// streamTimeout is the timeout for streaming invocations. It is much higher than the
+	// timeout for regular invocations since streams are used for long-running operations.
+	// Streaming invocations of actors are further limited by the maximum duration of a
+	// single KV transaction, if the registry has one.
+	streamTimeout = 5 * time.Minute
 )
 
 type server struct {
 	// Dependencies.
 	registry    registry.Registry
 	environment Environment
+	opts        ServerOptions
+}
+
+// ServerOptions contains the options for the server.
+type ServerOptions struct {
+	// Auth contains the authentication and authorization options for the public API.
+	Auth AuthOptions
+	// InternalPort is the port of a separate listener for the endpoints that servers use
+	// to communicate with each other (invoke-actor-direct*) and /debug/pprof. They're
+	// served on the public port if it's zero. If it's set, the environment should
+	// advertise it to the discovery service instead of the public port.
+	InternalPort int
+	// InternalToken is the credential that servers use to authenticate the requests they
+	// send to each other. It must be the same for every server in the cluster and must
+	// also be passed to NewHTTPClient. It's required when authentication is enabled.
+	InternalToken string
+	// TLS contains the TLS options for both listeners.
+	TLS TLSOptions
+}
+
+// Validate validates the options.
+func (o *ServerOptions) Validate() error {
+	if err := o.Auth.Validate(); err != nil {
+		return err
+	}
+	if err := o.TLS.Validate(); err != nil {
+		return err
+	}
+	if o.Auth.enabled() && o.InternalToken == "" {
+		return errors.New(
+			"an internal token is required when authentication is enabled, otherwise the " +
+				"internal endpoints would be served unauthenticated")
+	}
+	return nil
 }
 
 // NewServer creates a new server for the actor virtual environment.
 func NewServer(
 	registry registry.Registry,
 	environment Environment,
+	opts ServerOptions,
 ) *server {
 	return &server{
 		registry:    registry,
 		environment: environment,
+		opts:        opts,
+	}
+}
+
+// Start starts the server.
+func (s *server) Start(port int) error {
+	if err := s.opts.Validate(); err != nil {
+		return fmt.Errorf("error validating server options: %w", err)
+	}
+
+	var tlsConfig *tls.Config
+	if s.opts.TLS.Enabled() {
+		var err error
+		tlsConfig, err = s.opts.TLS.serverConfig()
+		if err != nil {
+			return err
+		}
+	}
+
+	errCh := make(chan error, 2)
+	if s.opts.InternalPort != 0 {
+		go func() {
+			errCh <- listenAndServe(s.opts.InternalPort, s.internalHandler(), tlsConfig)
+		}()
+	}
+	go func() {
+		errCh <- listenAndServe(port, s.publicHandler(), tlsConfig)
+	}()
+	return <-errCh
+}
+
+// listenAndServe serves the handler on the port, over TLS if tlsConfig is not nil.
+func listenAndServe(port int, handler http.Handler, tlsConfig *tls.Config) error {
+	server := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		// The certificates are already in tlsConfig.
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// publicHandler returns the handler for the public API.
+func (s *server) publicHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/register-module", s.authenticated(s.registerModule))
+	mux.HandleFunc("/api/v1/describe-module", s.authenticated(s.describeModule))
+	mux.HandleFunc("/api/v1/create-actor", s.authenticated(s.createActor))
+	mux.HandleFunc("/api/v1/invoke-actor", s.authenticated(s.invoke))
+	mux.HandleFunc("/api/v1/invoke-actor-stream", s.authenticated(s.invokeStream))
+	mux.HandleFunc("/api/v1/invoke-worker", s.authenticated(s.invokeWorker))
+	mux.HandleFunc("/api/v1/publish", s.authenticated(s.publish))
+	mux.HandleFunc("/api/v1/watch-actor-kv", s.authenticated(s.watchActorKV))
+	mux.HandleFunc("/api/v1/export-actor-kv", s.authenticated(s.exportActorKV))
+	mux.HandleFunc("/api/v1/import-actor-kv", s.authenticated(s.importActorKV))
+	mux.HandleFunc("/api/v1/create-namespace", s.authenticated(s.admin(s.putNamespace(false))))
+	mux.HandleFunc("/api/v1/update-namespace", s.authenticated(s.admin(s.putNamespace(true))))
+	mux.HandleFunc("/api/v1/delete-namespace", s.authenticated(s.admin(s.deleteNamespace)))
+	mux.HandleFunc("/api/v1/list-namespaces", s.authenticated(s.admin(s.listNamespaces)))
+	mux.HandleFunc("/api/v1/namespace-usage", s.authenticated(s.namespaceUsage))
+	mux.HandleFunc("/api/v1/tail-actor-logs", s.authenticated(s.tailActorLogs))
+	mux.HandleFunc("/api/v1/list-modules", s.authenticated(s.listModules))
+	mux.HandleFunc("/api/v1/delete-module", s.authenticated(s.deleteModule))
+	mux.HandleFunc("/api/v1/list-actors", s.authenticated(s.listActors))
+	mux.HandleFunc("/api/v1/delete-actor", s.authenticated(s.deleteActor))
+	mux.HandleFunc("/api/v1/get-actor-kv", s.authenticated(s.getActorKV))
+	mux.HandleFunc("/api/v1/put-actor-kv", s.authenticated(s.putActorKV))
+	mux.HandleFunc("/api/v1/scan-actor-kv", s.authenticated(s.scanActorKV))
+	mux.HandleFunc("/api/v1/admin/servers", s.authenticated(s.admin(s.listServers)))
+	mux.HandleFunc("/api/v1/admin/activations", s.authenticated(s.admin(s.listActivations)))
+	mux.HandleFunc("/api/v1/admin/actor", s.authenticated(s.admin(s.describeActor)))
+	if s.opts.InternalPort == 0 {
+		s.registerInternalHandlers(mux)
+	}
+	return mux
+}
+
+// internalHandler returns the handler for the internal listener, see
+// ServerOptions.InternalPort.
+func (s *server) internalHandler() http.Handler {
+	mux := http.NewServeMux()
+	s.registerInternalHandlers(mux)
+	return mux
+}
+
+func (s *server) registerInternalHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/invoke-actor-direct", s.internal(s.invokeDirect))
+	mux.HandleFunc("/api/v1/invoke-actor-direct-stream", s.internal(s.invokeDirectStream))
+	mux.HandleFunc("/api/v1/tail-actor-logs-direct", s.internal(s.tailActorLogsDirect))
+	// The pprof handlers register themselves with the default mux. They're for operators,
+	// not servers, so they require the admin action instead of the internal token.
+	mux.HandleFunc("/debug/pprof/", s.authenticated(s.admin(http.DefaultServeMux.ServeHTTP)))
+	// Same for metrics, which also contain the names of namespaces, modules and operations.
+	mux.HandleFunc("/metrics", s.authenticated(s.admin(s.serveMetrics)))
+}
+
+// serveMetrics writes the metrics in the Prometheus text exposition format.
+func (s *server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := metrics.DefaultRegistry.WriteText(&buf); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+// authenticated wraps a handler so that it's only called for authenticated requests. The
+// principal is stored in the request's context so the handler can authorize the request
+// once it knows which namespace the request is for, see authorize().
+func (s *server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.opts.Auth.enabled() {
+			h(w, r)
+			return
+		}
+
+		principal, err := s.opts.Auth.authenticate(r)
+		if err != nil {
+			w.WriteHeader(401)
+			w.Write([]byte(fmt.Sprintf("error authenticating request: %v", err)))
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), authPrincipalKey{}, principal)))
+	}
+}
+
+// authorize returns whether the request's principal is allowed to perform the action in
+// the namespace. If it isn't, then an error has already been written to w.
+func (s *server) authorize(
+	w http.ResponseWriter,
+	r *http.Request,
+	namespace string,
+	action string,
+) bool {
+	if !s.opts.Auth.enabled() {
+		return true
+	}
+
+	principal, _ := principalFromContext(r.Context())
+	if s.opts.Auth.authorize(principal, namespace, action) {
+		return true
+	}
+	w.WriteHeader(403)
+	w.Write([]byte(fmt.Sprintf(
+		"principal: %s is not allowed to: %s in namespace: %s", principal, action, namespace)))
+	return false
+}
+
+// admin wraps a handler so that it's only called for requests from principals that are
+// allowed to perform AuthActionAdmin.
+func (s *server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorize(w, r, AuthWildcard, AuthActionAdmin) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// internal wraps a handler so that it's only called for requests that carry the internal
+// token, see ServerOptions.InternalToken.
+func (s *server) internal(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkInternalToken(r, s.opts.InternalToken) {
+			w.WriteHeader(401)
+			w.Write([]byte("missing or invalid internal token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// This one is a bit weird because its basically a file upload with some JSON
+// so we just shove the JSON into the headers cause I'm lazy to do anything
+// more clever.
+func (s *server) registerModule(w http.ResponseWriter, r *http.Request) {
+	var (
+		namespace  = r.Header.Get("namespace")
+		moduleID   = r.Header.Get("module_id")
+		manifest   = r.Header.Get("manifest")
+		hostPolicy = r.Header.Get("host_policy")
+		opts       = registry.ModuleOptions{WASMRuntime: r.Header.Get("wasm_runtime")}
+	)
+	if !s.authorize(w, r, namespace, AuthActionManage) {
+		return
+	}
+	if manifest != "" {
+		if err := json.Unmarshal([]byte(manifest), &opts.Manifest); err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(fmt.Sprintf("error unmarshaling manifest: %v", err)))
+			return
+		}
+	}
+	if hostPolicy != "" {
+		if err := json.Unmarshal([]byte(hostPolicy), &opts.HostPolicy); err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(fmt.Sprintf("error unmarshaling host policy: %v", err)))
+			return
+		}
+	}
+
+	// Stream the module directly into the registry instead of buffering it since modules
+	// can be large. The registry is responsible for enforcing the maximum module size.
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cc()
+	result, err := s.registry.RegisterModuleStream(ctx, namespace, moduleID, r.Body, opts)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+type describeModuleRequest struct {
+	Namespace string `json:"namespace"`
+	ModuleID  string `json:"module_id"`
+}
+
+type describeModuleResponse struct {
+	Namespace string                   `json:"namespace"`
+	ModuleID  string                   `json:"module_id"`
+	Hash      string                   `json:"hash,omitempty"`
+	Size      int64                    `json:"size"`
+	Manifest  *registry.ModuleManifest `json:"manifest,omitempty"`
+}
+
+// describeModule returns a module's metadata, including its manifest (if it has one) so
+// that clients can be generated for it.
+func (s *server) describeModule(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req describeModuleRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	info, err := s.registry.GetModuleInfo(ctx, req.Namespace, req.ModuleID)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(describeModuleResponse{
+		Namespace: req.Namespace,
+		ModuleID:  req.ModuleID,
+		Hash:      info.Hash,
+		Size:      info.Size,
+		Manifest:  info.Opts.Manifest,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+// writeInvocationError writes the error that an invocation failed with. Invocations that
+// were rejected by a rate limit return a 429 with a Retry-After header so that clients
+// can back off, everything else returns a 500.
+func writeInvocationError(w http.ResponseWriter, err error) {
+	if retryAfter, ok := IsRateLimitedErr(err); ok {
+		w.Header().Set("Retry-After", formatRetryAfter(retryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(500)
+	w.Write([]byte(err.Error()))
+}
+
+// formatRetryAfter formats the duration as the number of seconds in a Retry-After
+// header, rounded up since the header doesn't support fractional seconds.
+func formatRetryAfter(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+type putNamespaceRequest struct {
+	Namespace string                    `json:"namespace"`
+	Opts      registry.NamespaceOptions `json:"opts"`
+}
+
+// putNamespace returns a handler that creates a namespace, or updates an existing one if
+// update is true. Namespaces are server-wide resources since they contain the quotas
+// that constrain their users, so the handler requires AuthActionAdmin.
+func (s *server) putNamespace(update bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		var req putNamespaceRequest
+		if err := json.Unmarshal(jsonBytes, &req); err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cc()
+		if update {
+			err = s.registry.UpdateNamespace(ctx, req.Namespace, req.Opts)
+		} else {
+			err = s.registry.CreateNamespace(ctx, req.Namespace, req.Opts)
+		}
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		w.WriteHeader(200)
+	}
+}
+
+type namespaceRequest struct {
+	Namespace string `json:"namespace"`
+}
+
+func (s *server) deleteNamespace(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req namespaceRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Deleting a namespace deletes all of its actors and modules which can take a while.
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cc()
+	if err := s.registry.DeleteNamespace(ctx, req.Namespace); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+func (s *server) listNamespaces(w http.ResponseWriter, r *http.Request) {
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	namespaces, err := s.registry.ListNamespaces(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(namespaces)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+type namespaceUsageResponse struct {
+	Namespace string                   `json:"namespace"`
+	Quotas    registry.NamespaceQuotas `json:"quotas"`
+	Usage     registry.NamespaceUsage  `json:"usage"`
+}
+
+// namespaceUsage returns a namespace's quotas and its current usage. Namespaces that
+// haven't been created explicitly and don't contain any modules yet have no quotas.
+func (s *server) namespaceUsage(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req namespaceRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	var quotas registry.NamespaceQuotas
+	info, err := s.registry.GetNamespace(ctx, req.Namespace)
+	if err == nil {
+		quotas = info.Opts.Quotas
+	} else if !registry.IsNamespaceDoesNotExistErr(err) {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	usage, err := s.registry.GetNamespaceUsage(ctx, req.Namespace)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(namespaceUsageResponse{
+		Namespace: req.Namespace,
+		Quotas:    quotas,
+		Usage:     usage,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+type tailActorLogsRequest struct {
+	Namespace string `json:"namespace"`
+	ActorID   string `json:"actor_id"`
+	// Limit is the maximum number of messages to return. All the retained messages are
+	// returned if it's zero.
+	Limit int `json:"limit"`
+}
+
+type tailActorLogsResponse struct {
+	// Activated is whether the actor is activated. Logs are only retained by the server
+	// that the actor is activated on, which the request is forwarded to.
+	Activated bool       `json:"activated"`
+	Logs      []LogEntry `json:"logs"`
+}
+
+// tailActorLogsDirectRequest is the request that servers send to each other to tail the
+// logs of an actor that is activated on the server that receives it.
+type tailActorLogsDirectRequest struct {
+	ServerID  string `json:"server_id"`
+	Namespace string `json:"namespace"`
+	ActorID   string `json:"actor_id"`
+	Limit     int    `json:"limit"`
+}
+
+// tailActorLogs returns the most recent messages that were logged for an actor, oldest
+// first.
+func (s *server) tailActorLogs(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req tailActorLogsRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	logs, activated, err := s.environment.TailActorLogs(ctx, req.Namespace, req.ActorID, req.Limit)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeTailActorLogsResponse(w, logs, activated)
+}
+
+// tailActorLogsDirect returns the most recent messages that were logged for an actor that
+// is activated on this server, see Environment.TailActorLogsDirect.
+func (s *server) tailActorLogsDirect(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req tailActorLogsDirectRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	logs, activated, err := s.environment.TailActorLogsDirect(req.ServerID, req.Namespace, req.ActorID, req.Limit)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeTailActorLogsResponse(w, logs, activated)
+}
+
+func writeTailActorLogsResponse(w http.ResponseWriter, logs []LogEntry, activated bool) {
+	if logs == nil {
+		logs = []LogEntry{}
+	}
+	marshaled, err := json.Marshal(tailActorLogsResponse{
+		Activated: activated,
+		Logs:      logs,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+// listServers returns the live servers in the cluster, ordered by ID.
+func (s *server) listServers(w http.ResponseWriter, r *http.Request) {
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	servers, err := s.registry.ListServers(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(servers)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+// listActivations returns the actors and workers that are activated on the server that
+// handled the request.
+func (s *server) listActivations(w http.ResponseWriter, r *http.Request) {
+	marshaled, err := json.Marshal(s.environment.ListActivations())
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+// describeActor returns the registry's record of the actor identified by the ns and id
+// query parameters, including the server it's currently activated on, if any, and the
+// size of its KV storage.
+func (s *server) describeActor(w http.ResponseWriter, r *http.Request) {
+	var (
+		query     = r.URL.Query()
+		namespace = query.Get("ns")
+		actorID   = query.Get("id")
+	)
+	if namespace == "" || actorID == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("ns and id query parameters are required"))
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	info, err := s.registry.DescribeActor(ctx, namespace, actorID)
+	if err != nil {
+		if registry.IsActorDoesNotExistErr(err) {
+			w.WriteHeader(404)
+		} else {
+			w.WriteHeader(500)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(info)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+type listModulesResponse struct {
+	Namespace string   `json:"namespace"`
+	ModuleIDs []string `json:"module_ids"`
+}
+
+// listModules returns the IDs of the modules registered in a namespace.
+func (s *server) listModules(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req namespaceRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	moduleIDs, err := s.registry.ListModules(ctx, req.Namespace)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(listModulesResponse{
+		Namespace: req.Namespace,
+		ModuleIDs: moduleIDs,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+// deleteModule deletes a module. It fails while actors that were created from it exist.
+func (s *server) deleteModule(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req describeModuleRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionManage) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	if err := s.registry.DeleteModule(ctx, req.Namespace, req.ModuleID); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type listActorsRequest struct {
+	Namespace string `json:"namespace"`
+	// After is the ID of the last actor of the previous page, the first page is returned
+	// if it's empty.
+	After string `json:"after,omitempty"`
+	// Limit is the maximum number of actor IDs to return, 1000 by default.
+	Limit int `json:"limit"`
+}
+
+type listActorsResponse struct {
+	Namespace string   `json:"namespace"`
+	ActorIDs  []string `json:"actor_ids"`
+}
+
+// listActors returns a page of the IDs of the actors in a namespace.
+func (s *server) listActors(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req listActorsRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+
+	if req.Limit == 0 {
+		req.Limit = 1000
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	actorIDs, err := s.registry.ListActors(ctx, req.Namespace, req.After, req.Limit)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(listActorsResponse{
+		Namespace: req.Namespace,
+		ActorIDs:  actorIDs,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+type actorRequest struct {
+	Namespace string `json:"namespace"`
+	ActorID   string `json:"actor_id"`
+}
+
+// deleteActor deletes an actor along with its KV storage, inbox and topic subscriptions.
+func (s *server) deleteActor(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req actorRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionManage) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cc()
+	if err := s.registry.DeleteActor(ctx, req.Namespace, req.ActorID); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+type actorKVRequest struct {
+	Namespace string `json:"namespace"`
+	ActorID   string `json:"actor_id"`
+	Key       []byte `json:"key"`
+	// Value is only used by put-actor-kv.
+	Value []byte `json:"value,omitempty"`
+}
+
+type getActorKVResponse struct {
+	Exists bool   `json:"exists"`
+	Value  []byte `json:"value,omitempty"`
+}
+
+// getActorKV reads a key from an actor's KV storage without invoking the actor.
+func (s *server) getActorKV(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req actorKVRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	value, ok, err := s.registry.GetActorKV(ctx, req.Namespace, req.ActorID, req.Key)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(getActorKVResponse{Exists: ok, Value: value})
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+// putActorKV writes a key to an actor's KV storage without invoking the actor. Same as
+// import-actor-kv, the write doesn't take the actor's activation into account so it's
+// only intended for debugging.
+func (s *server) putActorKV(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
 	}
-}
 
-// Start starts the server.
-func (s *server) Start(port int) error {
-	http.HandleFunc("/api/v1/register-module", s.registerModule)
-	http.HandleFunc("/api/v1/create-actor", s.createActor)
-	http.HandleFunc("/api/v1/invoke-actor", s.invoke)
-	http.HandleFunc("/api/v1/invoke-actor-direct", s.invokeDirect)
-	http.HandleFunc("/api/v1/invoke-worker", s.invokeWorker)
+	var req actorKVRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionManage) {
+		return
+	}
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-		return err
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	if err := s.registry.PutActorKV(ctx, req.Namespace, req.ActorID, req.Key, req.Value); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
-	return nil
+	w.WriteHeader(200)
 }
 
-// This one is a bit weird because its basically a file upload with some JSON
-// so we just shove the JSON into the headers cause I'm lazy to do anything
-// more clever.
-func (s *server) registerModule(w http.ResponseWriter, r *http.Request) {
-	var (
-		namespace = r.Header.Get("namespace")
-		moduleID  = r.Header.Get("module_id")
-	)
+type scanActorKVRequest struct {
+	Namespace string `json:"namespace"`
+	ActorID   string `json:"actor_id"`
+	// Prefix limits the scan to the keys that start with it. Every key is scanned if
+	// it's empty.
+	Prefix []byte `json:"prefix,omitempty"`
+	// Limit is the maximum number of key/value pairs to return, 100 by default.
+	Limit int `json:"limit"`
+}
+
+type scanActorKVResponse struct {
+	KVs []registry.ActorKV `json:"kvs"`
+}
 
-	moduleBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+// scanActorKV returns the key/value pairs in an actor's KV storage, ordered by key.
+func (s *server) scanActorKV(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	ctx, cc := context.WithTimeout(context.Background(), 60*time.Second)
+	var req scanActorKVRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = 100
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cc()
-	result, err := s.registry.RegisterModule(ctx, namespace, moduleID, moduleBytes, registry.ModuleOptions{})
+	kvs, err := s.registry.ScanActorKV(ctx, req.Namespace, req.ActorID, req.Prefix, req.Limit)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	marshaled, err := json.Marshal(result)
+	marshaled, err := json.Marshal(scanActorKVResponse{KVs: kvs})
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
@@ -101,6 +1046,9 @@ func (s *server) createActor(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if !s.authorize(w, r, req.Namespace, AuthActionManage) {
+		return
+	}
 
 	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cc()
@@ -145,6 +1093,9 @@ func (s *server) invoke(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if !s.authorize(w, r, req.Namespace, AuthActionInvoke) {
+		return
+	}
 
 	if len(req.Payload) == 0 && req.PayloadJSON != nil {
 		marshaled, err := json.Marshal(req.PayloadJSON)
@@ -159,11 +1110,11 @@ func (s *server) invoke(w http.ResponseWriter, r *http.Request) {
 	// TODO: This should be configurable, probably in a header with some maximum.
 	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cc()
+	ctx = withRequestTraceparent(ctx, r)
 	result, err := s.environment.InvokeActor(
-		ctx, req.Namespace, req.ActorID, req.Operation, req.Payload, req.CreateIfNotExist)
+		ctx, req.Namespace, req.ActorID, req.Operation, req.Payload, req.CreateIfNotExist, req.IdempotencyKey)
 	if err != nil {
-		w.WriteHeader(500)
-		w.Write([]byte(err.Error()))
+		writeInvocationError(w, err)
 		return
 	}
 
@@ -171,6 +1122,51 @@ func (s *server) invoke(w http.ResponseWriter, r *http.Request) {
 	w.Write(result)
 }
 
+// invokeStream is the same as invoke, except the result is streamed back to the caller
+// as NDJSON-encoded streamFrames as the actor emits them.
+func (s *server) invokeStream(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req invokeActorRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionInvoke) {
+		return
+	}
+
+	if len(req.Payload) == 0 && req.PayloadJSON != nil {
+		marshaled, err := json.Marshal(req.PayloadJSON)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		req.Payload = marshaled
+	}
+
+	// TODO: This should be configurable, probably in a header with some maximum.
+	ctx, cc := context.WithTimeout(r.Context(), streamTimeout)
+	defer cc()
+	ctx = withRequestTraceparent(ctx, r)
+	stream, err := s.environment.InvokeActorStream(
+		ctx, req.Namespace, req.ActorID, req.Operation, req.Payload, req.CreateIfNotExist)
+	if err != nil {
+		writeInvocationError(w, err)
+		return
+	}
+	defer stream.Close()
+
+	writeStream(w, stream)
+}
+
 type invokeActorDirectRequest struct {
 	VersionStamp  int64  `json:"version_stamp"`
 	ServerID      string `json:"server_id"`
@@ -181,6 +1177,11 @@ type invokeActorDirectRequest struct {
 	Generation    uint64 `json:"generation"`
 	Operation     string `json:"operation"`
 	Payload       []byte `json:"payload"`
+	// IdempotencyKey is forwarded from the original invocation, see
+	// Environment.InvokeActor().
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// Traceparent is the W3C trace context of the original invocation, if any.
+	Traceparent string `json:"traceparent,omitempty"`
 }
 
 func (s *server) invokeDirect(w http.ResponseWriter, r *http.Request) {
@@ -201,6 +1202,7 @@ func (s *server) invokeDirect(w http.ResponseWriter, r *http.Request) {
 	// TODO: This should be configurable, probably in a header with some maximum.
 	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cc()
+	ctx = withTraceparent(ctx, req.Traceparent)
 
 	ref, err := types.NewVirtualActorReference(req.Namespace, req.ModuleID, req.ActorID, uint64(req.Generation))
 	if err != nil {
@@ -209,15 +1211,80 @@ func (s *server) invokeDirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := s.environment.InvokeActorDirect(ctx, req.VersionStamp, req.ServerID, req.ServerVersion, ref, req.Operation, req.Payload)
+	result, err := s.environment.InvokeActorDirect(
+		ctx, req.VersionStamp, req.ServerID, req.ServerVersion, ref, req.Operation, req.Payload, req.IdempotencyKey)
+	if err != nil {
+		writeInvocationError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(result)
+}
+
+func (s *server) invokeDirectStream(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req invokeActorDirectRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// TODO: This should be configurable, probably in a header with some maximum.
+	ctx, cc := context.WithTimeout(r.Context(), streamTimeout)
+	defer cc()
+	ctx = withTraceparent(ctx, req.Traceparent)
+
+	ref, err := types.NewVirtualActorReference(req.Namespace, req.ModuleID, req.ActorID, uint64(req.Generation))
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
+	stream, err := s.environment.InvokeActorDirectStream(ctx, req.VersionStamp, req.ServerID, req.ServerVersion, ref, req.Operation, req.Payload)
+	if err != nil {
+		writeInvocationError(w, err)
+		return
+	}
+	defer stream.Close()
+
+	writeStream(w, stream)
+}
+
+// writeStream writes every chunk from the stream to w as an NDJSON-encoded streamFrame,
+// flushing after each one so the caller receives chunks as soon as they're emitted. The
+// status code has already been sent by the time an error is encountered so errors are
+// reported in the final frame instead, which also tells the caller whether the
+// invocation was committed.
+func writeStream(w http.ResponseWriter, stream InvokeStream) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
 	w.WriteHeader(200)
-	w.Write(result)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for stream.Next() {
+		if err := enc.Encode(streamFrame{Payload: stream.Chunk()}); err != nil {
+			// Caller went away, nothing else we can do.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		enc.Encode(streamFrame{Error: err.Error(), Done: true})
+	} else {
+		enc.Encode(streamFrame{Done: true, Committed: stream.Committed()})
+	}
 }
 
 type invokeWorkerRequest struct {
@@ -243,18 +1310,252 @@ func (s *server) invokeWorker(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if !s.authorize(w, r, req.Namespace, AuthActionInvoke) {
+		return
+	}
 
 	// TODO: This should be configurable, probably in a header with some maximum.
 	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cc()
+	ctx = withRequestTraceparent(ctx, r)
 
 	result, err := s.environment.InvokeWorker(ctx, req.Namespace, req.ModuleID, req.Operation, req.Payload)
 	if err != nil {
+		writeInvocationError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(result)
+}
+
+type publishRequest struct {
+	Namespace string `json:"namespace"`
+	wapcutils.PublishRequest
+	// Same data as Payload (in wapcutils.PublishRequest), but different field so it doesn't
+	// have to be encoded as base64.
+	PayloadJSON interface{} `json:"payload_json"`
+}
+
+func (s *server) publish(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<24))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req publishRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionInvoke) {
+		return
+	}
+
+	if len(req.Payload) == 0 && req.PayloadJSON != nil {
+		marshaled, err := json.Marshal(req.PayloadJSON)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		req.Payload = marshaled
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cc()
+	ctx = withRequestTraceparent(ctx, r)
+	if err := s.environment.Publish(ctx, req.Namespace, req.Topic, req.Payload); err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
 	w.WriteHeader(200)
-	w.Write(result)
+}
+
+type watchActorKVRequest struct {
+	Namespace string `json:"namespace"`
+	ActorID   string `json:"actor_id"`
+	Prefix    []byte `json:"prefix"`
+	// AfterVersion is optional, if it is omitted then the Last-Event-ID header is used
+	// instead (if present) so that SSE clients can resume automatically.
+	AfterVersion []byte `json:"after_version"`
+}
+
+// watchActorKV streams every change committed to the actor's KV storage (for keys with
+// the provided prefix) to the caller as server-sent events until the caller disconnects.
+// Each event's ID is the base64 encoded version of the change.
+//
+// The request is read from the namespace, actor_id and prefix query parameters for GET
+// requests since that's the only kind of request browsers' EventSource can make, and
+// from the JSON body otherwise.
+func (s *server) watchActorKV(w http.ResponseWriter, r *http.Request) {
+	var (
+		req watchActorKVRequest
+		err error
+	)
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		req.Namespace = query.Get("namespace")
+		req.ActorID = query.Get("actor_id")
+		if prefix := query.Get("prefix"); prefix != "" {
+			req.Prefix = []byte(prefix)
+		}
+		if req.Namespace == "" || req.ActorID == "" {
+			w.WriteHeader(400)
+			w.Write([]byte("namespace and actor_id query parameters are required"))
+			return
+		}
+	} else {
+		jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err := json.Unmarshal(jsonBytes, &req); err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+	if len(req.AfterVersion) == 0 {
+		if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+			req.AfterVersion, err = base64.StdEncoding.DecodeString(lastEventID)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(fmt.Sprintf("error decoding Last-Event-ID: %v", err)))
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	var (
+		ctx          = r.Context()
+		afterVersion = req.AfterVersion
+	)
+	for {
+		changes, err := s.registry.WatchActorKV(ctx, req.Namespace, req.ActorID, req.Prefix, afterVersion)
+		if err != nil {
+			// The status code has already been sent so report the error as an event
+			// instead. If the caller went away then this is a no-op.
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(err.Error(), "\n", " "))
+			return
+		}
+
+		for _, change := range changes {
+			marshaled, err := json.Marshal(&change)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(
+				w, "id: %s\ndata: %s\n\n",
+				base64.StdEncoding.EncodeToString(change.Version), marshaled)
+			if err != nil {
+				return
+			}
+			afterVersion = change.Version
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+type exportActorKVRequest struct {
+	Namespace string `json:"namespace"`
+	// ActorID is optional, if it is omitted then every actor in the namespace is exported.
+	ActorID string `json:"actor_id"`
+}
+
+// exportActorKV streams an export of the KV storage of a single actor, or of every actor
+// in a namespace, to the caller. The export can be passed to importActorKV as-is.
+func (s *server) exportActorKV(w http.ResponseWriter, r *http.Request) {
+	jsonBytes, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var req exportActorKVRequest
+	if err := json.Unmarshal(jsonBytes, &req); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !s.authorize(w, r, req.Namespace, AuthActionRead) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	tw := &trackingWriter{w: w}
+	if req.ActorID != "" {
+		err = s.registry.ExportActorKV(r.Context(), req.Namespace, req.ActorID, tw)
+	} else {
+		err = s.registry.ExportNamespaceKV(r.Context(), req.Namespace, tw)
+	}
+	if err != nil && !tw.wrote {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// If the export failed after some of it was already written then there is no way to
+	// change the status code. The export will be missing its footer so importing it will
+	// fail.
+}
+
+// Similar to registerModule, the namespace is passed as a header so the body can be the
+// export itself.
+func (s *server) importActorKV(w http.ResponseWriter, r *http.Request) {
+	namespace := r.Header.Get("namespace")
+	if !s.authorize(w, r, namespace, AuthActionManage) {
+		return
+	}
+
+	ctx, cc := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cc()
+	result, err := s.registry.ImportActorKV(ctx, namespace, r.Body)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	marshaled, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(marshaled)
+}
+
+// trackingWriter wraps an io.Writer and keeps track of whether anything has been
+// written to it yet.
+type trackingWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (t *trackingWriter) Write(b []byte) (int, error) {
+	t.wrote = true
+	return t.w.Write(b)
 }
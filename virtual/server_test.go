@@ -1,3 +1,576 @@
 package virtual
 
-// TODO: Write tests. For now we have some basic smoke tests via `make run-playground`.
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestServerAuth tests that requests to the public API are authenticated and authorized
+// per namespace.
+func TestServerAuth(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	for _, ns := range []string{"ns-1", "ns-2"} {
+		_, err = reg.RegisterModule(ctx, ns, "test-module", utilWasmBytes, registry.ModuleOptions{})
+		require.NoError(t, err)
+	}
+
+	hmacSecret := []byte("hmac-secret")
+	s := NewServer(reg, env, ServerOptions{
+		Auth: AuthOptions{
+			Authenticators: []Authenticator{
+				NewStaticTokenAuthenticator(map[string]string{"alice-token": "alice"}),
+				NewHMACAuthenticator(map[string][]byte{"bob": hmacSecret}),
+			},
+			Rules: []AuthorizationRule{
+				{Principal: "alice", Namespace: "ns-1", Actions: []string{AuthActionManage, AuthActionInvoke}},
+				{Principal: "bob", Namespace: AuthWildcard, Actions: []string{AuthWildcard}},
+			},
+		},
+		InternalToken: "internal-token",
+	})
+	server := httptest.NewServer(s.publicHandler())
+	defer server.Close()
+
+	do := func(path string, body any, setAuth func(r *http.Request, body []byte)) (int, string) {
+		marshaled, err := json.Marshal(body)
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", server.URL+path, bytes.NewReader(marshaled))
+		require.NoError(t, err)
+		if setAuth != nil {
+			setAuth(req, marshaled)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(respBody)
+	}
+	bearer := func(token string) func(r *http.Request, body []byte) {
+		return func(r *http.Request, body []byte) {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	createActor := func(ns, actorID string) createActorRequest {
+		return createActorRequest{Namespace: ns, ActorID: actorID, ModuleID: "test-module"}
+	}
+
+	// Unauthenticated requests are rejected.
+	status, _ := do("/api/v1/create-actor", createActor("ns-1", "a"), nil)
+	require.Equal(t, 401, status)
+	status, _ = do("/api/v1/create-actor", createActor("ns-1", "a"), bearer("wrong-token"))
+	require.Equal(t, 401, status)
+
+	// Principals can only perform the actions they're allowed to in each namespace.
+	status, body := do("/api/v1/create-actor", createActor("ns-1", "a"), bearer("alice-token"))
+	require.Equal(t, 200, status, body)
+	status, _ = do("/api/v1/create-actor", createActor("ns-2", "a"), bearer("alice-token"))
+	require.Equal(t, 403, status)
+	status, _ = do(
+		"/api/v1/describe-module",
+		describeModuleRequest{Namespace: "ns-1", ModuleID: "test-module"},
+		bearer("alice-token"))
+	require.Equal(t, 403, status)
+	status, _ = do("/debug/pprof/", nil, bearer("alice-token"))
+	require.Equal(t, 403, status)
+
+	// HMAC-signed requests are authenticated, and the signature covers the body.
+	sign := func(r *http.Request, body []byte) {
+		SignHTTPRequest(r, "bob", hmacSecret, body)
+	}
+	status, body = do("/api/v1/create-actor", createActor("ns-2", "a"), sign)
+	require.Equal(t, 200, status, body)
+	status, _ = do("/api/v1/create-actor", createActor("ns-2", "b"), func(r *http.Request, body []byte) {
+		SignHTTPRequest(r, "bob", hmacSecret, []byte("some other body"))
+	})
+	require.Equal(t, 401, status)
+	status, _ = do("/api/v1/create-actor", createActor("ns-2", "b"), func(r *http.Request, body []byte) {
+		SignHTTPRequest(r, "bob", []byte("wrong-secret"), body)
+	})
+	require.Equal(t, 401, status)
+
+	// The internal endpoints require the internal token instead of user credentials.
+	status, _ = do("/api/v1/invoke-actor-direct", invokeActorDirectRequest{}, bearer("alice-token"))
+	require.Equal(t, 401, status)
+	status, _ = do("/api/v1/invoke-actor-direct", invokeActorDirectRequest{}, func(r *http.Request, body []byte) {
+		r.Header.Set(internalTokenHeader, "internal-token")
+	})
+	require.Equal(t, 500, status)
+}
+
+// TestServerInternalListener tests that the internal endpoints are only served by the
+// internal listener when one is configured.
+func TestServerInternalListener(t *testing.T) {
+	s := NewServer(nil, nil, ServerOptions{InternalPort: 9091, InternalToken: "internal-token"})
+	public := httptest.NewServer(s.publicHandler())
+	defer public.Close()
+	internal := httptest.NewServer(s.internalHandler())
+	defer internal.Close()
+
+	post := func(url, token string) int {
+		req, err := http.NewRequest("POST", url+"/api/v1/invoke-actor-direct", bytes.NewReader([]byte("{")))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set(internalTokenHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, 404, post(public.URL, "internal-token"))
+	require.Equal(t, 401, post(internal.URL, ""))
+	require.Equal(t, 401, post(internal.URL, "wrong-token"))
+	// Passes authentication, but the body is invalid.
+	require.Equal(t, 500, post(internal.URL, "internal-token"))
+}
+
+// TestServerNamespaces tests the namespace management and usage endpoints.
+func TestServerNamespaces(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	s := NewServer(reg, nil, ServerOptions{
+		Auth: AuthOptions{
+			Authenticators: []Authenticator{
+				NewStaticTokenAuthenticator(map[string]string{"admin-token": "admin", "alice-token": "alice"}),
+			},
+			Rules: []AuthorizationRule{
+				{Principal: "admin", Namespace: AuthWildcard, Actions: []string{AuthWildcard}},
+				{Principal: "alice", Namespace: "ns-1", Actions: []string{AuthActionRead, AuthActionManage}},
+			},
+		},
+		InternalToken: "internal-token",
+	})
+	server := httptest.NewServer(s.publicHandler())
+	defer server.Close()
+
+	do := func(path, token string, body any) (int, []byte) {
+		marshaled, err := json.Marshal(body)
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", server.URL+path, bytes.NewReader(marshaled))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, respBody
+	}
+
+	quotas := registry.NamespaceQuotas{MaxActors: 10, MaxInvocationsPerSecond: 100}
+	create := putNamespaceRequest{Namespace: "ns-1", Opts: registry.NamespaceOptions{Quotas: quotas}}
+	// Only admins can manage namespaces since they contain the quotas.
+	status, _ := do("/api/v1/create-namespace", "alice-token", create)
+	require.Equal(t, 403, status)
+	status, body := do("/api/v1/create-namespace", "admin-token", create)
+	require.Equal(t, 200, status, string(body))
+
+	ctx := context.Background()
+	_, err := reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	status, body = do("/api/v1/namespace-usage", "alice-token", namespaceRequest{Namespace: "ns-1"})
+	require.Equal(t, 200, status, string(body))
+	var usage namespaceUsageResponse
+	require.NoError(t, json.Unmarshal(body, &usage))
+	require.Equal(t, namespaceUsageResponse{
+		Namespace: "ns-1",
+		Quotas:    quotas,
+		Usage:     registry.NamespaceUsage{NumModules: 1, ModuleBytes: int64(len(utilWasmBytes))},
+	}, usage)
+	status, _ = do("/api/v1/namespace-usage", "alice-token", namespaceRequest{Namespace: "ns-2"})
+	require.Equal(t, 403, status)
+
+	status, _ = do("/api/v1/list-namespaces", "alice-token", nil)
+	require.Equal(t, 403, status)
+	status, body = do("/api/v1/list-namespaces", "admin-token", nil)
+	require.Equal(t, 200, status, string(body))
+	var namespaces []registry.NamespaceInfo
+	require.NoError(t, json.Unmarshal(body, &namespaces))
+	require.Equal(t, []registry.NamespaceInfo{{Namespace: "ns-1", Opts: create.Opts}}, namespaces)
+
+	status, body = do("/api/v1/delete-namespace", "admin-token", namespaceRequest{Namespace: "ns-1"})
+	require.Equal(t, 200, status, string(body))
+	_, _, err = reg.GetModule(ctx, "ns-1", "test-module")
+	require.Error(t, err)
+}
+
+// TestServerRateLimitedInvocation tests that rate limited invocations are returned as a
+// 429 with a Retry-After header, and that the HTTP client preserves the hint.
+func TestServerRateLimitedInvocation(t *testing.T) {
+	rateLimitedErr := &RateLimitedError{RetryAfter: 1500 * time.Millisecond, err: errors.New("rate limited")}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeInvocationError(w, fmt.Errorf("error invoking actor: %w", rateLimitedErr))
+	}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "2", resp.Header.Get("Retry-After"))
+
+	client, err := NewHTTPClient(HTTPClientOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewActorReference(
+		"serverID1", 0, strings.TrimPrefix(server.URL, "http://"), "ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	_, err = client.InvokeActorRemote(context.Background(), 0, ref, "inc", nil, "")
+	retryAfter, ok := IsRateLimitedErr(err)
+	require.True(t, ok, err)
+	require.Equal(t, 2*time.Second, retryAfter)
+}
+
+// TestServerTraceparent tests that the traceparent header of API requests is honored, and
+// that the HTTP client forwards the trace context to the server it invokes.
+func TestServerTraceparent(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	exporter := &testSpanExporter{}
+	opts := defaultOptsWASM
+	opts.TraceExporter = exporter
+
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, opts)
+	require.NoError(t, err)
+	defer env.Close()
+	_, err = reg.RegisterModule(context.Background(), "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(NewServer(reg, env, ServerOptions{}).publicHandler())
+	defer server.Close()
+
+	marshaled, err := json.Marshal(invokeActorRequest{
+		Namespace: "ns-1",
+		InvokeActorRequest: types.InvokeActorRequest{
+			ActorID:          "a",
+			Operation:        "inc",
+			CreateIfNotExist: types.CreateIfNotExist{ModuleID: "test-module"},
+		},
+	})
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", server.URL+"/api/v1/invoke-actor", bytes.NewReader(marshaled))
+	require.NoError(t, err)
+	req.Header.Set(tracing.TraceparentHeader, traceparent)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+
+	spans := exporter.getSpans()
+	require.NotEmpty(t, spans)
+	for _, span := range spans {
+		require.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.TraceID)
+	}
+
+	// The HTTP client forwards the trace context of the invocation.
+	received := make(chan string, 1)
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ir invokeActorDirectRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&ir))
+		received <- ir.Traceparent
+	}))
+	defer direct.Close()
+
+	client, err := NewHTTPClient(HTTPClientOptions{})
+	require.NoError(t, err)
+	ref, err := types.NewActorReference(
+		"serverID2", 0, strings.TrimPrefix(direct.URL, "http://"), "ns-1", "test-module", "a", 1)
+	require.NoError(t, err)
+	sc, err := tracing.ParseTraceparent(traceparent)
+	require.NoError(t, err)
+	ctx := tracing.ContextWithRemoteSpanContext(context.Background(), sc)
+	_, err = client.InvokeActorRemote(ctx, 0, ref, "inc", nil, "")
+	require.NoError(t, err)
+	require.Equal(t, traceparent, <-received)
+}
+
+// TestServerAdminEndpoints tests the admin endpoints that introspect the cluster's servers,
+// the server's activations and the registry's actors.
+func TestServerAdminEndpoints(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	_, err = reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	_, err = env.InvokeActor(
+		ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+	require.NoError(t, err)
+	_, err = env.InvokeActor(ctx, "ns-1", "a", "kvPutCount", []byte("key"), types.CreateIfNotExist{}, "")
+	require.NoError(t, err)
+
+	s := NewServer(reg, env, ServerOptions{
+		Auth: AuthOptions{
+			Authenticators: []Authenticator{
+				NewStaticTokenAuthenticator(map[string]string{"admin-token": "admin", "alice-token": "alice"}),
+			},
+			Rules: []AuthorizationRule{
+				{Principal: "admin", Namespace: AuthWildcard, Actions: []string{AuthWildcard}},
+				{Principal: "alice", Namespace: "ns-1", Actions: []string{AuthWildcard}},
+			},
+		},
+	})
+	server := httptest.NewServer(s.publicHandler())
+	defer server.Close()
+
+	get := func(path, token string) (int, []byte) {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, body
+	}
+
+	// Only admins can introspect the cluster, even if they have every action in a
+	// namespace.
+	for _, path := range []string{
+		"/api/v1/admin/servers",
+		"/api/v1/admin/activations",
+		"/api/v1/admin/actor?ns=ns-1&id=a",
+	} {
+		status, _ := get(path, "alice-token")
+		require.Equal(t, 403, status, path)
+	}
+
+	status, body := get("/api/v1/admin/servers", "admin-token")
+	require.Equal(t, 200, status, string(body))
+	var servers []registry.ServerInfo
+	require.NoError(t, json.Unmarshal(body, &servers))
+	require.Equal(t, 1, len(servers))
+	require.Equal(t, "serverID1", servers[0].ServerID)
+
+	status, body = get("/api/v1/admin/activations", "admin-token")
+	require.Equal(t, 200, status, string(body))
+	var activations []ActivationInfo
+	require.NoError(t, json.Unmarshal(body, &activations))
+	require.Equal(t, 1, len(activations))
+	require.Equal(t, "ns-1", activations[0].Namespace)
+	require.Equal(t, "a", activations[0].ActorID)
+	require.Equal(t, "test-module", activations[0].ModuleID)
+	require.Equal(t, int64(0), activations[0].QueueDepth)
+
+	status, body = get("/api/v1/admin/actor?ns=ns-1&id=a", "admin-token")
+	require.Equal(t, 200, status, string(body))
+	var info registry.ActorInfo
+	require.NoError(t, json.Unmarshal(body, &info))
+	require.Equal(t, "test-module", info.ModuleID)
+	require.NotNil(t, info.Activation)
+	require.Equal(t, "serverID1", info.Activation.ServerID)
+	require.True(t, info.KVBytes > 0)
+
+	status, _ = get("/api/v1/admin/actor?ns=ns-1&id=does-not-exist", "admin-token")
+	require.Equal(t, 404, status)
+	status, _ = get("/api/v1/admin/actor?ns=ns-1", "admin-token")
+	require.Equal(t, 400, status)
+}
+
+// TestServerModuleAndActorManagement tests the endpoints for listing and deleting modules
+// and actors and for accessing actors' KV storage directly.
+func TestServerModuleAndActorManagement(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	s := NewServer(reg, nil, ServerOptions{
+		Auth: AuthOptions{
+			Authenticators: []Authenticator{
+				NewStaticTokenAuthenticator(map[string]string{"alice-token": "alice", "bob-token": "bob"}),
+			},
+			Rules: []AuthorizationRule{
+				{Principal: "alice", Namespace: "ns-1", Actions: []string{AuthActionRead, AuthActionManage}},
+				{Principal: "bob", Namespace: "ns-1", Actions: []string{AuthActionRead}},
+			},
+		},
+	})
+	server := httptest.NewServer(s.publicHandler())
+	defer server.Close()
+
+	do := func(path, token string, body any) (int, []byte) {
+		marshaled, err := json.Marshal(body)
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", server.URL+path, bytes.NewReader(marshaled))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, respBody
+	}
+
+	ctx := context.Background()
+	_, err := reg.RegisterModule(ctx, "ns-1", "test-module", utilWasmBytes, registry.ModuleOptions{})
+	require.NoError(t, err)
+	for _, actorID := range []string{"a", "b"} {
+		_, err = reg.CreateActor(ctx, "ns-1", actorID, "test-module", types.ActorOptions{})
+		require.NoError(t, err)
+	}
+
+	status, body := do("/api/v1/list-modules", "bob-token", namespaceRequest{Namespace: "ns-1"})
+	require.Equal(t, 200, status, string(body))
+	require.JSONEq(t, `{"namespace":"ns-1","module_ids":["test-module"]}`, string(body))
+	status, body = do("/api/v1/list-actors", "bob-token", namespaceRequest{Namespace: "ns-1"})
+	require.Equal(t, 200, status, string(body))
+	require.JSONEq(t, `{"namespace":"ns-1","actor_ids":["a","b"]}`, string(body))
+
+	// Writing requires the manage action, reading only requires the read action.
+	put := actorKVRequest{Namespace: "ns-1", ActorID: "a", Key: []byte("key"), Value: []byte("value")}
+	status, _ = do("/api/v1/put-actor-kv", "bob-token", put)
+	require.Equal(t, 403, status)
+	status, body = do("/api/v1/put-actor-kv", "alice-token", put)
+	require.Equal(t, 200, status, string(body))
+
+	status, body = do("/api/v1/get-actor-kv", "bob-token", actorKVRequest{
+		Namespace: "ns-1", ActorID: "a", Key: []byte("key")})
+	require.Equal(t, 200, status, string(body))
+	var getResp getActorKVResponse
+	require.NoError(t, json.Unmarshal(body, &getResp))
+	require.Equal(t, getActorKVResponse{Exists: true, Value: []byte("value")}, getResp)
+
+	status, body = do("/api/v1/scan-actor-kv", "bob-token", scanActorKVRequest{Namespace: "ns-1", ActorID: "a"})
+	require.Equal(t, 200, status, string(body))
+	var scanResp scanActorKVResponse
+	require.NoError(t, json.Unmarshal(body, &scanResp))
+	require.Equal(t, []registry.ActorKV{{Key: []byte("key"), Value: []byte("value")}}, scanResp.KVs)
+
+	status, _ = do("/api/v1/delete-actor", "bob-token", actorRequest{Namespace: "ns-1", ActorID: "a"})
+	require.Equal(t, 403, status)
+	status, body = do("/api/v1/delete-actor", "alice-token", actorRequest{Namespace: "ns-1", ActorID: "a"})
+	require.Equal(t, 200, status, string(body))
+	actorIDs, err := reg.ListActors(ctx, "ns-1", "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, actorIDs)
+
+	deleteModule := describeModuleRequest{Namespace: "ns-1", ModuleID: "test-module"}
+	status, _ = do("/api/v1/delete-module", "bob-token", deleteModule)
+	require.Equal(t, 403, status)
+	status, body = do("/api/v1/delete-module", "alice-token", deleteModule)
+	require.Equal(t, 500, status)
+	require.Contains(t, string(body), "used by 1 actors")
+	status, body = do("/api/v1/delete-actor", "alice-token", actorRequest{Namespace: "ns-1", ActorID: "b"})
+	require.Equal(t, 200, status, string(body))
+	status, body = do("/api/v1/delete-module", "alice-token", deleteModule)
+	require.Equal(t, 200, status, string(body))
+	moduleIDs, err := reg.ListModules(ctx, "ns-1")
+	require.NoError(t, err)
+	require.Empty(t, moduleIDs)
+}
+
+func TestServerOptionsValidate(t *testing.T) {
+	auth := AuthOptions{
+		Authenticators: []Authenticator{NewStaticTokenAuthenticator(map[string]string{"token": "alice"})},
+	}
+	require.NoError(t, (&ServerOptions{}).Validate())
+	require.Error(t, (&ServerOptions{Auth: auth}).Validate())
+	require.NoError(t, (&ServerOptions{Auth: auth, InternalToken: "token"}).Validate())
+	require.Error(t, (&ServerOptions{Auth: auth, InternalPort: 9091}).Validate())
+
+	auth.Rules = []AuthorizationRule{{Principal: "alice", Namespace: "ns-1", Actions: []string{"unknown"}}}
+	require.Error(t, (&ServerOptions{Auth: auth, InternalToken: "token"}).Validate())
+}
+
+func TestHMACAuthenticatorClockSkew(t *testing.T) {
+	secret := []byte("secret")
+	authenticator := NewHMACAuthenticator(map[string][]byte{"key": secret}).(*hmacAuthenticator)
+
+	req := httptest.NewRequest("POST", "/api/v1/invoke-actor", bytes.NewReader([]byte("body")))
+	SignHTTPRequest(req, "key", secret, []byte("body"))
+	principal, err := authenticator.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "key", principal)
+
+	// The body can still be read by the handler.
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, "body", string(body))
+
+	// The query string and the headers that endpoints take arguments from are signed.
+	req = httptest.NewRequest("POST", "/api/v1/admin/actor?ns=ns-1&id=a", bytes.NewReader([]byte("body")))
+	req.Header.Set("namespace", "ns-1")
+	SignHTTPRequest(req, "key", secret, []byte("body"))
+	_, err = authenticator.Authenticate(req)
+	require.NoError(t, err)
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte("body")))
+	req.URL.RawQuery = "ns=ns-2&id=a"
+	_, err = authenticator.Authenticate(req)
+	require.Error(t, err)
+	req.URL.RawQuery = "id=a&ns=ns-1"
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte("body")))
+	_, err = authenticator.Authenticate(req)
+	require.NoError(t, err)
+	req.Header.Set("namespace", "ns-2")
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte("body")))
+	_, err = authenticator.Authenticate(req)
+	require.Error(t, err)
+
+	authenticator.now = func() time.Time { return time.Now().Add(time.Hour) }
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte("body")))
+	_, err = authenticator.Authenticate(req)
+	require.Error(t, err)
+}
+
+func TestHMACAuthenticatorLargeBody(t *testing.T) {
+	secret := []byte("secret")
+	authenticator := NewHMACAuthenticator(map[string][]byte{"key": secret})
+
+	// Bodies that are too large to buffer are verified as they're read.
+	body := bytes.Repeat([]byte("a"), 3*hmacMaxBufferedBodySize)
+	req := httptest.NewRequest("POST", "/api/v1/register-module", bytes.NewReader(body))
+	SignHTTPRequest(req, "key", secret, body)
+	_, err := authenticator.Authenticate(req)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, body, read)
+
+	tampered := append([]byte(nil), body...)
+	tampered[len(tampered)-1] = 'b'
+	req = httptest.NewRequest("POST", "/api/v1/register-module", bytes.NewReader(tampered))
+	SignHTTPRequest(req, "key", secret, body)
+	_, err = authenticator.Authenticate(req)
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(req.Body)
+	require.Error(t, err)
+}
+
+func TestMTLSAuthenticator(t *testing.T) {
+	authenticator := NewMTLSAuthenticator()
+
+	req := httptest.NewRequest("POST", "/api/v1/invoke-actor", nil)
+	_, err := authenticator.Authenticate(req)
+	require.ErrorIs(t, err, errNoCredentials)
+
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+		{Subject: pkix.Name{CommonName: "alice"}},
+	}}}
+	principal, err := authenticator.Authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, "alice", principal)
+}
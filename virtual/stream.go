@@ -0,0 +1,132 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/richardartoul/nola/virtual/registry"
+)
+
+var errStreamClosed = errors.New("stream closed by consumer")
+
+// streamFrame is the JSON struct that is used to encode streaming invocation results
+// over HTTP. Each frame is encoded on its own line (NDJSON) and the stream is always
+// terminated with a trailer frame that has Done set to true. The trailer has Committed
+// set to true if the invocation completed successfully, otherwise the invocation was
+// aborted (and its writes rolled back) and Error describes why.
+type streamFrame struct {
+	Payload   []byte `json:"payload,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Done      bool   `json:"done,omitempty"`
+	Committed bool   `json:"committed,omitempty"`
+}
+
+// chanStream implements InvokeStream for invocations that are running in the current
+// process by running the invocation in a background goroutine and handing each chunk
+// to the consumer over an unbuffered channel. This means that a slow consumer will
+// apply backpressure to the actor.
+type chanStream struct {
+	ch        chan []byte
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	// Only safe to access once ch has been closed.
+	err error
+
+	// Only accessed by the consumer.
+	curr     []byte
+	finished bool
+}
+
+func newChanStream(
+	ctx context.Context,
+	fn func(emit func(chunk []byte) error) error,
+) InvokeStream {
+	s := &chanStream{
+		ch:      make(chan []byte),
+		closeCh: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.ch)
+		s.err = fn(func(chunk []byte) error {
+			// Copy the chunk since the producer is allowed to reuse it (and WASM
+			// actors will reuse their memory).
+			chunk = append([]byte(nil), chunk...)
+			select {
+			case s.ch <- chunk:
+				return nil
+			case <-s.closeCh:
+				return errStreamClosed
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return s
+}
+
+func (s *chanStream) Next() bool {
+	if s.finished {
+		return false
+	}
+	chunk, ok := <-s.ch
+	if !ok {
+		s.curr = nil
+		s.finished = true
+		return false
+	}
+	s.curr = chunk
+	return true
+}
+
+func (s *chanStream) Chunk() []byte {
+	return s.curr
+}
+
+func (s *chanStream) Err() error {
+	if !s.finished {
+		return nil
+	}
+	return s.err
+}
+
+func (s *chanStream) Committed() bool {
+	return s.finished && s.err == nil
+}
+
+func (s *chanStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+	// Wait for the producer to complete so that callers can be certain the invocation
+	// (and its transaction) is no longer running once Close() returns.
+	for range s.ch {
+	}
+	s.finished = true
+	return nil
+}
+
+// invokeActorStream invokes the provided actor in streaming mode, falling back to a
+// regular invocation with a single chunk if the actor does not implement StreamingActor.
+func invokeActorStream(
+	ctx context.Context,
+	actor Actor,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+	emit func(chunk []byte) error,
+) error {
+	if streamer, ok := actor.(StreamingActor); ok {
+		return streamer.InvokeStream(ctx, operation, payload, transaction, emit)
+	}
+
+	result, err := actor.Invoke(ctx, operation, payload, transaction)
+	if err != nil {
+		return err
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return emit(result)
+}
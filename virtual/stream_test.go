@@ -0,0 +1,283 @@
+package virtual
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestStreamHTTPRoundtrip tests that streams encoded by writeStream() can be decoded by
+// the httpStream implementation used by the HTTP client, including errors and whether the
+// invocation committed.
+func TestStreamHTTPRoundtrip(t *testing.T) {
+	for _, streamErr := range []error{nil, errors.New("some fake error")} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			stream := newChanStream(r.Context(), func(emit func(chunk []byte) error) error {
+				for _, chunk := range []string{"a", "b\n", "c"} {
+					if err := emit([]byte(chunk)); err != nil {
+						return err
+					}
+				}
+				return streamErr
+			})
+			defer stream.Close()
+			writeStream(w, stream)
+		}))
+
+		resp, err := http.Get(server.URL)
+		require.NoError(t, err)
+
+		stream := newHTTPStream(resp.Body)
+		var chunks []string
+		for stream.Next() {
+			chunks = append(chunks, string(stream.Chunk()))
+		}
+		require.Equal(t, []string{"a", "b\n", "c"}, chunks)
+		if streamErr == nil {
+			require.NoError(t, stream.Err())
+			require.True(t, stream.Committed())
+		} else {
+			require.EqualError(t, stream.Err(), streamErr.Error())
+			require.False(t, stream.Committed())
+		}
+		require.NoError(t, stream.Close())
+		server.Close()
+	}
+}
+
+// TestWatchActorKVHTTP tests that changes to an actor's KV storage are streamed by the
+// watch endpoint as server-sent events, and that callers can resume with Last-Event-ID.
+func TestWatchActorKVHTTP(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsGo)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	require.NoError(t, reg.UpdateNamespace(ctx, "ns-1", registry.NamespaceOptions{KVChangeLog: true}))
+	_, err = reg.CreateActor(ctx, "ns-1", "a", "test-module", types.ActorOptions{})
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(NewServer(reg, env, ServerOptions{}).watchActorKV))
+	defer server.Close()
+
+	// watch watches with a POST request, unless lastEventID is set in which case it
+	// resumes with a GET request like EventSource would.
+	watch := func(lastEventID string) (*http.Response, *bufio.Scanner) {
+		body, err := json.Marshal(watchActorKVRequest{
+			Namespace: "ns-1",
+			ActorID:   "a",
+			Prefix:    []byte("key-"),
+		})
+		require.NoError(t, err)
+		req, err := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+		require.NoError(t, err)
+		if lastEventID != "" {
+			req, err = http.NewRequest("GET", server.URL+"?namespace=ns-1&actor_id=a&prefix=key-", nil)
+			require.NoError(t, err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		return resp, bufio.NewScanner(resp.Body)
+	}
+	// nextEvent returns the ID of the next event and the change it contains.
+	nextEvent := func(scanner *bufio.Scanner) (string, registry.ActorKVChange) {
+		var (
+			id     string
+			change registry.ActorKVChange
+		)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &change))
+			case line == "":
+				return id, change
+			}
+		}
+		t.Fatalf("stream ended unexpectedly: %v", scanner.Err())
+		return "", registry.ActorKVChange{}
+	}
+
+	resp, scanner := watch("")
+	for i := 0; i < 3; i++ {
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "inc", nil, types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+		_, err = env.InvokeActor(ctx, "ns-1", "a", "kvPutCount", []byte(fmt.Sprintf("key-%d", i)), types.CreateIfNotExist{}, "")
+		require.NoError(t, err)
+	}
+
+	var lastEventID string
+	for i := 0; i < 2; i++ {
+		id, change := nextEvent(scanner)
+		require.Equal(t, fmt.Sprintf("key-%d", i), string(change.Key))
+		require.Equal(t, fmt.Sprintf("%d", i+1), string(change.Value))
+		lastEventID = id
+	}
+	resp.Body.Close()
+
+	// Resume from the last event that was received.
+	resp, scanner = watch(lastEventID)
+	defer resp.Body.Close()
+	_, change := nextEvent(scanner)
+	require.Equal(t, "key-2", string(change.Key))
+	require.Equal(t, "3", string(change.Value))
+}
+
+// TestExportImportActorKVHTTP tests that exports streamed by the export endpoint can be
+// imported by the import endpoint.
+func TestExportImportActorKVHTTP(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsGo)
+	require.NoError(t, err)
+	defer env.Close()
+
+	ctx := context.Background()
+	for _, actor := range []string{"a", "b"} {
+		for i := 0; i < 3; i++ {
+			_, err = env.InvokeActor(ctx, "ns-1", actor, "inc", nil, types.CreateIfNotExist{ModuleID: "test-module"}, "")
+			require.NoError(t, err)
+			_, err = env.InvokeActor(ctx, "ns-1", actor, "kvPutCount", []byte(fmt.Sprintf("key-%d", i)), types.CreateIfNotExist{}, "")
+			require.NoError(t, err)
+		}
+	}
+	s := NewServer(reg, env, ServerOptions{})
+	exportServer := httptest.NewServer(http.HandlerFunc(s.exportActorKV))
+	defer exportServer.Close()
+	importServer := httptest.NewServer(http.HandlerFunc(s.importActorKV))
+	defer importServer.Close()
+
+	export := func(namespace, actorID string) (int, []byte) {
+		body, err := json.Marshal(exportActorKVRequest{Namespace: namespace, ActorID: actorID})
+		require.NoError(t, err)
+		resp, err := http.Post(exportServer.URL, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		exported, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, exported
+	}
+	importKV := func(namespace string, exported []byte) (int, []byte) {
+		req, err := http.NewRequest("POST", importServer.URL, bytes.NewReader(exported))
+		require.NoError(t, err)
+		req.Header.Set("namespace", namespace)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		result, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, result
+	}
+
+	status, body := export("ns-1", "c")
+	require.Equal(t, 500, status)
+	require.Contains(t, string(body), "does not exist")
+
+	status, exported := export("ns-1", "")
+	require.Equal(t, 200, status)
+
+	status, _ = importKV("ns-2", exported[:len(exported)-10])
+	require.Equal(t, 500, status)
+
+	status, body = importKV("ns-2", exported)
+	require.Equal(t, 200, status, string(body))
+	var result registry.ImportResult
+	require.NoError(t, json.Unmarshal(body, &result))
+	require.Equal(t, registry.ImportResult{NumActors: 2, NumKeys: 6}, result)
+
+	for _, actor := range []string{"a", "b"} {
+		status, original := export("ns-1", actor)
+		require.Equal(t, 200, status)
+		status, imported := export("ns-2", actor)
+		require.Equal(t, 200, status)
+		// Skip the header and footer since the header contains the namespace.
+		originalLines := bytes.Split(bytes.TrimSpace(original), []byte("\n"))
+		importedLines := bytes.Split(bytes.TrimSpace(imported), []byte("\n"))
+		require.Equal(t, originalLines[1:len(originalLines)-1], importedLines[1:len(importedLines)-1])
+	}
+}
+
+// TestRegisterAndDescribeModuleHTTP tests that a module's manifest can be provided when
+// it's registered over HTTP, and that it's returned by the describe-module endpoint.
+func TestRegisterAndDescribeModuleHTTP(t *testing.T) {
+	reg := registry.NewLocalRegistry()
+	env, err := NewEnvironment(context.Background(), "serverID1", reg, nil, defaultOptsWASM)
+	require.NoError(t, err)
+	defer env.Close()
+
+	s := NewServer(reg, env, ServerOptions{})
+	registerServer := httptest.NewServer(http.HandlerFunc(s.registerModule))
+	defer registerServer.Close()
+	describeServer := httptest.NewServer(http.HandlerFunc(s.describeModule))
+	defer describeServer.Close()
+
+	manifest := `{"operations": [{"name": "inc"}, {"name": "getCount", "read_only": true}]}`
+	register := func(moduleID, manifest string) (int, []byte) {
+		req, err := http.NewRequest("POST", registerServer.URL, bytes.NewReader(utilWasmBytes))
+		require.NoError(t, err)
+		req.Header.Set("namespace", "ns-1")
+		req.Header.Set("module_id", moduleID)
+		req.Header.Set("manifest", manifest)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, body
+	}
+	status, body := register("test-module", manifest)
+	require.Equal(t, 200, status, string(body))
+	var result registry.RegisterModuleResult
+	require.NoError(t, json.Unmarshal(body, &result))
+	require.Contains(t, result.Exports, "__guest_call")
+
+	status, _ = register("invalid-manifest", `{"operations": [{"name": ""}]}`)
+	require.Equal(t, 500, status)
+	status, _ = register("malformed-manifest", `{"operations"`)
+	require.Equal(t, 500, status)
+
+	reqBody, err := json.Marshal(describeModuleRequest{Namespace: "ns-1", ModuleID: "test-module"})
+	require.NoError(t, err)
+	resp, err := http.Post(describeServer.URL, "application/json", bytes.NewReader(reqBody))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	var described describeModuleResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&described))
+	require.Equal(t, describeModuleResponse{
+		Namespace: "ns-1",
+		ModuleID:  "test-module",
+		Hash:      result.Hash,
+		Size:      int64(len(utilWasmBytes)),
+		Manifest: &registry.ModuleManifest{Operations: []registry.OperationManifest{
+			{Name: "inc"},
+			{Name: "getCount", ReadOnly: true},
+		}},
+	}, described)
+
+	reqBody, err = json.Marshal(describeModuleRequest{Namespace: "ns-1", ModuleID: "does-not-exist"})
+	require.NoError(t, err)
+	resp, err = http.Post(describeServer.URL, "application/json", bytes.NewReader(reqBody))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 500, resp.StatusCode)
+}
@@ -0,0 +1,187 @@
+package virtual
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLSOptions contains the TLS options for the server and for the HTTP client that
+// servers use to communicate with each other. TLS is disabled if CertFile is empty.
+type TLSOptions struct {
+	// CertFile and KeyFile are the paths of the PEM-encoded certificate and private key
+	// that the server presents to clients, and that the HTTP client presents to other
+	// servers for mutual TLS. The certificate must be valid for the server's ID (as a DNS
+	// SAN) since other servers verify it against the server ID in actor references, and
+	// must allow client authentication if RequireClientCert is set.
+	CertFile string
+	KeyFile  string
+	// CAFile is the path of the PEM-encoded CA certificates that are used to verify other
+	// servers' certificates and client certificates. The system's CAs are used to verify
+	// server certificates if it's empty.
+	CAFile string
+	// RequireClientCert requires every client to present a certificate signed by one of
+	// the CAs in CAFile (mutual TLS). Otherwise client certificates are only verified if
+	// they're presented, see NewMTLSAuthenticator.
+	RequireClientCert bool
+}
+
+// Enabled returns whether TLS is enabled.
+func (t *TLSOptions) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Validate validates the options.
+func (t *TLSOptions) Validate() error {
+	if !t.Enabled() {
+		if t.KeyFile != "" || t.CAFile != "" || t.RequireClientCert {
+			return errors.New("TLS options require a certificate file")
+		}
+		return nil
+	}
+	if t.KeyFile == "" {
+		return errors.New("TLS key file is required when a certificate file is provided")
+	}
+	if t.RequireClientCert && t.CAFile == "" {
+		return errors.New("TLS CA file is required to verify client certificates")
+	}
+	return nil
+}
+
+// verifyServerID returns an error if the certificate is not valid for the server ID, in
+// which case other servers would reject every request to this one.
+func (t *TLSOptions) verifyServerID(serverID string) error {
+	cert, err := t.loadCertificate()
+	if err != nil {
+		return err
+	}
+	if err := cert.Leaf.VerifyHostname(serverID); err != nil {
+		return fmt.Errorf("TLS certificate is not valid for server ID: %s, err: %w", serverID, err)
+	}
+	return nil
+}
+
+func (t *TLSOptions) serverConfig() (*tls.Config, error) {
+	cert, err := t.loadCertificate()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.CAFile != "" {
+		config.ClientCAs, err = t.loadCAs()
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+func (t *TLSOptions) clientConfig() (*tls.Config, error) {
+	cert, err := t.loadCertificate()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.CAFile != "" {
+		config.RootCAs, err = t.loadCAs()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func (t *TLSOptions) loadCertificate() (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error parsing TLS certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func (t *TLSOptions) loadCAs() (*x509.CertPool, error) {
+	b, err := os.ReadFile(t.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading TLS CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("TLS CA file: %s does not contain any PEM-encoded certificates", t.CAFile)
+	}
+	return pool, nil
+}
+
+type tlsPeerKey struct{}
+
+// tlsPeer is the server that a request is sent to.
+type tlsPeer struct {
+	serverID string
+	address  string
+}
+
+// withTLSPeer returns a context that makes dialTLSWithServerID dial address and verify
+// the peer's certificate against serverID.
+func withTLSPeer(ctx context.Context, serverID, address string) context.Context {
+	return context.WithValue(ctx, tlsPeerKey{}, tlsPeer{serverID: serverID, address: address})
+}
+
+// tlsPeerHost returns the host that requests to the server with the provided ID and
+// address are sent to. The HTTP transport pools connections by host, so using a host that
+// is unique to the server ID and address, instead of the address alone, ensures that
+// connections that were verified against one server ID are never reused for requests to
+// another one (for example, when a server is replaced by a new one with the same address).
+// dialTLSWithServerID dials the address from the context instead of the host.
+func tlsPeerHost(serverID, address string) string {
+	h := sha256.Sum256([]byte(serverID + "\x00" + address))
+	return hex.EncodeToString(h[:16]) + ".nola:443"
+}
+
+// dialTLSWithServerID returns a function that dials TLS connections to the address
+// stored in the context by withTLSPeer, and verifies the peer's certificate against the
+// server ID stored with it during the handshake, before any request is sent over the
+// connection. Certificates are verified against server IDs instead of the host that is
+// being dialed since servers are addressed by IP.
+func dialTLSWithServerID(
+	dialer *net.Dialer,
+	config *tls.Config,
+) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		peer, ok := ctx.Value(tlsPeerKey{}).(tlsPeer)
+		if !ok || peer.serverID == "" {
+			return nil, fmt.Errorf("no server ID to verify the TLS certificate of: %s against", addr)
+		}
+		config := config.Clone()
+		config.ServerName = peer.serverID
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("server: %s did not present a TLS certificate", peer.serverID)
+			}
+			if err := cs.PeerCertificates[0].VerifyHostname(peer.serverID); err != nil {
+				return fmt.Errorf("TLS certificate is not valid for server ID: %s, err: %w", peer.serverID, err)
+			}
+			return nil
+		}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: config}
+		return tlsDialer.DialContext(ctx, network, peer.address)
+	}
+}
@@ -0,0 +1,180 @@
+package virtual
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestHTTPClientTLS tests that the HTTP client verifies the certificates of other servers
+// against the server IDs in actor references, and presents its own certificate for
+// mutual TLS.
+func TestHTTPClientTLS(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		ca      = newTestCA(t)
+		caFile  = writeTestPEM(t, dir, "ca.pem", "CERTIFICATE", ca.cert.Raw)
+		server1 = ca.issue(t, dir, "serverID1")
+		server2 = ca.issue(t, dir, "serverID2")
+	)
+	server1.CAFile = caFile
+	server1.RequireClientCert = true
+	server2.CAFile = caFile
+
+	serverConfig, err := server1.serverConfig()
+	require.NoError(t, err)
+	s := NewServer(nil, nil, ServerOptions{TLS: server1})
+	mux := http.NewServeMux()
+	var numRequests int64
+	mux.HandleFunc("/api/v1/invoke-actor-direct", s.internal(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&numRequests, 1)
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+
+	invoke := func(client RemoteClient, serverID string) ([]byte, error) {
+		ref, err := types.NewActorReference(
+			serverID, 0, strings.TrimPrefix(server.URL, "https://"), "ns-1", "test-module", "a", 1)
+		require.NoError(t, err)
+		return client.InvokeActorRemote(context.Background(), 0, ref, "inc", nil, "")
+	}
+
+	client, err := NewHTTPClient(HTTPClientOptions{TLS: server2})
+	require.NoError(t, err)
+	result, err := invoke(client, "serverID1")
+	require.NoError(t, err)
+	// The server received the client's certificate.
+	require.Equal(t, "serverID2", string(result))
+
+	// The server's certificate is not valid for a different server ID, even when there
+	// is a pooled connection to the same address, and the certificate is verified before
+	// the request is sent.
+	_, err = invoke(client, "serverID2")
+	require.Error(t, err)
+	require.Equal(t, int64(1), atomic.LoadInt64(&numRequests))
+	_, err = invoke(client, "serverID1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), atomic.LoadInt64(&numRequests))
+	client, err = NewHTTPClient(HTTPClientOptions{TLS: server2})
+	require.NoError(t, err)
+	_, err = invoke(client, "serverID2")
+	require.Error(t, err)
+
+	// Clients without a certificate are rejected since the server requires mutual TLS.
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	plainClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "serverID1"},
+	}}
+	_, err = plainClient.Post(server.URL+"/api/v1/invoke-actor-direct", "application/json", nil)
+	require.Error(t, err)
+
+	// The client doesn't trust certificates that weren't signed by the CA.
+	untrusted := newTestCA(t).issue(t, dir, "serverID2")
+	untrusted.CAFile = writeTestPEM(t, dir, "other-ca.pem", "CERTIFICATE", newTestCA(t).cert.Raw)
+	client, err = NewHTTPClient(HTTPClientOptions{TLS: untrusted})
+	require.NoError(t, err)
+	_, err = invoke(client, "serverID1")
+	require.Error(t, err)
+}
+
+// TestEnvironmentTLSServerID tests that environments refuse to start with a certificate
+// that isn't valid for their server ID.
+func TestEnvironmentTLSServerID(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		cert = newTestCA(t).issue(t, dir, "serverID1")
+		opts = defaultOptsWASM
+	)
+
+	opts.TLS = cert
+	env, err := NewEnvironment(context.Background(), "serverID1", registry.NewLocalRegistry(), nil, opts)
+	require.NoError(t, err)
+	require.NoError(t, env.Close())
+
+	_, err = NewEnvironment(context.Background(), "serverID2", registry.NewLocalRegistry(), nil, opts)
+	require.Error(t, err)
+
+	opts.TLS = TLSOptions{CertFile: cert.CertFile}
+	_, err = NewEnvironment(context.Background(), "serverID1", registry.NewLocalRegistry(), nil, opts)
+	require.Error(t, err)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nola-test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCA{cert: cert, key: key}
+}
+
+// issue issues a certificate for the server ID that can be used for both server and
+// client authentication, and returns TLSOptions that point to it.
+func (ca testCA) issue(t *testing.T, dir, serverID string) TLSOptions {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: serverID},
+		DNSNames:     []string{serverID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir, err = os.MkdirTemp(dir, serverID)
+	require.NoError(t, err)
+	return TLSOptions{
+		CertFile: writeTestPEM(t, dir, "cert.pem", "CERTIFICATE", der),
+		KeyFile:  writeTestPEM(t, dir, "key.pem", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+func writeTestPEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600))
+	return path
+}
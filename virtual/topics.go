@@ -0,0 +1,229 @@
+package virtual
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+const (
+	// maxPendingTopicDeliveries is the maximum number of outstanding topic deliveries
+	// that will be buffered in memory for a single subscriber before new deliveries are
+	// dropped.
+	maxPendingTopicDeliveries = 10_000
+	// topicDeliveryTimeout is the timeout for delivering a single message to a single
+	// subscriber.
+	topicDeliveryTimeout = 5 * time.Second
+	// maxTopicDeliveryAttempts is the maximum number of times delivering a message to a
+	// subscriber is attempted before the message is dropped.
+	maxTopicDeliveryAttempts = 5
+	// minTopicRetryBackoff and maxTopicRetryBackoff bound the exponential backoff between
+	// attempts to deliver a message to a subscriber.
+	minTopicRetryBackoff = 100 * time.Millisecond
+	maxTopicRetryBackoff = 5 * time.Second
+)
+
+// topicDeliverer is responsible for delivering messages published to topics to each of the
+// topic's subscribers. Deliveries are asynchronous so that actors can publish to topics they
+// are subscribed to themselves without deadlocking, but every subscriber gets its own FIFO
+// queue so messages published from this environment are always delivered to each subscriber
+// in the order they were published.
+//
+// Delivery is best-effort. Failed deliveries are retried with a backoff (which blocks the
+// subscriber's queue to preserve the order). Every attempt to deliver a message uses the
+// same idempotency key so that attempts which failed after the subscriber processed the
+// message (for example, because they timed out) aren't applied twice. Messages that still
+// can't be delivered after maxTopicDeliveryAttempts, or that don't fit in the subscriber's
+// queue, are logged and dropped. Queues are only kept in memory so messages that haven't
+// been delivered when the environment is closed are dropped too.
+//
+// The deliverer is only used for messages that are published from outside of an actor.
+// Messages that actors publish are enqueued in the subscribers' inboxes instead, see
+// publishToInboxes.
+type topicDeliverer struct {
+	sync.Mutex
+
+	// State.
+	queues map[types.NamespacedIDNoType]*topicDeliveryQueue
+	closed bool
+	// ctx is canceled when the deliverer is closed to abort in-flight deliveries and
+	// backoffs, and wg tracks the goroutines that drain the queues.
+	ctx    context.Context
+	cancel func()
+	wg     sync.WaitGroup
+
+	// Dependencies.
+	invoke func(ctx context.Context, namespace, actorID, operation string, payload []byte, idempotencyKey string) error
+	logger Logger
+}
+
+type topicDeliveryQueue struct {
+	pending []topicDelivery
+}
+
+type topicDelivery struct {
+	topic          string
+	operation      string
+	payload        []byte
+	idempotencyKey string
+}
+
+func newTopicDeliverer(
+	invoke func(ctx context.Context, namespace, actorID, operation string, payload []byte, idempotencyKey string) error,
+	logger Logger,
+) *topicDeliverer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &topicDeliverer{
+		queues: make(map[types.NamespacedIDNoType]*topicDeliveryQueue),
+		ctx:    ctx,
+		cancel: cancel,
+		invoke: invoke,
+		logger: logger,
+	}
+}
+
+// enqueue enqueues the delivery of payload to the provided subscriber. It never blocks.
+func (t *topicDeliverer) enqueue(
+	namespace string,
+	topic string,
+	actorID string,
+	operation string,
+	payload []byte,
+) error {
+	key := types.NewNamespacedIDNoType(namespace, actorID)
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.closed {
+		return fmt.Errorf("error delivering to subscriber: %s of topic: %s, environment is closed", actorID, topic)
+	}
+	q, ok := t.queues[key]
+	if !ok {
+		q = &topicDeliveryQueue{}
+		t.queues[key] = q
+		t.wg.Add(1)
+		go t.drain(key, q)
+	}
+	if len(q.pending) >= maxPendingTopicDeliveries {
+		return fmt.Errorf(
+			"too many pending deliveries (%d) for subscriber: %s of topic: %s",
+			len(q.pending), actorID, topic)
+	}
+
+	q.pending = append(q.pending, topicDelivery{
+		topic:          topic,
+		operation:      operation,
+		payload:        payload,
+		idempotencyKey: "topic-delivery-" + uuid.New().String(),
+	})
+	return nil
+}
+
+// drain delivers messages from the queue one at a time until it is empty, at which point
+// the queue is removed and the goroutine exits. It also exits when the deliverer is
+// closed, dropping the messages that are still pending.
+func (t *topicDeliverer) drain(key types.NamespacedIDNoType, q *topicDeliveryQueue) {
+	defer t.wg.Done()
+	for {
+		t.Lock()
+		if len(q.pending) == 0 || t.closed {
+			if len(q.pending) > 0 {
+				t.logger.Log(
+					LogLevelError, "dropping undelivered topic messages since the environment is closed",
+					"namespace", key.Namespace, "actor_id", key.ID, "num_messages", len(q.pending))
+			}
+			delete(t.queues, key)
+			t.Unlock()
+			return
+		}
+		d := q.pending[0]
+		q.pending[0] = topicDelivery{}
+		q.pending = q.pending[1:]
+		t.Unlock()
+
+		t.deliver(key, d)
+	}
+}
+
+// deliver delivers the message to the subscriber, retrying failed attempts with a backoff
+// until maxTopicDeliveryAttempts or until the deliverer is closed.
+func (t *topicDeliverer) deliver(key types.NamespacedIDNoType, d topicDelivery) {
+	for attempt := 1; ; attempt++ {
+		ctx, cc := context.WithTimeout(t.ctx, topicDeliveryTimeout)
+		err := t.invoke(ctx, key.Namespace, key.ID, d.operation, d.payload, d.idempotencyKey)
+		cc()
+		if err == nil {
+			return
+		}
+		if attempt >= maxTopicDeliveryAttempts || t.ctx.Err() != nil {
+			t.logger.Log(
+				LogLevelError, "error delivering message to topic subscriber, dropping it",
+				"namespace", key.Namespace, "topic", d.topic, "actor_id", key.ID,
+				"attempts", attempt, "error", err)
+			return
+		}
+
+		backoff := retryBackoff(attempt, minTopicRetryBackoff, maxTopicRetryBackoff)
+		if retryAfter, ok := IsRateLimitedErr(err); ok && retryAfter > backoff {
+			backoff = retryAfter
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+// close stops delivering messages and waits for in-flight deliveries to be aborted.
+// Messages that haven't been delivered yet are dropped.
+func (t *topicDeliverer) close() {
+	t.Lock()
+	t.closed = true
+	t.Unlock()
+	t.cancel()
+	t.wg.Wait()
+}
+
+// publishToInboxes publishes payload to the topic on behalf of the actor whose invocation
+// tr belongs to by enqueueing it in the inbox of every subscriber. Since the messages are
+// enqueued within tr, they're only delivered if the invocation commits, and they're
+// delivered durably and in order like any other inbox messages. Every message of a single
+// publish has the same ID so that the inboxes dedup it if the publish is retried.
+func publishToInboxes(
+	ctx context.Context,
+	reg registry.Registry,
+	tr registry.ActorKVTransaction,
+	namespace string,
+	topic string,
+	payload []byte,
+) error {
+	subscriptions, err := reg.GetSubscriptions(ctx, namespace, topic)
+	if err != nil {
+		return fmt.Errorf("error getting subscriptions for topic: %s, err: %w", topic, err)
+	}
+
+	id := fmt.Sprintf("topic-%s-%s", topic, uuid.New().String())
+	for _, sub := range subscriptions {
+		err := tr.EnqueueMessage(ctx, sub.ActorID, registry.InboxMessage{
+			ID:        id,
+			Operation: sub.Operation,
+			Payload:   payload,
+		})
+		if registry.IsActorDoesNotExistErr(err) {
+			// The subscriber was deleted after the subscriptions were read.
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error publishing to subscriber: %s of topic: %s, err: %w", sub.ActorID, topic, err)
+		}
+	}
+	return nil
+}
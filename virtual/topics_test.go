@@ -0,0 +1,102 @@
+package virtual
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTopicDelivererRetries tests that failed deliveries are retried in order with the same
+// idempotency key and that messages are dropped after maxTopicDeliveryAttempts.
+func TestTopicDelivererRetries(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		failures  = map[string]int{"a": 2, "b": maxTopicDeliveryAttempts}
+		delivered []string
+		keys      = map[string]map[string]struct{}{}
+	)
+	deliverer := newTopicDeliverer(func(
+		ctx context.Context,
+		namespace, actorID, operation string,
+		payload []byte,
+		idempotencyKey string,
+	) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if keys[string(payload)] == nil {
+			keys[string(payload)] = map[string]struct{}{}
+		}
+		keys[string(payload)][idempotencyKey] = struct{}{}
+		if failures[string(payload)] > 0 {
+			failures[string(payload)]--
+			return errors.New("failed")
+		}
+		delivered = append(delivered, string(payload))
+		return nil
+	}, &testLogger{})
+	defer deliverer.close()
+
+	for _, payload := range []string{"a", "b", "c"} {
+		require.NoError(t, deliverer.enqueue("ns-1", "topic", "actor", "op", []byte(payload)))
+	}
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	// "a" succeeded after being retried, "b" failed every attempt.
+	require.Equal(t, []string{"a", "c"}, delivered)
+	// Every attempt to deliver a message used the same key, and every message used a
+	// different one.
+	unique := map[string]struct{}{}
+	for payload, payloadKeys := range keys {
+		require.Len(t, payloadKeys, 1, payload)
+		for key := range payloadKeys {
+			require.NotEmpty(t, key)
+			unique[key] = struct{}{}
+		}
+	}
+	require.Len(t, unique, 3)
+}
+
+// TestTopicDelivererClose tests that closing the deliverer aborts in-flight deliveries and
+// stops the goroutines that drain the queues.
+func TestTopicDelivererClose(t *testing.T) {
+	started := make(chan struct{}, 1)
+	deliverer := newTopicDeliverer(func(
+		ctx context.Context,
+		namespace, actorID, operation string,
+		payload []byte,
+		idempotencyKey string,
+	) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}, &testLogger{})
+
+	require.NoError(t, deliverer.enqueue("ns-1", "topic", "actor", "op", nil))
+	require.NoError(t, deliverer.enqueue("ns-1", "topic", "actor", "op", nil))
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		deliverer.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close did not abort the in-flight delivery")
+	}
+	require.Empty(t, deliverer.queues)
+	require.Error(t, deliverer.enqueue("ns-1", "topic", "actor", "op", nil))
+}
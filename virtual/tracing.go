@@ -0,0 +1,46 @@
+package virtual
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/richardartoul/nola/virtual/tracing"
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+func actorSpanAttributes(namespace, actorID, operation string) []tracing.Attribute {
+	return []tracing.Attribute{
+		tracing.String("namespace", namespace),
+		tracing.String("actor_id", actorID),
+		tracing.String("operation", operation),
+	}
+}
+
+func referenceSpanAttributes(reference types.ActorReferenceVirtual, operation string) []tracing.Attribute {
+	return []tracing.Attribute{
+		tracing.String("namespace", reference.Namespace()),
+		tracing.String("module_id", reference.ModuleID().ID),
+		tracing.String("actor_id", reference.ActorID().ID),
+		tracing.String("operation", operation),
+	}
+}
+
+// withTraceparent returns a context that carries the trace context in the traceparent,
+// if it's valid. Invalid trace context is ignored, as recommended by the W3C spec, so
+// the invocation starts a new trace instead.
+func withTraceparent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	sc, err := tracing.ParseTraceparent(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return tracing.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// withRequestTraceparent is the same as withTraceparent, except the traceparent is read
+// from the request's headers.
+func withRequestTraceparent(ctx context.Context, r *http.Request) context.Context {
+	return withTraceparent(ctx, r.Header.Get(tracing.TraceparentHeader))
+}
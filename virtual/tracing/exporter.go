@@ -0,0 +1,34 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/richardartoul/nola/virtual/types"
+)
+
+type writerExporter struct {
+	sync.Mutex
+	enc    *json.Encoder
+	logger types.Logger
+}
+
+// NewWriterExporter returns an Exporter that writes every span to w as a line of JSON.
+// It's intended for local development and tests, for example with os.Stdout or a file.
+// Spans that can't be written are logged to logger, or to stderr if it's nil.
+func NewWriterExporter(w io.Writer, logger types.Logger) Exporter {
+	if logger == nil {
+		logger = types.NewWriterLogger(os.Stderr)
+	}
+	return &writerExporter{enc: json.NewEncoder(w), logger: logger}
+}
+
+func (w *writerExporter) ExportSpan(span SpanData) {
+	w.Lock()
+	defer w.Unlock()
+	if err := w.enc.Encode(&span); err != nil {
+		w.logger.Log(types.LogLevelError, "error exporting span", "span", span.Name, "error", err)
+	}
+}
@@ -0,0 +1,268 @@
+// Package tracing implements distributed tracing for invocations that hop through
+// multiple actors and servers. Trace context is propagated between servers in the W3C
+// traceparent format (https://www.w3.org/TR/trace-context/) and finished spans are handed
+// to a pluggable Exporter.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the HTTP header that trace context is propagated in.
+const TraceparentHeader = "traceparent"
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext is the part of a span that is propagated across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Sampled indicates whether the trace is being recorded. Spans of traces that
+	// aren't sampled are still propagated, but not exported.
+	Sampled bool
+}
+
+// IsValid returns whether the span context has a non-zero trace and span ID.
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != TraceID{} && s.SpanID != SpanID{}
+}
+
+// Traceparent formats the span context as a W3C traceparent header value.
+func (s SpanContext) Traceparent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value.
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent: %s", traceparent)
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	// Future versions may append fields, but version 00 has exactly four.
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("invalid traceparent version: %s", traceparent)
+	}
+
+	var sc SpanContext
+	if err := decodeHex(traceID, sc.TraceID[:]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent trace ID: %w", err)
+	}
+	if err := decodeHex(spanID, sc.SpanID[:]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent span ID: %w", err)
+	}
+	var flagBytes [1]byte
+	if err := decodeHex(flags, flagBytes[:]); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent flags: %w", err)
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, errors.New("traceparent trace and span IDs must not be zero")
+	}
+	sc.Sampled = flagBytes[0]&1 == 1
+	return sc, nil
+}
+
+func decodeHex(s string, dst []byte) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return fmt.Errorf("expected %d lowercase hex characters, got: %s", 2*len(dst), s)
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+type spanCtxKey struct{}
+
+// spanCtxValue is stored in the context so that spans started by the same process share
+// the tracer of their parent.
+type spanCtxValue struct {
+	sc     SpanContext
+	tracer *Tracer
+}
+
+// ContextWithRemoteSpanContext returns a context that carries a span context that was
+// received from another process, so spans started from it become its children.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, spanCtxKey{}, spanCtxValue{sc: sc})
+}
+
+// SpanContextFromContext returns the span context of the current span in the context.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	v, ok := ctx.Value(spanCtxKey{}).(spanCtxValue)
+	return v.sc, ok
+}
+
+// Traceparent returns the traceparent header value for the current span in the context,
+// or an empty string if there is none.
+func Traceparent(ctx context.Context) string {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return sc.Traceparent()
+}
+
+// Start starts a span that is a child of the current span in the context, using the
+// same tracer. It returns the context unmodified and a nil span (whose methods are
+// no-ops) if the context doesn't contain a span that was started by a Tracer.
+func Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	v, ok := ctx.Value(spanCtxKey{}).(spanCtxValue)
+	if !ok || v.tracer == nil {
+		return ctx, nil
+	}
+	return v.tracer.Start(ctx, name, attributes...)
+}
+
+// Attribute is a key/value pair that describes a span.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// String returns an Attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanData is a finished span.
+type SpanData struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	// Error is the error that the span's operation failed with, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Exporter exports finished spans. Implementations must be safe for concurrent use, and
+// should not block since spans are exported synchronously when they end.
+type Exporter interface {
+	ExportSpan(span SpanData)
+}
+
+// Tracer starts spans and exports them once they end.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer creates a new Tracer. Spans are still started and propagated if exporter is
+// nil so that traces that pass through this process aren't broken, but they aren't
+// exported.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Start starts a span that is a child of the current span in the context, if any, or the
+// root span of a new trace otherwise. The returned context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	parent, hasParent := SpanContextFromContext(ctx)
+	span := &Span{
+		name:   name,
+		start:  time.Now(),
+		tracer: t,
+	}
+	if hasParent {
+		span.sc.TraceID = parent.TraceID
+		span.sc.Sampled = parent.Sampled
+		span.parentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+		span.sc.Sampled = true
+	}
+	rand.Read(span.sc.SpanID[:])
+	for _, attr := range attributes {
+		span.SetAttribute(attr.Key, attr.Value)
+	}
+	return context.WithValue(ctx, spanCtxKey{}, spanCtxValue{sc: span.sc, tracer: t}), span
+}
+
+// Span is an operation that is part of a trace. A nil *Span is valid and does nothing.
+type Span struct {
+	sync.Mutex
+	name         string
+	sc           SpanContext
+	parentSpanID SpanID
+	start        time.Time
+	attributes   map[string]string
+	ended        bool
+	tracer       *Tracer
+}
+
+// SpanContext returns the span's span context.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute sets an attribute on the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = value
+}
+
+// End ends the span and exports it if the trace is sampled. err is the error that the
+// span's operation failed with, if any. Only the first call to End has any effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		Name:       s.name,
+		TraceID:    s.sc.TraceID.String(),
+		SpanID:     s.sc.SpanID.String(),
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: s.attributes,
+	}
+	s.Unlock()
+
+	if !s.sc.Sampled || s.tracer.exporter == nil {
+		return
+	}
+	if s.parentSpanID != (SpanID{}) {
+		data.ParentSpanID = s.parentSpanID.String()
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	s.tracer.exporter.ExportSpan(data)
+}
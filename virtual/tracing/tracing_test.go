@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/richardartoul/nola/virtual/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const traceparent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	sc, err := ParseTraceparent(traceparent)
+	require.NoError(t, err)
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", sc.TraceID.String())
+	require.Equal(t, "b7ad6b7169203331", sc.SpanID.String())
+	require.True(t, sc.Sampled)
+	require.Equal(t, traceparent, sc.Traceparent())
+
+	sc, err = ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	require.NoError(t, err)
+	require.False(t, sc.Sampled)
+
+	// Future versions may append fields.
+	_, err = ParseTraceparent("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra")
+	require.NoError(t, err)
+
+	for _, invalid := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-zz",
+	} {
+		_, err := ParseTraceparent(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestTracer(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(NewWriterExporter(&buf, nil))
+
+	// Spans can't be started without a tracer in the context.
+	ctx, span := Start(context.Background(), "no-tracer")
+	require.Nil(t, span)
+	span.End(nil)
+	require.Equal(t, "", Traceparent(ctx))
+
+	ctx, root := tracer.Start(context.Background(), "root", String("k", "v"))
+	require.True(t, root.SpanContext().IsValid())
+	require.Equal(t, root.SpanContext().Traceparent(), Traceparent(ctx))
+
+	_, child := Start(ctx, "child")
+	require.Equal(t, root.SpanContext().TraceID, child.SpanContext().TraceID)
+	child.End(errors.New("some error"))
+	child.End(nil)
+	root.End(nil)
+
+	dec := json.NewDecoder(&buf)
+	var childData, rootData SpanData
+	require.NoError(t, dec.Decode(&childData))
+	require.NoError(t, dec.Decode(&rootData))
+	require.False(t, dec.More())
+
+	require.Equal(t, "child", childData.Name)
+	require.Equal(t, root.SpanContext().SpanID.String(), childData.ParentSpanID)
+	require.Equal(t, "some error", childData.Error)
+	require.Equal(t, "root", rootData.Name)
+	require.Equal(t, "", rootData.ParentSpanID)
+	require.Equal(t, map[string]string{"k": "v"}, rootData.Attributes)
+
+	// Spans that descend from an unsampled remote span are propagated, but not exported.
+	remote, err := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	require.NoError(t, err)
+	ctx, span = tracer.Start(ContextWithRemoteSpanContext(context.Background(), remote), "unsampled")
+	require.Equal(t, remote.TraceID, span.SpanContext().TraceID)
+	require.False(t, span.SpanContext().Sampled)
+	require.Contains(t, Traceparent(ctx), remote.TraceID.String())
+	span.End(nil)
+	require.Equal(t, 0, buf.Len())
+}
+
+// TestWriterExporterErrors tests that spans that can't be written are logged.
+func TestWriterExporterErrors(t *testing.T) {
+	var logs bytes.Buffer
+	exporter := NewWriterExporter(errWriter{}, types.NewWriterLogger(&logs))
+	exporter.ExportSpan(SpanData{Name: "some-span"})
+	require.Contains(t, logs.String(), "level=error")
+	require.Contains(t, logs.String(), "span=some-span")
+	require.Contains(t, logs.String(), `error="some error"`)
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("some error")
+}
@@ -18,6 +18,11 @@ type Environment interface {
 	// provided payload. If the actor is already activated somewhere in the system,
 	// the invocation will be routed appropriately. Otherwise, the request will
 	// activate the actor somewhere in the system and then perform the invocation.
+	//
+	// If idempotencyKey is not empty then the invocation is idempotent: if an invocation
+	// with the same key succeeded for the target actor within the last day then the
+	// result it returned is returned again instead of invoking the actor. Streaming
+	// invocations and worker invocations don't support idempotency keys.
 	InvokeActor(
 		ctx context.Context,
 		namespace string,
@@ -25,8 +30,26 @@ type Environment interface {
 		operation string,
 		payload []byte,
 		createIfNotExist types.CreateIfNotExist,
+		idempotencyKey string,
 	) ([]byte, error)
 
+	// InvokeActorStream is the same as InvokeActor, except the result is returned as a
+	// stream of chunks instead of a single []byte. Actors that implement StreamingActor
+	// (or WASM actors that use the STREAM-EMIT host function) can emit an arbitrary number
+	// of chunks, all other actors will emit their result as a single chunk. Chunks are
+	// delivered as they're emitted, but since actors run the invocation in a single KV
+	// transaction the caller must check InvokeStream.Committed() once the stream ends to
+	// determine whether the invocation's writes were committed, and the invocation must
+	// complete within the registry's transaction duration limit, if it has one.
+	InvokeActorStream(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		operation string,
+		payload []byte,
+		createIfNotExist types.CreateIfNotExist,
+	) (InvokeStream, error)
+
 	// InvokeActorDirect is the same as InvokeActor, however, it performs the invocation
 	// "directly".
 	//
@@ -41,8 +64,21 @@ type Environment interface {
 		reference types.ActorReferenceVirtual,
 		operation string,
 		payload []byte,
+		idempotencyKey string,
 	) ([]byte, error)
 
+	// InvokeActorDirectStream is the same as InvokeActorDirect, except the result is
+	// returned as a stream. See InvokeActorStream for more details.
+	InvokeActorDirectStream(
+		ctx context.Context,
+		versionStamp int64,
+		serverID string,
+		serverVersion int64,
+		reference types.ActorReferenceVirtual,
+		operation string,
+		payload []byte,
+	) (InvokeStream, error)
+
 	// InvokeWorker invokes the specified operation from the specified module. Unlike
 	// actors, workers provide no guarantees about single-threaded execution or only
 	// a single instance running at a time. This makes them easier to scale than
@@ -61,6 +97,48 @@ type Environment interface {
 		payload []byte,
 	) ([]byte, error)
 
+	// Publish publishes the payload to every actor that is subscribed to the provided
+	// topic. Delivery to each subscriber is asynchronous and best-effort (failed deliveries
+	// are retried a few times, but messages are only buffered in memory), but messages
+	// published from the same environment are always delivered to each subscriber in
+	// the order they were published. Subscribers that are not currently activated will
+	// be activated on demand. Actors publish through their HostCapabilities instead, which
+	// delivers messages durably through the subscribers' inboxes.
+	Publish(
+		ctx context.Context,
+		namespace string,
+		topic string,
+		payload []byte,
+	) error
+
+	// TailActorLogs returns up to the last limit messages that were logged for the actor,
+	// oldest first, and whether the actor is activated. Messages are retained in memory
+	// by the environment that the actor is activated in (see
+	// EnvironmentOptions.ActorLogBufferSize) and discarded when it's deactivated, so the
+	// request is forwarded to that environment if it's not this one. All the retained
+	// messages are returned if limit is not positive.
+	TailActorLogs(
+		ctx context.Context,
+		namespace string,
+		actorID string,
+		limit int,
+	) ([]LogEntry, bool, error)
+
+	// TailActorLogsDirect is the same as TailActorLogs, except it only returns the
+	// messages that are retained by this environment. It's used by other environments to
+	// forward TailActorLogs requests to the environment that the actor is activated in,
+	// and returns an error if serverID is not this environment's server ID.
+	TailActorLogsDirect(
+		serverID string,
+		namespace string,
+		actorID string,
+		limit int,
+	) ([]LogEntry, bool, error)
+
+	// ListActivations returns the actors and workers that are currently activated in this
+	// environment, ordered by namespace and ID.
+	ListActivations() []ActivationInfo
+
 	// Close closes the Environment and all of its associated resources.
 	Close() error
 }
@@ -100,7 +178,52 @@ type RemoteClient interface {
 		reference types.ActorReference,
 		operation string,
 		payload []byte,
+		idempotencyKey string,
 	) ([]byte, error)
+
+	// InvokeActorRemoteStream is the same as InvokeActorRemote, except the result is
+	// returned as a stream.
+	InvokeActorRemoteStream(
+		ctx context.Context,
+		versionStamp int64,
+		reference types.ActorReference,
+		operation string,
+		payload []byte,
+	) (InvokeStream, error)
+
+	// TailActorLogsRemote is the same as Environment.TailActorLogsDirect, except it tails
+	// the logs that are retained by the server with the provided ID and address.
+	TailActorLogsRemote(
+		ctx context.Context,
+		serverID string,
+		address string,
+		namespace string,
+		actorID string,
+		limit int,
+	) ([]LogEntry, bool, error)
+}
+
+// InvokeStream is an iterator over the chunks emitted by a streaming invocation. Callers
+// must always call Close() once they're done with the stream, even if it was consumed
+// in its entirety.
+type InvokeStream interface {
+	// Next advances the stream to the next chunk. It returns false once the stream is
+	// exhausted or an error is encountered, at which point Err() should be checked.
+	Next() bool
+	// Chunk returns the current chunk. It is only valid until the next call to Next().
+	Chunk() []byte
+	// Err returns the error that terminated the stream, if any. It should only be called
+	// after Next() returns false.
+	Err() error
+	// Committed returns true if the invocation completed successfully and its KV
+	// transaction (if any) committed. It should only be called after Next() returns
+	// false. If it returns false then the invocation was aborted and any writes it made
+	// were rolled back, so chunks that were already received should be discarded.
+	Committed() bool
+	// Close releases all the resources associated with the stream. If the stream has not
+	// been consumed in its entirety then the invocation will be interrupted the next time
+	// the actor tries to emit a chunk.
+	Close() error
 }
 
 // Module represents a "module" / template from which new actors are constructed/instantiated.
@@ -130,10 +253,43 @@ type Actor interface {
 	Close(ctx context.Context) error
 }
 
+// StreamingActor is an optional interface that can be implemented by an Actor that
+// wants to emit its result as a stream of chunks instead of a single []byte. Actors that
+// do not implement this interface can still be invoked with InvokeActorStream(), their
+// result will just be emitted as a single chunk.
+type StreamingActor interface {
+	Actor
+
+	// InvokeStream is the same as Invoke, except the actor should call emit once for
+	// every chunk it wants to send back to the caller. emit copies the chunk so the
+	// actor may reuse it. If emit returns an error then the actor should stop and return
+	// it since the caller is no longer consuming the stream.
+	InvokeStream(
+		ctx context.Context,
+		operation string,
+		payload []byte,
+		transaction registry.ActorKVTransaction,
+		emit func(chunk []byte) error,
+	) error
+}
+
 // HostCapabilities defines the interface of capabilities exposed by the host to the Actor.
 type HostCapabilities interface {
 	KV
 
+	// TransactMultiActor calls fn with access to the KV storage of the calling actor and
+	// every actor in actorIDs (which must all exist in the same namespace as the calling
+	// actor) within tr, which must be the transaction of the calling actor's current
+	// invocation. fn's writes are committed atomically with the rest of the invocation's
+	// writes, and only if none of the participants were activated elsewhere in the
+	// meantime. See registry.ActorKVTransaction.JoinActors for more details.
+	TransactMultiActor(
+		ctx context.Context,
+		tr registry.ActorKVTransaction,
+		actorIDs []string,
+		fn func(kv registry.MultiActorKV) (any, error),
+	) (any, error)
+
 	// CreateActor creates a new actor.
 	CreateActor(context.Context, wapcutils.CreateActorRequest) (CreateActorResult, error)
 
@@ -144,6 +300,18 @@ type HostCapabilities interface {
 	// in memory to be run later.
 	ScheduleInvokeActor(context.Context, wapcutils.ScheduleInvocationRequest) error
 
+	// Subscribe subscribes the actor to the provided topic.
+	Subscribe(context.Context, wapcutils.SubscribeRequest) error
+
+	// Unsubscribe unsubscribes the actor from the provided topic.
+	Unsubscribe(context.Context, wapcutils.UnsubscribeRequest) error
+
+	// Publish publishes a message to every actor that is subscribed to the provided
+	// topic by enqueueing it in their inboxes within tr, which must be the transaction of
+	// the calling actor's current invocation. The message is only published if the
+	// invocation commits.
+	Publish(context.Context, registry.ActorKVTransaction, wapcutils.PublishRequest) error
+
 	// CustomFn invoke a custom (user defined) host function. This will only work if the
 	// custom host function was registered with the environment when it was instantiated.
 	CustomFn(
@@ -0,0 +1,103 @@
+package types
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelError:
+		return "error"
+	default:
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+}
+
+// ParseLogLevel parses the name of a log level, I.E debug, info, warn or error.
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch level {
+	case "debug":
+		return LogLevelDebug, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "warn":
+		return LogLevelWarn, nil
+	case "error":
+		return LogLevelError, nil
+	default:
+		return 0, fmt.Errorf(
+			"invalid log level: %s, valid options are: debug|info|warn|error", level)
+	}
+}
+
+// Logger is a leveled, structured logger. keyvals are alternating keys and values that
+// provide context for the message, for example: "namespace", "ns-1", "actor_id", "a".
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...any)
+}
+
+// NewWriterLogger returns a Logger that writes every message to w as a line of
+// space-separated key=value pairs (logfmt).
+func NewWriterLogger(w io.Writer) Logger {
+	return &writerLogger{w: w}
+}
+
+type writerLogger struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (l *writerLogger) Log(level LogLevel, msg string, keyvals ...any) {
+	var buf bytes.Buffer
+	buf.WriteString("time=")
+	buf.WriteString(time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(" level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	buf.WriteString(logfmtValue(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(keyvals[i]))
+		buf.WriteByte('=')
+		if i+1 < len(keyvals) {
+			buf.WriteString(logfmtValue(fmt.Sprint(keyvals[i+1])))
+		} else {
+			buf.WriteString(`""`)
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.Lock()
+	defer l.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\n\t") {
+		return strconv.Quote(v)
+	}
+	return v
+}
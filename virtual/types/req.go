@@ -14,6 +14,10 @@ type InvokeActorRequest struct {
 	// CreateIfNotExist provides the arguments for InvokeActorRequest to construct the
 	// actor if it doesn't already exist. This field is optional.
 	CreateIfNotExist CreateIfNotExist `json:"create_if_not_exist"`
+	// IdempotencyKey is an optional key that makes the invocation idempotent. If an
+	// invocation with the same key previously succeeded for the target actor then its
+	// stored result will be returned instead of invoking the actor again.
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
 // CreateIfNotExist provides the arguments for InvokeActorRequest to construct the
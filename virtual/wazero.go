@@ -4,11 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/richardartoul/nola/durable"
 	"github.com/richardartoul/nola/virtual/registry"
+	"github.com/richardartoul/nola/virtual/tracing"
 	"github.com/richardartoul/nola/virtual/types"
 	"github.com/richardartoul/nola/wapcutils"
 )
@@ -17,18 +17,33 @@ import (
 // from the context.
 type hostFnActorIDCtxKey struct{}
 
+// hostFnActorModuleKey is the key that is used to store/retrieve the actor's namespace
+// and module ID from the context.
+type hostFnActorModuleKey struct{}
+
 // hostFnActorTxnKey is the key that is used to store/retrieve the actor's per-invocation
 // lazyTransaction from the context.
 type hostFnActorTxnKey struct{}
 
-// TODO: Should have some kind of ACL enforcement polic here, but for now allow any module to
-// run any host function.
+// hostFnActorPolicyKey is the key that is used to store/retrieve the host policy of the
+// actor's module from the context.
+type hostFnActorPolicyKey struct{}
+
+// hostFnStreamEmitKey is the key that is used to store/retrieve the emit function for
+// streaming invocations from the context.
+type hostFnStreamEmitKey struct{}
+
+// newHostFnRouter returns the function that handles the host calls of WASM actors. Host
+// calls are checked against the host policy of the actor's module (if it has one) before
+// they're performed.
+//
+// The router is shared by every actor of every module that is compiled from the same WASM
+// bytes, regardless of namespace, so everything about the actor that is performing the
+// host call is extracted from the context.
 func newHostFnRouter(
 	reg registry.Registry,
 	environment Environment,
 	customHostFns map[string]func([]byte) ([]byte, error),
-	actorNamespace string,
-	actorModuleID string,
 ) func(ctx context.Context, binding, namespace, operation string, payload []byte) ([]byte, error) {
 	return func(
 		ctx context.Context,
@@ -41,9 +56,27 @@ func newHostFnRouter(
 		if err != nil {
 			return nil, fmt.Errorf("error extracting actorID from context: %w", err)
 		}
+		actorModule, err := extractActorModule(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting actor module from context: %w", err)
+		}
+		var (
+			actorNamespace = actorModule.Namespace
+			actorModuleID  = actorModule.ID
+			policy         = hostPolicy{
+				policy:    extractActorPolicy(ctx),
+				reg:       reg,
+				namespace: actorNamespace,
+				moduleID:  actorModuleID,
+				actorID:   actorID,
+			}
+		)
 
 		switch wapcOperation {
 		case wapcutils.KVPutOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
 			k, v, err := wapcutils.ExtractKVFromPutPayload(wapcPayload)
 			if err != nil {
 				return nil, fmt.Errorf("error extracting KV from PUT payload: %w", err)
@@ -60,6 +93,9 @@ func newHostFnRouter(
 
 			return nil, nil
 		case wapcutils.KVGetOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
 			tr, err := extractTransaction(ctx)
 			if err != nil {
 				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
@@ -78,7 +114,44 @@ func newHostFnRouter(
 				resp = append(resp, v...)
 				return resp, nil
 			}
+		case wapcutils.KVPutActorOperationName, wapcutils.KVGetActorOperationName:
+			// The host policy is also enforced by the transaction for the target actor, see
+			// hostPolicyActorKVTransaction.JoinActors.
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
+			var req wapcutils.ActorKVRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling ActorKVRequest: %w", err)
+			}
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+			kv, err := joinActors(ctx, reg, policy, tr, []string{req.ActorID})
+			if err != nil {
+				return nil, fmt.Errorf("error joining actor: %s to transaction, err: %w", req.ActorID, err)
+			}
+
+			if wapcOperation == wapcutils.KVPutActorOperationName {
+				if err := kv.Put(ctx, req.ActorID, req.Key, req.Value); err != nil {
+					return nil, fmt.Errorf("error performing PUT against registry: %w", err)
+				}
+				return nil, nil
+			}
+			v, ok, err := kv.Get(ctx, req.ActorID, req.Key)
+			if err != nil {
+				return nil, fmt.Errorf("error performing GET against registry: %w", err)
+			}
+			// Same encoding as KV-GET.
+			if !ok {
+				return []byte{0}, nil
+			}
+			return append([]byte{1}, v...), nil
 		case wapcutils.CreateActorOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
 			var req wapcutils.CreateActorRequest
 			if err := json.Unmarshal(wapcPayload, &req); err != nil {
 				return nil, fmt.Errorf("error unmarshaling CreateActorRequest: %w", err)
@@ -90,6 +163,9 @@ func newHostFnRouter(
 				// actor.
 				req.ModuleID = actorModuleID
 			}
+			if err := policy.checkCreateActor(req.ModuleID); err != nil {
+				return nil, err
+			}
 
 			if _, err := reg.CreateActor(
 				ctx, actorNamespace, req.ActorID, req.ModuleID, types.ActorOptions{}); err != nil {
@@ -99,14 +175,24 @@ func newHostFnRouter(
 			return nil, nil
 
 		case wapcutils.InvokeActorOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
 			var req types.InvokeActorRequest
 			if err := json.Unmarshal(wapcPayload, &req); err != nil {
 				return nil, fmt.Errorf("error unmarshaling InvokeActorRequest: %w", err)
 			}
+			if err := policy.checkTargetActor(ctx, req.ActorID, req.CreateIfNotExist); err != nil {
+				return nil, err
+			}
 
-			return environment.InvokeActor(ctx, actorNamespace, req.ActorID, req.Operation, req.Payload, req.CreateIfNotExist)
+			return environment.InvokeActor(
+				ctx, actorNamespace, req.ActorID, req.Operation, req.Payload, req.CreateIfNotExist, req.IdempotencyKey)
 
 		case wapcutils.ScheduleInvocationOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
 			var req wapcutils.ScheduleInvocationRequest
 			if err := json.Unmarshal(wapcPayload, &req); err != nil {
 				return nil, fmt.Errorf(
@@ -118,6 +204,13 @@ func newHostFnRouter(
 				// Omitted if the actor wants to schedule a delayed invocation (timer) for itself.
 				req.Invoke.ActorID = actorID
 			}
+			if err := policy.checkTargetActor(ctx, req.Invoke.ActorID, req.Invoke.CreateIfNotExist); err != nil {
+				return nil, err
+			}
+			logger, err := extractActorLogger(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting actor logger from context: %w", err)
+			}
 
 			// TODO: When the actor gets GC'd (which is not currently implemented), this
 			//       timer won't get GC'd with it. We should keep track of all outstanding
@@ -127,19 +220,98 @@ func newHostFnRouter(
 				// Copy the payload to make sure its safe to retain across invocations.
 				payloadCopy := make([]byte, len(req.Invoke.Payload))
 				copy(payloadCopy, req.Invoke.Payload)
+				ctx, span := tracing.Start(
+					ctx, "nola.ScheduledInvocation",
+					actorSpanAttributes(actorNamespace, req.Invoke.ActorID, req.Invoke.Operation)...)
 				_, err := environment.InvokeActor(
-					ctx, actorNamespace, req.Invoke.ActorID, req.Invoke.Operation, payloadCopy, req.Invoke.CreateIfNotExist)
+					ctx, actorNamespace, req.Invoke.ActorID, req.Invoke.Operation, payloadCopy,
+					req.Invoke.CreateIfNotExist, req.Invoke.IdempotencyKey)
+				span.End(err)
 				if err != nil {
-					log.Printf(
-						"error performing scheduled invocation from actor: %s to actor: %s for operation: %s, err: %v\n",
-						actorID, req.Invoke.ActorID, req.Invoke.Operation, err)
+					logger.log(
+						ctx, LogLevelError, "error performing scheduled invocation",
+						"target_actor_id", req.Invoke.ActorID, "target_operation", req.Invoke.Operation,
+						"error", err)
 				}
 			})
 
+			return nil, nil
+		case wapcutils.SubscribeOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
+			var req wapcutils.SubscribeRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling SubscribeRequest: %w", err)
+			}
+			if err := reg.Subscribe(ctx, actorNamespace, req.Topic, actorID, req.Operation); err != nil {
+				return nil, fmt.Errorf("error subscribing to topic: %s, err: %w", req.Topic, err)
+			}
+			return nil, nil
+		case wapcutils.UnsubscribeOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
+			var req wapcutils.UnsubscribeRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling UnsubscribeRequest: %w", err)
+			}
+			if err := reg.Unsubscribe(ctx, actorNamespace, req.Topic, actorID); err != nil {
+				return nil, fmt.Errorf("error unsubscribing from topic: %s, err: %w", req.Topic, err)
+			}
+			return nil, nil
+		case wapcutils.PublishOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
+			var req wapcutils.PublishRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling PublishRequest: %w", err)
+			}
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+			if err := publishToInboxes(ctx, reg, tr, actorNamespace, req.Topic, req.Payload); err != nil {
+				return nil, err
+			}
+			return nil, nil
+		case wapcutils.SendMessageOperationName:
+			if err := policy.checkOperation(wapcOperation); err != nil {
+				return nil, err
+			}
+			var req wapcutils.SendMessageRequest
+			if err := json.Unmarshal(wapcPayload, &req); err != nil {
+				return nil, fmt.Errorf("error unmarshaling SendMessageRequest: %w", err)
+			}
+			tr, err := extractTransaction(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting transaction from context: %w", err)
+			}
+			err = tr.EnqueueMessage(ctx, req.ActorID, registry.InboxMessage{
+				ID:        req.ID,
+				Operation: req.Operation,
+				Payload:   req.Payload,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error enqueueing message for actor: %s, err: %w", req.ActorID, err)
+			}
+			return nil, nil
+		case wapcutils.StreamEmitOperationName:
+			emit, err := extractStreamEmit(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("error extracting stream emit function from context: %w", err)
+			}
+			if err := emit(wapcPayload); err != nil {
+				return nil, fmt.Errorf("error emitting stream chunk: %w", err)
+			}
 			return nil, nil
 		default:
 			customFn, ok := customHostFns[wapcOperation]
 			if ok {
+				if err := policy.checkCustomFn(wapcOperation); err != nil {
+					return nil, err
+				}
 				res, err := customFn(wapcPayload)
 				if err != nil {
 					return nil, fmt.Errorf("error running custom host function: %s, err: %w", wapcOperation, err)
@@ -168,6 +340,25 @@ func extractActorID(ctx context.Context) (string, error) {
 	return actorID, nil
 }
 
+func extractActorModule(ctx context.Context) (types.NamespacedIDNoType, error) {
+	moduleIface := ctx.Value(hostFnActorModuleKey{})
+	if moduleIface == nil {
+		return types.NamespacedIDNoType{}, fmt.Errorf("wazeroHostFnRouter: could not find actor module in context")
+	}
+	module, ok := moduleIface.(types.NamespacedIDNoType)
+	if !ok {
+		return types.NamespacedIDNoType{}, fmt.Errorf("wazeroHostFnRouter: wrong type for actor module in context: %T", moduleIface)
+	}
+	return module, nil
+}
+
+// extractActorPolicy returns the host policy of the actor's module, which is nil if the
+// module doesn't have one.
+func extractActorPolicy(ctx context.Context) *registry.HostPolicy {
+	policy, _ := ctx.Value(hostFnActorPolicyKey{}).(*registry.HostPolicy)
+	return policy
+}
+
 func extractTransaction(ctx context.Context) (registry.ActorKVTransaction, error) {
 	trIface := ctx.Value(hostFnActorTxnKey{})
 	if trIface == nil {
@@ -180,8 +371,24 @@ func extractTransaction(ctx context.Context) (registry.ActorKVTransaction, error
 	return tr, nil
 }
 
+func extractStreamEmit(ctx context.Context) (func([]byte) error, error) {
+	emitIface := ctx.Value(hostFnStreamEmitKey{})
+	if emitIface == nil {
+		return nil, fmt.Errorf("wazeroHostFnRouter: invocation is not a streaming invocation")
+	}
+	emit, ok := emitIface.(func([]byte) error)
+	if !ok {
+		return nil, fmt.Errorf("wazeroHostFnRouter: wrong type for stream emit function in context: %T", emitIface)
+	}
+	return emit, nil
+}
+
+// wazeroModule is a module in a specific namespace. The underlying compiled module may be
+// shared with modules in other namespaces that were registered with the same WASM bytes.
 type wazeroModule struct {
-	m durable.Module
+	m      durable.Module
+	module types.NamespacedIDNoType
+	policy *registry.HostPolicy
 }
 
 func (w wazeroModule) Instantiate(
@@ -189,12 +396,14 @@ func (w wazeroModule) Instantiate(
 	id string,
 	host HostCapabilities,
 ) (Actor, error) {
-	obj, err := w.m.Instantiate(ctx, id)
+	// Actor IDs are only unique within a namespace, but the compiled module may be shared
+	// across namespaces.
+	obj, err := w.m.Instantiate(ctx, fmt.Sprintf("%s::%s", w.module.Namespace, id))
 	if err != nil {
 		return nil, err
 	}
 
-	return wazeroActor{obj, id}, nil
+	return wazeroActor{obj, id, w.module, w.policy}, nil
 }
 
 func (w wazeroModule) Close(ctx context.Context) error {
@@ -202,8 +411,14 @@ func (w wazeroModule) Close(ctx context.Context) error {
 }
 
 type wazeroActor struct {
-	obj durable.Object
-	id  string
+	obj    durable.Object
+	id     string
+	module types.NamespacedIDNoType
+	policy *registry.HostPolicy
+}
+
+func (w wazeroActor) MemoryUsage() int64 {
+	return w.obj.MemoryUsage()
 }
 
 func (w wazeroActor) Invoke(
@@ -219,6 +434,10 @@ func (w wazeroActor) Invoke(
 	// the actor ID into each invocation. See newHostFnRouter in wazero.go to see
 	// the implementation.
 	ctx = context.WithValue(ctx, hostFnActorIDCtxKey{}, w.id)
+	// Same for the namespace and module ID since the compiled module (and therefore the
+	// host router) may be shared across namespaces.
+	ctx = context.WithValue(ctx, hostFnActorModuleKey{}, w.module)
+	ctx = context.WithValue(ctx, hostFnActorPolicyKey{}, w.policy)
 
 	// This is required for modules that are using WASM/wazero so we can propagate a
 	// per-invocation transaction to the hostFnRouter. The reason this is required is
@@ -231,6 +450,29 @@ func (w wazeroActor) Invoke(
 	return w.obj.Invoke(ctx, operation, payload)
 }
 
+// InvokeStream implements StreamingActor. The WASM module emits chunks by calling the
+// STREAM-EMIT host function. Any non-empty value returned by the module is emitted as
+// the final chunk.
+func (w wazeroActor) InvokeStream(
+	ctx context.Context,
+	operation string,
+	payload []byte,
+	transaction registry.ActorKVTransaction,
+	emit func(chunk []byte) error,
+) error {
+	// Smuggle the emit function into the hostFnRouter for the same reasons described in
+	// Invoke() above.
+	ctx = context.WithValue(ctx, hostFnStreamEmitKey{}, emit)
+	result, err := w.Invoke(ctx, operation, payload, transaction)
+	if err != nil {
+		return err
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return emit(result)
+}
+
 func (w wazeroActor) Close(ctx context.Context) error {
 	return w.obj.Close(ctx)
 }
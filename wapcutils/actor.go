@@ -21,3 +21,58 @@ type ScheduleInvocationRequest struct {
 	Invoke      types.InvokeActorRequest `json:"invocation"`
 	AfterMillis int                      `json:"after_millis"`
 }
+
+// SubscribeRequest is the JSON struct that represents a request from an existing actor
+// to subscribe itself to a topic.
+type SubscribeRequest struct {
+	// Topic is the name of the topic to subscribe to.
+	Topic string `json:"topic"`
+	// Operation is the operation that should be invoked on the subscribing actor for
+	// every message that is published to the topic.
+	Operation string `json:"operation"`
+}
+
+// UnsubscribeRequest is the JSON struct that represents a request from an existing
+// actor to unsubscribe itself from a topic.
+type UnsubscribeRequest struct {
+	// Topic is the name of the topic to unsubscribe from.
+	Topic string `json:"topic"`
+}
+
+// ActorKVRequest is the JSON struct that represents a request from an existing actor to
+// read (KV-GET-ACTOR) or write (KV-PUT-ACTOR) a key in the KV storage of another actor in
+// the same namespace. The request is performed in the caller's transaction so all of the
+// caller's reads and writes, across every actor, are committed atomically.
+type ActorKVRequest struct {
+	// ActorID is the ID of the actor whose KV storage should be read or written.
+	ActorID string `json:"actor_id"`
+	// Key is the key to read or write.
+	Key []byte `json:"key"`
+	// Value is the value to write, it is ignored by reads.
+	Value []byte `json:"value"`
+}
+
+// PublishRequest is the JSON struct that represents a request from an existing actor
+// to publish a message to a topic.
+type PublishRequest struct {
+	// Topic is the name of the topic to publish to.
+	Topic string `json:"topic"`
+	// Payload is the []byte payload that will be provided to every subscriber.
+	Payload []byte `json:"payload"`
+}
+
+// SendMessageRequest is the JSON struct that represents a request from an existing actor
+// to durably enqueue a message in another actor's inbox. The message is only enqueued
+// if the sending actor's invocation (and its transaction) succeeds.
+type SendMessageRequest struct {
+	// ActorID is the ID of the actor whose inbox the message should be enqueued in.
+	ActorID string `json:"actor_id"`
+	// ID is used to deduplicate messages. Sending a message with the same ID to the same
+	// actor more than once is a no-op.
+	ID string `json:"id"`
+	// Operation is the operation that will be invoked on the target actor to deliver
+	// the message.
+	Operation string `json:"operation"`
+	// Payload is the []byte payload that the operation will be invoked with.
+	Payload []byte `json:"payload"`
+}
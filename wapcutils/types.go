@@ -5,6 +5,12 @@ const (
 	KVPutOperationName = "KV-PUT"
 	// KVGetOperationName is the string that indicates the operation in WAPC is a KV GET.
 	KVGetOperationName = "KV-GET"
+	// KVPutActorOperationName is the string that indicates the operation in WAPC is a KV
+	// PUT against the KV storage of another actor, within the caller's transaction.
+	KVPutActorOperationName = "KV-PUT-ACTOR"
+	// KVGetActorOperationName is the string that indicates the operation in WAPC is a KV
+	// GET against the KV storage of another actor, within the caller's transaction.
+	KVGetActorOperationName = "KV-GET-ACTOR"
 	// CreateActorOperationName is the string that indicates the operation in WAPC is to
 	// create a new actor.
 	CreateActorOperationName = "CREATE-ACTOR"
@@ -22,4 +28,24 @@ const (
 	// ScheduleInvocationOperationName is the string that indicates the operation in WAPC
 	// is to schedule an invocation for later.
 	ScheduleInvocationOperationName = "SCHEDULE-INVOCATION"
+	// StreamEmitOperationName is the string that indicates the operation in WAPC is to
+	// emit a chunk of the result of a streaming invocation back to the caller.
+	StreamEmitOperationName = "STREAM-EMIT"
+	// SubscribeOperationName is the string that indicates the operation in WAPC is to
+	// subscribe the actor to a topic.
+	SubscribeOperationName = "SUBSCRIBE"
+	// UnsubscribeOperationName is the string that indicates the operation in WAPC is to
+	// unsubscribe the actor from a topic.
+	UnsubscribeOperationName = "UNSUBSCRIBE"
+	// PublishOperationName is the string that indicates the operation in WAPC is to
+	// publish a message to a topic.
+	PublishOperationName = "PUBLISH"
+	// SendMessageOperationName is the string that indicates the operation in WAPC is to
+	// durably enqueue a message in another actor's inbox as part of the current
+	// invocation's transaction.
+	SendMessageOperationName = "SEND-MESSAGE"
+	// DeliverInboxOperationName is the string that indicates the operation is to deliver
+	// all pending messages in the actor's inbox. It is reserved for internal use and is
+	// never invoked on the actor itself.
+	DeliverInboxOperationName = "DELIVER-INBOX"
 )